@@ -6,9 +6,15 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/armistcxy/shorten/internal/background"
+	"github.com/armistcxy/shorten/internal/cache"
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/armistcxy/shorten/internal/shard"
+	"github.com/armistcxy/shorten/internal/util"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
@@ -30,24 +36,68 @@ func main() {
 	urlDSN := os.Getenv("URL_DSN")
 	db := sqlx.MustConnect("postgres", urlDSN)
 
+	// With URL_SHARD_DSNS (comma separated) views and retried batches go to the shard of their short URL,
+	// the shard key depends on ID_CHECK_DIGIT like in the API
+	if checkDigits, _ := strconv.ParseBool(os.Getenv("ID_CHECK_DIGIT")); checkDigits {
+		domain.SetCheckDigits(true)
+	}
+	shardDBs := []*sqlx.DB{db}
+	var router *shard.Router
+	if dsns := os.Getenv("URL_SHARD_DSNS"); dsns != "" {
+		for _, dsn := range strings.Split(dsns, ",") {
+			shardDBs = append(shardDBs, sqlx.MustConnect("postgres", strings.TrimSpace(dsn)))
+		}
+		shardStore := shard.NewStore(db)
+		shardMap, err := shardStore.Init(context.Background(), shard.Even(1))
+		if err != nil {
+			log.Fatalf("failed to load the shard map: %s", err)
+		}
+		if router, err = shard.NewRouter(len(shardDBs), shardMap); err != nil {
+			log.Fatal(err)
+		}
+		go router.Run(context.Background(), shardStore, util.EnvDuration("SHARD_MAP_REFRESH", 5*time.Second))
+	}
+
 	workers := river.NewWorkers()
 	river.AddWorker(workers, background.NewAddLastUsedIDWorker(db))
 
 	batchCreateWorker := background.NewBatchCreateWorker(db)
+	if router != nil {
+		batchCreateWorker.WithShards(shardDBs, router)
+	}
 	river.AddWorker(workers, batchCreateWorker)
 
-	incCntWorker := background.NewIncreaseCountWorker(db)
+	// Flushed batches are acknowledged in the view cache shared with the API. Without Redis the view cache
+	// lives in the API process, which acknowledges its batches itself
+	cacheConfig, err := cache.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	redisClient, err := cache.NewClient(cacheConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var viewCache cache.ViewCache
+	if redisClient != nil {
+		viewCache = cache.NewViewCache(cacheConfig, redisClient)
+	}
+
+	incCntWorker := background.NewIncreaseCountWorker(db, viewCache)
+	if router != nil {
+		incCntWorker.WithShards(shardDBs, router)
+	}
 	river.AddWorker(workers, incCntWorker)
 
 	go func() {
-		start := time.Now()
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
 
-		for {
-			if time.Since(start) >= 1*time.Second {
-				if err := incCntWorker.BatchUpdate(); err != nil {
-					slog.Error("failed to perform batch update on increasing 'count' field", "error", err.Error())
+		for range ticker.C {
+			// in-flight batches are resent after a few minutes, a day is plenty
+			for _, shardDB := range shardDBs {
+				if err := background.PruneViewFlushes(context.Background(), shardDB, time.Now().Add(-24*time.Hour)); err != nil {
+					slog.Error("failed to prune applied view batches", "error", err.Error())
 				}
-				start = time.Now()
 			}
 		}
 	}()
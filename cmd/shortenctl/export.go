@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/armistcxy/shorten/internal/export"
+)
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	kind := fs.String("kind", "clicks", "What to export: clicks (of one short URL) or links (of one owner)")
+	id := fs.String("id", "", "ID of the short URL whose clicks are exported")
+	owner := fs.String("owner", "", "Owner whose links are exported")
+	from := fs.String("from", "", "Start of the time range, inclusive (RFC 3339 or YYYY-MM-DD)")
+	to := fs.String("to", "", "End of the time range, exclusive (RFC 3339 or YYYY-MM-DD), defaults to now")
+	bots := fs.Bool("bots", false, "Include bot traffic")
+	formatName := fs.String("format", "csv", "Output format: csv, ndjson or parquet")
+	out := fs.String("out", "", "Output file, defaults to stdout")
+	_ = fs.Parse(args)
+
+	format, err := export.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	filter := domain.StatsFilter{
+		From:        time.Unix(0, 0).UTC(),
+		To:          time.Now().UTC(),
+		IncludeBots: *bots,
+	}
+	if *from != "" {
+		if filter.From, err = parseTime(*from); err != nil {
+			return fmt.Errorf("invalid -from: %w", err)
+		}
+	}
+	if *to != "" {
+		if filter.To, err = parseTime(*to); err != nil {
+			return fmt.Errorf("invalid -to: %w", err)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	ctx := context.Background()
+	store, err := openURLStore(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var n int
+	switch *kind {
+	case "clicks":
+		if *id == "" {
+			return errors.New("-id is required to export clicks")
+		}
+		n, err = export.Clicks(ctx, store.clicks, *id, filter, export.NewWriter[export.ClickRecord](format, w), nil)
+	case "links":
+		if *owner == "" {
+			return errors.New("-owner is required to export links")
+		}
+		n, err = export.Links(ctx, store.urls, *owner, filter, export.NewWriter[export.LinkRecord](format, w), nil)
+	default:
+		return fmt.Errorf("unknown kind %q, use clicks or links", *kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("export finished", "kind", *kind, "records", n)
+	return nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
@@ -0,0 +1,54 @@
+package main
+
+// shortenctl is the command line tool for operating the shortener.
+// It talks to the databases (URL_DSN, URL_SHARD_DSNS) and the cache (CACHE_*) directly, so it must only be run by operators.
+//
+// Usage:
+//
+//	shortenctl <command> [flags]
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"export", "stream link metadata or clicks as csv, ndjson or parquet", runExport},
+	{"migrate", "apply (up), revert (down -steps N) or list (status) the schema migrations", runMigrate},
+	{"shard", "show the shard map, move key ranges between shards (move, spread) or clean up rows (backfill, prune)", runShard},
+	{"warm", "load the most viewed short urls into the cache", runWarm},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", cmd.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: shortenctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
+	}
+}
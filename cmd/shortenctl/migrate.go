@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/background"
+	"github.com/armistcxy/shorten/internal/migrate"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// runMigrate applies, reverts or lists the schema migrations of the urls databases (URL_DSN and every
+// shard of URL_SHARD_DSNS). up also migrates the River tables when RIVER_DSN is set
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected up, down or status")
+	}
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	steps := fs.Int("steps", 1, "Number of migrations to revert (down)")
+	_ = fs.Parse(args[1:])
+	if args[0] != "up" && args[0] != "down" && args[0] != "status" {
+		return fmt.Errorf("unknown subcommand %q, expected up, down or status", args[0])
+	}
+	if args[0] == "down" && *steps <= 0 {
+		return fmt.Errorf("-steps must be positive")
+	}
+
+	ctx := context.Background()
+	dsns := shardDSNs()
+	for i, dsn := range dsns {
+		if len(dsns) > 1 {
+			fmt.Fprintf(os.Stderr, "shard %d:\n", i)
+		}
+		if err := migrateShard(ctx, args[0], dsn, *steps); err != nil {
+			return err
+		}
+	}
+
+	if dsn := os.Getenv("RIVER_DSN"); dsn != "" && args[0] == "up" {
+		pool, err := pgxpool.New(ctx, dsn)
+		if err != nil {
+			return err
+		}
+		defer pool.Close()
+		return background.Migrate(ctx, pool)
+	}
+	return nil
+}
+
+func migrateShard(ctx context.Context, subcommand string, dsn string, steps int) error {
+	db := sqlx.MustConnect("postgres", dsn)
+	defer db.Close()
+	migrator, err := migrate.New(db)
+	if err != nil {
+		return err
+	}
+
+	switch subcommand {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, version := range applied {
+			fmt.Fprintf(os.Stderr, "applied %d\n", version)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(os.Stderr, "schema is up to date")
+		}
+		return nil
+
+	case "down":
+		reverted, err := migrator.Down(ctx, steps)
+		for _, version := range reverted {
+			fmt.Fprintf(os.Stderr, "reverted %d\n", version)
+		}
+		return err
+
+	default:
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.Applied {
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+		return w.Flush()
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/armistcxy/shorten/internal/repository"
+	"github.com/armistcxy/shorten/internal/shard"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// shardDSNs returns URL_DSN followed by the additional shards of URL_SHARD_DSNS (comma separated)
+func shardDSNs() []string {
+	dsns := []string{os.Getenv("URL_DSN")}
+	if extra := os.Getenv("URL_SHARD_DSNS"); extra != "" {
+		for _, dsn := range strings.Split(extra, ",") {
+			dsns = append(dsns, strings.TrimSpace(dsn))
+		}
+	}
+	return dsns
+}
+
+// urlStore is the connections to every shard of the urls table and the repositories over them
+type urlStore struct {
+	dbs    []*sqlx.DB
+	pools  []*pgxpool.Pool
+	urls   domain.URLRepository
+	clicks domain.ClickRepository
+}
+
+// openURLStore connects to the shards, short URLs are routed with the latest shard map
+func openURLStore(ctx context.Context) (*urlStore, error) {
+	// the shard key of an id depends on its check digit
+	if checkDigits, _ := strconv.ParseBool(os.Getenv("ID_CHECK_DIGIT")); checkDigits {
+		domain.SetCheckDigits(true)
+	}
+
+	s := &urlStore{}
+	var (
+		urls   []domain.URLRepository
+		clicks []domain.ClickRepository
+	)
+	for _, dsn := range shardDSNs() {
+		db := sqlx.MustConnect("postgres", dsn)
+		pool, err := pgxpool.New(ctx, dsn)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.dbs, s.pools = append(s.dbs, db), append(s.pools, pool)
+
+		urlRepo, err := repository.NewPostgresURLRepository(db, pool)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		urls, clicks = append(urls, urlRepo), append(clicks, repository.NewPostgresClickRepository(pool))
+	}
+	if len(s.dbs) == 1 {
+		s.urls, s.clicks = urls[0], clicks[0]
+		return s, nil
+	}
+
+	m, err := shard.NewStore(s.dbs[0]).Load(ctx)
+	if errors.Is(err, shard.ErrNoMap) {
+		m, err = shard.Even(1), nil
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	router, err := shard.NewRouter(len(s.dbs), m)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.urls, err = repository.NewShardedURLRepository(urls, router); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.clicks, err = repository.NewShardedClickRepository(clicks, router); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *urlStore) Close() {
+	for _, pool := range s.pools {
+		pool.Close()
+	}
+	for _, db := range s.dbs {
+		db.Close()
+	}
+}
+
+// runShard shows and changes the shard map of the urls table (URL_DSN and URL_SHARD_DSNS)
+func runShard(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected status, init, spread, move, backfill, prune or key")
+	}
+	fs := flag.NewFlagSet("shard "+args[0], flag.ExitOnError)
+	even := fs.Bool("even", false, "Split the keys evenly (init), only for new deployments: existing short URLs are on the first shard")
+	start := fs.Uint64("start", 0, "First key of the range to move (move)")
+	end := fs.Uint64("end", shard.MaxKey, "Last key of the range to move (move)")
+	to := fs.Int("to", -1, "Shard to move the range to (move)")
+	settle := fs.Duration("settle", 30*time.Second, "Wait after each change of the map, longer than SHARD_MAP_REFRESH of every process")
+	batchSize := fs.Int("batch", 1000, "Rows copied or deleted per query")
+	_ = fs.Parse(args[1:])
+
+	ctx := context.Background()
+	s, err := openURLStore(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	store := shard.NewStore(s.dbs[0])
+	rebalancer := shard.NewRebalancer(store, s.dbs, *settle).WithBatchSize(*batchSize)
+
+	switch args[0] {
+	case "status":
+		m, err := store.Load(ctx)
+		if errors.Is(err, shard.ErrNoMap) {
+			fmt.Fprintf(os.Stderr, "no shard map yet, every key is on the first of %d shards\n", len(s.dbs))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return printMap(m)
+
+	case "init":
+		initial := shard.Even(1)
+		if *even {
+			initial = shard.Even(len(s.dbs))
+		}
+		if err := store.Save(ctx, initial); errors.Is(err, shard.ErrStaleMap) {
+			fmt.Fprintln(os.Stderr, "a shard map exists already")
+		} else if err != nil {
+			return err
+		}
+		m, err := store.Load(ctx)
+		if err != nil {
+			return err
+		}
+		return printMap(m)
+
+	case "spread":
+		// move the keys towards an even split, one range after the other
+		if _, err := store.Init(ctx, shard.Even(1)); err != nil {
+			return err
+		}
+		for i, r := range shard.Even(len(s.dbs)).Ranges {
+			fmt.Fprintf(os.Stderr, "moving [%d, %d] to shard %d\n", r.Start, r.End, i)
+			if err := rebalancer.Move(ctx, r.Start, r.End, i); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "move":
+		if *to < 0 || *to >= len(s.dbs) {
+			return fmt.Errorf("-to must name one of the %d shards", len(s.dbs))
+		}
+		if _, err := store.Init(ctx, shard.Even(1)); err != nil {
+			return err
+		}
+		return rebalancer.Move(ctx, *start, *end, *to)
+
+	case "backfill":
+		for i := range s.dbs {
+			n, err := rebalancer.Backfill(ctx, i)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "shard %d: computed the key of %d short urls\n", i, n)
+		}
+		return nil
+
+	case "prune":
+		n, err := rebalancer.Prune(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "deleted %d short urls held by the wrong shard\n", n)
+		return nil
+
+	case "key":
+		m, err := store.Load(ctx)
+		if errors.Is(err, shard.ErrNoMap) {
+			m, err = shard.Even(1), nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, id := range fs.Args() {
+			route := m.Route(id)
+			fmt.Printf("%s\tkey %d\tshard %d\treads %v\n", id, shard.Key(id), route.Write, route.Reads)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown subcommand %q, expected status, init, spread, move, backfill, prune or key", args[0])
+}
+
+func printMap(m shard.Map) error {
+	fmt.Fprintf(os.Stderr, "shard map version %d\n", m.Version)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "START\tEND\tSHARD\tMOVING")
+	for _, r := range m.Ranges {
+		moving := ""
+		if r.Moving() {
+			moving = fmt.Sprintf("to %d (%s)", r.Target, r.Phase)
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\n", r.Start, r.End, r.Shard, moving)
+	}
+	return w.Flush()
+}
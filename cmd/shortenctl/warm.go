@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/cache"
+	"github.com/armistcxy/shorten/internal/warm"
+)
+
+// runWarm loads the most viewed short URLs into the cache configured by the CACHE_* variables
+func runWarm(args []string) error {
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	n := fs.Int("n", warm.DefaultN, "Number of short URLs to load")
+	since := fs.Duration("since", 0, "Select short URLs by their clicks in this window (e.g. 24h) instead of their all-time views")
+	concurrency := fs.Int("concurrency", warm.DefaultConcurrency, "Number of cache writes in flight")
+	_ = fs.Parse(args)
+
+	cacheConfig, err := cache.ConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	if !cacheConfig.Shared() {
+		return fmt.Errorf("the %s cache backend lives in the API process, it can't be warmed from here", cacheConfig.Backend)
+	}
+	redisClient, err := cache.NewClient(cacheConfig)
+	if err != nil {
+		return err
+	}
+	defer redisClient.Close()
+	ca, err := cache.New(cacheConfig, redisClient)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if runner, ok := ca.(cache.Runner); ok {
+		go runner.Run(ctx)
+	}
+
+	store, err := openURLStore(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	opts := warm.Options{
+		N:           *n,
+		Concurrency: *concurrency,
+		Progress: func(p warm.Progress) {
+			fmt.Fprintf(os.Stderr, "warmed %d/%d short urls (%d failed)\n", p.Done, p.Total, p.Failed)
+		},
+	}
+	if *since > 0 {
+		opts.Since = time.Now().Add(-*since)
+	}
+	_, err = warm.NewWarmer(store.urls, ca).Run(ctx, opts)
+	return err
+}
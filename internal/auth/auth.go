@@ -0,0 +1,69 @@
+package auth
+
+// API keys identify the owner of short URLs. Requests without key are anonymous:
+// they can create and follow short URLs but can't access anything restricted to the owner.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/armistcxy/shorten/internal/util"
+)
+
+// Keys maps API keys to the owner they belong to
+type Keys map[string]string
+
+// ParseKeys parses a list of API keys in the form "key1:owner1,key2:owner2"
+func ParseKeys(s string) (Keys, error) {
+	keys := make(Keys)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, owner, ok := strings.Cut(pair, ":")
+		if !ok || key == "" || owner == "" {
+			return nil, fmt.Errorf("invalid API key entry %q, expected key:owner", pair)
+		}
+		keys[key] = owner
+	}
+	return keys, nil
+}
+
+var ErrInvalidKey = errors.New("invalid API key")
+
+type ownerKey struct{}
+
+// Middleware resolves the owner of the API key sent as "Authorization: Bearer <key>"
+// and stores it in the request context. Requests with an unknown key are rejected.
+func (k Keys) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, ok := strings.CutPrefix(header, "Bearer ")
+		owner, known := k[key]
+		if !ok || !known {
+			util.WriteError(w, r, util.Unauthorized(ErrInvalidKey.Error()))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithOwner(r.Context(), owner)))
+	})
+}
+
+func WithOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, ownerKey{}, owner)
+}
+
+// Owner returns the owner of the request, or an empty string for anonymous requests
+func Owner(ctx context.Context) string {
+	owner, _ := ctx.Value(ownerKey{}).(string)
+	return owner
+}
@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"log"
 	"log/slog"
-	"strings"
-	"sync"
+	"time"
 
+	"github.com/armistcxy/shorten/internal/cache"
+	"github.com/armistcxy/shorten/internal/shard"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jmoiron/sqlx"
 	"github.com/riverqueue/river"
@@ -61,80 +61,147 @@ func updateLastUsedID(db *sqlx.DB, id uint64) error {
 }
 
 type IncreaseCountArgs struct {
-	ID    string
-	Count int
+	ID       string
+	Count    int
+	BotCount int
+	Bot      bool   // Count belongs to bot traffic, only set by jobs enqueued before BotCount existed
+	Token    string // identifies a flushed batch of views, a batch with token is applied at most once
 }
 
 func (IncreaseCountArgs) Kind() string {
 	return "increase_count"
 }
 
+// IncreaseCountWorker applies flushed views to the database.
+// Views are applied inside the job (no in-memory aggregation), together with the token of the batch
+// in the same transaction, so a retried job (at-least-once delivery) never counts the batch twice.
 type IncreaseCountWorker struct {
-	db      *sqlx.DB
-	mu      sync.Mutex
-	counter map[string]int
+	db        *sqlx.DB
+	viewCache cache.ViewCache
+	shards    *shards // set when the urls table is sharded
 	river.WorkerDefaults[IncreaseCountArgs]
 }
 
-func NewIncreaseCountWorker(db *sqlx.DB) *IncreaseCountWorker {
+func NewIncreaseCountWorker(db *sqlx.DB, viewCache cache.ViewCache) *IncreaseCountWorker {
 	return &IncreaseCountWorker{
-		db:      db,
-		mu:      sync.Mutex{},
-		counter: make(map[string]int),
+		db:        db,
+		viewCache: viewCache,
 	}
 }
 
+// WithShards applies the views on the shard of the short URL, see shards
+func (iw *IncreaseCountWorker) WithShards(dbs []*sqlx.DB, router *shard.Router) *IncreaseCountWorker {
+	iw.shards = &shards{dbs: dbs, router: router}
+	return iw
+}
+
 func (iw *IncreaseCountWorker) Work(ctx context.Context, job *river.Job[IncreaseCountArgs]) error {
-	iw.mu.Lock()
-	defer iw.mu.Unlock()
-	iw.counter[job.Args.ID] += job.Args.Count
-	return nil
+	args := job.Args
+	count, botCount := args.Count, args.BotCount
+	if args.Bot {
+		count, botCount = 0, args.Count
+	}
+
+	// each shard has its own tokens, a retry skips the shards that have the batch already.
+	// While the short URL moves, the target may not have its row yet: the copy carries the views of the source
+	found := false
+	for _, db := range iw.shards.all(iw.db, args.ID) {
+		applied, err := applyViews(ctx, db, args.ID, args.Token, count, botCount)
+		if err != nil {
+			return err
+		}
+		found = found || applied
+	}
+	if !found {
+		// The row may still be waiting in the buffer of the API or in a batch_create job, the job is retried
+		// until it shows up. Views of a short URL that was deleted are dropped in the end
+		err := fmt.Errorf("short url %s is not in the database yet", args.ID)
+		if job.Attempt < missingURLAttempts {
+			return err
+		}
+		slog.Warn("dropping views of a short url that doesn't exist", "url_id", args.ID, "count", count, "bot_count", botCount, "attempts", job.Attempt)
+		if args.Token != "" && iw.viewCache != nil {
+			if err := iw.viewCache.Ack(ctx, args.ID, args.Token); err != nil {
+				return err
+			}
+		}
+		return river.JobCancel(err)
+	}
+
+	if args.Token == "" || iw.viewCache == nil {
+		return nil
+	}
+	// The batch is in the database now, stop counting it as in-flight.
+	// If this fails the job is retried, applyViews skips the batch and the acknowledgement is sent again
+	return iw.viewCache.Ack(ctx, args.ID, args.Token)
 }
 
 var (
-	batchUpdateQuery = `
-		UPDATE urls AS u
-		SET count = u.count + c.new_count::integer
-		FROM (VALUES %s) AS c(id, new_count)
-		WHERE u.id = c.id;
+	insertViewFlushQuery = `
+		INSERT INTO view_flushes (token, url_id) VALUES ($1, $2)
+		ON CONFLICT (token) DO NOTHING;
+	`
+	increaseViewQuery = `
+		UPDATE urls
+		SET count = count + $2, bot_count = bot_count + $3
+		WHERE id = $1;
+	`
+	pruneViewFlushesQuery = `
+		DELETE FROM view_flushes WHERE applied_at < $1;
 	`
 )
 
-func (iw *IncreaseCountWorker) BatchUpdate() error {
-	iw.mu.Lock()
-	defer iw.mu.Unlock()
-
-	valuesBuilder := strings.Builder{}
-	params := []interface{}{}
+// missingURLAttempts is how many times views wait for the row of their short URL, about an hour and a half
+// with the default backoff of River
+const missingURLAttempts = 8
 
-	i := 1
-	for id, cnt := range iw.counter {
-		valuesBuilder.WriteString(fmt.Sprintf("($%d, $%d),", i, i+1))
-		params = append(params, id, cnt)
-		i += 2
+// applyViews adds the views to the row of id, with the token of the batch. It reports false, and records
+// nothing, when there is no such row
+func applyViews(ctx context.Context, db *sqlx.DB, id string, token string, count int, botCount int) (bool, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
 	}
+	defer tx.Rollback()
 
-	if len(params) == 0 {
-		return nil
+	if token != "" {
+		result, err := tx.ExecContext(ctx, insertViewFlushQuery, token, id)
+		if err != nil {
+			return false, err
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return false, err
+		} else if affected == 0 {
+			slog.Info("views batch has already been applied", "url_id", id, "token", token)
+			return true, tx.Commit()
+		}
 	}
 
-	values := valuesBuilder.String()
-	values = values[:len(values)-1]
-
-	query := fmt.Sprintf(batchUpdateQuery, values)
-	log.Printf("Query statement: %s\n", query)
-
-	if _, err := iw.db.Exec(query, params...); err != nil {
-		return err
+	result, err := tx.ExecContext(ctx, increaseViewQuery, id, count, botCount)
+	if err != nil {
+		return false, err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return false, err
+	} else if affected == 0 {
+		// the token must not be recorded, the batch is applied once the row exists
+		return false, nil
 	}
+	return true, tx.Commit()
+}
 
-	iw.counter = make(map[string]int)
-	return nil
+// PruneViewFlushes removes tokens of batches applied before the given time.
+// Keep them longer than a batch can stay in-flight, otherwise a resent batch is counted twice
+func PruneViewFlushes(ctx context.Context, db *sqlx.DB, before time.Time) error {
+	_, err := db.ExecContext(ctx, pruneViewFlushesQuery, before)
+	return err
 }
 
 type BatchCreateArgs struct {
 	IDs        []string
 	OriginURLs []string
+	Owners     []string // empty for jobs enqueued before short URLs had owners
+	Campaigns  []string // empty for jobs enqueued before short URLs had campaigns
 }
 
 func (BatchCreateArgs) Kind() string {
@@ -142,7 +209,8 @@ func (BatchCreateArgs) Kind() string {
 }
 
 type BatchCreateWorker struct {
-	db *sqlx.DB
+	db     *sqlx.DB
+	shards *shards // set when the urls table is sharded
 	river.WorkerDefaults[BatchCreateArgs]
 }
 
@@ -152,21 +220,85 @@ func NewBatchCreateWorker(db *sqlx.DB) *BatchCreateWorker {
 	}
 }
 
+// WithShards inserts the short URLs on their shard, see shards
+func (bw *BatchCreateWorker) WithShards(dbs []*sqlx.DB, router *shard.Router) *BatchCreateWorker {
+	bw.shards = &shards{dbs: dbs, router: router}
+	return bw
+}
+
 func (bw *BatchCreateWorker) Work(ctx context.Context, job *river.Job[BatchCreateArgs]) error {
-	byteBuffer := bytes.NewBufferString(`INSERT INTO urls (id, original_url) VALUES `)
-	tuples := make([]string, len(job.Args.IDs))
-	for i := range tuples {
-		tuples[i] = fmt.Sprintf("('%s', '%s')", job.Args.IDs[i], job.Args.OriginURLs[i])
+	args := job.Args
+	if len(args.IDs) == 0 {
+		return nil
 	}
-	byteBuffer.WriteString(strings.Join(tuples, ","))
 
-	query := byteBuffer.String()
-	if _, err := bw.db.ExecContext(ctx, query); err != nil {
-		return err
+	batches := make(map[*sqlx.DB][]int)
+	for i, id := range args.IDs {
+		db := bw.shards.write(bw.db, id)
+		batches[db] = append(batches[db], i)
+	}
+
+	for db, batch := range batches {
+		byteBuffer := bytes.NewBufferString(`INSERT INTO urls (id, original_url, owner, campaign, shard_key) VALUES `)
+		params := make([]interface{}, 0, 5*len(batch))
+		for j, i := range batch {
+			if j > 0 {
+				byteBuffer.WriteString(",")
+			}
+			fmt.Fprintf(byteBuffer, "($%d, $%d, $%d, $%d, $%d)", 5*j+1, 5*j+2, 5*j+3, 5*j+4, 5*j+5)
+			owner, campaign := "", ""
+			if i < len(args.Owners) {
+				owner = args.Owners[i]
+			}
+			if i < len(args.Campaigns) {
+				campaign = args.Campaigns[i]
+			}
+			params = append(params, args.IDs[i], args.OriginURLs[i], owner, campaign, int64(shard.Key(args.IDs[i])))
+		}
+		// A taken id must not fail the batch: the job would be retried forever and the other short URLs lost.
+		// The rows inserted by a failed attempt of a sharded batch are skipped the same way
+		byteBuffer.WriteString(" ON CONFLICT (id) DO NOTHING")
+
+		query := byteBuffer.String()
+		res, err := db.ExecContext(ctx, query, params...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n < int64(len(batch)) {
+			slog.Warn("skipped short urls whose id is taken or already inserted", "job_id", job.ID, "skipped", int64(len(batch))-n)
+		}
 	}
 	return nil
 }
 
+// shards are the databases of a sharded urls table, the router says which one holds a short URL.
+// Its methods fall back to db on a nil set (the urls table isn't sharded)
+type shards struct {
+	dbs    []*sqlx.DB
+	router *shard.Router
+}
+
+// write returns the database new rows of id go to
+func (s *shards) write(db *sqlx.DB, id string) *sqlx.DB {
+	if s == nil {
+		return db
+	}
+	return s.dbs[s.router.Route(id).Write]
+}
+
+// all returns every database that may hold id, more than one while it moves to another shard
+func (s *shards) all(db *sqlx.DB, id string) []*sqlx.DB {
+	if s == nil {
+		return []*sqlx.DB{db}
+	}
+	route := s.router.Route(id)
+	dbs := make([]*sqlx.DB, len(route.All))
+	for i, n := range route.All {
+		dbs[i] = s.dbs[n]
+	}
+	return dbs
+}
+
 func Migrate(ctx context.Context, dbPool *pgxpool.Pool) error {
 	migrator, err := rivermigrate.New(riverpgxv5.New(dbPool), nil)
 	if err != nil {
@@ -0,0 +1,71 @@
+package background
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/armistcxy/shorten/internal/migrate"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/riverqueue/river"
+	"github.com/riverqueue/river/rivertype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Views can be flushed before the row of their short URL is inserted (it waits in the buffer of the API
+// or in a batch_create job): the batch must be applied once the row is there, not marked as applied
+func TestIncreaseCountBeforeRowExists(t *testing.T) {
+	db := sqlx.MustConnect("postgres", os.Getenv("URL_DSN"))
+	defer db.Close()
+	ctx := context.Background()
+	migrator, err := migrate.New(db)
+	require.NoError(t, err)
+	_, err = migrator.Up(ctx)
+	require.NoError(t, err)
+
+	const id, token = "bgearly", "bgearly-token"
+	cleanup := func() {
+		db.MustExec(`DELETE FROM view_flushes WHERE token = $1`, token)
+		db.MustExec(`DELETE FROM urls WHERE id = $1`, id)
+	}
+	cleanup()
+	defer cleanup()
+
+	worker := NewIncreaseCountWorker(db, nil)
+	job := func(attempt int) *river.Job[IncreaseCountArgs] {
+		return &river.Job[IncreaseCountArgs]{
+			JobRow: &rivertype.JobRow{Attempt: attempt},
+			Args:   IncreaseCountArgs{ID: id, Count: 3, BotCount: 1, Token: token},
+		}
+	}
+
+	// no row yet: the job fails and the token isn't recorded
+	assert.Error(t, worker.Work(ctx, job(1)))
+	var tokens int
+	require.NoError(t, db.Get(&tokens, `SELECT COUNT(*) FROM view_flushes WHERE token = $1`, token))
+	assert.Zero(t, tokens)
+
+	// the retry after the row is inserted applies the views, once
+	db.MustExec(`INSERT INTO urls (id, original_url) VALUES ($1, $2)`, id, "https://example.com/early")
+	require.NoError(t, worker.Work(ctx, job(2)))
+	require.NoError(t, worker.Work(ctx, job(3)))
+	var count, botCount int
+	require.NoError(t, db.QueryRow(`SELECT count, bot_count FROM urls WHERE id = $1`, id).Scan(&count, &botCount))
+	assert.Equal(t, 3, count)
+	assert.Equal(t, 1, botCount)
+}
+
+// The views of a short URL that never shows up are dropped after a while
+func TestIncreaseCountGivesUpOnMissingRow(t *testing.T) {
+	db := sqlx.MustConnect("postgres", os.Getenv("URL_DSN"))
+	defer db.Close()
+
+	err := NewIncreaseCountWorker(db, nil).Work(context.Background(), &river.Job[IncreaseCountArgs]{
+		JobRow: &rivertype.JobRow{Attempt: missingURLAttempts},
+		Args:   IncreaseCountArgs{ID: "bgnever", Count: 1},
+	})
+	var cancel *river.JobCancelError
+	assert.ErrorAs(t, err, &cancel)
+}
@@ -0,0 +1,68 @@
+package bloom
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// Filter is a Bloom filter of strings: Test never returns false for a string that has been added,
+// it returns true for a string that hasn't been added with a probability close to the configured rate.
+// Strings can't be removed.
+type Filter struct {
+	mu   sync.RWMutex
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint64 // number of hash functions
+}
+
+// New sizes the filter for n strings with a false positive rate of fpRate
+func New(n uint64, fpRate float64) *Filter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = max((m+63)/64*64, 64)
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	k = max(k, 1)
+	return &Filter{
+		bits: make([]uint64, m/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// hashes returns the two halves of a 64 bit FNV-1a hash, the k positions are derived from them
+// by double hashing (h1 + i*h2)
+func hashes(s string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+	// h2 must be odd so that the positions don't collapse when m is a power of two
+	return h1, h2 | 1
+}
+
+func (f *Filter) Add(s string) {
+	h1, h2 := hashes(s)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.k {
+		pos := (h1 + i*h2) % f.m
+		f.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+// Test reports whether s may have been added
+func (f *Filter) Test(s string) bool {
+	h1, h2 := hashes(s)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for i := range f.k {
+		pos := (h1 + i*h2) % f.m
+		if f.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
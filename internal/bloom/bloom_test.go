@@ -0,0 +1,35 @@
+package bloom
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterNoFalseNegatives(t *testing.T) {
+	f := New(10000, 0.01)
+	for i := range 10000 {
+		f.Add(strconv.Itoa(i))
+	}
+	for i := range 10000 {
+		if !f.Test(strconv.Itoa(i)) {
+			t.Fatalf("%d has been added but is not in the filter", i)
+		}
+	}
+}
+
+func TestFilterFalsePositiveRate(t *testing.T) {
+	f := New(10000, 0.01)
+	for i := range 10000 {
+		f.Add(strconv.Itoa(i))
+	}
+
+	falsePositives := 0
+	for i := 10000; i < 110000; i++ {
+		if f.Test(strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, float64(falsePositives)/100000, 0.02)
+}
@@ -0,0 +1,92 @@
+package bot
+
+import (
+	"net/http"
+	"strings"
+)
+
+// crawlerWords are lowercase words that automated clients put in their User-Agent. They only match as a word
+// of their own ("Sogou web spider") or at the end of a product token ("Googlebot/2.1", "AdsBot-Google"):
+// browsers on a phone model like "CUBOT X19" or with "robot" in their name aren't bots.
+var crawlerWords = []string{"bot", "crawler", "spider", "slurp", "scrapy"}
+
+// signatures are lowercase fragments of User-Agent strings sent by link unfurlers,
+// crawlers, scanners and health checkers. Matching is a plain substring search,
+// so keep entries specific enough to not catch real browsers.
+var signatures = []string{
+	// crawlers that don't call themselves bots
+	"googleother", "google-inspectiontool", "mediapartners-google", "bingpreview",
+	// link unfurlers
+	"slackbot", "slack-imgproxy", "twitterbot", "facebookexternalhit", "facebot",
+	"linkedinbot", "discordbot", "telegrambot", "whatsapp", "skypeuripreview",
+	"embedly", "vkshare", "pinterest", "redditbot", "applebot",
+	// scanners (VirusTotal is used by our own fraud-detection service)
+	"virustotal", "urlscan", "safebrowsing", "phishtank", "netcraft",
+	// health checkers and monitoring
+	"kube-probe", "elb-healthchecker", "googlehc", "uptimerobot", "pingdom",
+	"statuscake", "site24x7", "traefik",
+	// http libraries and command line tools
+	"curl/", "wget/", "python-requests", "python-urllib", "go-http-client",
+	"java/", "okhttp", "libwww-perl", "httpclient", "axios/", "node-fetch",
+	"apachebench", "headlesschrome", "phantomjs",
+}
+
+// IsBot reports whether the request most likely comes from an automated client rather than a human.
+// A request is classified as bot traffic when:
+//   - its User-Agent is empty or matches one of the known signatures
+//   - it is a HEAD request (unfurlers and health checkers only care about the status)
+//   - it does not send an Accept header (every browser does)
+func IsBot(r *http.Request) bool {
+	return Reason(r) != ""
+}
+
+// Reason returns why the request is classified as bot traffic, or an empty string for human traffic.
+func Reason(r *http.Request) string {
+	if r.Method == http.MethodHead {
+		return "head request"
+	}
+
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return "empty user agent"
+	}
+	for _, sig := range signatures {
+		if strings.Contains(ua, sig) {
+			return "user agent matches " + sig
+		}
+	}
+	for _, word := range crawlerWords {
+		if containsCrawlerWord(ua, word) {
+			return "user agent matches " + word
+		}
+	}
+
+	if r.Header.Get("Accept") == "" {
+		return "no accept header"
+	}
+
+	return ""
+}
+
+// containsCrawlerWord reports whether word is in ua as a word of its own, or ends a product token: it is followed
+// by a separator other than a space ("googlebot/2.1", "duckduckbot-https", "baiduspider+")
+func containsCrawlerWord(ua, word string) bool {
+	for i := 0; ; {
+		j := strings.Index(ua[i:], word)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(word)
+		if end == len(ua) || !isWordChar(ua[end]) {
+			alone := start == 0 || !isWordChar(ua[start-1])
+			if alone || (end < len(ua) && ua[end] != ' ') {
+				return true
+			}
+		}
+		i = start + 1
+	}
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_'
+}
@@ -0,0 +1,50 @@
+package bot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsBot(t *testing.T) {
+	const chrome = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Safari/537.36"
+
+	testcases := []struct {
+		testname  string
+		method    string
+		userAgent string
+		accept    string
+		want      bool
+	}{
+		{"browser", http.MethodGet, chrome, "text/html", false},
+		{"head request from browser", http.MethodHead, chrome, "text/html", true},
+		{"browser without accept header", http.MethodGet, chrome, "", true},
+		{"empty user agent", http.MethodGet, "", "*/*", true},
+		{"slack unfurler", http.MethodGet, "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", "*/*", true},
+		{"facebook unfurler", http.MethodGet, "facebookexternalhit/1.1", "*/*", true},
+		{"twitter unfurler", http.MethodGet, "Twitterbot/1.0", "*/*", true},
+		{"virustotal", http.MethodGet, "Mozilla/5.0 (compatible; VirusTotal)", "*/*", true},
+		{"curl", http.MethodGet, "curl/8.5.0", "*/*", true},
+		{"kubernetes probe", http.MethodGet, "kube-probe/1.30", "*/*", true},
+		{"googlebot", http.MethodGet, "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "*/*", true},
+		{"bingbot", http.MethodGet, "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", "*/*", true},
+		{"duckduckbot", http.MethodGet, "DuckDuckBot-Https/1.1; (+https://duckduckgo.com/duckduckbot)", "*/*", true},
+		{"baidu spider", http.MethodGet, "Mozilla/5.0 (compatible; Baiduspider/2.0; +http://www.baidu.com/search/spider.html)", "*/*", true},
+		{"crawler word", http.MethodGet, "Sogou web spider/4.0", "*/*", true},
+		{"phone named like a bot", http.MethodGet, "Mozilla/5.0 (Linux; Android 9; CUBOT X19 Build/PPR1.180610.011) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36", "text/html", false},
+		{"robot in the name", http.MethodGet, "Mozilla/5.0 (Windows NT 10.0; Win64; x64; RobotStudio) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Safari/537.36", "text/html", false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.testname, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/short/abc", nil)
+			r.Header.Set("User-Agent", tc.userAgent)
+			if tc.accept != "" {
+				r.Header.Set("Accept", tc.accept)
+			}
+			assert.Equal(t, tc.want, IsBot(r), Reason(r))
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package breaker
+
+// A circuit breaker stops calling a dependency that keeps failing: after Threshold consecutive failures
+// it opens and calls fail right away with ErrOpen. After OpenTimeout it lets a few calls through (half-open),
+// the breaker closes again if they succeed and opens again if one of them fails.
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+type Config struct {
+	// Threshold is the number of consecutive failures that opens the breaker
+	Threshold int
+	// OpenTimeout is how long the breaker stays open before trying again
+	OpenTimeout time.Duration
+	// HalfOpenCalls is the number of calls let through when half-open, they must all succeed to close the breaker
+	HalfOpenCalls int
+	// IsFailure tells which errors count as failures, by default every error does
+	IsFailure func(error) bool
+	// OnStateChange is called (with the lock held, it must not call the breaker) when the state changes
+	OnStateChange func(from State, to State)
+}
+
+// Counts are exposed in metrics
+type Counts struct {
+	Successes int64 `json:"successes"`
+	Failures  int64 `json:"failures"`
+	Rejected  int64 `json:"rejected"`
+	Opened    int64 `json:"opened"`
+}
+
+type Breaker struct {
+	cfg Config
+	now func() time.Time
+
+	mu          sync.Mutex
+	state       State
+	failures    int // consecutive failures when closed
+	openedAt    time.Time
+	halfOpenIn  int // calls in flight when half-open
+	halfOpenOKs int // successful calls when half-open
+	counts      Counts
+}
+
+func New(cfg Config) *Breaker {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = 5
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 5 * time.Second
+	}
+	if cfg.HalfOpenCalls <= 0 {
+		cfg.HalfOpenCalls = 1
+	}
+	if cfg.IsFailure == nil {
+		cfg.IsFailure = func(err error) bool { return err != nil }
+	}
+	return &Breaker{cfg: cfg, now: time.Now}
+}
+
+// Execute calls fn unless the breaker is open, the error of fn is returned as it is
+func (b *Breaker) Execute(fn func() error) error {
+	if err := b.before(); err != nil {
+		return err
+	}
+	err := fn()
+	b.after(!b.cfg.IsFailure(err))
+	return err
+}
+
+func (b *Breaker) before() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		b.setState(HalfOpen)
+	}
+
+	switch b.state {
+	case Open:
+		b.counts.Rejected++
+		return ErrOpen
+	case HalfOpen:
+		if b.halfOpenIn+b.halfOpenOKs >= b.cfg.HalfOpenCalls {
+			b.counts.Rejected++
+			return ErrOpen
+		}
+		b.halfOpenIn++
+	}
+	return nil
+}
+
+func (b *Breaker) after(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		b.counts.Successes++
+	} else {
+		b.counts.Failures++
+	}
+
+	switch b.state {
+	case Closed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.cfg.Threshold {
+			b.setState(Open)
+		}
+	case HalfOpen:
+		b.halfOpenIn--
+		if !success {
+			b.setState(Open)
+			return
+		}
+		b.halfOpenOKs++
+		if b.halfOpenOKs >= b.cfg.HalfOpenCalls {
+			b.setState(Closed)
+		}
+	case Open:
+		// the call started before the breaker opened, its result doesn't matter anymore
+	}
+}
+
+func (b *Breaker) setState(to State) {
+	from := b.state
+	if from == to {
+		return
+	}
+	b.state = to
+	b.failures = 0
+	b.halfOpenIn = 0
+	b.halfOpenOKs = 0
+	if to == Open {
+		b.openedAt = b.now()
+		b.counts.Opened++
+	}
+	if b.cfg.OnStateChange != nil {
+		b.cfg.OnStateChange(from, to)
+	}
+}
+
+// State returns the current state, an open breaker whose timeout has elapsed is reported as half-open
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		return HalfOpen
+	}
+	return b.state
+}
+
+func (b *Breaker) Counts() Counts {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.counts
+}
+
+// Var exposes the state and the counts of the breaker in expvar
+func (b *Breaker) Var() expvar.Var {
+	return expvar.Func(func() any {
+		return map[string]any{
+			"state":  b.State().String(),
+			"counts": b.Counts(),
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errDB = errors.New("db is down")
+
+func newTestBreaker(cfg Config) (*Breaker, *time.Time) {
+	now := time.Unix(0, 0)
+	b := New(cfg)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b, _ := newTestBreaker(Config{Threshold: 3, OpenTimeout: time.Second})
+	fail := func() error { return errDB }
+
+	assert.ErrorIs(t, b.Execute(fail), errDB)
+	assert.NoError(t, b.Execute(func() error { return nil }))
+	// a success resets the consecutive failures
+	assert.ErrorIs(t, b.Execute(fail), errDB)
+	assert.ErrorIs(t, b.Execute(fail), errDB)
+	assert.Equal(t, Closed, b.State())
+	assert.ErrorIs(t, b.Execute(fail), errDB)
+	assert.Equal(t, Open, b.State())
+
+	called := false
+	assert.ErrorIs(t, b.Execute(func() error { called = true; return nil }), ErrOpen)
+	assert.False(t, called)
+	assert.Equal(t, Counts{Successes: 1, Failures: 4, Rejected: 1, Opened: 1}, b.Counts())
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b, now := newTestBreaker(Config{Threshold: 1, OpenTimeout: time.Second, HalfOpenCalls: 2})
+	_ = b.Execute(func() error { return errDB })
+	assert.Equal(t, Open, b.State())
+
+	*now = now.Add(time.Second)
+	assert.Equal(t, HalfOpen, b.State())
+	assert.NoError(t, b.Execute(func() error { return nil }))
+	assert.Equal(t, HalfOpen, b.State())
+	assert.NoError(t, b.Execute(func() error { return nil }))
+	assert.Equal(t, Closed, b.State())
+
+	// a failure when half-open opens the breaker again
+	_ = b.Execute(func() error { return errDB })
+	*now = now.Add(time.Second)
+	assert.ErrorIs(t, b.Execute(func() error { return errDB }), errDB)
+	assert.Equal(t, Open, b.State())
+}
+
+func TestBreakerIgnoresExpectedErrors(t *testing.T) {
+	errNotFound := errors.New("not found")
+	b, _ := newTestBreaker(Config{
+		Threshold: 1,
+		IsFailure: func(err error) bool { return err != nil && !errors.Is(err, errNotFound) },
+	})
+
+	assert.ErrorIs(t, b.Execute(func() error { return errNotFound }), errNotFound)
+	assert.Equal(t, Closed, b.State())
+}
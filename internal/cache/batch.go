@@ -0,0 +1,233 @@
+package cache
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type waitKey struct{}
+
+// WaitForWrite makes the writes of a BatchedRedisCache made with ctx wait until Redis acknowledged them,
+// for callers that need to read their own write (possibly from another replica) right away
+func WaitForWrite(ctx context.Context) context.Context {
+	return context.WithValue(ctx, waitKey{}, true)
+}
+
+func waitsForWrite(ctx context.Context) bool {
+	wait, _ := ctx.Value(waitKey{}).(bool)
+	return wait
+}
+
+type writeOp struct {
+	key   string
+	value string
+	ttl   time.Duration
+	del   bool
+	done  chan error // nil if nobody waits for the acknowledgement
+}
+
+// BatchWriter coalesces the writes of concurrent callers into Redis pipelines. A batch is flushed
+// when it has maxBatch writes or maxDelay after its first write. On a cluster, writes are grouped
+// by slot and every master gets its own pipeline. Batches are flushed one after the other,
+// so writes to the same key are applied in order.
+type BatchWriter struct {
+	client   redis.UniversalClient
+	ops      chan writeOp
+	maxBatch int
+	maxDelay time.Duration
+	flush    func(ctx context.Context, ops []writeOp) []error
+}
+
+func NewBatchWriter(client redis.UniversalClient, maxBatch int, maxDelay time.Duration) *BatchWriter {
+	bw := &BatchWriter{
+		client:   client,
+		ops:      make(chan writeOp, 4*maxBatch),
+		maxBatch: maxBatch,
+		maxDelay: maxDelay,
+	}
+	bw.flush = bw.pipeline
+	return bw
+}
+
+// Write queues a write, it waits for the acknowledgement only if ctx was made with WaitForWrite.
+// Errors of writes that nobody waits for are logged.
+func (bw *BatchWriter) Write(ctx context.Context, op writeOp) error {
+	if waitsForWrite(ctx) {
+		op.done = make(chan error, 1)
+	}
+
+	select {
+	case bw.ops <- op:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if op.done == nil {
+		return nil
+	}
+
+	select {
+	case err := <-op.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run flushes the queued writes until ctx is done
+func (bw *BatchWriter) Run(ctx context.Context) {
+	batch := make([]writeOp, 0, bw.maxBatch)
+	timer := time.NewTimer(bw.maxDelay)
+	timer.Stop()
+
+	flush := func() {
+		errs := bw.flush(context.Background(), batch)
+		for i, op := range batch {
+			if op.done != nil {
+				op.done <- errs[i]
+			} else if errs[i] != nil {
+				slog.Error("failed to write to cache", "key", op.key, "error", errs[i].Error())
+			}
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case op := <-bw.ops:
+			if len(batch) == 0 {
+				timer.Reset(bw.maxDelay)
+			}
+			batch = append(batch, op)
+			if len(batch) >= bw.maxBatch {
+				timer.Stop()
+				flush()
+			}
+		case <-timer.C:
+			if len(batch) > 0 {
+				flush()
+			}
+		}
+	}
+}
+
+// pipeline sends ops and returns the error of each of them
+func (bw *BatchWriter) pipeline(ctx context.Context, ops []writeOp) []error {
+	errs := make([]error, len(ops))
+	cluster, ok := bw.client.(*redis.ClusterClient)
+	if !ok {
+		bw.exec(ctx, bw.client, ops, indexes(len(ops)), errs)
+		return errs
+	}
+
+	// group by slot, then by the master serving the slot
+	masterOfSlot := make(map[int]*redis.Client)
+	byMaster := make(map[*redis.Client][]int)
+	var unrouted []int
+	for i, op := range ops {
+		slot := Slot(op.key)
+		master, ok := masterOfSlot[slot]
+		if !ok {
+			var err error
+			if master, err = cluster.MasterForKey(ctx, op.key); err != nil {
+				unrouted = append(unrouted, i)
+				continue
+			}
+			masterOfSlot[slot] = master
+		}
+		byMaster[master] = append(byMaster[master], i)
+	}
+
+	var wg sync.WaitGroup
+	for master, idx := range byMaster {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bw.exec(ctx, master, ops, idx, errs)
+		}()
+	}
+	wg.Wait()
+
+	// writes that couldn't be routed or hit a slot being migrated go through the cluster client,
+	// which follows the redirections
+	for i, err := range errs {
+		if err != nil && (redis.HasErrorPrefix(err, "MOVED") || redis.HasErrorPrefix(err, "ASK")) {
+			unrouted = append(unrouted, i)
+		}
+	}
+	if len(unrouted) > 0 {
+		bw.exec(ctx, cluster, ops, unrouted, errs)
+	}
+	return errs
+}
+
+func (bw *BatchWriter) exec(ctx context.Context, client redis.Cmdable, ops []writeOp, idx []int, errs []error) {
+	cmds := make([]redis.Cmder, len(idx))
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for j, i := range idx {
+			if ops[i].del {
+				cmds[j] = pipe.Del(ctx, ops[i].key)
+			} else {
+				cmds[j] = pipe.Set(ctx, ops[i].key, ops[i].value, ops[i].ttl)
+			}
+		}
+		return nil
+	})
+	for j, i := range idx {
+		if cmds[j] != nil {
+			errs[i] = cmds[j].Err()
+		} else {
+			errs[i] = err
+		}
+	}
+}
+
+func indexes(n int) []int {
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	return idx
+}
+
+// BatchedRedisCache is a RedisCache whose writes go through a BatchWriter, reads are sent right away.
+// Deletes are queued as well so that they are applied after the writes queued before them.
+type BatchedRedisCache struct {
+	*RedisCache
+	writer *BatchWriter
+}
+
+func NewBatchedRedisCache(rc *RedisCache, writer *BatchWriter) *BatchedRedisCache {
+	return &BatchedRedisCache{
+		RedisCache: rc,
+		writer:     writer,
+	}
+}
+
+func (bc *BatchedRedisCache) Set(ctx context.Context, id string, url string) error {
+	return bc.writer.Write(ctx, writeOp{key: id, value: url, ttl: bc.ttl})
+}
+
+func (bc *BatchedRedisCache) SetWithTTL(ctx context.Context, id string, url string, ttl time.Duration) error {
+	return bc.writer.Write(ctx, writeOp{key: id, value: url, ttl: ttl})
+}
+
+// SetNX is sent right away, it can't be merged with the queued writes
+func (bc *BatchedRedisCache) SetNX(ctx context.Context, id string, url string, ttl time.Duration) (bool, error) {
+	return bc.RedisCache.SetNX(ctx, id, url, ttl)
+}
+
+func (bc *BatchedRedisCache) Delete(ctx context.Context, id string) error {
+	return bc.writer.Write(ctx, writeOp{key: id, del: true})
+}
+
+// Run flushes the queued writes until ctx is done
+func (bc *BatchedRedisCache) Run(ctx context.Context) {
+	bc.writer.Run(ctx)
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingFlush records the batches instead of sending them to Redis, writes to "bad" fail
+type recordingFlush struct {
+	mu      sync.Mutex
+	batches [][]writeOp
+}
+
+func (rf *recordingFlush) flush(_ context.Context, ops []writeOp) []error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.batches = append(rf.batches, append([]writeOp(nil), ops...))
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		if op.key == "bad" {
+			errs[i] = errors.New("OOM command not allowed")
+		}
+	}
+	return errs
+}
+
+func (rf *recordingFlush) sizes() []int {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	sizes := make([]int, len(rf.batches))
+	for i := range rf.batches {
+		sizes[i] = len(rf.batches[i])
+	}
+	return sizes
+}
+
+func newTestBatchWriter(maxBatch int, maxDelay time.Duration) (*BatchWriter, *recordingFlush) {
+	bw := NewBatchWriter(nil, maxBatch, maxDelay)
+	rf := &recordingFlush{}
+	bw.flush = rf.flush
+	return bw, rf
+}
+
+func TestBatchWriterFlushesOnSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bw, rf := newTestBatchWriter(4, time.Hour)
+	go bw.Run(ctx)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, bw.Write(WaitForWrite(ctx), writeOp{key: "abc", value: "https://example.com"}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, []int{4, 4}, rf.sizes())
+}
+
+func TestBatchWriterFlushesOnDelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bw, rf := newTestBatchWriter(100, 10*time.Millisecond)
+	go bw.Run(ctx)
+
+	_ = bw.Write(ctx, writeOp{key: "a"})
+	_ = bw.Write(ctx, writeOp{key: "b"})
+	assert.Eventually(t, func() bool {
+		sizes := rf.sizes()
+		return len(sizes) == 1 && sizes[0] == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestBatchWriterReportsErrorsToWaiters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bw, _ := newTestBatchWriter(100, time.Millisecond)
+	go bw.Run(ctx)
+
+	assert.Error(t, bw.Write(WaitForWrite(ctx), writeOp{key: "bad"}))
+	assert.NoError(t, bw.Write(WaitForWrite(ctx), writeOp{key: "good"}))
+	// without waiting, the error is only logged
+	assert.NoError(t, bw.Write(ctx, writeOp{key: "bad"}))
+}
+
+func TestBatchWriterWaitHonoursContext(t *testing.T) {
+	// nothing runs the writer, the write is never acknowledged
+	bw, _ := newTestBatchWriter(100, time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, bw.Write(WaitForWrite(ctx), writeOp{key: "abc"}), context.DeadlineExceeded)
+}
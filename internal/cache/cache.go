@@ -9,6 +9,31 @@ type Cache interface {
 	Get(ctx context.Context, id string) (string, error)
 	Set(ctx context.Context, id string, url string) error
 	SetWithTTL(ctx context.Context, id string, url string, ttl time.Duration) error
+	Delete(ctx context.Context, id string) error
+}
+
+// NXCache is implemented by caches that can write a value only when the key is not set
+type NXCache interface {
+	Cache
+	// SetNX sets id for ttl unless it already has a value, it reports whether the value was set
+	SetNX(ctx context.Context, id string, url string, ttl time.Duration) (bool, error)
+}
+
+// SetNX sets id in c unless it already has a value. Caches that don't implement NXCache are read first,
+// a concurrent write can still be overwritten then.
+func SetNX(ctx context.Context, c Cache, id string, url string, ttl time.Duration) (bool, error) {
+	if nc, ok := c.(NXCache); ok {
+		return nc.SetNX(ctx, id, url, ttl)
+	}
+	if val, err := c.Get(ctx, id); err != nil || val != "" {
+		return false, err
+	}
+	return true, c.SetWithTTL(ctx, id, url, ttl)
+}
+
+// Runner is implemented by caches that have work to do in the background, e.g. receive invalidations
+type Runner interface {
+	Run(ctx context.Context)
 }
 
 type ViewCache interface {
@@ -16,4 +41,42 @@ type ViewCache interface {
 	Set(ctx context.Context, key string, count int) error
 	SetWithTTL(ctx context.Context, key string, count int, ttl time.Duration) error
 	Increase(ctx context.Context, key string) error
+
+	// View counting pipeline: hits are added to a pending counter of the URL, the flusher claims
+	// pending counters into an in-flight batch tagged with a unique token and hands it to the database,
+	// the batch is acknowledged (removed) once the database has applied it.
+
+	// AddPending adds delta to the pending counters of id and marks id as dirty.
+	AddPending(ctx context.Context, id string, delta ViewDelta) error
+	// Pending returns views of id that are not in the database yet (pending and in-flight).
+	Pending(ctx context.Context, id string) (ViewDelta, error)
+	// PopDirty removes and returns at most n ids that have pending views.
+	PopDirty(ctx context.Context, n int) ([]string, error)
+	// MarkDirty marks ids as having pending views so that they are picked up by the next flush.
+	MarkDirty(ctx context.Context, ids ...string) error
+	// Claim atomically moves the pending counters of id into an in-flight batch identified by token.
+	// When id already has an in-flight batch, nothing is claimed. If that batch has not been acknowledged
+	// within staleAfter, it is returned with its original token so that it can be sent again.
+	Claim(ctx context.Context, id string, token string, staleAfter time.Duration) (ViewBatch, ClaimStatus, error)
+	// Ack removes the in-flight batch of id if it is still identified by token.
+	Ack(ctx context.Context, id string, token string) error
 }
+
+type ViewDelta struct {
+	Count    int `json:"count"`
+	BotCount int `json:"bot_count"`
+}
+
+type ViewBatch struct {
+	Token string
+	Delta ViewDelta
+}
+
+type ClaimStatus int
+
+const (
+	ClaimEmpty  ClaimStatus = iota // nothing pending
+	ClaimNew                       // pending counters moved into a new batch
+	ClaimResend                    // in-flight batch is stale and must be sent again
+	ClaimBusy                      // in-flight batch is waiting for its acknowledgement
+)
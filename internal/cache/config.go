@@ -0,0 +1,294 @@
+package cache
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+type Backend string
+
+const (
+	BackendNone         Backend = "none"          // no URL cache, views are counted in memory
+	BackendMemory       Backend = "memory"        // in-process Ristretto cache, views are counted in memory
+	BackendRedis        Backend = "redis"         // single Redis node
+	BackendRedisCluster Backend = "redis-cluster" // Redis Cluster
+	BackendTiered       Backend = "tiered"        // Ristretto in front of Redis (single node or cluster)
+)
+
+// Config selects and configures the cache backend, it is shared by the URL cache and the view cache
+type Config struct {
+	Backend Backend
+	// Addrs are the Redis nodes, as host:port or redis:// (rediss:// for TLS) URLs
+	Addrs    []string
+	Password string
+	TLS      bool
+	// PoolSize is the number of connections per Redis node, 0 uses the go-redis default
+	PoolSize int
+	// Cluster tells whether Addrs are nodes of a Redis Cluster, only used by the tiered backend
+	Cluster bool
+
+	// TTL of cached URLs in Redis and in the memory backend
+	TTL time.Duration
+	// L1TTL bounds how long the tiered backend serves an URL from memory
+	L1TTL time.Duration
+	// L1MaxEntries is the number of URLs kept in memory by the memory and tiered backends
+	L1MaxEntries int64
+	// WriteBatchSize is the maximum number of writes sent to Redis in one pipeline, 0 sends every write on its own
+	WriteBatchSize int
+	// WriteBatchDelay is how long a write waits for others to join its pipeline
+	WriteBatchDelay time.Duration
+	// SoftTTL is the age after which a cached URL is refreshed in the background while still being served,
+	// 0 disables stale-while-revalidate
+	SoftTTL time.Duration
+}
+
+// ConfigFromEnv reads the cache configuration:
+//
+//	CACHE_BACKEND       none, memory, redis, redis-cluster or tiered (default memory)
+//	CACHE_ADDRS         comma separated Redis nodes
+//	CACHE_PASSWORD      Redis password
+//	CACHE_TLS           true to connect to Redis over TLS
+//	CACHE_POOL_SIZE     connections per Redis node
+//	CACHE_CLUSTER       true if the tiered backend sits in front of a Redis Cluster (default true)
+//	CACHE_TTL           TTL of cached URLs (default 24h)
+//	CACHE_L1_TTL        TTL of URLs cached in memory by the tiered backend (default 30s)
+//	CACHE_L1_MAX_ITEMS  number of URLs cached in memory (default 100000)
+//	CACHE_WRITE_BATCH   maximum number of writes per Redis pipeline (default 128, 0 disables batching)
+//	CACHE_WRITE_DELAY   how long a write waits for others to join its pipeline (default 1ms)
+//	CACHE_SOFT_TTL      age after which cached URLs are refreshed in the background (default 5m, 0 disables)
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Backend:      Backend(strings.ToLower(os.Getenv("CACHE_BACKEND"))),
+		Password:     os.Getenv("CACHE_PASSWORD"),
+		Cluster:      true,
+		TTL:          defaultTTL,
+		L1TTL:        30 * time.Second,
+		L1MaxEntries: 100_000,
+		SoftTTL:      5 * time.Minute,
+
+		WriteBatchSize:  128,
+		WriteBatchDelay: time.Millisecond,
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = BackendMemory
+	}
+	for _, addr := range strings.Split(os.Getenv("CACHE_ADDRS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			cfg.Addrs = append(cfg.Addrs, addr)
+		}
+	}
+
+	var err error
+	if v := os.Getenv("CACHE_TLS"); v != "" {
+		if cfg.TLS, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid CACHE_TLS: %w", err)
+		}
+	}
+	if v := os.Getenv("CACHE_CLUSTER"); v != "" {
+		if cfg.Cluster, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid CACHE_CLUSTER: %w", err)
+		}
+	}
+	if v := os.Getenv("CACHE_POOL_SIZE"); v != "" {
+		if cfg.PoolSize, err = strconv.Atoi(v); err != nil {
+			return cfg, fmt.Errorf("invalid CACHE_POOL_SIZE: %w", err)
+		}
+	}
+	if v := os.Getenv("CACHE_TTL"); v != "" {
+		if cfg.TTL, err = time.ParseDuration(v); err != nil {
+			return cfg, fmt.Errorf("invalid CACHE_TTL: %w", err)
+		}
+	}
+	if v := os.Getenv("CACHE_L1_TTL"); v != "" {
+		if cfg.L1TTL, err = time.ParseDuration(v); err != nil {
+			return cfg, fmt.Errorf("invalid CACHE_L1_TTL: %w", err)
+		}
+	}
+	if v := os.Getenv("CACHE_WRITE_BATCH"); v != "" {
+		if cfg.WriteBatchSize, err = strconv.Atoi(v); err != nil {
+			return cfg, fmt.Errorf("invalid CACHE_WRITE_BATCH: %w", err)
+		}
+	}
+	if v := os.Getenv("CACHE_WRITE_DELAY"); v != "" {
+		if cfg.WriteBatchDelay, err = time.ParseDuration(v); err != nil {
+			return cfg, fmt.Errorf("invalid CACHE_WRITE_DELAY: %w", err)
+		}
+	}
+	if v := os.Getenv("CACHE_SOFT_TTL"); v != "" {
+		if cfg.SoftTTL, err = time.ParseDuration(v); err != nil {
+			return cfg, fmt.Errorf("invalid CACHE_SOFT_TTL: %w", err)
+		}
+	}
+	if v := os.Getenv("CACHE_L1_MAX_ITEMS"); v != "" {
+		if cfg.L1MaxEntries, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return cfg, fmt.Errorf("invalid CACHE_L1_MAX_ITEMS: %w", err)
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func (cfg Config) Validate() error {
+	if cfg.TTL <= 0 || cfg.L1TTL <= 0 {
+		return errors.New("cache TTLs must be positive")
+	}
+	if cfg.L1MaxEntries <= 0 {
+		return errors.New("the number of URLs cached in memory must be positive")
+	}
+	if cfg.WriteBatchSize > 0 && cfg.WriteBatchDelay <= 0 {
+		return errors.New("the delay of batched cache writes must be positive")
+	}
+
+	switch cfg.Backend {
+	case BackendNone, BackendMemory:
+		return nil
+	case BackendRedis:
+		if len(cfg.Addrs) != 1 {
+			return errors.New("the redis cache backend needs exactly one address")
+		}
+	case BackendRedisCluster, BackendTiered:
+		if len(cfg.Addrs) == 0 {
+			return fmt.Errorf("the %s cache backend needs at least one address", cfg.Backend)
+		}
+	default:
+		return fmt.Errorf("unknown cache backend %q", cfg.Backend)
+	}
+	return nil
+}
+
+// Shared tells whether the backend keeps its data in Redis, where every replica and tool can reach it
+func (cfg Config) Shared() bool {
+	return cfg.Backend == BackendRedis || cfg.Backend == BackendRedisCluster || cfg.Backend == BackendTiered
+}
+
+func (cfg Config) cluster() bool {
+	return cfg.Backend == BackendRedisCluster || (cfg.Backend == BackendTiered && cfg.Cluster)
+}
+
+// NewClient connects to the Redis nodes of the configuration, it returns nil
+// for the backends that don't use Redis
+func NewClient(cfg Config) (redis.UniversalClient, error) {
+	if !cfg.Shared() {
+		return nil, nil
+	}
+
+	addrs := make([]string, len(cfg.Addrs))
+	useTLS := cfg.TLS
+	for i, addr := range cfg.Addrs {
+		if !strings.Contains(addr, "://") {
+			addrs[i] = addr
+			continue
+		}
+		opt, err := redis.ParseURL(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis address %q: %w", addr, err)
+		}
+		addrs[i] = opt.Addr
+		useTLS = useTLS || opt.TLSConfig != nil
+	}
+
+	var tlsConfig *tls.Config
+	if useTLS {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	if cfg.cluster() {
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     addrs,
+			Password:  cfg.Password,
+			PoolSize:  cfg.PoolSize,
+			TLSConfig: tlsConfig,
+		}), nil
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:      addrs[0],
+		Password:  cfg.Password,
+		PoolSize:  cfg.PoolSize,
+		TLSConfig: tlsConfig,
+	}), nil
+}
+
+// New creates the URL cache of the configuration. client is the one returned by NewClient.
+// Caches that implement Runner must be run, e.g. the tiered cache receives invalidations from other replicas.
+func New(cfg Config, client redis.UniversalClient) (Cache, error) {
+	c, err := newCache(cfg, client)
+	if err != nil || cfg.SoftTTL <= 0 {
+		return c, err
+	}
+	return NewSoftTTLCache(c, cfg.SoftTTL), nil
+}
+
+// newCache creates the backends of the configuration, each of them is instrumented under its name
+func newCache(cfg Config, client redis.UniversalClient) (Cache, error) {
+	switch cfg.Backend {
+	case BackendNone:
+		return NoopCache{}, nil
+	case BackendMemory:
+		l1, err := newRistretto(cfg.L1MaxEntries)
+		if err != nil {
+			return nil, err
+		}
+		return NewInstrumentedCache(NewRistrettoCache(l1, cfg.TTL), string(BackendMemory)), nil
+	case BackendRedis, BackendRedisCluster:
+		return NewInstrumentedCache(newRedisCache(cfg, client), string(cfg.Backend)), nil
+	case BackendTiered:
+		l1, err := newRistretto(cfg.L1MaxEntries)
+		if err != nil {
+			return nil, err
+		}
+		l2Name := BackendRedis
+		if cfg.cluster() {
+			l2Name = BackendRedisCluster
+		}
+		return NewTieredCache(
+			NewInstrumentedCache(NewRistrettoCache(l1, cfg.L1TTL), string(BackendMemory)),
+			NewInstrumentedCache(newRedisCache(cfg, client), string(l2Name)),
+			cfg.L1TTL,
+			NewRedisInvalidator(client),
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.Backend)
+	}
+}
+
+// newRedisCache batches the writes unless it is disabled, the returned cache must then be run
+func newRedisCache(cfg Config, client redis.UniversalClient) Cache {
+	rc := NewRedisCacheWithClient(client, cfg.TTL)
+	if cfg.WriteBatchSize <= 0 {
+		return rc
+	}
+	return NewBatchedRedisCache(rc, NewBatchWriter(client, cfg.WriteBatchSize, cfg.WriteBatchDelay))
+}
+
+// NewViewCache creates the view cache of the configuration, the backends without Redis count views in memory
+func NewViewCache(cfg Config, client redis.UniversalClient) ViewCache {
+	if !cfg.Shared() {
+		return NewMemoryViewCache()
+	}
+	return NewViewRedisCacheWithClient(client)
+}
+
+// IsShared tells whether the view cache is shared with the background worker,
+// batches of a view cache that isn't must be acknowledged by the API itself
+func IsShared(vc ViewCache) bool {
+	_, local := vc.(*MemoryViewCache)
+	return !local
+}
+
+func newRistretto(maxEntries int64) (*ristretto.Cache[string, string], error) {
+	return ristretto.NewCache(&ristretto.Config[string, string]{
+		NumCounters: 10 * maxEntries,
+		MaxCost:     maxEntries,
+		BufferItems: 64,
+		// every entry costs 1, MaxCost is the number of entries
+		IgnoreInternalCost: true,
+	})
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("CACHE_BACKEND", "redis-cluster")
+	t.Setenv("CACHE_ADDRS", "redis://redis_1:6379, redis_2:6379")
+	t.Setenv("CACHE_POOL_SIZE", "20")
+	t.Setenv("CACHE_TTL", "1h")
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("failed to read config: %s", err)
+	}
+	assert.Equal(t, BackendRedisCluster, cfg.Backend)
+	assert.Equal(t, []string{"redis://redis_1:6379", "redis_2:6379"}, cfg.Addrs)
+	assert.Equal(t, 20, cfg.PoolSize)
+	assert.Equal(t, time.Hour, cfg.TTL)
+	assert.Equal(t, 30*time.Second, cfg.L1TTL)
+}
+
+func TestConfigFromEnvDefaultsToMemory(t *testing.T) {
+	t.Setenv("CACHE_BACKEND", "")
+	t.Setenv("CACHE_ADDRS", "")
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("failed to read config: %s", err)
+	}
+	assert.Equal(t, BackendMemory, cfg.Backend)
+}
+
+func TestConfigValidate(t *testing.T) {
+	base := Config{TTL: time.Hour, L1TTL: time.Second, L1MaxEntries: 10}
+
+	cfg := base
+	cfg.Backend = "memcached"
+	assert.Error(t, cfg.Validate())
+
+	cfg = base
+	cfg.Backend = BackendRedis
+	assert.Error(t, cfg.Validate())
+	cfg.Addrs = []string{"localhost:6379"}
+	assert.NoError(t, cfg.Validate())
+
+	cfg = base
+	cfg.Backend = BackendTiered
+	assert.Error(t, cfg.Validate())
+
+	cfg = base
+	cfg.Backend = BackendNone
+	cfg.TTL = 0
+	assert.Error(t, cfg.Validate())
+}
+
+func TestNewWithoutRedis(t *testing.T) {
+	base := Config{TTL: time.Hour, L1TTL: time.Second, L1MaxEntries: 10}
+
+	cfg := base
+	cfg.Backend = BackendNone
+	client, err := NewClient(cfg)
+	assert.NoError(t, err)
+	assert.Nil(t, client)
+	c, err := New(cfg, client)
+	assert.NoError(t, err)
+	assert.IsType(t, NoopCache{}, c)
+
+	cfg = base
+	cfg.Backend = BackendMemory
+	c, err = New(cfg, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Set(context.Background(), "abc", "https://example.com"))
+	assert.Eventually(t, func() bool {
+		got, _ := c.Get(context.Background(), "abc")
+		return got == "https://example.com"
+	}, time.Second, time.Millisecond)
+
+	cfg.SoftTTL = time.Minute
+	c, err = New(cfg, nil)
+	assert.NoError(t, err)
+	assert.IsType(t, &SoftTTLCache{}, c)
+
+	vc := NewViewCache(cfg, nil)
+	assert.IsType(t, &MemoryViewCache{}, vc)
+	assert.False(t, IsShared(vc))
+}
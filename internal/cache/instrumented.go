@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// metrics of every instrumented cache, published in expvar as "cache" and keyed by backend name
+var cacheMetrics = expvar.NewMap("cache")
+
+// latencyBuckets are the upper bounds of the latency histogram, the last bucket has no bound
+var latencyBuckets = []struct {
+	name  string
+	bound time.Duration
+}{
+	{"le_100us", 100 * time.Microsecond},
+	{"le_1ms", time.Millisecond},
+	{"le_10ms", 10 * time.Millisecond},
+	{"le_100ms", 100 * time.Millisecond},
+	{"gt_100ms", 0},
+}
+
+type backendMetrics struct {
+	hits, misses, errors, sets, deletes *expvar.Int
+	latencyTotalUs, operations          *expvar.Int
+	latency                             *expvar.Map
+}
+
+var (
+	backendMetricsMu sync.Mutex
+	backendMetricsOf = make(map[string]*backendMetrics)
+)
+
+// metricsFor returns the metrics of the backend, caches with the same name share them
+func metricsFor(name string) *backendMetrics {
+	backendMetricsMu.Lock()
+	defer backendMetricsMu.Unlock()
+	if m, ok := backendMetricsOf[name]; ok {
+		return m
+	}
+
+	m := &backendMetrics{
+		hits:           new(expvar.Int),
+		misses:         new(expvar.Int),
+		errors:         new(expvar.Int),
+		sets:           new(expvar.Int),
+		deletes:        new(expvar.Int),
+		latencyTotalUs: new(expvar.Int),
+		operations:     new(expvar.Int),
+		latency:        new(expvar.Map).Init(),
+	}
+	for _, b := range latencyBuckets {
+		m.latency.Set(b.name, new(expvar.Int))
+	}
+
+	vars := new(expvar.Map).Init()
+	vars.Set("hits", m.hits)
+	vars.Set("misses", m.misses)
+	vars.Set("errors", m.errors)
+	vars.Set("sets", m.sets)
+	vars.Set("deletes", m.deletes)
+	vars.Set("operations", m.operations)
+	vars.Set("latency_total_us", m.latencyTotalUs)
+	vars.Set("latency", m.latency)
+	cacheMetrics.Set(name, vars)
+
+	backendMetricsOf[name] = m
+	return m
+}
+
+func (m *backendMetrics) observe(start time.Time, err error) {
+	elapsed := time.Since(start)
+	m.operations.Add(1)
+	m.latencyTotalUs.Add(elapsed.Microseconds())
+	for _, b := range latencyBuckets {
+		if b.bound == 0 || elapsed <= b.bound {
+			m.latency.Add(b.name, 1)
+			break
+		}
+	}
+	if err != nil {
+		m.errors.Add(1)
+	}
+}
+
+// InstrumentedCache records hits, misses, errors and latency of the cache below under the backend name
+type InstrumentedCache struct {
+	cache   Cache
+	metrics *backendMetrics
+}
+
+func NewInstrumentedCache(cache Cache, name string) *InstrumentedCache {
+	return &InstrumentedCache{
+		cache:   cache,
+		metrics: metricsFor(name),
+	}
+}
+
+func (ic *InstrumentedCache) Get(ctx context.Context, id string) (string, error) {
+	start := time.Now()
+	val, err := ic.cache.Get(ctx, id)
+	ic.metrics.observe(start, err)
+	switch {
+	case err != nil:
+	case val == "":
+		ic.metrics.misses.Add(1)
+	default:
+		ic.metrics.hits.Add(1)
+	}
+	return val, err
+}
+
+func (ic *InstrumentedCache) Set(ctx context.Context, id string, url string) error {
+	start := time.Now()
+	err := ic.cache.Set(ctx, id, url)
+	ic.metrics.observe(start, err)
+	ic.metrics.sets.Add(1)
+	return err
+}
+
+func (ic *InstrumentedCache) SetWithTTL(ctx context.Context, id string, url string, ttl time.Duration) error {
+	start := time.Now()
+	err := ic.cache.SetWithTTL(ctx, id, url, ttl)
+	ic.metrics.observe(start, err)
+	ic.metrics.sets.Add(1)
+	return err
+}
+
+func (ic *InstrumentedCache) SetNX(ctx context.Context, id string, url string, ttl time.Duration) (bool, error) {
+	start := time.Now()
+	ok, err := SetNX(ctx, ic.cache, id, url, ttl)
+	ic.metrics.observe(start, err)
+	if ok {
+		ic.metrics.sets.Add(1)
+	}
+	return ok, err
+}
+
+func (ic *InstrumentedCache) Delete(ctx context.Context, id string) error {
+	start := time.Now()
+	err := ic.cache.Delete(ctx, id)
+	ic.metrics.observe(start, err)
+	ic.metrics.deletes.Add(1)
+	return err
+}
+
+// Run runs the cache below if it needs to
+func (ic *InstrumentedCache) Run(ctx context.Context) {
+	if r, ok := ic.cache.(Runner); ok {
+		r.Run(ctx)
+	}
+}
@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingCache struct {
+	NoopCache
+}
+
+func (failingCache) Get(context.Context, string) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+func TestInstrumentedCache(t *testing.T) {
+	ctx := context.Background()
+	below := newTestRistretto(t)
+	ic := NewInstrumentedCache(below, "test-instrumented")
+
+	_ = ic.Set(ctx, "abc", "https://example.com")
+	below.Wait()
+	_, _ = ic.Get(ctx, "abc")
+	_, _ = ic.Get(ctx, "missing")
+	_, _ = NewInstrumentedCache(failingCache{}, "test-instrumented").Get(ctx, "abc")
+	_ = ic.Delete(ctx, "abc")
+
+	m := metricsFor("test-instrumented")
+	assert.Equal(t, int64(1), m.hits.Value())
+	assert.Equal(t, int64(1), m.misses.Value())
+	assert.Equal(t, int64(1), m.errors.Value())
+	assert.Equal(t, int64(1), m.sets.Value())
+	assert.Equal(t, int64(1), m.deletes.Value())
+	assert.Equal(t, int64(5), m.operations.Value())
+
+	var bucketed int64
+	for _, b := range latencyBuckets {
+		bucketed += m.latency.Get(b.name).(interface{ Value() int64 }).Value()
+	}
+	assert.Equal(t, int64(5), bucketed)
+	assert.NotNil(t, cacheMetrics.Get("test-instrumented"))
+}
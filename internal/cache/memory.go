@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// NoopCache caches nothing, every lookup goes to the database
+type NoopCache struct{}
+
+func (NoopCache) Get(context.Context, string) (string, error)                     { return "", nil }
+func (NoopCache) Set(context.Context, string, string) error                       { return nil }
+func (NoopCache) SetWithTTL(context.Context, string, string, time.Duration) error { return nil }
+func (NoopCache) Delete(context.Context, string) error                            { return nil }
+
+type memoryCounter struct {
+	value     int
+	expiresAt time.Time // zero if the counter doesn't expire
+}
+
+type memoryBatch struct {
+	ViewBatch
+	claimedAt time.Time
+}
+
+// MemoryViewCache keeps the view counting pipeline in memory, it behaves like ViewRedisCache
+// but pending views are lost on restart and not shared between replicas.
+// It is meant for running a single replica without Redis.
+type MemoryViewCache struct {
+	mu       sync.Mutex
+	counters map[string]memoryCounter
+	pending  map[string]ViewDelta
+	inflight map[string]memoryBatch
+	dirty    map[string]struct{}
+}
+
+func NewMemoryViewCache() *MemoryViewCache {
+	return &MemoryViewCache{
+		counters: make(map[string]memoryCounter),
+		pending:  make(map[string]ViewDelta),
+		inflight: make(map[string]memoryBatch),
+		dirty:    make(map[string]struct{}),
+	}
+}
+
+func (mc *MemoryViewCache) Get(_ context.Context, key string) (int, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	c, ok := mc.counters[key]
+	if !ok || (!c.expiresAt.IsZero() && time.Now().After(c.expiresAt)) {
+		return -1, nil
+	}
+	return c.value, nil
+}
+
+func (mc *MemoryViewCache) Set(ctx context.Context, key string, count int) error {
+	return mc.SetWithTTL(ctx, key, count, 0)
+}
+
+func (mc *MemoryViewCache) SetWithTTL(_ context.Context, key string, count int, ttl time.Duration) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	c := memoryCounter{value: count}
+	if ttl > 0 {
+		c.expiresAt = time.Now().Add(ttl)
+	}
+	mc.counters[key] = c
+	return nil
+}
+
+func (mc *MemoryViewCache) Increase(_ context.Context, key string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	c := mc.counters[key]
+	if !c.expiresAt.IsZero() && time.Now().After(c.expiresAt) {
+		c = memoryCounter{}
+	}
+	c.value++
+	mc.counters[key] = c
+	return nil
+}
+
+func (mc *MemoryViewCache) AddPending(_ context.Context, id string, delta ViewDelta) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	p := mc.pending[id]
+	p.Count += delta.Count
+	p.BotCount += delta.BotCount
+	mc.pending[id] = p
+	mc.dirty[id] = struct{}{}
+	return nil
+}
+
+func (mc *MemoryViewCache) Pending(_ context.Context, id string) (ViewDelta, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	delta := mc.pending[id]
+	if batch, ok := mc.inflight[id]; ok {
+		delta.Count += batch.Delta.Count
+		delta.BotCount += batch.Delta.BotCount
+	}
+	return delta, nil
+}
+
+func (mc *MemoryViewCache) PopDirty(_ context.Context, n int) ([]string, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	ids := make([]string, 0, min(n, len(mc.dirty)))
+	for id := range mc.dirty {
+		if len(ids) == n {
+			break
+		}
+		ids = append(ids, id)
+		delete(mc.dirty, id)
+	}
+	return ids, nil
+}
+
+func (mc *MemoryViewCache) MarkDirty(_ context.Context, ids ...string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, id := range ids {
+		mc.dirty[id] = struct{}{}
+	}
+	return nil
+}
+
+func (mc *MemoryViewCache) Claim(_ context.Context, id string, token string, staleAfter time.Duration) (ViewBatch, ClaimStatus, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	now := time.Now()
+	if batch, ok := mc.inflight[id]; ok {
+		if now.Sub(batch.claimedAt) < staleAfter {
+			return ViewBatch{}, ClaimBusy, nil
+		}
+		batch.claimedAt = now
+		mc.inflight[id] = batch
+		return batch.ViewBatch, ClaimResend, nil
+	}
+
+	delta, ok := mc.pending[id]
+	if !ok {
+		return ViewBatch{}, ClaimEmpty, nil
+	}
+	delete(mc.pending, id)
+	batch := ViewBatch{Token: token, Delta: delta}
+	mc.inflight[id] = memoryBatch{ViewBatch: batch, claimedAt: now}
+	return batch, ClaimNew, nil
+}
+
+func (mc *MemoryViewCache) Ack(_ context.Context, id string, token string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if batch, ok := mc.inflight[id]; ok && batch.Token == token {
+		delete(mc.inflight, id)
+	}
+	return nil
+}
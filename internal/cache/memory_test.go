@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryViewCachePipeline(t *testing.T) {
+	ctx := context.Background()
+	vc := NewMemoryViewCache()
+
+	_ = vc.AddPending(ctx, "abc", ViewDelta{Count: 2})
+	_ = vc.AddPending(ctx, "abc", ViewDelta{BotCount: 1})
+
+	ids, _ := vc.PopDirty(ctx, 10)
+	assert.Equal(t, []string{"abc"}, ids)
+
+	batch, status, _ := vc.Claim(ctx, "abc", "t1", time.Minute)
+	assert.Equal(t, ClaimNew, status)
+	assert.Equal(t, ViewBatch{Token: "t1", Delta: ViewDelta{Count: 2, BotCount: 1}}, batch)
+
+	// views recorded while the batch is in flight stay pending
+	_ = vc.AddPending(ctx, "abc", ViewDelta{Count: 1})
+	pending, _ := vc.Pending(ctx, "abc")
+	assert.Equal(t, ViewDelta{Count: 3, BotCount: 1}, pending)
+
+	_, status, _ = vc.Claim(ctx, "abc", "t2", time.Minute)
+	assert.Equal(t, ClaimBusy, status)
+
+	// a stale batch is handed out again with its original token
+	batch, status, _ = vc.Claim(ctx, "abc", "t3", 0)
+	assert.Equal(t, ClaimResend, status)
+	assert.Equal(t, "t1", batch.Token)
+
+	_ = vc.Ack(ctx, "abc", "other")
+	pending, _ = vc.Pending(ctx, "abc")
+	assert.Equal(t, ViewDelta{Count: 3, BotCount: 1}, pending)
+
+	_ = vc.Ack(ctx, "abc", "t1")
+	pending, _ = vc.Pending(ctx, "abc")
+	assert.Equal(t, ViewDelta{Count: 1}, pending)
+
+	batch, status, _ = vc.Claim(ctx, "abc", "t4", time.Minute)
+	assert.Equal(t, ClaimNew, status)
+	assert.Equal(t, ViewDelta{Count: 1}, batch.Delta)
+
+	_ = vc.Ack(ctx, "abc", "t4")
+	_, status, _ = vc.Claim(ctx, "abc", "t5", time.Minute)
+	assert.Equal(t, ClaimEmpty, status)
+}
@@ -2,14 +2,20 @@ package cache
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// defaultTTL is applied to cached URLs, Redis only evicts keys that have an expiry
+// (maxmemory-policy volatile-lru) so that pending view counters are never evicted
+const defaultTTL = 24 * time.Hour
+
 type RedisCache struct {
-	client *redis.Client
+	client redis.UniversalClient
+	ttl    time.Duration
 }
 
 func NewRedisCache(redisURL string) *RedisCache {
@@ -28,33 +34,21 @@ func NewRedisCache(redisURL string) *RedisCache {
 	if err = client.Ping(ctx).Err(); err != nil {
 		panic(err)
 	}
-	return &RedisCache{client: client}
+	return &RedisCache{client: client, ttl: defaultTTL}
 }
 
-func (rc *RedisCache) Get(ctx context.Context, id string) (string, error) {
-	val, err := rc.client.Get(ctx, id).Result()
-	if err != nil {
-		if err == redis.Nil {
-			return "", nil
-		}
-		return "", err
-	}
-	return val, nil
+// NewRedisClusterCache caches URLs in the Redis Cluster whose nodes are given as redis:// URLs
+func NewRedisClusterCache(redisURLs []string) *RedisCache {
+	return &RedisCache{client: NewClusterClient(redisURLs), ttl: defaultTTL}
 }
 
-func (rc *RedisCache) Set(ctx context.Context, id string, url string) error {
-	return rc.client.Set(ctx, id, url, 0).Err()
-}
-
-func (rc *RedisCache) SetWithTTL(ctx context.Context, id string, url string, ttl time.Duration) error {
-	return rc.client.Set(ctx, id, url, ttl).Err()
+// NewRedisCacheWithClient caches URLs with any Redis client (single node or cluster) for ttl
+func NewRedisCacheWithClient(client redis.UniversalClient, ttl time.Duration) *RedisCache {
+	return &RedisCache{client: client, ttl: ttl}
 }
 
-type RedisClusterCache struct {
-	client *redis.ClusterClient
-}
-
-func NewRedisClusterCache(redisURLs []string) *RedisClusterCache {
+// NewClusterClient creates a client of the Redis Cluster whose nodes are given as redis:// URLs
+func NewClusterClient(redisURLs []string) *redis.ClusterClient {
 	parsedURLs := make([]string, len(redisURLs))
 	for i := range parsedURLs {
 		if opt, err := redis.ParseURL(redisURLs[i]); err != nil {
@@ -63,14 +57,13 @@ func NewRedisClusterCache(redisURLs []string) *RedisClusterCache {
 			parsedURLs[i] = opt.Addr
 		}
 	}
-	client := redis.NewClusterClient(&redis.ClusterOptions{
+	return redis.NewClusterClient(&redis.ClusterOptions{
 		Addrs: parsedURLs,
 	})
-	return &RedisClusterCache{client: client}
 }
 
-func (rcc *RedisClusterCache) Get(ctx context.Context, id string) (string, error) {
-	val, err := rcc.client.Get(ctx, id).Result()
+func (rc *RedisCache) Get(ctx context.Context, id string) (string, error) {
+	val, err := rc.client.Get(ctx, id).Result()
 	if err != nil {
 		if err == redis.Nil {
 			return "", nil
@@ -80,30 +73,31 @@ func (rcc *RedisClusterCache) Get(ctx context.Context, id string) (string, error
 	return val, nil
 }
 
-func (rcc *RedisClusterCache) Set(ctx context.Context, id string, url string) error {
-	return rcc.client.Set(ctx, id, url, 0).Err()
+func (rc *RedisCache) Set(ctx context.Context, id string, url string) error {
+	return rc.client.Set(ctx, id, url, rc.ttl).Err()
+}
+
+func (rc *RedisCache) SetWithTTL(ctx context.Context, id string, url string, ttl time.Duration) error {
+	return rc.client.Set(ctx, id, url, ttl).Err()
 }
 
-func (rcc *RedisClusterCache) SetWithTTL(ctx context.Context, id string, url string, ttl time.Duration) error {
-	return rcc.client.Set(ctx, id, url, ttl).Err()
+func (rc *RedisCache) SetNX(ctx context.Context, id string, url string, ttl time.Duration) (bool, error) {
+	return rc.client.SetNX(ctx, id, url, ttl).Result()
+}
+
+func (rc *RedisCache) Delete(ctx context.Context, id string) error {
+	return rc.client.Del(ctx, id).Err()
 }
 
 type ViewRedisCache struct {
-	client *redis.ClusterClient
+	client redis.UniversalClient
 }
 
 func NewViewRedisCache(redisURLs []string) *ViewRedisCache {
-	parsedURLs := make([]string, len(redisURLs))
-	for i := range parsedURLs {
-		if opt, err := redis.ParseURL(redisURLs[i]); err != nil {
-			panic(err)
-		} else {
-			parsedURLs[i] = opt.Addr
-		}
-	}
-	client := redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs: parsedURLs,
-	})
+	return &ViewRedisCache{client: NewClusterClient(redisURLs)}
+}
+
+func NewViewRedisCacheWithClient(client redis.UniversalClient) *ViewRedisCache {
 	return &ViewRedisCache{client: client}
 }
 
@@ -133,3 +127,140 @@ func (vc *ViewRedisCache) SetWithTTL(ctx context.Context, key string, count int,
 func (vc *ViewRedisCache) Increase(ctx context.Context, key string) error {
 	return vc.client.Incr(ctx, key).Err()
 }
+
+// Keys of the view counting pipeline. The id is wrapped in a hash tag so that
+// the pending and in-flight keys of an URL always live in the same cluster slot,
+// which is required by the Lua scripts below.
+const viewDirtyKey = "views:dirty"
+
+func viewPendingKey(id string) string {
+	return fmt.Sprintf("views:{%s}:pending", id)
+}
+
+func viewInflightKey(id string) string {
+	return fmt.Sprintf("views:{%s}:inflight", id)
+}
+
+func (vc *ViewRedisCache) AddPending(ctx context.Context, id string, delta ViewDelta) error {
+	key := viewPendingKey(id)
+	_, err := vc.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if delta.Count != 0 {
+			pipe.HIncrBy(ctx, key, "count", int64(delta.Count))
+		}
+		if delta.BotCount != 0 {
+			pipe.HIncrBy(ctx, key, "bot_count", int64(delta.BotCount))
+		}
+		pipe.SAdd(ctx, viewDirtyKey, id)
+		return nil
+	})
+	return err
+}
+
+func (vc *ViewRedisCache) Pending(ctx context.Context, id string) (ViewDelta, error) {
+	var pending, inflight *redis.SliceCmd
+	_, err := vc.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pending = pipe.HMGet(ctx, viewPendingKey(id), "count", "bot_count")
+		inflight = pipe.HMGet(ctx, viewInflightKey(id), "count", "bot_count")
+		return nil
+	})
+	if err != nil {
+		return ViewDelta{}, err
+	}
+
+	var delta ViewDelta
+	for _, cmd := range []*redis.SliceCmd{pending, inflight} {
+		vals := cmd.Val()
+		delta.Count += parseRedisInt(vals[0])
+		delta.BotCount += parseRedisInt(vals[1])
+	}
+	return delta, nil
+}
+
+func (vc *ViewRedisCache) PopDirty(ctx context.Context, n int) ([]string, error) {
+	ids, err := vc.client.SPopN(ctx, viewDirtyKey, int64(n)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (vc *ViewRedisCache) MarkDirty(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(ids))
+	for i := range ids {
+		members[i] = ids[i]
+	}
+	return vc.client.SAdd(ctx, viewDirtyKey, members...).Err()
+}
+
+// KEYS[1] pending key, KEYS[2] in-flight key
+// ARGV[1] token, ARGV[2] now (unix ms), ARGV[3] stale after (ms)
+var claimViewScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	local f = redis.call('HMGET', KEYS[2], 'count', 'bot_count', 'token', 'ts')
+	if tonumber(ARGV[2]) - tonumber(f[4]) < tonumber(ARGV[3]) then
+		return {3, '0', '0', ''}
+	end
+	redis.call('HSET', KEYS[2], 'ts', ARGV[2])
+	return {2, f[1], f[2], f[3]}
+end
+local p = redis.call('HMGET', KEYS[1], 'count', 'bot_count')
+if not p[1] and not p[2] then
+	return {0, '0', '0', ''}
+end
+local count = p[1] or '0'
+local botCount = p[2] or '0'
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[2], 'count', count, 'bot_count', botCount, 'token', ARGV[1], 'ts', ARGV[2])
+return {1, count, botCount, ARGV[1]}
+`)
+
+func (vc *ViewRedisCache) Claim(ctx context.Context, id string, token string, staleAfter time.Duration) (ViewBatch, ClaimStatus, error) {
+	res, err := claimViewScript.Run(ctx, vc.client,
+		[]string{viewPendingKey(id), viewInflightKey(id)},
+		token, time.Now().UnixMilli(), staleAfter.Milliseconds(),
+	).Slice()
+	if err != nil {
+		return ViewBatch{}, ClaimEmpty, err
+	}
+	if len(res) != 4 {
+		return ViewBatch{}, ClaimEmpty, fmt.Errorf("unexpected claim result: %v", res)
+	}
+
+	status := ClaimStatus(parseRedisInt(res[0]))
+	batch := ViewBatch{
+		Token: fmt.Sprint(res[3]),
+		Delta: ViewDelta{
+			Count:    parseRedisInt(res[1]),
+			BotCount: parseRedisInt(res[2]),
+		},
+	}
+	return batch, status, nil
+}
+
+// KEYS[1] in-flight key, ARGV[1] token
+var ackViewScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'token') == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (vc *ViewRedisCache) Ack(ctx context.Context, id string, token string) error {
+	return ackViewScript.Run(ctx, vc.client, []string{viewInflightKey(id)}, token).Err()
+}
+
+// parseRedisInt converts a reply value (integer, string or nil) into an int, invalid values count as 0
+func parseRedisInt(val interface{}) int {
+	switch v := val.(type) {
+	case int64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	default:
+		return 0
+	}
+}
@@ -9,11 +9,13 @@ import (
 
 type RistrettoCache struct {
 	cache *ristretto.Cache[string, string]
+	ttl   time.Duration // 0 keeps entries until they are evicted
 }
 
-func NewRistrettoCache(cache *ristretto.Cache[string, string]) *RistrettoCache {
+func NewRistrettoCache(cache *ristretto.Cache[string, string], ttl time.Duration) *RistrettoCache {
 	return &RistrettoCache{
 		cache: cache,
+		ttl:   ttl,
 	}
 }
 
@@ -26,7 +28,7 @@ func (c *RistrettoCache) Get(_ context.Context, id string) (string, error) {
 }
 
 func (c *RistrettoCache) Set(_ context.Context, id string, url string) error {
-	c.cache.Set(id, url, 1)
+	c.cache.SetWithTTL(id, url, 1, c.ttl)
 	return nil
 }
 
@@ -34,3 +36,13 @@ func (c *RistrettoCache) SetWithTTL(_ context.Context, id string, url string, tt
 	c.cache.SetWithTTL(id, url, 1, ttl)
 	return nil
 }
+
+func (c *RistrettoCache) Delete(_ context.Context, id string) error {
+	c.cache.Del(id)
+	return nil
+}
+
+// Wait blocks until every buffered Set has been applied
+func (c *RistrettoCache) Wait() {
+	c.cache.Wait()
+}
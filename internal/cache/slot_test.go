@@ -0,0 +1,17 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlot(t *testing.T) {
+	// values given by CLUSTER KEYSLOT
+	assert.Equal(t, 12182, Slot("foo"))
+	assert.Equal(t, 5061, Slot("bar"))
+	assert.Equal(t, Slot("user1000"), Slot("{user1000}.following"))
+	assert.Equal(t, Slot("views:{abc}:pending"), Slot("views:{abc}:inflight"))
+	// an empty hash tag hashes the whole key
+	assert.Equal(t, int(crc16("{}foo"))%clusterSlots, Slot("{}foo"))
+}
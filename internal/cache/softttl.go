@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SoftTTLCache stores every value with a soft expiry on top of the hard TTL of the cache below.
+// Past the soft expiry the value is still returned but reported as stale, the caller serves it
+// and refreshes it in the background (stale-while-revalidate). The hard TTL bounds how long
+// a value can be served when it can't be refreshed.
+type SoftTTLCache struct {
+	cache   Cache
+	softTTL time.Duration
+	now     func() time.Time
+}
+
+func NewSoftTTLCache(cache Cache, softTTL time.Duration) *SoftTTLCache {
+	return &SoftTTLCache{
+		cache:   cache,
+		softTTL: softTTL,
+		now:     time.Now,
+	}
+}
+
+// StaleCache is implemented by caches that know when a value should be refreshed
+type StaleCache interface {
+	Cache
+	// GetStale returns the value of id and whether it is past its soft expiry
+	GetStale(ctx context.Context, id string) (value string, stale bool, err error)
+}
+
+// GetStale reads id from c, values of caches that don't implement StaleCache are never stale
+func GetStale(ctx context.Context, c Cache, id string) (string, bool, error) {
+	if sc, ok := c.(StaleCache); ok {
+		return sc.GetStale(ctx, id)
+	}
+	val, err := c.Get(ctx, id)
+	return val, false, err
+}
+
+// Values are stored as "\x00swr:<soft expiry, unix ms>:<value>". URLs can't contain a NUL byte,
+// so values written before soft TTLs existed are told apart and treated as fresh.
+const softTTLPrefix = "\x00swr:"
+
+func (sc *SoftTTLCache) wrap(value string, softTTL time.Duration) string {
+	return softTTLPrefix + strconv.FormatInt(sc.now().Add(softTTL).UnixMilli(), 10) + ":" + value
+}
+
+func (sc *SoftTTLCache) unwrap(raw string) (string, bool) {
+	rest, ok := strings.CutPrefix(raw, softTTLPrefix)
+	if !ok {
+		return raw, false
+	}
+	expiry, value, ok := strings.Cut(rest, ":")
+	if !ok {
+		return raw, false
+	}
+	ms, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return raw, false
+	}
+	return value, sc.now().UnixMilli() >= ms
+}
+
+func (sc *SoftTTLCache) GetStale(ctx context.Context, id string) (string, bool, error) {
+	raw, err := sc.cache.Get(ctx, id)
+	if err != nil || raw == "" {
+		return "", false, err
+	}
+	value, stale := sc.unwrap(raw)
+	return value, stale, nil
+}
+
+func (sc *SoftTTLCache) Get(ctx context.Context, id string) (string, error) {
+	value, _, err := sc.GetStale(ctx, id)
+	return value, err
+}
+
+func (sc *SoftTTLCache) Set(ctx context.Context, id string, url string) error {
+	return sc.cache.Set(ctx, id, sc.wrap(url, sc.softTTL))
+}
+
+func (sc *SoftTTLCache) SetWithTTL(ctx context.Context, id string, url string, ttl time.Duration) error {
+	return sc.cache.SetWithTTL(ctx, id, sc.wrap(url, min(ttl, sc.softTTL)), ttl)
+}
+
+func (sc *SoftTTLCache) SetNX(ctx context.Context, id string, url string, ttl time.Duration) (bool, error) {
+	return SetNX(ctx, sc.cache, id, sc.wrap(url, min(ttl, sc.softTTL)), ttl)
+}
+
+func (sc *SoftTTLCache) Delete(ctx context.Context, id string) error {
+	return sc.cache.Delete(ctx, id)
+}
+
+// Invalidate invalidates id in the cache below, see Invalidate
+func (sc *SoftTTLCache) Invalidate(ctx context.Context, id string) error {
+	return Invalidate(ctx, sc.cache, id)
+}
+
+// Run runs the cache below if it needs to
+func (sc *SoftTTLCache) Run(ctx context.Context) {
+	if r, ok := sc.cache.(Runner); ok {
+		r.Run(ctx)
+	}
+}
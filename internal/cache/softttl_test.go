@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSoftTTLCache(t *testing.T) {
+	ctx := context.Background()
+	below := newTestRistretto(t)
+	sc := NewSoftTTLCache(below, time.Minute)
+	now := time.Unix(1000, 0)
+	sc.now = func() time.Time { return now }
+
+	_ = sc.Set(ctx, "abc", "https://example.com/a:b")
+	below.Wait()
+
+	val, stale, err := sc.GetStale(ctx, "abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/a:b", val)
+	assert.False(t, stale)
+
+	now = now.Add(time.Minute)
+	val, stale, _ = sc.GetStale(ctx, "abc")
+	assert.Equal(t, "https://example.com/a:b", val)
+	assert.True(t, stale)
+
+	// values written without soft TTL are fresh
+	_ = below.Set(ctx, "legacy", "https://example.com")
+	below.Wait()
+	val, stale, _ = GetStale(ctx, sc, "legacy")
+	assert.Equal(t, "https://example.com", val)
+	assert.False(t, stale)
+
+	val, stale, _ = GetStale(ctx, sc, "missing")
+	assert.Equal(t, "", val)
+	assert.False(t, stale)
+}
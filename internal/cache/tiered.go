@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TieredCache reads the in-process L1 cache first, then the shared L2 cache (Redis), L2 hits are copied into L1.
+// Writes go through both tiers. Entries only live in L1 for l1TTL, which bounds how long a replica can serve
+// a link that was changed or deleted by another replica if the invalidation message is lost.
+type TieredCache struct {
+	l1          Cache
+	l2          Cache
+	l1TTL       time.Duration
+	invalidator Invalidator
+}
+
+func NewTieredCache(l1 Cache, l2 Cache, l1TTL time.Duration, invalidator Invalidator) *TieredCache {
+	return &TieredCache{
+		l1:          l1,
+		l2:          l2,
+		l1TTL:       l1TTL,
+		invalidator: invalidator,
+	}
+}
+
+func (tc *TieredCache) Get(ctx context.Context, id string) (string, error) {
+	if val, err := tc.l1.Get(ctx, id); err == nil && val != "" {
+		return val, nil
+	}
+
+	val, err := tc.l2.Get(ctx, id)
+	if err != nil || val == "" {
+		return val, err
+	}
+	_ = tc.l1.SetWithTTL(ctx, id, val, tc.l1TTL)
+	return val, nil
+}
+
+func (tc *TieredCache) Set(ctx context.Context, id string, url string) error {
+	if err := tc.l2.Set(ctx, id, url); err != nil {
+		return err
+	}
+	return tc.l1.SetWithTTL(ctx, id, url, tc.l1TTL)
+}
+
+func (tc *TieredCache) SetWithTTL(ctx context.Context, id string, url string, ttl time.Duration) error {
+	if err := tc.l2.SetWithTTL(ctx, id, url, ttl); err != nil {
+		return err
+	}
+	return tc.l1.SetWithTTL(ctx, id, url, min(ttl, tc.l1TTL))
+}
+
+// SetNX sets the entry in L2 unless it has a value there, L1 only gets the value when it was set
+func (tc *TieredCache) SetNX(ctx context.Context, id string, url string, ttl time.Duration) (bool, error) {
+	ok, err := SetNX(ctx, tc.l2, id, url, ttl)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, tc.l1.SetWithTTL(ctx, id, url, min(ttl, tc.l1TTL))
+}
+
+// Delete removes the entry from both tiers and tells the other replicas to drop it from their L1.
+// The L2 delete must be applied before the other replicas hear about it, or they could copy the entry
+// back into their L1.
+func (tc *TieredCache) Delete(ctx context.Context, id string) error {
+	_ = tc.l1.Delete(ctx, id)
+	if err := tc.l2.Delete(WaitForWrite(ctx), id); err != nil {
+		return err
+	}
+	return tc.Invalidate(ctx, id)
+}
+
+// Invalidate drops the entry from the L1 of every replica, it is used when the link changed
+// and the new value has already been written to L2
+func (tc *TieredCache) Invalidate(ctx context.Context, id string) error {
+	_ = tc.l1.Delete(ctx, id)
+	if tc.invalidator == nil {
+		return nil
+	}
+	return tc.invalidator.Publish(ctx, id)
+}
+
+// Invalidate drops id from the L1 of every replica when c is a tiered cache (or wraps one),
+// the other caches have no copies to drop
+func Invalidate(ctx context.Context, c Cache, id string) error {
+	if ic, ok := c.(interface {
+		Invalidate(ctx context.Context, id string) error
+	}); ok {
+		return ic.Invalidate(ctx, id)
+	}
+	return nil
+}
+
+// Run drops the entries invalidated by other replicas from L1 until ctx is done,
+// it also runs the tiers that need to
+func (tc *TieredCache) Run(ctx context.Context) {
+	for _, tier := range []Cache{tc.l1, tc.l2} {
+		if r, ok := tier.(Runner); ok {
+			go r.Run(ctx)
+		}
+	}
+	if tc.invalidator == nil {
+		return
+	}
+	tc.invalidator.Listen(ctx, func(id string) {
+		_ = tc.l1.Delete(ctx, id)
+	})
+}
+
+// Invalidator broadcasts the ids of cache entries that must be dropped from every L1
+type Invalidator interface {
+	Publish(ctx context.Context, id string) error
+	// Listen calls fn with every invalidated id until ctx is done
+	Listen(ctx context.Context, fn func(id string))
+}
+
+const invalidationChannel = "cache:invalidate"
+
+// RedisInvalidator broadcasts invalidations over Redis pub/sub.
+// Pub/sub is fire and forget: replicas that are disconnected miss the message and rely on the L1 TTL.
+type RedisInvalidator struct {
+	client redis.UniversalClient
+}
+
+func NewRedisInvalidator(client redis.UniversalClient) *RedisInvalidator {
+	return &RedisInvalidator{client: client}
+}
+
+func (ri *RedisInvalidator) Publish(ctx context.Context, id string) error {
+	return ri.client.Publish(ctx, invalidationChannel, id).Err()
+}
+
+func (ri *RedisInvalidator) Listen(ctx context.Context, fn func(id string)) {
+	pubsub := ri.client.Subscribe(ctx, invalidationChannel)
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				slog.Error("cache invalidation subscription closed")
+				return
+			}
+			fn(msg.Payload)
+		}
+	}
+}
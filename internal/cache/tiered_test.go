@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRistretto(t *testing.T) *RistrettoCache {
+	c, err := ristretto.NewCache(&ristretto.Config[string, string]{
+		NumCounters: 1000,
+		MaxCost:     100,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to create ristretto cache: %s", err)
+	}
+	return NewRistrettoCache(c, 0)
+}
+
+// memoryInvalidator delivers invalidations to every listener of the process
+type memoryInvalidator struct {
+	mu        sync.Mutex
+	listeners []func(string)
+}
+
+func (mi *memoryInvalidator) Publish(_ context.Context, id string) error {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	for _, fn := range mi.listeners {
+		fn(id)
+	}
+	return nil
+}
+
+func (mi *memoryInvalidator) Listen(ctx context.Context, fn func(string)) {
+	mi.mu.Lock()
+	mi.listeners = append(mi.listeners, fn)
+	mi.mu.Unlock()
+	<-ctx.Done()
+}
+
+func TestTieredCacheReadThrough(t *testing.T) {
+	ctx := context.Background()
+	l1, l2 := newTestRistretto(t), newTestRistretto(t)
+	tc := NewTieredCache(l1, l2, time.Minute, nil)
+
+	_ = l2.Set(ctx, "abc", "https://example.com")
+	l2.Wait()
+
+	got, err := tc.Get(ctx, "abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com", got)
+
+	// the L2 hit has been copied into L1
+	l1.Wait()
+	got, _ = l1.Get(ctx, "abc")
+	assert.Equal(t, "https://example.com", got)
+
+	got, err = tc.Get(ctx, "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, "", got)
+}
+
+func TestTieredCacheWriteThrough(t *testing.T) {
+	ctx := context.Background()
+	l1, l2 := newTestRistretto(t), newTestRistretto(t)
+	tc := NewTieredCache(l1, l2, time.Minute, nil)
+
+	assert.NoError(t, tc.Set(ctx, "abc", "https://example.com"))
+	l1.Wait()
+	l2.Wait()
+
+	got, _ := l1.Get(ctx, "abc")
+	assert.Equal(t, "https://example.com", got)
+	got, _ = l2.Get(ctx, "abc")
+	assert.Equal(t, "https://example.com", got)
+}
+
+func TestTieredCacheSetNX(t *testing.T) {
+	ctx := context.Background()
+	l1, l2 := newTestRistretto(t), newTestRistretto(t)
+	tc := NewTieredCache(l1, l2, time.Minute, nil)
+
+	_ = l2.Set(ctx, "abc", "https://example.com")
+	l2.Wait()
+
+	ok, err := tc.SetNX(ctx, "abc", "marker", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	got, _ := tc.Get(ctx, "abc")
+	assert.Equal(t, "https://example.com", got)
+
+	ok, err = tc.SetNX(ctx, "missing", "marker", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	l1.Wait()
+	l2.Wait()
+	got, _ = l1.Get(ctx, "missing")
+	assert.Equal(t, "marker", got)
+	got, _ = l2.Get(ctx, "missing")
+	assert.Equal(t, "marker", got)
+}
+
+func TestTieredCacheInvalidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	invalidator := &memoryInvalidator{}
+	l2 := newTestRistretto(t)
+	l1a, l1b := newTestRistretto(t), newTestRistretto(t)
+	replicaA := NewTieredCache(l1a, l2, time.Minute, invalidator)
+	replicaB := NewTieredCache(l1b, l2, time.Minute, invalidator)
+	go replicaA.Run(ctx)
+	go replicaB.Run(ctx)
+	assert.Eventually(t, func() bool {
+		invalidator.mu.Lock()
+		defer invalidator.mu.Unlock()
+		return len(invalidator.listeners) == 2
+	}, time.Second, time.Millisecond)
+
+	_ = replicaA.Set(ctx, "abc", "https://example.com")
+	_ = replicaB.Set(ctx, "abc", "https://example.com")
+	l1a.Wait()
+	l1b.Wait()
+	l2.Wait()
+
+	assert.NoError(t, replicaA.Delete(ctx, "abc"))
+	l1a.Wait()
+	l1b.Wait()
+	l2.Wait()
+
+	got, _ := replicaB.Get(ctx, "abc")
+	assert.Equal(t, "", got)
+}
+
+// A value written on one replica replaces what the others hold in L1 (e.g. a not-found marker) once invalidated
+func TestTieredCacheInvalidateAfterSet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	invalidator := &memoryInvalidator{}
+	l2 := newTestRistretto(t)
+	l1a, l1b := newTestRistretto(t), newTestRistretto(t)
+	replicaA := NewSoftTTLCache(NewTieredCache(l1a, l2, time.Minute, invalidator), time.Minute)
+	replicaB := NewSoftTTLCache(NewTieredCache(l1b, l2, time.Minute, invalidator), time.Minute)
+	go replicaA.Run(ctx)
+	go replicaB.Run(ctx)
+	assert.Eventually(t, func() bool {
+		invalidator.mu.Lock()
+		defer invalidator.mu.Unlock()
+		return len(invalidator.listeners) == 2
+	}, time.Second, time.Millisecond)
+
+	_ = replicaB.SetWithTTL(ctx, "abc", "missing", time.Minute)
+	l1b.Wait()
+	l2.Wait()
+
+	_ = replicaA.Set(ctx, "abc", "https://example.com")
+	l2.Wait()
+	assert.NoError(t, Invalidate(ctx, replicaA, "abc"))
+	l1a.Wait()
+	l1b.Wait()
+
+	got, _ := replicaB.Get(ctx, "abc")
+	assert.Equal(t, "https://example.com", got)
+}
@@ -0,0 +1,114 @@
+package denylist
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"os"
+	"strings"
+)
+
+// Generated ids sometimes spell words we don't want in a link, and custom aliases could take the name
+// of a route. A List blocks them: ids are normalised (lower case, leetspeak undone) before matching
+
+//go:embed default.txt
+var defaultWords string
+
+type List struct {
+	words []string        // blocked anywhere in an id
+	exact map[string]bool // blocked as a whole id
+}
+
+// New builds a list from words, a word starting with = only blocks ids that are exactly that word
+func New(words []string) *List {
+	l := &List{exact: make(map[string]bool)}
+	for _, word := range words {
+		word = strings.TrimSpace(word)
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if exact, ok := strings.CutPrefix(word, "="); ok {
+			l.exact[normalise(exact)] = true
+		} else {
+			l.words = append(l.words, normalise(word))
+		}
+	}
+	return l
+}
+
+// Default is the built-in list: route names and common profanity
+func Default() *List {
+	return New(strings.Split(defaultWords, "\n"))
+}
+
+// Read builds a list from r, one word per line, blank lines and lines starting with # are skipped
+func Read(r io.Reader) (*List, error) {
+	var words []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		words = append(words, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return New(words), nil
+}
+
+// Load reads the list in the file at path, the built-in words are kept
+func Load(path string) (*List, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l, err := Read(f)
+	if err != nil {
+		return nil, err
+	}
+	return l.Merge(Default()), nil
+}
+
+// Merge returns a list blocking what l or other block
+func (l *List) Merge(other *List) *List {
+	merged := &List{
+		words: append(append([]string(nil), l.words...), other.words...),
+		exact: make(map[string]bool, len(l.exact)+len(other.exact)),
+	}
+	for word := range l.exact {
+		merged.exact[word] = true
+	}
+	for word := range other.exact {
+		merged.exact[word] = true
+	}
+	return merged
+}
+
+// Blocked reports whether id contains a blocked word, a nil list blocks nothing
+func (l *List) Blocked(id string) bool {
+	if l == nil {
+		return false
+	}
+	id = normalise(id)
+	if l.exact[id] {
+		return true
+	}
+	for _, word := range l.words {
+		if strings.Contains(id, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalise folds what reads alike into one letter: case, digits and symbols used as letters.
+// i, l and 1 all become i, so "k1ll", "kiil" and "kill" look the same
+var leet = strings.NewReplacer(
+	"0", "o", "1", "i", "!", "i", "|", "i", "l", "i",
+	"3", "e", "4", "a", "@", "a", "5", "s", "$", "s",
+	"7", "t", "+", "t", "8", "b", "9", "g", "2", "z",
+)
+
+func normalise(s string) string {
+	return leet.Replace(strings.ToLower(s))
+}
@@ -0,0 +1,52 @@
+package denylist
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlocked(t *testing.T) {
+	l := New([]string{"shit", "=admin", "# comment", ""})
+
+	for _, id := range []string{"shit", "SHIT", "xSh1tx", "5h!t", "sH1T9", "admin", "ADM1N"} {
+		assert.True(t, l.Blocked(id), id)
+	}
+	for _, id := range []string{"shirt", "admins", "xadmin", "abc123", "comment", ""} {
+		assert.False(t, l.Blocked(id), id)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	l := Default()
+	for _, id := range []string{"short", "Admin", "v1ew", "fUck1", "aPorn"} {
+		assert.True(t, l.Blocked(id), id)
+	}
+	assert.False(t, l.Blocked("shortcut"))
+	assert.False(t, l.Blocked("g8Kq2"))
+}
+
+func TestNilListBlocksNothing(t *testing.T) {
+	var l *List
+	assert.False(t, l.Blocked("shit"))
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist.txt")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join([]string{"# ours", "spam", "=promo"}, "\n")), 0o644))
+
+	l, err := Load(path)
+	require.NoError(t, err)
+	assert.True(t, l.Blocked("xxSp4mxx"))
+	assert.True(t, l.Blocked("promo"))
+	assert.False(t, l.Blocked("promotion"))
+	// the built-in words are still blocked
+	assert.True(t, l.Blocked("admin"))
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.Error(t, err)
+}
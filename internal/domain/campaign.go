@@ -0,0 +1,96 @@
+package domain
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// UTM holds the campaign parameters appended to the origin URL
+type UTM struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
+
+// params returns the UTM parameters in their canonical order
+func (u UTM) params() [][2]string {
+	return [][2]string{
+		{"utm_source", u.Source},
+		{"utm_medium", u.Medium},
+		{"utm_campaign", u.Campaign},
+		{"utm_term", u.Term},
+		{"utm_content", u.Content},
+	}
+}
+
+// UTMConflict is reported when the origin URL already has a UTM parameter with another value
+type UTMConflict struct {
+	Param     string `json:"param"`
+	Existing  string `json:"existing"`
+	Requested string `json:"requested"`
+}
+
+// MergeUTM appends the UTM parameters to the query string of origin.
+// The existing query string is kept byte for byte (order, encoding), parameters that are already present
+// keep their value: a different requested value is reported as a conflict instead of overwriting it.
+// The fragment stays at the end of the URL.
+func MergeUTM(origin string, utm UTM) (string, []UTMConflict, error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", nil, err
+	}
+	existing, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid query string: %w", err)
+	}
+
+	var (
+		added     []string
+		conflicts []UTMConflict
+	)
+	for _, param := range utm.params() {
+		key, value := param[0], param[1]
+		if value == "" {
+			continue
+		}
+		if !existing.Has(key) {
+			added = append(added, url.QueryEscape(key)+"="+url.QueryEscape(value))
+			continue
+		}
+		if current := existing.Get(key); current != value {
+			conflicts = append(conflicts, UTMConflict{Param: key, Existing: current, Requested: value})
+		}
+	}
+
+	if len(added) == 0 {
+		return origin, conflicts, nil
+	}
+	if u.RawQuery == "" {
+		u.RawQuery = strings.Join(added, "&")
+	} else {
+		u.RawQuery = strings.TrimSuffix(u.RawQuery, "&") + "&" + strings.Join(added, "&")
+	}
+	u.ForceQuery = false
+	return u.String(), conflicts, nil
+}
+
+// CampaignOf returns the utm_campaign of the URL, short URLs are grouped by it
+func CampaignOf(origin string) string {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return ""
+	}
+	query, _ := url.ParseQuery(u.RawQuery)
+	return query.Get("utm_campaign")
+}
+
+// CampaignStats aggregates the views of every short URL of a campaign
+type CampaignStats struct {
+	Campaign string `json:"campaign"`
+	Links    int    `json:"links"`
+	Count    int    `json:"count"`
+	BotCount int    `json:"bot_count"`
+}
@@ -0,0 +1,73 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeUTM(t *testing.T) {
+	testcases := []struct {
+		testname      string
+		origin        string
+		utm           UTM
+		want          string
+		wantConflicts []UTMConflict
+	}{
+		{
+			testname: "no query string",
+			origin:   "https://example.com/landing",
+			utm:      UTM{Source: "newsletter", Medium: "email", Campaign: "black friday"},
+			want:     "https://example.com/landing?utm_source=newsletter&utm_medium=email&utm_campaign=black+friday",
+		},
+		{
+			testname: "existing params are kept as they are",
+			origin:   "https://example.com/search?q=a%20b&z=1&a=2",
+			utm:      UTM{Source: "twitter"},
+			want:     "https://example.com/search?q=a%20b&z=1&a=2&utm_source=twitter",
+		},
+		{
+			testname: "fragment stays at the end",
+			origin:   "https://example.com/docs#install",
+			utm:      UTM{Campaign: "launch"},
+			want:     "https://example.com/docs?utm_campaign=launch#install",
+		},
+		{
+			testname: "same value is not a conflict",
+			origin:   "https://example.com/?utm_source=twitter",
+			utm:      UTM{Source: "twitter", Medium: "social"},
+			want:     "https://example.com/?utm_source=twitter&utm_medium=social",
+		},
+		{
+			testname: "conflicting value is kept and reported",
+			origin:   "https://example.com/?utm_campaign=spring",
+			utm:      UTM{Campaign: "summer", Content: "banner"},
+			want:     "https://example.com/?utm_campaign=spring&utm_content=banner",
+			wantConflicts: []UTMConflict{
+				{Param: "utm_campaign", Existing: "spring", Requested: "summer"},
+			},
+		},
+		{
+			testname: "nothing to add",
+			origin:   "https://example.com/?a=1",
+			utm:      UTM{},
+			want:     "https://example.com/?a=1",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.testname, func(t *testing.T) {
+			got, conflicts, err := MergeUTM(tc.origin, tc.utm)
+			if err != nil {
+				t.Fatalf("failed to merge utm: %s", err)
+			}
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.wantConflicts, conflicts)
+		})
+	}
+}
+
+func TestCampaignOf(t *testing.T) {
+	assert.Equal(t, "spring", CampaignOf("https://example.com/?utm_campaign=spring&utm_source=x"))
+	assert.Equal(t, "", CampaignOf("https://example.com/"))
+}
@@ -0,0 +1,74 @@
+package domain
+
+import "sync/atomic"
+
+// A check digit at the end of the IDs catches most typos (any single wrong character and most swaps of
+// two neighbours) before the lookup reaches the cache or the database. It uses the Luhn mod N algorithm
+// over the base 62 alphabet. IDs generated before check digits were enabled don't pass the check, they have
+// the shape of LegacyID and callers must check that they exist (the API uses its Bloom filter of the stored IDs).
+
+var checkDigits atomic.Bool
+
+// SetCheckDigits turns the check digit on or off for every ID encoded or validated afterwards
+func SetCheckDigits(enabled bool) {
+	checkDigits.Store(enabled)
+}
+
+// CheckDigits reports whether IDs carry a check digit
+func CheckDigits() bool {
+	return checkDigits.Load()
+}
+
+// WithCheckDigit appends the check digit of id when check digits are enabled, id must be base 62
+func WithCheckDigit(id string) string {
+	if !checkDigits.Load() {
+		return id
+	}
+	return id + string(characters[checkDigit(id)])
+}
+
+// StripCheckDigit removes the check digit of id when check digits are enabled
+func StripCheckDigit(id string) string {
+	if !checkDigits.Load() || id == "" {
+		return id
+	}
+	return id[:len(id)-1]
+}
+
+// LegacyID reports whether id may have been created before check digits were enabled: base 62 characters
+// without check digit. Mistyped IDs look the same
+func LegacyID(id string) bool {
+	if !checkDigits.Load() || len(id) == 0 || len(id) > MaxIDLength-1 {
+		return false
+	}
+	for i := range len(id) {
+		if char2order[id[i]] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidCheckDigit reports whether the last character of id is the check digit of the ones before it
+func ValidCheckDigit(id string) bool {
+	if len(id) < 2 {
+		return false
+	}
+	return luhnSum(id, 1) == 0
+}
+
+func checkDigit(id string) int {
+	return (int(BASE) - luhnSum(id, 2)) % int(BASE)
+}
+
+// luhnSum walks id from the right, doubling every other code point starting with factor
+func luhnSum(id string, factor int) int {
+	n := int(BASE)
+	sum := 0
+	for i := len(id) - 1; i >= 0; i-- {
+		addend := factor * int(char2order[id[i]])
+		sum += addend/n + addend%n
+		factor = 3 - factor
+	}
+	return sum % n
+}
@@ -0,0 +1,79 @@
+package domain
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func enableCheckDigits(t *testing.T) {
+	SetCheckDigits(true)
+	t.Cleanup(func() { SetCheckDigits(false) })
+}
+
+func TestCheckDigitRoundTrip(t *testing.T) {
+	enableCheckDigits(t)
+
+	for range 1000 {
+		num := rand.Uint64()
+		id := EncodeID(num)
+		assert.True(t, ValidID(id), id)
+		decoded, err := DecodeID(id)
+		require.NoError(t, err)
+		assert.Equal(t, num, decoded)
+	}
+}
+
+func TestCheckDigitCatchesSingleCharacterTypos(t *testing.T) {
+	enableCheckDigits(t)
+
+	id := EncodeID(916_132_832)
+	for i := range len(id) {
+		for _, ch := range characters {
+			if ch == id[i] {
+				continue
+			}
+			typo := id[:i] + string(ch) + id[i+1:]
+			assert.False(t, ValidID(typo), "%s accepted instead of %s", typo, id)
+			_, err := DecodeID(typo)
+			assert.ErrorIs(t, err, ErrInvalidID)
+		}
+	}
+}
+
+func TestCheckDigitCatchesMostSwaps(t *testing.T) {
+	enableCheckDigits(t)
+
+	var swaps, caught int
+	for range 1000 {
+		id := EncodeID(rand.Uint64N(1 << 40))
+		i := rand.IntN(len(id) - 1)
+		if id[i] == id[i+1] {
+			continue
+		}
+		swapped := id[:i] + string(id[i+1]) + string(id[i]) + id[i+2:]
+		swaps++
+		if !ValidID(swapped) {
+			caught++
+		}
+	}
+	assert.Greater(t, float64(caught)/float64(swaps), 0.95)
+}
+
+func TestCheckDigitsDisabled(t *testing.T) {
+	assert.Equal(t, "abc", WithCheckDigit("abc"))
+	assert.Equal(t, "g8", EncodeID(1000))
+}
+
+func TestLegacyID(t *testing.T) {
+	assert.False(t, LegacyID("abc"))
+
+	enableCheckDigits(t)
+	assert.True(t, LegacyID("abc"))
+	assert.True(t, LegacyID("1"))
+	assert.False(t, LegacyID(""))
+	assert.False(t, LegacyID("ab-c"))
+	assert.False(t, LegacyID("abcdefghijklmnop"))
+}
@@ -0,0 +1,29 @@
+package domain
+
+import (
+	"context"
+	"time"
+)
+
+// Click is a single hit on a short URL
+type Click struct {
+	URLID     string    `json:"url_id"`
+	At        time.Time `json:"at"`
+	Bot       bool      `json:"bot"`
+	Referer   string    `json:"referer"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// StatsFilter selects the clicks (or links) stats and exports are computed from
+type StatsFilter struct {
+	From        time.Time // inclusive
+	To          time.Time // exclusive
+	IncludeBots bool
+}
+
+type ClickRepository interface {
+	BatchRecord(ctx context.Context, clicks []Click) error
+	// StreamClicks calls fn with every click of the short URL matching the filter, in chronological order.
+	// Clicks are fetched in chunks so memory doesn't grow with the number of clicks.
+	StreamClicks(ctx context.Context, id string, filter StatsFilter, fn func(Click) error) error
+}
@@ -0,0 +1,22 @@
+package domain
+
+import "errors"
+
+// Errors returned by the repositories, whatever the storage behind them.
+// Callers check them with errors.Is, the HTTP layer maps them to status codes.
+var (
+	// ErrNotFound is returned when the short URL (or another resource) doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrExpired is returned when the short URL existed but is no longer valid
+	ErrExpired = errors.New("expired")
+	// ErrDisabled is returned when the short URL exists but has been disabled (flagged as fraud)
+	ErrDisabled = errors.New("disabled")
+	// ErrConflict is returned when the short URL (or another resource) already exists
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidID is returned when a short ID can't have been generated (bad character or check digit)
+	ErrInvalidID = errors.New("invalid id")
+	// ErrUnknownStrategy is returned when a short URL asks for an id strategy that doesn't exist
+	ErrUnknownStrategy = errors.New("unknown id strategy")
+	// ErrUnavailable is returned when the storage is known to be unhealthy and isn't even tried
+	ErrUnavailable = errors.New("unavailable")
+)
@@ -1,6 +1,8 @@
 package domain
 
 import (
+	"fmt"
+	"math"
 	"math/rand"
 	"time"
 )
@@ -35,35 +37,92 @@ const (
 	// UPPERCASE_OFFSET int64 = 36
 )
 
+// EncodeID encodes num in base 62, followed by a check digit when check digits are enabled
 func EncodeID(num uint64) string {
-	var encoded []byte
+	return EncodePrefixedID("", num)
+}
+
+// TaggedPrefix starts the ids of the generators that don't share the keyspace of the encoded numbers,
+// a letter naming the generator follows it. EncodeID never starts with it (but for 0), nor may custom aliases
+const TaggedPrefix = "0"
+
+// EncodePrefixedID is EncodeID with prefix in front of the number, the check digit covers both
+func EncodePrefixedID(prefix string, num uint64) string {
+	if num == 0 {
+		return WithCheckDigit(prefix + string(characters[0]))
+	}
+	encoded := []byte(prefix)
 	for num > 0 {
 		encoded = append(encoded, characters[num%BASE])
 		num /= BASE
 	}
 
-	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+	for i, j := len(prefix), len(encoded)-1; i < j; i, j = i+1, j-1 {
 		encoded[i], encoded[j] = encoded[j], encoded[i]
 	}
 
-	return string(encoded)
+	return WithCheckDigit(string(encoded))
 }
 
-func DecodeID(id string) uint64 {
+// DecodeID is the inverse of EncodeID, it fails when id has characters outside the alphabet,
+// a wrong check digit or is too big for an uint64
+func DecodeID(id string) (uint64, error) {
+	for i := range len(id) {
+		if char2order[id[i]] < 0 {
+			return 0, fmt.Errorf("%w: %q is not a base 62 character", ErrInvalidID, id[i])
+		}
+	}
+	if checkDigits.Load() {
+		if !ValidCheckDigit(id) {
+			return 0, fmt.Errorf("%w: %q has a wrong check digit", ErrInvalidID, id)
+		}
+		id = id[:len(id)-1]
+	}
+	if id == "" {
+		return 0, fmt.Errorf("%w: empty id", ErrInvalidID)
+	}
 	var num uint64
-	for i := range id {
-		num = num*62 + uint64(char2order(id[i]))
+	for i := range len(id) {
+		order := char2order[id[i]]
+		if num > (math.MaxUint64-uint64(order))/BASE {
+			return 0, fmt.Errorf("%w: %q overflows", ErrInvalidID, id)
+		}
+		num = num*BASE + uint64(order)
 	}
-	return num
+	return num, nil
 }
 
-func char2order(ch byte) int {
-	for i := range characters {
-		if characters[i] == ch {
-			return i
+// MaxIDLength is longer than any ID that can be generated, longer IDs are rejected without looking them up
+const MaxIDLength = 16
+
+// ValidID reports whether id could have been generated: it must be made of base 62 characters,
+// and end with the right check digit when check digits are enabled
+func ValidID(id string) bool {
+	if len(id) == 0 || len(id) > MaxIDLength {
+		return false
+	}
+	for i := range len(id) {
+		if char2order[id[i]] < 0 {
+			return false
+		}
+	}
+	return !checkDigits.Load() || ValidCheckDigit(id)
+}
+
+// MinAliasLength keeps the short ids free for the generators
+const MinAliasLength = 3
+
+// ValidAlias reports whether a custom alias can be used as an id: base 62 characters, with room for a check digit
+func ValidAlias(alias string) bool {
+	if len(alias) < MinAliasLength || len(alias) > MaxIDLength-1 {
+		return false
+	}
+	for i := range len(alias) {
+		if char2order[alias[i]] < 0 {
+			return false
 		}
 	}
-	return -1
+	return true
 }
 
 var characters = []byte{
@@ -75,3 +134,14 @@ var characters = []byte{
 	'K', 'L', 'M', 'N', 'O', 'P', 'Q', 'R', 'S', 'T',
 	'U', 'V', 'W', 'X', 'Y', 'Z',
 }
+
+// char2order maps a byte to its position in characters, -1 for bytes outside the alphabet
+var char2order = func() (table [256]int8) {
+	for i := range table {
+		table[i] = -1
+	}
+	for i, ch := range characters {
+		table[ch] = int8(i)
+	}
+	return table
+}()
@@ -1,6 +1,7 @@
 package domain
 
 import (
+	"math"
 	"math/rand/v2"
 	"runtime"
 	"testing"
@@ -44,12 +45,33 @@ BenchmarkGenerateRandomStringLength6-12           109509             10719 ns/op
 
 func TestDecodeID(t *testing.T) {
 	num := uint64(rand.IntN(100000000))
-	assert.Equal(t, num, DecodeID(EncodeID(num)))
+	decoded, err := DecodeID(EncodeID(num))
+	assert.NoError(t, err)
+	assert.Equal(t, num, decoded)
 }
 
 func TestEncodeID(t *testing.T) {
 	randStr := "abc1Az24e"
-	assert.Equal(t, randStr, EncodeID(DecodeID(randStr)))
+	num, err := DecodeID(randStr)
+	assert.NoError(t, err)
+	assert.Equal(t, randStr, EncodeID(num))
+}
+
+func TestEncodeIDZero(t *testing.T) {
+	assert.Equal(t, "0", EncodeID(0))
+	num, err := DecodeID(EncodeID(0))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), num)
+}
+
+func TestDecodeIDInvalid(t *testing.T) {
+	for _, id := range []string{"", "abc-def", "ab\x00c", "é", "zzzzzzzzzzzzzzzz"} {
+		_, err := DecodeID(id)
+		assert.ErrorIs(t, err, ErrInvalidID, "id %q", id)
+	}
+	num, err := DecodeID("lYGhA16ahyf")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), num)
 }
 
 // Note that benchmark this way will create variety results, run about 4-5 times
@@ -98,7 +120,7 @@ func benchmarkDecodeID(b *testing.B, len int) {
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		num = DecodeID(ids[i%1000])
+		num, _ = DecodeID(ids[i%1000])
 	}
 	runtime.KeepAlive(num)
 }
@@ -126,3 +148,18 @@ func BenchmarkDecodeIDWithLengthEqual5(b *testing.B) {
 func BenchmarkDecodeIDWithLengthEqual6(b *testing.B) {
 	benchmarkDecodeID(b, 6)
 }
+
+func TestValidAlias(t *testing.T) {
+	assert.True(t, ValidAlias("promo2024"))
+	assert.False(t, ValidAlias("ab"))
+	assert.False(t, ValidAlias("black-friday"))
+	assert.False(t, ValidAlias("aaaaaaaaaaaaaaaa"))
+}
+
+func TestValidID(t *testing.T) {
+	assert.True(t, ValidID("abcXYZ019"))
+	assert.False(t, ValidID(""))
+	assert.False(t, ValidID("abc-def"))
+	assert.False(t, ValidID("../etc"))
+	assert.False(t, ValidID("aaaaaaaaaaaaaaaaa"))
+}
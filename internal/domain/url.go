@@ -10,21 +10,70 @@ type ShortURL struct {
 	Origin    string    `json:"origin"`
 	CreatedAt time.Time `json:"created_at,omitempty"`
 	Fraud     bool      `json:"fraud"`
+	Owner     string    `json:"owner,omitempty"`
+	Campaign  string    `json:"campaign,omitempty"`
+	Count     int       `json:"count"`
+	BotCount  int       `json:"bot_count"`
 }
 
 type URLRepository interface {
 	Create(ctx context.Context, id string, url string) (*ShortURL, error)
+	// Get returns the origin of the short URL, ErrDisabled when it is flagged as fraud
 	Get(ctx context.Context, id string) (string, error)
 	RetrieveFraud(ctx context.Context, id string) (bool, error)
 	GetView(ctx context.Context, id string) (int, error)
+	GetBotView(ctx context.Context, id string) (int, error)
 	BatchCreate(ctx context.Context, inputs []CreateInput) error
+	// BatchCreateSkipTaken inserts the short URLs whose id is free and returns the ids that were taken,
+	// the others are inserted anyway
+	BatchCreateSkipTaken(ctx context.Context, inputs []CreateInput) (taken []string, err error)
+	// GetOwner returns the owner of the short URL, anonymous short URLs have no owner (empty string)
+	GetOwner(ctx context.Context, id string) (string, error)
+	// StreamLinks calls fn with every short URL of the owner created in the filter's time range, ordered by ID.
+	StreamLinks(ctx context.Context, owner string, filter StatsFilter, fn func(ShortURL) error) error
+	// TopLinks returns the n most viewed short URLs (ID, Origin and Count only). With a non zero since,
+	// views are the human clicks recorded since then, otherwise the all-time count.
+	TopLinks(ctx context.Context, n int, since time.Time) ([]ShortURL, error)
+	// ScanIDs calls fn with the ID of every short URL
+	ScanIDs(ctx context.Context, fn func(id string) error) error
+	// Delete removes the short URL and its clicks, it returns ErrNotFound if there is no such short URL
+	Delete(ctx context.Context, id string) error
+	// ListCampaignStats aggregates the views of the owner's short URLs by campaign
+	ListCampaignStats(ctx context.Context, owner string) ([]CampaignStats, error)
+	// GetCampaignStats aggregates the views of the owner's short URLs of one campaign
+	GetCampaignStats(ctx context.Context, owner string, campaign string) (CampaignStats, error)
 }
 
 type IDGenerator interface {
 	GenerateID() string
 }
 
+// ContextIDGenerator is implemented by generators that depend on the database: GenerateIDContext fails
+// with ErrUnavailable instead of waiting for it
+type ContextIDGenerator interface {
+	IDGenerator
+	GenerateIDContext(ctx context.Context) (string, error)
+}
+
+// UniqueIDGenerator is implemented by generators whose ids may already be used. Their short URLs are
+// inserted as soon as they're created: GenerateUniqueID calls insert with new ids until one isn't taken,
+// insert must fail with ErrConflict for a taken id
+type UniqueIDGenerator interface {
+	IDGenerator
+	GenerateUniqueID(ctx context.Context, insert func(ctx context.Context, id string) error) (string, error)
+}
+
+// IDStrategies picks the generator of each short URL
+type IDStrategies interface {
+	// Pick returns the generator for a short URL of owner, requested is the strategy asked for (may be empty)
+	Pick(owner string, requested string) (IDGenerator, error)
+	// ValidID reports whether id (without check digit) could have been generated
+	ValidID(id string) bool
+}
+
 type CreateInput struct {
-	ID  string
-	URL string
+	ID       string
+	URL      string
+	Owner    string
+	Campaign string
 }
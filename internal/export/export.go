@@ -0,0 +1,237 @@
+package export
+
+// Writers encoding clicks and links as CSV, NDJSON or Parquet.
+// Records are written one at a time and flushed in chunks, so memory stays flat no matter
+// how many records are exported (a Parquet row group holds at most one chunk).
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/parquet-go/parquet-go"
+)
+
+type Format string
+
+const (
+	CSV     Format = "csv"
+	NDJSON  Format = "ndjson"
+	Parquet Format = "parquet"
+)
+
+// ChunkSize is the number of records written between two flushes
+const ChunkSize = 5000
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case CSV, NDJSON, Parquet:
+		return f, nil
+	case "":
+		return CSV, nil
+	default:
+		return "", fmt.Errorf("unsupported export format %q, use csv, ndjson or parquet", s)
+	}
+}
+
+func (f Format) ContentType() string {
+	switch f {
+	case NDJSON:
+		return "application/x-ndjson"
+	case Parquet:
+		return "application/vnd.apache.parquet"
+	default:
+		return "text/csv"
+	}
+}
+
+// Record is a row of an export
+type Record interface {
+	ClickRecord | LinkRecord
+	header() []string
+	row() []string
+}
+
+type ClickRecord struct {
+	URLID     string    `json:"url_id" parquet:"url_id,dict"`
+	At        time.Time `json:"at" parquet:"at,timestamp(microsecond)"`
+	Bot       bool      `json:"bot" parquet:"bot"`
+	Referer   string    `json:"referer" parquet:"referer"`
+	UserAgent string    `json:"user_agent" parquet:"user_agent"`
+}
+
+func NewClickRecord(c domain.Click) ClickRecord {
+	return ClickRecord(c)
+}
+
+func (ClickRecord) header() []string {
+	return []string{"url_id", "at", "bot", "referer", "user_agent"}
+}
+
+func (c ClickRecord) row() []string {
+	return []string{c.URLID, c.At.UTC().Format(time.RFC3339Nano), strconv.FormatBool(c.Bot), c.Referer, c.UserAgent}
+}
+
+type LinkRecord struct {
+	ID        string    `json:"id" parquet:"id"`
+	Origin    string    `json:"origin" parquet:"origin"`
+	CreatedAt time.Time `json:"created_at" parquet:"created_at,timestamp(microsecond)"`
+	Fraud     bool      `json:"fraud" parquet:"fraud"`
+	Count     int64     `json:"count" parquet:"count"`
+	BotCount  int64     `json:"bot_count" parquet:"bot_count"`
+}
+
+func NewLinkRecord(l domain.ShortURL) LinkRecord {
+	return LinkRecord{
+		ID:        l.ID,
+		Origin:    l.Origin,
+		CreatedAt: l.CreatedAt,
+		Fraud:     l.Fraud,
+		Count:     int64(l.Count),
+		BotCount:  int64(l.BotCount),
+	}
+}
+
+func (LinkRecord) header() []string {
+	return []string{"id", "origin", "created_at", "fraud", "count", "bot_count"}
+}
+
+func (l LinkRecord) row() []string {
+	return []string{l.ID, l.Origin, l.CreatedAt.UTC().Format(time.RFC3339Nano), strconv.FormatBool(l.Fraud),
+		strconv.FormatInt(l.Count, 10), strconv.FormatInt(l.BotCount, 10)}
+}
+
+type Writer[T Record] interface {
+	Write(record T) error
+	// Flush writes buffered records to the underlying writer
+	Flush() error
+	// Close flushes the remaining records and writes the footer (if any), it doesn't close the underlying writer
+	Close() error
+}
+
+func NewWriter[T Record](format Format, w io.Writer) Writer[T] {
+	switch format {
+	case NDJSON:
+		return &ndjsonWriter[T]{enc: json.NewEncoder(w)}
+	case Parquet:
+		return &parquetWriter[T]{
+			w: parquet.NewGenericWriter[T](w, parquet.MaxRowsPerRowGroup(ChunkSize)),
+		}
+	default:
+		return &csvWriter[T]{w: csv.NewWriter(w)}
+	}
+}
+
+type csvWriter[T Record] struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+func (cw *csvWriter[T]) Write(record T) error {
+	if !cw.headerWritten {
+		if err := cw.w.Write(record.header()); err != nil {
+			return err
+		}
+		cw.headerWritten = true
+	}
+	return cw.w.Write(record.row())
+}
+
+func (cw *csvWriter[T]) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func (cw *csvWriter[T]) Close() error {
+	if !cw.headerWritten {
+		var zero T
+		if err := cw.w.Write(zero.header()); err != nil {
+			return err
+		}
+	}
+	return cw.Flush()
+}
+
+type ndjsonWriter[T Record] struct {
+	enc *json.Encoder
+}
+
+func (nw *ndjsonWriter[T]) Write(record T) error {
+	return nw.enc.Encode(record)
+}
+
+func (nw *ndjsonWriter[T]) Flush() error {
+	return nil
+}
+
+func (nw *ndjsonWriter[T]) Close() error {
+	return nil
+}
+
+type parquetWriter[T Record] struct {
+	w *parquet.GenericWriter[T]
+}
+
+func (pw *parquetWriter[T]) Write(record T) error {
+	_, err := pw.w.Write([]T{record})
+	return err
+}
+
+// Flush ends the current row group
+func (pw *parquetWriter[T]) Flush() error {
+	return pw.w.Flush()
+}
+
+func (pw *parquetWriter[T]) Close() error {
+	return pw.w.Close()
+}
+
+// Clicks writes the clicks of the short URL matching the filter and closes w.
+// afterChunk (optional) is called every time a chunk has been flushed, e.g. to flush an HTTP response.
+func Clicks(ctx context.Context, repo domain.ClickRepository, id string, filter domain.StatsFilter,
+	w Writer[ClickRecord], afterChunk func()) (int, error) {
+	n := 0
+	err := repo.StreamClicks(ctx, id, filter, func(c domain.Click) error {
+		n++
+		return writeChunked(w, NewClickRecord(c), n, afterChunk)
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// Links writes the short URLs of the owner created in the filter's time range and closes w.
+func Links(ctx context.Context, repo domain.URLRepository, owner string, filter domain.StatsFilter,
+	w Writer[LinkRecord], afterChunk func()) (int, error) {
+	n := 0
+	err := repo.StreamLinks(ctx, owner, filter, func(l domain.ShortURL) error {
+		n++
+		return writeChunked(w, NewLinkRecord(l), n, afterChunk)
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+func writeChunked[T Record](w Writer[T], record T, n int, afterChunk func()) error {
+	if err := w.Write(record); err != nil {
+		return err
+	}
+	if n%ChunkSize != 0 {
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if afterChunk != nil {
+		afterChunk()
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClickRepository struct {
+	clicks []domain.Click
+}
+
+func (fr *fakeClickRepository) BatchRecord(_ context.Context, clicks []domain.Click) error {
+	fr.clicks = append(fr.clicks, clicks...)
+	return nil
+}
+
+func (fr *fakeClickRepository) StreamClicks(_ context.Context, id string, _ domain.StatsFilter, fn func(domain.Click) error) error {
+	for _, c := range fr.clicks {
+		if c.URLID != id {
+			continue
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prepareClicks(n int) *fakeClickRepository {
+	at := time.Date(2024, 11, 1, 10, 0, 0, 0, time.UTC)
+	repo := &fakeClickRepository{}
+	for i := range n {
+		repo.clicks = append(repo.clicks, domain.Click{
+			URLID:     "abc",
+			At:        at.Add(time.Duration(i) * time.Second),
+			Bot:       i%2 == 1,
+			Referer:   "https://example.com",
+			UserAgent: "Mozilla/5.0",
+		})
+	}
+	return repo
+}
+
+func TestClicksCSV(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := Clicks(context.Background(), prepareClicks(2), "abc", domain.StatsFilter{}, NewWriter[ClickRecord](CSV, &buf), nil)
+	if err != nil {
+		t.Fatalf("failed to export clicks: %s", err)
+	}
+
+	assert.Equal(t, 2, n)
+	assert.Equal(t, strings.Join([]string{
+		"url_id,at,bot,referer,user_agent",
+		"abc,2024-11-01T10:00:00Z,false,https://example.com,Mozilla/5.0",
+		"abc,2024-11-01T10:00:01Z,true,https://example.com,Mozilla/5.0",
+		"",
+	}, "\n"), buf.String())
+}
+
+func TestClicksCSVEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := Clicks(context.Background(), prepareClicks(0), "abc", domain.StatsFilter{}, NewWriter[ClickRecord](CSV, &buf), nil)
+	if err != nil {
+		t.Fatalf("failed to export clicks: %s", err)
+	}
+
+	assert.Equal(t, 0, n)
+	assert.Equal(t, "url_id,at,bot,referer,user_agent\n", buf.String())
+}
+
+func TestClicksNDJSON(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := Clicks(context.Background(), prepareClicks(1), "abc", domain.StatsFilter{}, NewWriter[ClickRecord](NDJSON, &buf), nil)
+	if err != nil {
+		t.Fatalf("failed to export clicks: %s", err)
+	}
+
+	assert.Equal(t, `{"url_id":"abc","at":"2024-11-01T10:00:00Z","bot":false,"referer":"https://example.com","user_agent":"Mozilla/5.0"}`+"\n", buf.String())
+}
+
+func TestClicksParquetChunked(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		chunks int
+		total  = 2*ChunkSize + 10
+	)
+	repo := prepareClicks(total)
+	n, err := Clicks(context.Background(), repo, "abc", domain.StatsFilter{}, NewWriter[ClickRecord](Parquet, &buf), func() { chunks++ })
+	if err != nil {
+		t.Fatalf("failed to export clicks: %s", err)
+	}
+	assert.Equal(t, total, n)
+	assert.Equal(t, 2, chunks)
+
+	records, err := parquet.Read[ClickRecord](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("failed to read parquet file: %s", err)
+	}
+	assert.Len(t, records, total)
+	assert.Equal(t, NewClickRecord(repo.clicks[total-1]), records[total-1])
+}
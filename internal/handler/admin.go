@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/idgen"
+	"github.com/armistcxy/shorten/internal/util"
+	"github.com/armistcxy/shorten/internal/warm"
+)
+
+// AdminTokenHeader carries the admin token, it is separate from the Authorization header used by API keys
+const AdminTokenHeader = "X-Admin-Token"
+
+// AdminHandler serves the operator endpoints, they are disabled when no admin token is configured
+type AdminHandler struct {
+	token  string
+	warmer *warm.Warmer
+	ids    *idgen.Registry
+}
+
+func NewAdminHandler(token string, warmer *warm.Warmer, ids *idgen.Registry) *AdminHandler {
+	return &AdminHandler{
+		token:  token,
+		warmer: warmer,
+		ids:    ids,
+	}
+}
+
+// RequireAdmin rejects requests without the admin token
+func (ah *AdminHandler) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(AdminTokenHeader)
+		if ah.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(ah.token)) != 1 {
+			util.WriteError(w, r, util.Unauthorized("a valid admin token is required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WarmCacheHandle loads the most viewed short URLs into the cache.
+// Query parameters: n (number of short URLs), since (duration, e.g. 24h, selects by recent clicks)
+// and concurrency. Progress is streamed as NDJSON, the last line has "final": true.
+func (ah *AdminHandler) WarmCacheHandle(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := warm.Options{}
+
+	var err error
+	if n := query.Get("n"); n != "" {
+		if opts.N, err = strconv.Atoi(n); err != nil || opts.N <= 0 {
+			util.WriteError(w, r, util.BadRequest("'n' must be a positive number"))
+			return
+		}
+	}
+	if concurrency := query.Get("concurrency"); concurrency != "" {
+		if opts.Concurrency, err = strconv.Atoi(concurrency); err != nil || opts.Concurrency <= 0 {
+			util.WriteError(w, r, util.BadRequest("'concurrency' must be a positive number"))
+			return
+		}
+	}
+	if since := query.Get("since"); since != "" {
+		d, err := time.ParseDuration(since)
+		if err != nil || d <= 0 {
+			util.WriteError(w, r, util.BadRequest("'since' must be a positive duration, e.g. 24h"))
+			return
+		}
+		opts.Since = time.Now().Add(-d)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flush := flushFunc(w)
+	opts.Progress = func(p warm.Progress) {
+		_ = enc.Encode(p)
+		if flush != nil {
+			flush()
+		}
+	}
+
+	if _, err := ah.warmer.Run(r.Context(), opts); err != nil {
+		slog.Error("fail to warm cache", "error", err.Error())
+		// the status code has already been sent, the error line tells the client it failed
+		_ = enc.Encode(map[string]string{"error": "cache warming failed", "request_id": util.RequestID(r.Context())})
+	}
+}
+
+// IDGeneratorsHandle dumps the state of the id generators in use: the shards of the sequential ones
+// (leased range, remaining ids, refills, waits for a shard), the keyspace of the random ones and the
+// node of the Snowflake one
+func (ah *AdminHandler) IDGeneratorsHandle(w http.ResponseWriter, r *http.Request) {
+	util.EncodeJSON(w, map[string]any{
+		"strategies": ah.ids.Names(),
+		"generators": ah.ids.Stats(),
+	})
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/armistcxy/shorten/internal/auth"
+	"github.com/armistcxy/shorten/internal/util"
+)
+
+// ListCampaignsHandle returns the aggregated views of every campaign of the owner
+func (uh *URLHandler) ListCampaignsHandle(w http.ResponseWriter, r *http.Request) {
+	owner := auth.Owner(r.Context())
+	if owner == "" {
+		util.WriteError(w, r, util.Unauthorized("an API key is required to list campaigns"))
+		return
+	}
+
+	stats, err := uh.urlRepo.ListCampaignStats(r.Context(), owner)
+	if err != nil {
+		slog.Error("fail to list campaign stats", "owner", owner, "error", err.Error())
+		util.WriteError(w, r, err)
+		return
+	}
+
+	util.EncodeJSON(w, map[string]interface{}{"campaigns": stats})
+}
+
+// CampaignStatsHandle returns the views of a campaign summed over all of its short URLs.
+// Views that are still pending in Redis are not included, they show up after the next flush.
+func (uh *URLHandler) CampaignStatsHandle(w http.ResponseWriter, r *http.Request) {
+	campaign := r.PathValue("campaign")
+
+	owner := auth.Owner(r.Context())
+	if owner == "" {
+		util.WriteError(w, r, util.Unauthorized("an API key is required to read campaign stats"))
+		return
+	}
+
+	stats, err := uh.urlRepo.GetCampaignStats(r.Context(), owner, campaign)
+	if err != nil {
+		slog.Error("fail to get campaign stats", "owner", owner, "campaign", campaign, "error", err.Error())
+		util.WriteError(w, r, err)
+		return
+	}
+	if stats.Links == 0 {
+		util.WriteError(w, r, util.NewError(http.StatusNotFound, "not_found", "campaign not found"))
+		return
+	}
+
+	util.EncodeJSON(w, stats)
+}
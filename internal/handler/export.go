@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/auth"
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/armistcxy/shorten/internal/export"
+	"github.com/armistcxy/shorten/internal/util"
+)
+
+// ExportClicksHandle streams the clicks of a short URL as CSV, NDJSON or Parquet.
+// Query parameters: from, to (RFC 3339 or YYYY-MM-DD), bots (include bot traffic) and format.
+// Only the owner of the short URL can export its clicks.
+func (uh *URLHandler) ExportClicksHandle(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	owner := auth.Owner(r.Context())
+	if owner == "" {
+		util.WriteError(w, r, util.Unauthorized("an API key is required to export clicks"))
+		return
+	}
+
+	filter, err := parseStatsFilter(r)
+	if err != nil {
+		util.WriteError(w, r, util.BadRequest(err.Error()))
+		return
+	}
+	format, err := export.ParseFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		util.WriteError(w, r, util.BadRequest(err.Error()))
+		return
+	}
+
+	linkOwner, err := uh.urlRepo.GetOwner(r.Context(), id)
+	if err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			slog.Error("fail to retrieve owner of short url", "url_id", id, "error", err.Error())
+		}
+		util.WriteError(w, r, err)
+		return
+	}
+	if linkOwner != owner {
+		util.WriteError(w, r, util.Forbidden("only the owner of the short url can export its clicks"))
+		return
+	}
+
+	setExportHeaders(w, format, fmt.Sprintf("%s-clicks", id))
+	n, err := export.Clicks(r.Context(), uh.clickRepo, id, filter, export.NewWriter[export.ClickRecord](format, w), flushFunc(w))
+	if err != nil {
+		// the response has already started, the client gets a truncated file
+		slog.Error("fail to export clicks", "url_id", id, "exported", n, "error", err.Error())
+	}
+}
+
+// ExportLinksHandle streams the short URLs of the owner (with their view counts) as CSV, NDJSON or Parquet.
+// from and to select short URLs by creation time.
+func (uh *URLHandler) ExportLinksHandle(w http.ResponseWriter, r *http.Request) {
+	owner := auth.Owner(r.Context())
+	if owner == "" {
+		util.WriteError(w, r, util.Unauthorized("an API key is required to export links"))
+		return
+	}
+
+	filter, err := parseStatsFilter(r)
+	if err != nil {
+		util.WriteError(w, r, util.BadRequest(err.Error()))
+		return
+	}
+	format, err := export.ParseFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		util.WriteError(w, r, util.BadRequest(err.Error()))
+		return
+	}
+
+	setExportHeaders(w, format, "links")
+	n, err := export.Links(r.Context(), uh.urlRepo, owner, filter, export.NewWriter[export.LinkRecord](format, w), flushFunc(w))
+	if err != nil {
+		slog.Error("fail to export links", "owner", owner, "exported", n, "error", err.Error())
+	}
+}
+
+func setExportHeaders(w http.ResponseWriter, format export.Format, name string) {
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+string(format)))
+}
+
+// flushFunc pushes every exported chunk to the client instead of letting the response buffer grow
+func flushFunc(w http.ResponseWriter) func() {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil
+	}
+	return flusher.Flush
+}
+
+// parseStatsFilter reads the filter of the export endpoints from the query string:
+// from (inclusive) and to (exclusive) accept RFC 3339 timestamps or dates (YYYY-MM-DD), they default to
+// all time like the view and campaign stats, which take no range. Bot traffic is left out unless bots=true,
+// as in the headline count of the stats.
+func parseStatsFilter(r *http.Request) (domain.StatsFilter, error) {
+	query := r.URL.Query()
+	filter := domain.StatsFilter{
+		From: time.Unix(0, 0).UTC(),
+		To:   time.Now().UTC(),
+	}
+
+	if from := query.Get("from"); from != "" {
+		t, err := parseTime(from)
+		if err != nil {
+			return filter, fmt.Errorf("invalid 'from': %w", err)
+		}
+		filter.From = t
+	}
+	if to := query.Get("to"); to != "" {
+		t, err := parseTime(to)
+		if err != nil {
+			return filter, fmt.Errorf("invalid 'to': %w", err)
+		}
+		filter.To = t
+	}
+	if !filter.From.Before(filter.To) {
+		return filter, errors.New("'from' must be before 'to'")
+	}
+
+	if bots := query.Get("bots"); bots != "" {
+		include, err := strconv.ParseBool(bots)
+		if err != nil {
+			return filter, fmt.Errorf("invalid 'bots': %w", err)
+		}
+		filter.IncludeBots = include
+	}
+
+	return filter, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/armistcxy/shorten/internal/breaker"
+	"github.com/armistcxy/shorten/internal/util"
+)
+
+// HealthHandler reports whether the replica can serve lookups
+type HealthHandler struct {
+	dbBreaker *breaker.Breaker
+}
+
+func NewHealthHandler(dbBreaker *breaker.Breaker) *HealthHandler {
+	return &HealthHandler{dbBreaker: dbBreaker}
+}
+
+// HealthHandle answers 200 with "status": "ok", or "degraded" when the database breaker isn't closed.
+// A degraded replica still serves cached short URLs, so it isn't reported as down.
+func (hh *HealthHandler) HealthHandle(w http.ResponseWriter, r *http.Request) {
+	state := hh.dbBreaker.State()
+	status := "ok"
+	if state != breaker.Closed {
+		status = "degraded"
+	}
+
+	util.EncodeJSON(w, map[string]interface{}{
+		"status": status,
+		"checks": map[string]string{
+			"db_breaker": state.String(),
+		},
+	})
+}
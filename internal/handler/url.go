@@ -2,17 +2,26 @@ package handler
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/armistcxy/shorten/internal/auth"
 	"github.com/armistcxy/shorten/internal/background"
+	"github.com/armistcxy/shorten/internal/bloom"
+	"github.com/armistcxy/shorten/internal/bot"
 	"github.com/armistcxy/shorten/internal/cache"
+	"github.com/armistcxy/shorten/internal/denylist"
 	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/armistcxy/shorten/internal/live"
 	"github.com/armistcxy/shorten/internal/msq"
 	"github.com/armistcxy/shorten/internal/util"
 	"github.com/jackc/pgx/v5"
@@ -25,21 +34,30 @@ import (
 // /create?url= POST => Return short url
 type URLHandler struct {
 	urlRepo     domain.URLRepository
-	idGen       domain.IDGenerator
+	clickRepo   domain.ClickRepository
+	idGen       domain.IDStrategies
 	cache       cache.Cache
 	pub         *msq.URLPublisher
 	riverClient *river.Client[pgx.Tx]
 	inputs      []domain.CreateInput
 	viewManager *ViewManager
 	viewCache   cache.ViewCache
+	live        *live.Hub
+	ids         *bloom.Filter
+	idsState    atomic.Int32
+	denied      *denylist.List
 	group       singleflight.Group
 	mu          sync.Mutex
+	clicks      []domain.Click
+	clickMu     sync.Mutex
 }
 
-func NewURLHandler(urlRepo domain.URLRepository, idGen domain.IDGenerator, cache cache.Cache,
-	pub *msq.URLPublisher, riverClient *river.Client[pgx.Tx], viewCache cache.ViewCache) *URLHandler {
+func NewURLHandler(urlRepo domain.URLRepository, clickRepo domain.ClickRepository, idGen domain.IDStrategies, cache cache.Cache,
+	pub *msq.URLPublisher, riverClient *river.Client[pgx.Tx], viewCache cache.ViewCache, liveHub *live.Hub, ids *bloom.Filter,
+	denied *denylist.List) *URLHandler {
 	return &URLHandler{
 		urlRepo:     urlRepo,
+		clickRepo:   clickRepo,
 		idGen:       idGen,
 		cache:       cache,
 		pub:         pub,
@@ -47,97 +65,405 @@ func NewURLHandler(urlRepo domain.URLRepository, idGen domain.IDGenerator, cache
 		inputs:      make([]domain.CreateInput, 0),
 		viewManager: NewViewManager(),
 		viewCache:   viewCache,
+		live:        liveHub,
+		ids:         ids,
+		denied:      denied,
 		group:       singleflight.Group{},
 		mu:          sync.Mutex{},
+		clicks:      make([]domain.Click, 0),
+		clickMu:     sync.Mutex{},
 	}
 }
 
 // GetOriginURLHandle handles the GET request to retrieve the original URL for a given short URL ID.
 // It extracts the ID from the request path, looks up the original URL in the URLRepository,
 // and encodes the original URL as a JSON response.
+//
+// Lookups of IDs that don't exist are answered without the database when possible: malformed IDs (that no
+// id strategy generates and that can't be an alias either) are rejected,
+// IDs that are not in the Bloom filter of existing IDs can't exist, and IDs the database didn't know about
+// are cached as not found for a short time. Links flagged as fraud are disabled, their marker replaces the
+// cached origin once the entry is refreshed.
 func (uh *URLHandler) GetOriginURLHandle(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
 	id := parts[len(parts)-1]
 
+	if !uh.validID(id) {
+		util.WriteError(w, r, domain.ErrNotFound)
+		return
+	}
+
 	cacheCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	originURL, err := uh.cache.Get(cacheCtx, id)
+	originURL, stale, err := cache.GetStale(cacheCtx, uh.cache, id)
 	if err != nil {
-		slog.Error("failed when trying to retrieve entry from cache", "error", err.Error())
+		slog.Error("failed when trying to retrieve entry from cache", "id", id, "error", err.Error())
+	} else if originURL == notFoundMarker {
+		util.WriteError(w, r, domain.ErrNotFound)
+		return
+	} else if originURL == disabledMarker {
+		if stale {
+			uh.refresh(id)
+		}
+		util.WriteError(w, r, domain.ErrDisabled)
+		return
 	} else if originURL != "" {
-		go func() {
-			uh.viewManager.counter.Increase(id)
-		}()
+		if stale {
+			uh.refresh(id)
+		}
+		uh.recordView(r, id)
 		util.EncodeJSON(w, map[string]string{"origin": originURL})
 		return
 	}
 
+	// The cache is checked first: a short URL created on another replica is cached
+	// right away, while it only reaches the Bloom filter of this replica through RabbitMQ
+	if uh.filtering() && !uh.ids.Test(id) {
+		util.WriteError(w, r, domain.ErrNotFound)
+		return
+	}
+
 	_, err, _ = uh.group.Do(id, func() (interface{}, error) {
 		dbQueryCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 		defer cancel()
 		originURL, err = uh.urlRepo.Get(dbQueryCtx, id)
+		if errors.Is(err, domain.ErrNotFound) {
+			setCacheCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			// the short URL may have been created (and cached) since the database was asked
+			if _, err := cache.SetNX(setCacheCtx, uh.cache, id, notFoundMarker, notFoundTTL); err != nil {
+				slog.Error("failed to cache not found short url", "id", id, "error", err.Error())
+			}
+			return nil, err
+		}
+		if errors.Is(err, domain.ErrDisabled) {
+			setCacheCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if err := uh.cache.Set(setCacheCtx, id, disabledMarker); err != nil {
+				slog.Error("failed to cache disabled short url", "id", id, "error", err.Error())
+			}
+			return nil, err
+		}
 		if err != nil {
-			slog.Error("fail to retrieve origin url", "error", err.Error())
+			// when the breaker is open, it already logged why
+			if !errors.Is(err, domain.ErrUnavailable) {
+				slog.Error("fail to retrieve origin url", "error", err.Error())
+			}
 			return nil, err
 		}
 		setCacheCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		if setCacheErr := uh.cache.Set(setCacheCtx, id, originURL); err != nil {
+		if setCacheErr := uh.cache.Set(setCacheCtx, id, originURL); setCacheErr != nil {
 			slog.Error("failed to set k-v to cache", "id", id, "origin", originURL, "error", setCacheErr.Error())
 		}
 		return nil, nil
 	})
 
 	if err != nil {
-		http.Error(w, fmt.Sprintf("fail to retrieve origin url, error: %s", err), http.StatusInternalServerError)
+		util.WriteError(w, r, err)
 		return
 	}
-	go func() {
-		uh.viewManager.counter.Increase(id)
-	}()
+	uh.recordView(r, id)
 
 	util.EncodeJSON(w, map[string]string{"origin": originURL})
 }
 
+const (
+	// notFoundMarker is cached for IDs that are not in the database, it can't be a valid URL
+	notFoundMarker = "\x00notfound"
+	notFoundTTL    = 30 * time.Second
+	// disabledMarker is cached for short URLs flagged as fraud
+	disabledMarker = "\x00disabled"
+)
+
+// refresh reloads a cache entry past its soft TTL in the background, the stale origin is served meanwhile.
+// Concurrent refreshes of the same id are merged. If the database can't be reached the entry is left as it is
+// and served until its hard TTL.
+func (uh *URLHandler) refresh(id string) {
+	_ = uh.group.DoChan("refresh:"+id, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		originURL, err := uh.urlRepo.Get(ctx, id)
+		switch {
+		case errors.Is(err, domain.ErrNotFound):
+			err = uh.cache.SetWithTTL(ctx, id, notFoundMarker, notFoundTTL)
+		case errors.Is(err, domain.ErrDisabled):
+			err = uh.cache.Set(ctx, id, disabledMarker)
+		case err != nil:
+			slog.Warn("fail to refresh stale short url, keep serving it", "url_id", id, "error", err.Error())
+			return nil, nil
+		default:
+			err = uh.cache.Set(ctx, id, originURL)
+		}
+		if err != nil {
+			slog.Error("failed to refresh short url in cache", "url_id", id, "error", err.Error())
+		}
+		return nil, nil
+	})
+}
+
+// LoadIDs fills the Bloom filter with the ID of every short URL, lookups are only rejected
+// by the filter once it has been loaded. IDs created in the meantime must be added with AddID.
+func (uh *URLHandler) LoadIDs(ctx context.Context) error {
+	n := 0
+	if err := uh.urlRepo.ScanIDs(ctx, func(id string) error {
+		uh.ids.Add(id)
+		n++
+		return nil
+	}); err != nil {
+		return err
+	}
+	if !uh.idsState.CompareAndSwap(idsLoading, idsReady) {
+		slog.Warn("loaded short url ids into bloom filter after it was stopped, lookups are not filtered", "ids", n)
+		return nil
+	}
+	slog.Info("loaded short url ids into bloom filter", "ids", n)
+	return nil
+}
+
+// states of the Bloom filter, once stopped it is never used again
+const (
+	idsLoading int32 = iota
+	idsReady
+	idsStopped
+)
+
+// filtering tells whether lookups can be rejected by the Bloom filter
+func (uh *URLHandler) filtering() bool {
+	return uh.idsState.Load() == idsReady
+}
+
+// AddID adds the ID of a new short URL to the Bloom filter
+func (uh *URLHandler) AddID(id string) {
+	uh.ids.Add(id)
+}
+
+// StopFilteringIDs is called when new IDs can no longer be added to the Bloom filter,
+// a stale filter would reject short URLs created by other replicas. A load still running can't enable it again.
+func (uh *URLHandler) StopFilteringIDs() {
+	uh.idsState.Store(idsStopped)
+}
+
+// recordView counts a hit on the short URL, bot traffic goes to a separate counter
+// so that the view count reflects humans only.
+// Views are added to the pending counters in Redis, which are shared by every replica and survive restarts.
+// If Redis is unavailable, they are kept in memory until the next BatchUpdateView.
+func (uh *URLHandler) recordView(r *http.Request, id string) {
+	isBot := bot.IsBot(r)
+	delta := cache.ViewDelta{Count: 1}
+	if isBot {
+		delta = cache.ViewDelta{BotCount: 1}
+	}
+	uh.live.Record(id, isBot)
+	uh.bufferClick(domain.Click{
+		URLID:     id,
+		At:        time.Now(),
+		Bot:       isBot,
+		Referer:   truncate(r.Referer(), maxHeaderLength),
+		UserAgent: truncate(r.UserAgent(), maxHeaderLength),
+	})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := uh.viewCache.AddPending(ctx, id, delta); err != nil {
+			slog.Error("failed to add pending view, keep it in memory", "url_id", id, "error", err.Error())
+			uh.viewManager.counter.Add(id, delta.Count)
+			uh.viewManager.botCounter.Add(id, delta.BotCount)
+		}
+	}()
+}
+
 // CreateShortURLHandle handles the POST request to create a new short URL.
 // It extracts the original URL from the request, creates a new short URL using the URLRepository,
 // and encodes the short URL as a JSON response.
+// UTM fields are merged into the query string of the origin, parameters the origin already has
+// are kept and reported in "utm_conflicts". The short URL joins the campaign of its utm_campaign.
+// A custom alias is used as the id (followed by a check digit when they're enabled) unless it's taken
+// or denied: route names and offensive words can't be used.
 func (uh *URLHandler) CreateShortURLHandle(w http.ResponseWriter, r *http.Request) {
 	form := CreateShortForm{}
 	if err := util.DecodeJSON(r, &form); err != nil {
 		slog.Error("fail when decoding json body", "error", err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		util.WriteError(w, r, util.BadRequest(err.Error()))
 		return
 	}
 
-	id := uh.idGen.GenerateID()
+	var conflicts []domain.UTMConflict
+	if form.UTM != nil {
+		origin, utmConflicts, err := domain.MergeUTM(form.Origin, *form.UTM)
+		if err != nil {
+			util.WriteError(w, r, util.BadRequest(fmt.Sprintf("invalid origin url: %s", err)))
+			return
+		}
+		form.Origin, conflicts = origin, utmConflicts
+	}
+	campaign := domain.CampaignOf(form.Origin)
+
+	input := domain.CreateInput{URL: form.Origin, Owner: auth.Owner(r.Context()), Campaign: campaign}
+	var (
+		id       string
+		inserted bool
+	)
+	if form.Alias != "" {
+		if !domain.ValidAlias(form.Alias) {
+			util.WriteError(w, r, util.BadRequest(fmt.Sprintf("alias must be %d to %d letters or digits", domain.MinAliasLength, domain.MaxIDLength-1)))
+			return
+		}
+		if strings.HasPrefix(form.Alias, domain.TaggedPrefix) {
+			util.WriteError(w, r, util.BadRequest(fmt.Sprintf("alias can't start with %q, it is kept for generated ids", domain.TaggedPrefix)))
+			return
+		}
+		input.ID = domain.WithCheckDigit(form.Alias)
+		if uh.denied.Blocked(input.ID) {
+			util.WriteError(w, r, util.BadRequest("alias is not allowed"))
+			return
+		}
+		// the alias may be taken, like the ids of UniqueIDGenerator
+		if err := uh.urlRepo.BatchCreate(r.Context(), []domain.CreateInput{input}); err != nil {
+			if !errors.Is(err, domain.ErrConflict) {
+				slog.Error("failed to create short url", "id", input.ID, "origin", form.Origin, "error", err.Error())
+			}
+			util.WriteError(w, r, err)
+			return
+		}
+		id, inserted = input.ID, true
+	} else if gen, err := uh.pickIDGenerator(w, r, input.Owner, form.IDStrategy); err != nil {
+		return
+	} else if unique, ok := gen.(domain.UniqueIDGenerator); ok {
+		// The id may be taken, that's only known once it's inserted: it can't wait for the next BatchCreate
+		id, err = unique.GenerateUniqueID(r.Context(), func(ctx context.Context, id string) error {
+			input.ID = id
+			return uh.urlRepo.BatchCreate(ctx, []domain.CreateInput{input})
+		})
+		if err != nil {
+			slog.Error("failed to create short url", "origin", form.Origin, "error", err.Error())
+			util.WriteError(w, r, err)
+			return
+		}
+		inserted = true
+	} else {
+		// Custom aliases and the other strategies share the ids of the generator, skip the ids that may be
+		// taken already (one created on another replica a moment ago can still slip through, BatchCreate
+		// skips it)
+		if id, inserted, err = uh.freeID(r.Context(), gen, input); err != nil {
+			slog.Error("failed to create short url", "origin", form.Origin, "error", err.Error())
+			util.WriteError(w, r, err)
+			return
+		}
+		input.ID = id
+	}
+	uh.AddID(id)
 
 	// Add k-v pair (id:origin_url) to cache for 5 minutes
 	cacheCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := uh.cache.Set(cacheCtx, id, form.Origin); err != nil {
+	// Unless it's inserted already, the short URL is only inserted in the database by the next BatchCreate,
+	// until then the cache is the only place where other replicas can find it, so the write must be done
+	// before responding
+	setCtx := cacheCtx
+	if !inserted {
+		setCtx = cache.WaitForWrite(cacheCtx)
+	}
+	if err := uh.cache.Set(setCtx, id, form.Origin); err != nil {
 		slog.Error("failed to set k-v to cache", "id", id, "origin", form.Origin, "error", err.Error())
 	}
+	// other replicas may hold the not-found marker of id in their L1 (an alias looked up before it was taken)
+	if err := cache.Invalidate(cacheCtx, uh.cache, id); err != nil {
+		slog.Error("failed to invalidate cached id", "id", id, "error", err.Error())
+	}
 
 	go func() {
 		if err := uh.pub.EnqueueURL(context.Background(), form.Origin, id); err != nil {
 			slog.Error("failed to enequeue url", "url", form.Origin, "url_id", id, "error", err.Error())
 		}
-		if _, err := uh.riverClient.Insert(context.Background(), background.IncreaseCountArgs{
-			ID: id,
-		}, nil); err != nil {
-			slog.Error("failed to enqueue increase view jobs", "url_id", id, "error", err.Error())
+		if inserted {
+			return
 		}
 		uh.mu.Lock()
 		defer uh.mu.Unlock()
-		uh.inputs = append(uh.inputs, domain.CreateInput{ID: id, URL: form.Origin})
+		uh.inputs = append(uh.inputs, input)
 	}()
 
-	util.EncodeJSON(w, map[string]interface{}{"id": id, "origin": form.Origin})
+	resp := map[string]interface{}{"id": id, "origin": form.Origin}
+	if campaign != "" {
+		resp["campaign"] = campaign
+	}
+	if len(conflicts) > 0 {
+		resp["utm_conflicts"] = conflicts
+	}
+	util.EncodeJSON(w, resp)
 }
 
 type CreateShortForm struct {
-	Origin string `json:"origin"`
+	Origin string      `json:"origin"`
+	UTM    *domain.UTM `json:"utm,omitempty"`
+	Alias  string      `json:"alias,omitempty"`
+	// IDStrategy picks how the id is generated (seq, random-N, snowflake ...), the tenant's strategy by default
+	IDStrategy string `json:"id_strategy,omitempty"`
+}
+
+// pickIDGenerator writes the error response when there's no generator for the request
+func (uh *URLHandler) pickIDGenerator(w http.ResponseWriter, r *http.Request, owner string, requested string) (domain.IDGenerator, error) {
+	gen, err := uh.idGen.Pick(owner, requested)
+	if errors.Is(err, domain.ErrUnknownStrategy) {
+		util.WriteError(w, r, util.BadRequest(err.Error()))
+		return nil, err
+	}
+	if err != nil {
+		slog.Error("failed to set up id generator", "owner", owner, "id_strategy", requested, "error", err.Error())
+		util.WriteError(w, r, err)
+		return nil, err
+	}
+	return gen, nil
+}
+
+// validID reports whether id may exist: an id generated by one of the strategies or a custom alias.
+// Ids created before check digits were enabled are told apart from mistyped ones by the Bloom filter,
+// they're all looked up while it loads
+func (uh *URLHandler) validID(id string) bool {
+	if !domain.ValidID(id) {
+		return domain.LegacyID(id) && (!uh.filtering() || uh.ids.Test(id))
+	}
+	id = domain.StripCheckDigit(id)
+	return uh.idGen.ValidID(id) || domain.ValidAlias(id)
+}
+
+// DeleteShortURLHandle deletes a short URL of the owner, the entry is removed from the caches of every replica
+func (uh *URLHandler) DeleteShortURLHandle(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	owner := auth.Owner(r.Context())
+	if owner == "" {
+		util.WriteError(w, r, util.Unauthorized("an API key is required to delete a short url"))
+		return
+	}
+
+	linkOwner, err := uh.urlRepo.GetOwner(r.Context(), id)
+	if err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			slog.Error("fail to retrieve owner of short url", "url_id", id, "error", err.Error())
+		}
+		util.WriteError(w, r, err)
+		return
+	}
+	if linkOwner != owner {
+		util.WriteError(w, r, util.Forbidden("only the owner of the short url can delete it"))
+		return
+	}
+
+	if err := uh.urlRepo.Delete(r.Context(), id); err != nil && !errors.Is(err, domain.ErrNotFound) {
+		slog.Error("fail to delete short url", "url_id", id, "error", err.Error())
+		util.WriteError(w, r, err)
+		return
+	}
+
+	cacheCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := uh.cache.Delete(cacheCtx, id); err != nil {
+		slog.Error("failed to delete short url from cache", "url_id", id, "error", err.Error())
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (uh *URLHandler) RetrieveFraudURLHandle(w http.ResponseWriter, r *http.Request) {
@@ -146,79 +472,200 @@ func (uh *URLHandler) RetrieveFraudURLHandle(w http.ResponseWriter, r *http.Requ
 
 	fraud, err := uh.urlRepo.RetrieveFraud(context.Background(), id)
 	if err != nil {
-		slog.Error("fail to retrieve fraud from database", "error", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if !errors.Is(err, domain.ErrNotFound) {
+			slog.Error("fail to retrieve fraud from database", "error", err.Error())
+		}
+		util.WriteError(w, r, err)
 		return
 	}
 
 	util.EncodeJSON(w, map[string]interface{}{"fraud": fraud})
 }
 
+// GetURLView returns the number of views of the short URL, the headline count only contains human traffic.
+// Views that are not in the database yet are read from Redis, which is shared by every replica,
+// so a view is visible right after it has been recorded no matter which replica serves the request.
 func (uh *URLHandler) GetURLView(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
 	id := parts[len(parts)-1]
 
-	var (
-		count    int
-		result   string
-		err      error
-		cacheKey string = fmt.Sprintf("count:%s", id)
-	)
+	// Pending views are read before the database: if a batch is applied in between, it is
+	// counted twice for this response instead of being missed
+	pendingCtx, pCancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer pCancel()
+	pending, err := uh.viewCache.Pending(pendingCtx, id)
+	if err != nil {
+		slog.Error("fail to get pending views from cache", "url_id", id, "error", err.Error())
+	}
 
-	getCacheCtx, gCancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer gCancel()
-	result, err = uh.cache.Get(getCacheCtx, cacheKey)
+	count, err := uh.urlRepo.GetView(context.Background(), id)
 	if err != nil {
-		slog.Error("fail to get view from cache", "error", err.Error())
-	} else if result != "" {
-		count, err = strconv.Atoi(result)
-		if err != nil {
-			slog.Error("fail to parse cache query result", "error", err.Error())
-		} else {
-			util.EncodeJSON(w, map[string]interface{}{"count": count})
-			return
+		if !errors.Is(err, domain.ErrNotFound) {
+			slog.Error("fail to get view from database", "error", err.Error())
 		}
+		util.WriteError(w, r, err)
+		return
+	}
+
+	botCount, err := uh.urlRepo.GetBotView(context.Background(), id)
+	if err != nil {
+		if !errors.Is(err, domain.ErrNotFound) {
+			slog.Error("fail to get bot view from database", "error", err.Error())
+		}
+		util.WriteError(w, r, err)
+		return
+	}
+
+	count += pending.Count + uh.viewManager.counter.Get(id)
+	botCount += pending.BotCount + uh.viewManager.botCounter.Get(id)
+
+	util.EncodeJSON(w, map[string]interface{}{"count": count, "bot_count": botCount})
+}
+
+const liveHeartbeatInterval = 15 * time.Second
+
+// StreamStatsHandle streams the clicks of a short URL as Server-Sent Events.
+// Clicks are aggregated per second on every replica and fanned out through the live hub,
+// each second with clicks produces a "stats" event. A heartbeat comment keeps the connection
+// (and the proxies in between) alive. Events are dropped for clients that don't keep up,
+// the number of dropped events is reported in the next delivered one.
+func (uh *URLHandler) StreamStatsHandle(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		util.WriteError(w, r, errors.New("streaming is not supported"))
+		return
 	}
 
-	count, err = uh.urlRepo.GetView(context.Background(), id)
+	sub, err := uh.live.Subscribe(r.Context(), id)
 	if err != nil {
-		slog.Error("fail to get view from database", "error", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.Error("fail to subscribe to live stats", "url_id", id, "error", err.Error())
+		if errors.Is(err, live.ErrTooManySubscribers) {
+			util.WriteError(w, r, util.NewError(http.StatusServiceUnavailable, "unavailable", err.Error()))
+			return
+		}
+		util.WriteError(w, r, err)
+		return
 	}
+	defer sub.Close()
 
-	// setCacheCtx, sCancel := context.WithTimeout(context.Background(), 5*time.Second)
-	// defer sCancel()
-	// err = uh.cache.SetWithTTL(setCacheCtx, cacheKey)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
 
-	// Old implementation
-	count += uh.viewManager.counter.Get(id)
-	count = max(count, uh.viewManager.GetLast(id))
-	uh.viewManager.UpdateLast(id, count)
+	heartbeat := time.NewTicker(liveHeartbeatInterval)
+	defer heartbeat.Stop()
 
-	util.EncodeJSON(w, map[string]interface{}{"count": count})
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case stats := <-sub.C():
+			data, err := json.Marshal(stats)
+			if err != nil {
+				slog.Error("fail to encode live stats", "url_id", id, "error", err.Error())
+				continue
+			}
+			fmt.Fprintf(w, "event: stats\ndata: %s\n\n", data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+			sub.KeepAlive(r.Context())
+		}
+	}
+}
+
+const (
+	// ids the Bloom filter may have seen before the database is asked
+	maxFilteredIDs = 10
+	// ids tried in the database before giving up
+	maxInsertedIDs = 5
+)
+
+// freeID generates an id the Bloom filter hasn't seen. When the filter is saturated (or the ids are really
+// taken) the short URL is inserted right away, reported by inserted: only the database can tell.
+// The same goes while the filter isn't loaded or has been stopped, it can't vouch for any id then
+func (uh *URLHandler) freeID(ctx context.Context, gen domain.IDGenerator, input domain.CreateInput) (id string, inserted bool, err error) {
+	if uh.filtering() {
+		for range maxFilteredIDs {
+			if id, err = generateID(ctx, gen); err != nil {
+				return "", false, err
+			}
+			if !uh.ids.Test(id) {
+				return id, false, nil
+			}
+		}
+	}
+	id, err = uh.insertFreeID(ctx, gen, input)
+	return id, err == nil, err
+}
+
+// insertFreeID inserts the short URL with ids of gen until one is free
+func (uh *URLHandler) insertFreeID(ctx context.Context, gen domain.IDGenerator, input domain.CreateInput) (string, error) {
+	for range maxInsertedIDs {
+		id, err := generateID(ctx, gen)
+		if err != nil {
+			return "", err
+		}
+		input.ID = id
+		err = uh.urlRepo.BatchCreate(ctx, []domain.CreateInput{input})
+		if err == nil {
+			return input.ID, nil
+		}
+		if !errors.Is(err, domain.ErrConflict) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("%w: no free id after %d attempts", domain.ErrUnavailable, maxInsertedIDs)
+}
+
+// generateID gives up when gen waits for a database that is unavailable
+func generateID(ctx context.Context, gen domain.IDGenerator) (string, error) {
+	if cg, ok := gen.(domain.ContextIDGenerator); ok {
+		return cg.GenerateIDContext(ctx)
+	}
+	return gen.GenerateID(), nil
 }
 
 // BatchCreate is a background process that periodically batches and creates URL entries in the system.
 // It collects URL creation requests in a buffer, and every 5 seconds or when the buffer reaches 1000 entries,
 // it batches the requests and creates them in the URL repository. If there is an error during the batch creation,
 // it will enqueue the batch to be retried in the background.
+// An id that turns out to be taken (by a custom alias or another strategy) doesn't fail the batch, its short URL
+// is lost: it is reported and dropped from the cache so that the id resolves to the short URL that holds it.
 func (uh *URLHandler) BatchCreate() {
 	start := time.Now()
 	for {
 		uh.mu.Lock()
 		if len(uh.inputs) >= 1000 || (time.Since(start) >= 5*time.Second && len(uh.inputs) > 0) {
-			if err := uh.urlRepo.BatchCreate(context.Background(), uh.inputs); err != nil {
+			taken, err := uh.urlRepo.BatchCreateSkipTaken(context.Background(), uh.inputs)
+			if len(taken) > 0 {
+				uh.dropTaken(uh.inputs, taken)
+			}
+			if err != nil {
 				slog.Error("failed to perform batch create", "error", err.Error())
 				// enqueue to background process to retry batch create again
 				ids := make([]string, len(uh.inputs))
 				originURLs := make([]string, len(uh.inputs))
+				owners := make([]string, len(uh.inputs))
+				campaigns := make([]string, len(uh.inputs))
 				for i := range len(uh.inputs) {
 					ids[i] = uh.inputs[i].ID
 					originURLs[i] = uh.inputs[i].URL
+					owners[i] = uh.inputs[i].Owner
+					campaigns[i] = uh.inputs[i].Campaign
 				}
 				if _, err = uh.riverClient.Insert(context.Background(), background.BatchCreateArgs{
 					IDs:        ids,
 					OriginURLs: originURLs,
+					Owners:     owners,
+					Campaigns:  campaigns,
 				}, nil); err != nil {
 					slog.Error("failed to enqueue retry batch create task", "error", err.Error())
 				}
@@ -230,54 +677,198 @@ func (uh *URLHandler) BatchCreate() {
 	}
 }
 
-// BatchUpdateView is a background process that periodically updates the view count for URLs in the system.
-// It retrieves the current view counts from an in-memory counter, resets the counter, and then inserts the view counts
-// into a separate system for further processing.
+// dropTaken reports the short URLs of inputs whose id was taken and removes them from the cache
+func (uh *URLHandler) dropTaken(inputs []domain.CreateInput, taken []string) {
+	origins := make(map[string]string, len(inputs))
+	for _, input := range inputs {
+		origins[input.ID] = input.URL
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, id := range taken {
+		slog.Error("generated id was taken, the short url is lost", "id", id, "origin", origins[id])
+		if err := uh.cache.Delete(ctx, id); err != nil {
+			slog.Error("failed to delete k-v from cache", "id", id, "error", err.Error())
+		}
+	}
+}
+
+const (
+	flushBatchSize  = 1000
+	staleBatchAfter = 2 * time.Minute
+)
+
+const (
+	maxBufferedClicks = 100_000
+	maxHeaderLength   = 512
+)
+
+// bufferClick keeps the click in memory until the next BatchRecordClicks.
+// Raw clicks are best-effort analytics data (view counts don't depend on them),
+// when the database can't keep up, clicks above maxBufferedClicks are dropped.
+func (uh *URLHandler) bufferClick(click domain.Click) {
+	uh.clickMu.Lock()
+	defer uh.clickMu.Unlock()
+	if len(uh.clicks) >= maxBufferedClicks {
+		return
+	}
+	uh.clicks = append(uh.clicks, click)
+}
+
+// BatchRecordClicks is a background process that stores the buffered clicks every 5 seconds
+func (uh *URLHandler) BatchRecordClicks() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		uh.clickMu.Lock()
+		clicks := uh.clicks
+		uh.clicks = make([]domain.Click, 0, len(clicks))
+		uh.clickMu.Unlock()
+
+		if len(clicks) == 0 {
+			continue
+		}
+		if len(clicks) == maxBufferedClicks {
+			slog.Warn("click buffer was full, some clicks have been dropped", "buffered", len(clicks))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := uh.clickRepo.BatchRecord(ctx, clicks); err != nil {
+			slog.Error("failed to record clicks", "clicks", len(clicks), "error", err.Error())
+		}
+		cancel()
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// BatchUpdateView is a background process that periodically flushes pending views to the database.
+// Pending views of every dirty URL are claimed into an in-flight batch identified by a unique token,
+// and each batch is handed to the background workers which apply it exactly once and acknowledge it.
+// A batch that could not be handed over stays in-flight and is sent again with the same token once it is stale.
+// Views kept in memory while Redis was unavailable are flushed without token (at-least-once).
 // This function runs in a separate goroutine and is triggered by a 20-second ticker.
 func (uh *URLHandler) BatchUpdateView() {
 	ticker := time.NewTicker(20 * time.Second)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		data := uh.viewManager.counter.Snapshot()
+		uh.flushPendingViews(context.Background())
+		uh.flushLocalViews(context.Background())
+	}
+}
+
+func (uh *URLHandler) flushPendingViews(ctx context.Context) {
+	// ids that still have views to flush after this round, they are marked dirty again at the end
+	// so that they are not popped twice in the same round
+	var retry []string
+	defer func() {
+		if err := uh.viewCache.MarkDirty(ctx, retry...); err != nil {
+			slog.Error("failed to mark urls with pending views as dirty", "error", err.Error())
+		}
+	}()
+
+	for {
+		ids, err := uh.viewCache.PopDirty(ctx, flushBatchSize)
+		if err != nil {
+			slog.Error("failed to retrieve urls with pending views", "error", err.Error())
+			return
+		}
 
-		for id, cnt := range data {
-			if _, err := uh.riverClient.Insert(context.Background(), background.IncreaseCountArgs{
-				ID:    id,
-				Count: cnt,
+		for _, id := range ids {
+			batch, status, err := uh.viewCache.Claim(ctx, id, newFlushToken(), staleBatchAfter)
+			if err != nil {
+				slog.Error("failed to claim pending views", "url_id", id, "error", err.Error())
+				retry = append(retry, id)
+				continue
+			}
+
+			switch status {
+			case cache.ClaimEmpty:
+				continue
+			case cache.ClaimBusy:
+				retry = append(retry, id)
+				continue
+			case cache.ClaimResend:
+				// views recorded after the stale batch are still pending
+				retry = append(retry, id)
+			}
+
+			if _, err := uh.riverClient.Insert(ctx, background.IncreaseCountArgs{
+				ID:       id,
+				Count:    batch.Delta.Count,
+				BotCount: batch.Delta.BotCount,
+				Token:    batch.Token,
 			}, nil); err != nil {
-				slog.Error("failed to enqueue increase view URL job", "error", err.Error())
+				slog.Error("failed to enqueue increase view URL job", "url_id", id, "error", err.Error())
+				retry = append(retry, id)
+				continue
+			}
+			if !cache.IsShared(uh.viewCache) {
+				// the worker can't reach an in-memory view cache, the job is durable and applied
+				// at most once thanks to its token, so the batch is done as far as we are concerned
+				if err := uh.viewCache.Ack(ctx, id, batch.Token); err != nil {
+					slog.Error("failed to acknowledge enqueued views", "url_id", id, "error", err.Error())
+				}
 			}
 		}
 
-		uh.viewManager.counter.Reset()
+		if len(ids) < flushBatchSize {
+			return
+		}
 	}
 }
 
-type ViewManager struct {
-	mu       sync.Mutex
-	counter  *Counter
-	lastView map[string]int
-}
+// flushLocalViews hands the views counted in memory over to the background workers,
+// the views that can't be enqueued are counted again
+func (uh *URLHandler) flushLocalViews(ctx context.Context) {
+	data := uh.viewManager.counter.Swap()
+	botData := uh.viewManager.botCounter.Swap()
 
-func NewViewManager() *ViewManager {
-	return &ViewManager{
-		mu:       sync.Mutex{},
-		counter:  NewCounter(),
-		lastView: make(map[string]int),
+	jobs := make(map[string]*background.IncreaseCountArgs, len(data))
+	for id, cnt := range data {
+		jobs[id] = &background.IncreaseCountArgs{ID: id, Count: cnt}
+	}
+	for id, cnt := range botData {
+		if job, ok := jobs[id]; ok {
+			job.BotCount = cnt
+			continue
+		}
+		jobs[id] = &background.IncreaseCountArgs{ID: id, BotCount: cnt}
+	}
+
+	for id, job := range jobs {
+		if _, err := uh.riverClient.Insert(ctx, *job, nil); err != nil {
+			slog.Error("failed to enqueue increase view URL job", "url_id", id, "error", err.Error())
+			// keep the views for the next flush
+			uh.viewManager.counter.Add(id, job.Count)
+			uh.viewManager.botCounter.Add(id, job.BotCount)
+		}
 	}
 }
 
-func (vm *ViewManager) GetLast(id string) int {
-	vm.mu.Lock()
-	defer vm.mu.Unlock()
-	return vm.lastView[id]
+func newFlushToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-func (vm *ViewManager) UpdateLast(id string, val int) {
-	vm.mu.Lock()
-	defer vm.mu.Unlock()
-	vm.lastView[id] = val
+type ViewManager struct {
+	counter    *Counter
+	botCounter *Counter
+}
+
+func NewViewManager() *ViewManager {
+	return &ViewManager{
+		counter:    NewCounter(),
+		botCounter: NewCounter(),
+	}
 }
 
 // Counter is a thread-safe counter that keeps track of the count for a set of keys.
@@ -299,6 +890,15 @@ func (c *Counter) Increase(key string) {
 	c.cnt[key]++
 }
 
+func (c *Counter) Add(key string, n int) {
+	if n == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cnt[key] += n
+}
+
 func (c *Counter) Get(key string) int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -311,7 +911,7 @@ func (c *Counter) Size() int {
 	return len(c.cnt)
 }
 
-// Snapshot retrieves a copy of the current counter data and resets it
+// Snapshot retrieves a copy of the current counter data
 func (c *Counter) Snapshot() map[string]int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -325,8 +925,13 @@ func (c *Counter) Snapshot() map[string]int {
 	return snapshot
 }
 
-func (c *Counter) Reset() {
+// Swap returns the current counter data and replaces it with an empty one in a single step,
+// so no increment can happen between reading and resetting the counter
+func (c *Counter) Swap() map[string]int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+
+	data := c.cnt
 	c.cnt = make(map[string]int)
+	return data
 }
@@ -0,0 +1,194 @@
+package idgen
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Ranges of ids are leased from the id_leases table, a range is never handed out twice:
+//   - fresh ranges are cut from a single high-water mark (id_lease_mark) that only moves forward
+//   - inside a range, the holder reserves ids step by step (hi/lo): before handing out an id it makes sure
+//     reserved_upto covers it, so a crash loses at most one step and never reissues an id
+//   - a holder keeps its leases alive by renewing them, the unreserved tail of an expired lease
+//     is taken over by another holder, starting after reserved_upto
+//   - every write is conditioned on the holder, a holder that lost its lease finds out on its next write
+
+var ErrLeaseLost = errors.New("id lease lost to another holder")
+
+// Lease is a range [Start, End] of ids, the ids up to Reserved may be handed out by its holder
+type Lease struct {
+	Start    uint64
+	End      uint64
+	Reserved uint64
+}
+
+type LeaseStore struct {
+	db        *sqlx.DB
+	holder    string
+	rangeSize uint64
+	step      uint64
+	ttl       time.Duration
+}
+
+// NewLeaseStore manages the leases of holder, which must be unique among the running generators
+func NewLeaseStore(db *sqlx.DB, holder string, rangeSize, step uint64, ttl time.Duration) *LeaseStore {
+	return &LeaseStore{
+		db:        db,
+		holder:    holder,
+		rangeSize: rangeSize,
+		step:      min(step, rangeSize),
+		ttl:       ttl,
+	}
+}
+
+// DefaultHolder identifies this process: host, pid and a random suffix in case pids are reused (containers)
+func DefaultHolder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d:%08x", host, os.Getpid(), rand.Uint32())
+}
+
+func (ls *LeaseStore) Holder() string {
+	return ls.holder
+}
+
+var (
+	takeOverLeaseQuery = `
+		WITH expired AS (
+			SELECT range_start, reserved_upto FROM id_leases
+			WHERE expires_at < now() AND reserved_upto < range_end
+			ORDER BY range_start
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE id_leases l
+		SET holder = $1, expires_at = now() + make_interval(secs => $2),
+			reserved_upto = LEAST(e.reserved_upto + $3, l.range_end)
+		FROM expired e
+		WHERE l.range_start = e.range_start
+		RETURNING l.range_start, l.range_end, e.reserved_upto, l.reserved_upto;
+	`
+	advanceMarkQuery = `
+		UPDATE id_lease_mark SET next_start = next_start + $1 RETURNING next_start - $1;
+	`
+	insertLeaseQuery = `
+		INSERT INTO id_leases (range_start, range_end, reserved_upto, holder, expires_at)
+		VALUES ($1, $2, $3, $4, now() + make_interval(secs => $5));
+	`
+	removeUsedLeasesQuery = `
+		DELETE FROM id_leases WHERE expires_at < now() AND reserved_upto >= range_end;
+	`
+)
+
+// Claim leases a range: the tail of an expired lease if there's one, a fresh range otherwise.
+// It returns the first id that can be handed out along with the lease
+func (ls *LeaseStore) Claim(ctx context.Context) (Lease, uint64, error) {
+	if _, err := ls.db.ExecContext(ctx, removeUsedLeasesQuery); err != nil {
+		return Lease{}, 0, err
+	}
+
+	var (
+		lease        Lease
+		prevReserved uint64
+	)
+	err := ls.db.QueryRowContext(ctx, takeOverLeaseQuery, ls.holder, ls.ttl.Seconds(), ls.step).
+		Scan(&lease.Start, &lease.End, &prevReserved, &lease.Reserved)
+	if err == nil {
+		return lease, prevReserved + 1, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Lease{}, 0, err
+	}
+
+	// The mark and the lease are written in the same transaction: a fresh range is either leased or not cut at all
+	tx, err := ls.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Lease{}, 0, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.GetContext(ctx, &lease.Start, advanceMarkQuery, ls.rangeSize); err != nil {
+		return Lease{}, 0, err
+	}
+	lease.End = lease.Start + ls.rangeSize - 1
+	lease.Reserved = lease.Start + ls.step - 1
+	if _, err := tx.ExecContext(ctx, insertLeaseQuery, lease.Start, lease.End, lease.Reserved, ls.holder, ls.ttl.Seconds()); err != nil {
+		return Lease{}, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Lease{}, 0, err
+	}
+	return lease, lease.Start, nil
+}
+
+var (
+	extendLeaseQuery = `
+		UPDATE id_leases
+		SET reserved_upto = LEAST(reserved_upto + $1, range_end), expires_at = now() + make_interval(secs => $2)
+		WHERE range_start = $3 AND holder = $4 AND reserved_upto = $5
+		RETURNING reserved_upto;
+	`
+)
+
+// Extend reserves the next step of lease, it fails with ErrLeaseLost when someone else took the lease over
+func (ls *LeaseStore) Extend(ctx context.Context, lease *Lease) error {
+	var reserved uint64
+	err := ls.db.GetContext(ctx, &reserved, extendLeaseQuery, ls.step, ls.ttl.Seconds(), lease.Start, ls.holder, lease.Reserved)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrLeaseLost
+	}
+	if err != nil {
+		return err
+	}
+	lease.Reserved = reserved
+	return nil
+}
+
+var (
+	renewLeasesQuery = `
+		UPDATE id_leases SET expires_at = now() + make_interval(secs => $1) WHERE holder = $2;
+	`
+	releaseLeaseQuery = `
+		UPDATE id_leases SET reserved_upto = $1, expires_at = now()
+		WHERE range_start = $2 AND holder = $3 AND reserved_upto >= $1;
+	`
+)
+
+// Renew pushes back the expiry of every lease of the holder, it must run well within the ttl
+func (ls *LeaseStore) Renew(ctx context.Context) error {
+	_, err := ls.db.ExecContext(ctx, renewLeasesQuery, ls.ttl.Seconds(), ls.holder)
+	return err
+}
+
+// Release gives lease back, next is the first id that hasn't been handed out: the rest of the range
+// can be taken over right away instead of waiting for the lease to expire
+func (ls *LeaseStore) Release(ctx context.Context, lease Lease, next uint64) error {
+	_, err := ls.db.ExecContext(ctx, releaseLeaseQuery, next-1, lease.Start, ls.holder)
+	return err
+}
+
+// Run renews the leases until ctx is done
+func (ls *LeaseStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(ls.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ls.Renew(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("failed to renew id leases", "holder", ls.holder, "error", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package idgen
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Many replicas starting together against the same database must never hand out the same id
+func TestLeasedGeneratorsNeverShareIDs(t *testing.T) {
+	var (
+		db                 = prepareDB()
+		numberOfGenerators = 8
+		numberOfWorkers    = 16
+		numberOfYieldIDs   = 500
+		used               = sync.Map{}
+		wg                 = sync.WaitGroup{}
+		start              = make(chan struct{})
+		generators         = make([]*SeqIDGenerator, numberOfGenerators)
+	)
+	for g := range generators {
+		// small ranges and steps, so that ranges run out and get extended during the test
+		leases := NewLeaseStore(db, fmt.Sprintf("test-%s-%d", t.Name(), g), 2000, 50, time.Minute)
+		generators[g] = NewSeqIDGenerator(leases, 4)
+	}
+
+	for g, sg := range generators {
+		for w := range numberOfWorkers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				for range numberOfYieldIDs {
+					id := sg.GenerateID()
+					if owner, appear := used.LoadOrStore(id, fmt.Sprintf("%d/%d", g, w)); appear {
+						t.Errorf("id %s handed out by generator/worker %v and %d/%d", id, owner, g, w)
+					}
+				}
+			}()
+		}
+	}
+	close(start)
+	wg.Wait()
+
+	for _, sg := range generators {
+		assert.NoError(t, sg.Release(context.Background()))
+	}
+}
+
+// A holder that crashed never released its lease: another one takes the rest of the range over after expiry
+func TestExpiredLeaseIsTakenOver(t *testing.T) {
+	ctx := context.Background()
+	db := prepareDB()
+	crashed := NewLeaseStore(db, "test-crashed-"+DefaultHolder(), 1000, 100, 50*time.Millisecond)
+	lease, next, err := crashed.Claim(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, lease.Start, next)
+	require.NoError(t, crashed.Extend(ctx, &lease))
+	assert.Equal(t, lease.Start+199, lease.Reserved)
+
+	time.Sleep(100 * time.Millisecond)
+	survivor := NewLeaseStore(db, "test-survivor-"+DefaultHolder(), 1000, 100, time.Minute)
+	// other expired leases may be left over by earlier runs, look for ours
+	for {
+		taken, next, err := survivor.Claim(ctx)
+		require.NoError(t, err)
+		if taken.Start == lease.Start {
+			assert.Equal(t, lease.Reserved+1, next, "ids reserved by the crashed holder must not be reissued")
+			break
+		}
+		require.Less(t, taken.Start, lease.Start, "the range of the crashed holder was skipped")
+		require.NoError(t, survivor.Release(ctx, taken, taken.End+1))
+	}
+
+	// the crashed holder comes back: its lease is gone
+	assert.ErrorIs(t, crashed.Extend(ctx, &lease), ErrLeaseLost)
+}
+
+func TestReleasedLeaseIsReused(t *testing.T) {
+	ctx := context.Background()
+	db := prepareDB()
+	first := NewLeaseStore(db, "test-first-"+DefaultHolder(), 1000, 100, time.Minute)
+	lease, next, err := first.Claim(ctx)
+	require.NoError(t, err)
+	require.NoError(t, first.Release(ctx, lease, next+10))
+
+	second := NewLeaseStore(db, "test-second-"+DefaultHolder(), 1000, 100, time.Minute)
+	for {
+		taken, next2, err := second.Claim(ctx)
+		require.NoError(t, err)
+		if taken.Start == lease.Start {
+			assert.Equal(t, next+10, next2)
+			break
+		}
+		require.Less(t, taken.Start, lease.Start)
+		require.NoError(t, second.Release(ctx, taken, taken.End+1))
+	}
+}
+
+func TestNodeLeasesAreExclusive(t *testing.T) {
+	ctx := context.Background()
+	db := prepareDB()
+	nodes := make(map[int]bool)
+	for i := range 4 {
+		leaser := NewNodeLeaser(db, fmt.Sprintf("test-node-%d-%s", i, DefaultHolder()), time.Minute)
+		sg, err := leaser.Acquire(ctx, SnowflakeEpoch)
+		require.NoError(t, err)
+		assert.False(t, nodes[sg.Node()], "node %d leased twice", sg.Node())
+		nodes[sg.Node()] = true
+		defer leaser.Release(ctx, sg)
+	}
+}
+
+// A node id taken over after expiry resumes a whole ttl after the last recorded timestamp
+func TestExpiredNodeLeaseResumesAfterTTL(t *testing.T) {
+	ctx := context.Background()
+	db := prepareDB()
+	ttl := 100 * time.Millisecond
+	crashed := NewNodeLeaser(db, "test-node-crashed-"+DefaultHolder(), ttl)
+	old, err := crashed.Acquire(ctx, SnowflakeEpoch)
+	require.NoError(t, err)
+	old.GenerateID()
+	require.NoError(t, crashed.Renew(ctx, old))
+
+	time.Sleep(2 * ttl)
+	survivor := NewNodeLeaser(db, "test-node-survivor-"+DefaultHolder(), time.Minute)
+	for {
+		sg, err := survivor.Acquire(ctx, SnowflakeEpoch)
+		require.NoError(t, err)
+		if sg.Node() == old.Node() {
+			assert.GreaterOrEqual(t, sg.Last(), old.Last()+ttl.Milliseconds())
+			require.NoError(t, survivor.Release(ctx, sg))
+			break
+		}
+		// leave the other expired node ids leased for a minute so that ours comes up
+		defer survivor.Release(ctx, sg)
+	}
+	assert.ErrorIs(t, crashed.Renew(ctx, old), ErrLeaseLost)
+}
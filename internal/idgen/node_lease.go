@@ -0,0 +1,147 @@
+package idgen
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Snowflake node ids can be set by hand or leased from the node_leases table, which records the last
+// timestamp used with each node id. A holder that takes over an expired node id resumes a whole ttl
+// after that timestamp: the previous holder may have kept minting ids until its lease ran out, and
+// its clock may have been ahead of ours.
+
+var ErrNoFreeNode = errors.New("every snowflake node id is leased")
+
+type NodeLeaser struct {
+	db     *sqlx.DB
+	holder string
+	ttl    time.Duration
+}
+
+func NewNodeLeaser(db *sqlx.DB, holder string, ttl time.Duration) *NodeLeaser {
+	return &NodeLeaser{
+		db:     db,
+		holder: holder,
+		ttl:    ttl,
+	}
+}
+
+var (
+	takeOverNodeQuery = `
+		WITH expired AS (
+			SELECT node_id, released FROM node_leases
+			WHERE expires_at < now()
+			ORDER BY node_id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE node_leases n
+		SET holder = $1, expires_at = now() + make_interval(secs => $2), released = false
+		FROM expired e
+		WHERE n.node_id = e.node_id
+		RETURNING n.node_id, n.last_ms, e.released;
+	`
+	insertNodeQuery = `
+		INSERT INTO node_leases (node_id, holder, expires_at, last_ms)
+		SELECT n, $1, now() + make_interval(secs => $2), 0 FROM generate_series(0, $3::int) n
+		WHERE NOT EXISTS (SELECT 1 FROM node_leases WHERE node_id = n)
+		ORDER BY n
+		LIMIT 1
+		ON CONFLICT (node_id) DO NOTHING
+		RETURNING node_id;
+	`
+)
+
+// Acquire leases a node id and returns a generator for it, the lease must then be kept alive with Run
+func (nl *NodeLeaser) Acquire(ctx context.Context, epoch time.Time) (*SnowflakeGenerator, error) {
+	for range 10 {
+		start := time.Now()
+		var (
+			node     int
+			last     int64
+			released bool
+		)
+		err := nl.db.QueryRowContext(ctx, takeOverNodeQuery, nl.holder, nl.ttl.Seconds()).Scan(&node, &last, &released)
+		if errors.Is(err, sql.ErrNoRows) {
+			// nothing to take over, lease a node id that was never used
+			last, released = 0, true
+			err = nl.db.GetContext(ctx, &node, insertNodeQuery, nl.holder, nl.ttl.Seconds(), MaxSnowflakeNode)
+			if errors.Is(err, sql.ErrNoRows) {
+				// another holder inserted the same node id first, or there is none left
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sg, err := NewSnowflakeGenerator(node, epoch)
+		if err != nil {
+			return nil, err
+		}
+		if !released {
+			last += nl.ttl.Milliseconds()
+		}
+		sg.Resume(last)
+		sg.SetValidUntil(start.Add(nl.ttl))
+		return sg, nil
+	}
+	return nil, ErrNoFreeNode
+}
+
+var (
+	renewNodeQuery = `
+		UPDATE node_leases SET expires_at = now() + make_interval(secs => $1), last_ms = GREATEST(last_ms, $2)
+		WHERE node_id = $3 AND holder = $4;
+	`
+	releaseNodeQuery = `
+		UPDATE node_leases SET expires_at = now(), last_ms = GREATEST(last_ms, $1), released = true
+		WHERE node_id = $2 AND holder = $3;
+	`
+)
+
+// Renew extends the lease of the node id of sg and records its last timestamp
+func (nl *NodeLeaser) Renew(ctx context.Context, sg *SnowflakeGenerator) error {
+	// the lease is counted from before the query, the database starts it a little later
+	start := time.Now()
+	res, err := nl.db.ExecContext(ctx, renewNodeQuery, nl.ttl.Seconds(), sg.Last(), sg.Node(), nl.holder)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrLeaseLost
+	}
+	sg.SetValidUntil(start.Add(nl.ttl))
+	return nil
+}
+
+// Release gives the node id back, sg must not be used afterwards
+func (nl *NodeLeaser) Release(ctx context.Context, sg *SnowflakeGenerator) error {
+	sg.SetValidUntil(time.Now())
+	_, err := nl.db.ExecContext(ctx, releaseNodeQuery, sg.Last(), sg.Node(), nl.holder)
+	return err
+}
+
+// Run renews the lease of sg until ctx is done. While the database is down ids are still minted
+// until the lease runs out
+func (nl *NodeLeaser) Run(ctx context.Context, sg *SnowflakeGenerator) {
+	ticker := time.NewTicker(nl.ttl / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := nl.Renew(ctx, sg); err != nil && ctx.Err() == nil {
+				slog.Error("failed to renew snowflake node lease", "node", sg.Node(), "holder", nl.holder, "error", err.Error())
+			}
+		}
+	}
+}
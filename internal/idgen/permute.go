@@ -0,0 +1,84 @@
+package idgen
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Sequential ids are easy to enumerate (abc => abd => abe ...), a keyed permutation scrambles the counter
+// before it is encoded: the ids look random but every counter still maps to a different id, and whoever
+// holds the key can turn an id back into its counter
+
+const feistelRounds = 8
+
+var ErrInvalidWidth = errors.New("permutation width must be an even number between 2 and 64")
+
+// FeistelPermutation is a balanced Feistel network over the low `width` bits of a number.
+// The bits above width are left untouched, so it is a bijection over every uint64: numbers
+// below 1<<width stay below it, counters that outgrow the width never collide either
+type FeistelPermutation struct {
+	width     uint
+	half      uint
+	halfMask  uint64
+	roundKeys [feistelRounds]uint64
+}
+
+func NewFeistelPermutation(key []byte, width uint) (*FeistelPermutation, error) {
+	if width < 2 || width > 64 || width%2 != 0 {
+		return nil, ErrInvalidWidth
+	}
+	fp := &FeistelPermutation{
+		width:    width,
+		half:     width / 2,
+		halfMask: 1<<(width/2) - 1,
+	}
+	// every round gets its own key, derived from the secret
+	for i := range fp.roundKeys {
+		sum := sha256.Sum256(append([]byte{byte(i)}, key...))
+		fp.roundKeys[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return fp, nil
+}
+
+// Width is the number of low bits that get scrambled
+func (fp *FeistelPermutation) Width() uint {
+	return fp.width
+}
+
+func (fp *FeistelPermutation) Permute(x uint64) uint64 {
+	high, left, right := fp.split(x)
+	for i := range feistelRounds {
+		left, right = right, left^fp.round(i, right)
+	}
+	return fp.join(high, left, right)
+}
+
+// Invert undoes Permute: Invert(Permute(x)) == x for every x
+func (fp *FeistelPermutation) Invert(y uint64) uint64 {
+	high, left, right := fp.split(y)
+	for i := feistelRounds - 1; i >= 0; i-- {
+		left, right = right^fp.round(i, left), left
+	}
+	return fp.join(high, left, right)
+}
+
+func (fp *FeistelPermutation) split(x uint64) (high, left, right uint64) {
+	if fp.width < 64 {
+		high = x >> fp.width << fp.width
+	}
+	return high, x >> fp.half & fp.halfMask, x & fp.halfMask
+}
+
+func (fp *FeistelPermutation) join(high, left, right uint64) uint64 {
+	return high | left<<fp.half | right
+}
+
+// The round function doesn't need to be invertible, it only has to mix well (splitmix64 finalizer)
+func (fp *FeistelPermutation) round(i int, x uint64) uint64 {
+	z := x ^ fp.roundKeys[i]
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return z & fp.halfMask
+}
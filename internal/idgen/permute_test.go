@@ -0,0 +1,78 @@
+package idgen
+
+import (
+	"math/rand/v2"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeistelPermutationInvalidWidth(t *testing.T) {
+	for _, width := range []uint{0, 1, 7, 66} {
+		_, err := NewFeistelPermutation([]byte("secret"), width)
+		assert.ErrorIs(t, err, ErrInvalidWidth, "width %d", width)
+	}
+}
+
+// With a small width the whole domain can be checked: every output shows up exactly once
+func TestFeistelPermutationIsBijection(t *testing.T) {
+	for _, width := range []uint{2, 8, 16} {
+		fp, err := NewFeistelPermutation([]byte("secret"), width)
+		require.NoError(t, err)
+
+		size := uint64(1) << width
+		seen := make([]bool, size)
+		for x := range size {
+			y := fp.Permute(x)
+			require.Less(t, y, size, "width %d: %d left the domain", width, x)
+			require.False(t, seen[y], "width %d: %d collides", width, x)
+			seen[y] = true
+			require.Equal(t, x, fp.Invert(y))
+		}
+	}
+}
+
+func TestFeistelPermutationRoundTrip(t *testing.T) {
+	for _, width := range []uint{36, 64} {
+		fp, err := NewFeistelPermutation([]byte("secret"), width)
+		require.NoError(t, err)
+
+		roundTrip := func(x uint64) bool {
+			return fp.Invert(fp.Permute(x)) == x && fp.Permute(fp.Invert(x)) == x
+		}
+		assert.NoError(t, quick.Check(roundTrip, &quick.Config{MaxCount: 10_000}), "width %d", width)
+	}
+}
+
+func TestFeistelPermutationKeepsHighBits(t *testing.T) {
+	fp, err := NewFeistelPermutation([]byte("secret"), 20)
+	require.NoError(t, err)
+
+	keepsHighBits := func(x uint64) bool {
+		return fp.Permute(x)>>20 == x>>20
+	}
+	assert.NoError(t, quick.Check(keepsHighBits, nil))
+}
+
+func TestFeistelPermutationScramblesCounters(t *testing.T) {
+	fp, err := NewFeistelPermutation([]byte("secret"), 36)
+	require.NoError(t, err)
+	other, err := NewFeistelPermutation([]byte("another secret"), 36)
+	require.NoError(t, err)
+
+	// consecutive counters shouldn't give consecutive ids, and the key should matter
+	var sequential, sameAsOther int
+	start := rand.Uint64N(1 << 30)
+	for x := start; x < start+1000; x++ {
+		if fp.Permute(x+1) == fp.Permute(x)+1 {
+			sequential++
+		}
+		if fp.Permute(x) == other.Permute(x) {
+			sameAsOther++
+		}
+	}
+	assert.Less(t, sequential, 5)
+	assert.Less(t, sameAsOther, 5)
+}
@@ -1,34 +1,216 @@
 package idgen
 
 import (
-	"time"
+	"context"
+	"crypto/rand"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"sync"
 
-	"math/rand"
+	"github.com/armistcxy/shorten/internal/denylist"
+	"github.com/armistcxy/shorten/internal/domain"
 )
 
-// Implement IDGenerator interface with totally random method
+// Implement IDGenerator interface with totally random method.
+// Random ids can collide with ids that are already used, so they are checked on insert (GenerateUniqueID):
+// on conflict another id is tried, and the ids get longer as the keyspace fills up.
+//
+// The share of the keyspace that is used is estimated from the collisions: a random id collides with
+// probability used/keyspace, so the collision rate over the last attempts is the utilisation.
 type RandomIDGenerator struct {
+	mu          sync.Mutex
+	length      int
+	maxLength   int
+	utilisation float64 // moving average of collisions per attempt at the current length
+	attempts    uint64
+	collisions  uint64
+	exhausted   uint64 // ids given up after maxAttempts
+	prefix      string
+	denied      *denylist.List
 }
 
-func NewRandomIDGenerator() *RandomIDGenerator {
-	return &RandomIDGenerator{}
+const (
+	idLen   int    = 6
+	charset string = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	// every attempt weighs 1/1000 in the utilisation
+	utilisationWeight = 0.001
+	// the ids get one character longer when 1 in 10 attempts collides
+	growUtilisation = 0.1
+	// collisions of one id before the ids get longer anyway, quicker than the utilisation when the keyspace
+	// is found full (1 in 3 million ids at 5% utilisation)
+	collisionsBeforeGrowing = 5
+	// attempts of one id before giving up
+	maxAttempts = 10
+)
+
+var ErrIDSpaceExhausted = errors.New("no free random id found")
+
+// NewRandomIDGenerator generates ids of length characters (idLen when length is 0), up to MaxIDLength - 1
+// (a check digit may be appended)
+func NewRandomIDGenerator(length int) *RandomIDGenerator {
+	if length <= 0 {
+		length = idLen
+	}
+	return &RandomIDGenerator{
+		length:    length,
+		maxLength: domain.MaxIDLength - 1,
+	}
+}
+
+// WithDenylist makes the generator skip the ids that denied blocks
+func (rg *RandomIDGenerator) WithDenylist(denied *denylist.List) *RandomIDGenerator {
+	rg.denied = denied
+	return rg
 }
 
+// WithPrefix starts the ids with prefix, it takes room from the random characters.
+// Must be called before the generator is used
+func (rg *RandomIDGenerator) WithPrefix(prefix string) *RandomIDGenerator {
+	rg.prefix = prefix
+	rg.maxLength = domain.MaxIDLength - 1 - len(prefix)
+	rg.length = min(rg.length, rg.maxLength)
+	return rg
+}
+
+// GenerateID returns a random id, nothing checks that it's free
 func (rg *RandomIDGenerator) GenerateID() string {
-	return randomString(idLen)
+	return rg.randomID(rg.Length())
 }
 
-const (
-	idLen   int    = 6
-	charset string = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-)
+func (rg *RandomIDGenerator) randomID(length int) string {
+	for {
+		if id := domain.WithCheckDigit(rg.prefix + randomString(length)); !rg.denied.Blocked(id) {
+			return id
+		}
+	}
+}
+
+// GenerateUniqueID tries random ids until insert accepts one: insert must fail with domain.ErrConflict
+// when the id is used, other errors stop the attempts
+func (rg *RandomIDGenerator) GenerateUniqueID(ctx context.Context, insert func(ctx context.Context, id string) error) (string, error) {
+	collisions := 0
+	for range maxAttempts {
+		length := rg.Length()
+		id := rg.randomID(length)
+		err := insert(ctx, id)
+		rg.record(length, errors.Is(err, domain.ErrConflict))
+		if err == nil {
+			return id, nil
+		}
+		if !errors.Is(err, domain.ErrConflict) {
+			return "", err
+		}
+
+		collisions++
+		if collisions%collisionsBeforeGrowing == 0 {
+			rg.grow(length)
+		}
+	}
+
+	rg.mu.Lock()
+	rg.exhausted++
+	rg.mu.Unlock()
+	return "", fmt.Errorf("%w after %d attempts", ErrIDSpaceExhausted, maxAttempts)
+}
+
+// Length is the number of random characters of the ids
+func (rg *RandomIDGenerator) Length() int {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	return rg.length
+}
+
+func (rg *RandomIDGenerator) record(length int, collided bool) {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	rg.attempts++
+	if collided {
+		rg.collisions++
+	}
+	// attempts made before the last growth say nothing about the new keyspace
+	if length != rg.length {
+		return
+	}
+	sample := 0.0
+	if collided {
+		sample = 1
+	}
+	rg.utilisation += utilisationWeight * (sample - rg.utilisation)
+	if rg.utilisation >= growUtilisation {
+		rg.growLocked(length)
+	}
+}
+
+func (rg *RandomIDGenerator) grow(from int) {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	rg.growLocked(from)
+}
+
+// growLocked makes the ids one character longer, unless another attempt already did since from was read
+func (rg *RandomIDGenerator) growLocked(from int) {
+	if rg.length != from || rg.length >= rg.maxLength {
+		return
+	}
+	rg.length++
+	// one more character makes the keyspace 62 times bigger
+	rg.utilisation /= float64(len(charset))
+}
+
+type RandomIDStats struct {
+	Length      int     `json:"length"`
+	Keyspace    float64 `json:"keyspace"`
+	Utilisation float64 `json:"utilisation"`
+	Attempts    uint64  `json:"attempts"`
+	Collisions  uint64  `json:"collisions"`
+	Exhausted   uint64  `json:"exhausted"`
+}
+
+// Stats reports the current length and the estimated utilisation of its keyspace
+func (rg *RandomIDGenerator) Stats() RandomIDStats {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	return RandomIDStats{
+		Length:      rg.length,
+		Keyspace:    math.Pow(float64(len(charset)), float64(rg.length)),
+		Utilisation: rg.utilisation,
+		Attempts:    rg.attempts,
+		Collisions:  rg.collisions,
+		Exhausted:   rg.exhausted,
+	}
+}
+
+// Var exposes the stats in expvar
+func (rg *RandomIDGenerator) Var() expvar.Var {
+	return expvar.Func(func() any {
+		return rg.Stats()
+	})
+}
 
+// randomString draws from crypto/rand, bytes above the largest multiple of 62 are dropped so that
+// every character is equally likely
 func randomString(length int) string {
-	seed := rand.NewSource(time.Now().UnixNano())
-	r := rand.New(seed)
+	const limit = 256 - 256%len(charset)
 	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[r.Intn(len(charset))]
+	buf := make([]byte, length+length/2)
+	for i := 0; i < length; {
+		if _, err := rand.Read(buf); err != nil {
+			// crypto/rand doesn't fail on the supported platforms
+			panic(err)
+		}
+		for _, r := range buf {
+			if int(r) >= limit {
+				continue
+			}
+			b[i] = charset[int(r)%len(charset)]
+			i++
+			if i == length {
+				break
+			}
+		}
 	}
 	return string(b)
 }
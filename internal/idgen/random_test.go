@@ -1,8 +1,15 @@
 package idgen
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"testing"
+
+	"github.com/armistcxy/shorten/internal/denylist"
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func BenchmarkRandomGenerateID(b *testing.B) {
@@ -10,7 +17,7 @@ func BenchmarkRandomGenerateID(b *testing.B) {
 		numberOfYieldIDs int                = 500
 		numberOfWorkers  int                = 2000
 		wg                                  = sync.WaitGroup{}
-		rg               *RandomIDGenerator = NewRandomIDGenerator()
+		rg               *RandomIDGenerator = NewRandomIDGenerator(0)
 	)
 
 	b.ResetTimer()
@@ -28,3 +35,99 @@ func BenchmarkRandomGenerateID(b *testing.B) {
 		wg.Wait()
 	}
 }
+
+func TestRandomGenerateIDConcurrency(t *testing.T) {
+	rg := NewRandomIDGenerator(8)
+	used := sync.Map{}
+	wg := sync.WaitGroup{}
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				id := rg.GenerateID()
+				assert.Len(t, id, 8)
+				assert.True(t, domain.ValidID(id), id)
+				if _, appear := used.LoadOrStore(id, struct{}{}); appear {
+					t.Errorf("id %s generated twice", id)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// taken stands for the urls table: insert fails with ErrConflict for taken ids
+type taken struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func (tk *taken) insert(_ context.Context, id string) error {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	if tk.ids[id] {
+		return domain.ErrConflict
+	}
+	tk.ids[id] = true
+	return nil
+}
+
+func TestRandomGenerateUniqueIDGrows(t *testing.T) {
+	rg := NewRandomIDGenerator(1)
+	tk := &taken{ids: make(map[string]bool)}
+	// far more ids than one character can hold
+	for range 500 {
+		_, err := rg.GenerateUniqueID(context.Background(), tk.insert)
+		require.NoError(t, err)
+	}
+	assert.Len(t, tk.ids, 500)
+	assert.Greater(t, rg.Length(), 1)
+	stats := rg.Stats()
+	assert.Greater(t, stats.Collisions, uint64(0))
+	assert.Equal(t, uint64(500)+stats.Collisions, stats.Attempts)
+}
+
+func TestRandomUtilisationEstimate(t *testing.T) {
+	rg := NewRandomIDGenerator(3)
+	// 5% of the 3 character keyspace is taken, attempts never take more
+	used := make(map[string]bool)
+	for len(used) < 238328/20 {
+		used[randomString(3)] = true
+	}
+	probe := func(_ context.Context, id string) error {
+		if used[id] {
+			return domain.ErrConflict
+		}
+		return errors.New("only probing")
+	}
+	for range 20_000 {
+		_, _ = rg.GenerateUniqueID(context.Background(), probe)
+	}
+	assert.Equal(t, 3, rg.Length())
+	assert.InDelta(t, 0.05, rg.Stats().Utilisation, 0.03)
+}
+
+func TestRandomGenerateUniqueIDGivesUp(t *testing.T) {
+	rg := NewRandomIDGenerator(1)
+	rg.maxLength = 2
+	alwaysTaken := func(context.Context, string) error { return domain.ErrConflict }
+	_, err := rg.GenerateUniqueID(context.Background(), alwaysTaken)
+	assert.ErrorIs(t, err, ErrIDSpaceExhausted)
+	assert.Equal(t, 2, rg.Length())
+
+	failing := errors.New("connection refused")
+	_, err = rg.GenerateUniqueID(context.Background(), func(context.Context, string) error { return failing })
+	assert.ErrorIs(t, err, failing)
+}
+
+func TestRandomGenerateIDSkipsDenied(t *testing.T) {
+	var words []string
+	for _, ch := range "abcdefghijklmnopqrstuvwyz0123456789" {
+		words = append(words, string(ch))
+	}
+	rg := NewRandomIDGenerator(1).WithDenylist(denylist.New(words))
+	for range 100 {
+		assert.Contains(t, []string{"x", "X"}, rg.GenerateID())
+	}
+}
@@ -0,0 +1,326 @@
+package idgen
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/armistcxy/shorten/internal/denylist"
+	"github.com/armistcxy/shorten/internal/domain"
+	"golang.org/x/sync/singleflight"
+)
+
+// Teams want different ids (short sequential ones internally, long random ones to share outside), so the
+// generator is picked per request among named strategies: the id_strategy of the request, otherwise the
+// strategy of the tenant (the owner of the API key), otherwise the default one.
+// Generators are only built when a strategy is first used: a Snowflake node id is leased on demand.
+
+// Strategies don't share ids: the sequential ones (seq and obfuscated, kept apart by permOffset) never start
+// with domain.TaggedPrefix, the others start with it and their own letter. Otherwise a sequential id could
+// be a random id inserted before it, and fail the batch it is inserted with.
+
+// Prefixes of the ids of the strategies that aren't sequential
+const (
+	RandomPrefix    = domain.TaggedPrefix + "r"
+	SnowflakePrefix = domain.TaggedPrefix + "s"
+)
+
+// Strategy is a named generator along with the shape of its ids (without check digit), lookups
+// reject ids that no strategy could have generated
+type Strategy struct {
+	Name string
+	// Prefix starts every id, the lengths don't count it. Ids of strategies without prefix can't start
+	// with domain.TaggedPrefix
+	Prefix    string
+	Alphabet  string
+	MinLength int
+	MaxLength int
+	// New builds the generator, release gives back what it holds on shutdown (nil when there's nothing)
+	New func() (gen domain.IDGenerator, release func(context.Context) error, err error)
+}
+
+// Matches reports whether id (without check digit) has the shape of the strategy's ids
+func (s Strategy) Matches(id string) bool {
+	if s.Prefix == "" && strings.HasPrefix(id, domain.TaggedPrefix) {
+		return false
+	}
+	id, ok := strings.CutPrefix(id, s.Prefix)
+	if !ok || len(id) < s.MinLength || len(id) > s.MaxLength {
+		return false
+	}
+	for i := range len(id) {
+		if strings.IndexByte(s.Alphabet, id[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type Registry struct {
+	strategies map[string]Strategy // only written before the registry is used
+	tenants    map[string]string
+	def        string
+	denied     *denylist.List
+
+	mu         sync.Mutex // guards the generators and releases
+	generators map[string]domain.IDGenerator
+	releases   []func(context.Context) error
+	// builds is keyed by strategy: a generator is built once at a time, without holding mu (a Snowflake
+	// node lease is a database round trip, picks of the generators that are built must not wait for it)
+	builds singleflight.Group
+}
+
+// NewRegistry uses the strategy def when neither the request nor the tenant picks one. Besides the
+// registered strategies, "random-N" gives random ids of N characters (MinRandomLength to MaxRandomLength)
+func NewRegistry(def string, tenants map[string]string, denied *denylist.List) *Registry {
+	return &Registry{
+		strategies: make(map[string]Strategy),
+		generators: make(map[string]domain.IDGenerator),
+		tenants:    tenants,
+		def:        def,
+		denied:     denied,
+	}
+}
+
+// MinRandomLength keeps random ids long enough to be worth it, MaxRandomLength leaves room for the
+// prefix and a check digit
+const (
+	MinRandomLength = 4
+	MaxRandomLength = domain.MaxIDLength - 1 - len(RandomPrefix)
+)
+
+// Register adds a strategy, strategies must all be registered before the registry is used
+func (r *Registry) Register(s Strategy) {
+	r.strategies[s.Name] = s
+}
+
+// ParseTenants parses the strategies of tenants in the form "owner1:strategy1,owner2:strategy2"
+func ParseTenants(s string) (map[string]string, error) {
+	tenants := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		owner, strategy, ok := strings.Cut(pair, ":")
+		if !ok || owner == "" || strategy == "" {
+			return nil, fmt.Errorf("invalid tenant id strategy %q, expected owner:strategy", pair)
+		}
+		tenants[owner] = strategy
+	}
+	return tenants, nil
+}
+
+// Validate checks that the default and tenant strategies exist
+func (r *Registry) Validate() error {
+	if _, err := r.strategy(r.def); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	for owner, name := range r.tenants {
+		if _, err := r.strategy(name); err != nil {
+			return fmt.Errorf("tenant %s: %w", owner, err)
+		}
+	}
+	return nil
+}
+
+// Pick returns the generator for a request of owner that asked for the strategy requested (may be empty)
+func (r *Registry) Pick(owner string, requested string) (domain.IDGenerator, error) {
+	name := requested
+	if name == "" {
+		name = r.tenants[owner]
+	}
+	if name == "" {
+		name = r.def
+	}
+
+	if gen, ok := r.built(name); ok {
+		return gen, nil
+	}
+	s, err := r.strategy(name)
+	if err != nil {
+		return nil, err
+	}
+	gen, err, _ := r.builds.Do(name, func() (any, error) {
+		// a build that just finished
+		if gen, ok := r.built(name); ok {
+			return gen, nil
+		}
+		gen, release, err := s.New()
+		if err != nil {
+			return nil, fmt.Errorf("id strategy %s: %w", name, err)
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.generators[name] = gen
+		if release != nil {
+			r.releases = append(r.releases, release)
+		}
+		return gen, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gen.(domain.IDGenerator), nil
+}
+
+func (r *Registry) built(name string) (domain.IDGenerator, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	gen, ok := r.generators[name]
+	return gen, ok
+}
+
+// ValidID reports whether id (without check digit) could have been generated by one of the strategies
+func (r *Registry) ValidID(id string) bool {
+	for _, s := range r.strategies {
+		if s.Matches(id) {
+			return true
+		}
+	}
+	// random-N ids of any N
+	return RandomStrategy("random-N", MinRandomLength, nil).Matches(id)
+}
+
+// Names lists the registered strategies
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.strategies)+1)
+	for name := range r.strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append(names, "random-N")
+}
+
+// Release gives back what the generators hold, once no id is generated anymore
+func (r *Registry) Release(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errs []error
+	for _, release := range r.releases {
+		errs = append(errs, release(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Stats reports the state of the generators that have been built, keyed by strategy
+func (r *Registry) Stats() map[string]any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make(map[string]any, len(r.generators))
+	for name, gen := range r.generators {
+		switch gen := gen.(type) {
+		case *SeqIDGenerator:
+			stats[name] = gen.Stats()
+		case *RandomIDGenerator:
+			stats[name] = gen.Stats()
+		case *SnowflakeGenerator:
+			stats[name] = gen.Stats()
+		default:
+			stats[name] = nil
+		}
+	}
+	return stats
+}
+
+// Var exposes the stats in expvar
+func (r *Registry) Var() expvar.Var {
+	return expvar.Func(func() any {
+		return r.Stats()
+	})
+}
+
+func (r *Registry) strategy(name string) (Strategy, error) {
+	if s, ok := r.strategies[name]; ok {
+		return s, nil
+	}
+	if n, ok := strings.CutPrefix(name, "random-"); ok {
+		length, err := strconv.Atoi(n)
+		if err == nil && length >= MinRandomLength && length <= MaxRandomLength {
+			return RandomStrategy(name, length, r.denied), nil
+		}
+	}
+	return Strategy{}, fmt.Errorf("%w %q, expected one of %s", domain.ErrUnknownStrategy, name, strings.Join(r.Names(), ", "))
+}
+
+// RandomStrategy generates random ids of length characters after RandomPrefix, they may grow up to MaxRandomLength
+func RandomStrategy(name string, length int, denied *denylist.List) Strategy {
+	return Strategy{
+		Name:      name,
+		Prefix:    RandomPrefix,
+		Alphabet:  charset,
+		MinLength: length,
+		MaxLength: MaxRandomLength,
+		New: func() (domain.IDGenerator, func(context.Context) error, error) {
+			return NewRandomIDGenerator(length).WithPrefix(RandomPrefix).WithDenylist(denied), nil, nil
+		},
+	}
+}
+
+// encodedLength is the length of num in base 62, without check digit
+func encodedLength(num uint64) int {
+	length := 1
+	for ; num >= domain.BASE; num /= domain.BASE {
+		length++
+	}
+	return length
+}
+
+// maxEncodedLength is the length of the biggest uint64 in base 62
+var maxEncodedLength = encodedLength(^uint64(0))
+
+// SeqStrategy hands out sequential ids from the leased ranges, scrambled when perm isn't nil
+func SeqStrategy(name string, leases *LeaseStore, perm *FeistelPermutation, denied *denylist.List) Strategy {
+	minLength := 1
+	if perm != nil {
+		// scrambled counters start at 1<<width
+		minLength = encodedLength(permOffset(perm))
+	}
+	return Strategy{
+		Name:      name,
+		Alphabet:  charset,
+		MinLength: minLength,
+		MaxLength: maxEncodedLength,
+		New: func() (domain.IDGenerator, func(context.Context) error, error) {
+			sg := NewSeqIDGenerator(leases, 16).WithPermutation(perm).WithDenylist(denied)
+			return sg, sg.Release, nil
+		},
+	}
+}
+
+// SnowflakeStrategy mints time ordered ids after SnowflakePrefix, for node (when it's not negative) or for a
+// node id leased with leaser
+func SnowflakeStrategy(name string, node int, leaser *NodeLeaser, denied *denylist.List) Strategy {
+	return Strategy{
+		Name:      name,
+		Prefix:    SnowflakePrefix,
+		Alphabet:  charset,
+		MinLength: encodedLength(1 << (snowflakeNodeBits + snowflakeSeqBits)),
+		MaxLength: maxEncodedLength,
+		New: func() (domain.IDGenerator, func(context.Context) error, error) {
+			if node >= 0 {
+				sg, err := NewSnowflakeGenerator(node, SnowflakeEpoch)
+				if err != nil {
+					return nil, nil, err
+				}
+				return sg.WithPrefix(SnowflakePrefix).WithDenylist(denied), nil, nil
+			}
+			sg, err := leaser.Acquire(context.Background(), SnowflakeEpoch)
+			if err != nil {
+				return nil, nil, err
+			}
+			sg.WithPrefix(SnowflakePrefix).WithDenylist(denied)
+			ctx, cancel := context.WithCancel(context.Background())
+			go leaser.Run(ctx, sg)
+			return sg, func(ctx context.Context) error {
+				cancel()
+				return leaser.Release(ctx, sg)
+			}, nil
+		},
+	}
+}
@@ -0,0 +1,164 @@
+package idgen
+
+import (
+	"context"
+	"testing"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type constGenerator string
+
+func (cg constGenerator) GenerateID() string {
+	return string(cg)
+}
+
+func constStrategy(name string, built *int, released *int) Strategy {
+	return Strategy{
+		Name:      name,
+		Alphabet:  "abc",
+		MinLength: 2,
+		MaxLength: 3,
+		New: func() (domain.IDGenerator, func(context.Context) error, error) {
+			*built++
+			return constGenerator(name), func(context.Context) error {
+				*released++
+				return nil
+			}, nil
+		},
+	}
+}
+
+func TestRegistryPick(t *testing.T) {
+	var built, released int
+	r := NewRegistry("internal", map[string]string{"marketing": "external"}, nil)
+	r.Register(constStrategy("internal", &built, &released))
+	r.Register(constStrategy("external", &built, &released))
+	require.NoError(t, r.Validate())
+
+	pick := func(owner, requested string) domain.IDGenerator {
+		gen, err := r.Pick(owner, requested)
+		require.NoError(t, err)
+		return gen
+	}
+	assert.Equal(t, "internal", pick("", "").GenerateID())
+	assert.Equal(t, "external", pick("marketing", "").GenerateID())
+	assert.Equal(t, "internal", pick("marketing", "internal").GenerateID())
+	// generators are built once
+	assert.Equal(t, 2, built)
+
+	rg, ok := pick("", "random-12").(*RandomIDGenerator)
+	require.True(t, ok)
+	assert.Equal(t, 12, rg.Length())
+	assert.Same(t, rg, pick("", "random-12"))
+
+	for _, name := range []string{"nope", "random-2", "random-99", "random-x"} {
+		_, err := r.Pick("", name)
+		assert.ErrorIs(t, err, domain.ErrUnknownStrategy, name)
+	}
+
+	require.NoError(t, r.Release(context.Background()))
+	assert.Equal(t, 2, released)
+}
+
+// A generator that takes long to build doesn't hold up the picks of the others
+func TestRegistryPickBuildsOutsideLock(t *testing.T) {
+	var built, released int
+	building, unblock := make(chan struct{}), make(chan struct{})
+	r := NewRegistry("fast", nil, nil)
+	r.Register(constStrategy("fast", &built, &released))
+	r.Register(Strategy{
+		Name: "slow",
+		New: func() (domain.IDGenerator, func(context.Context) error, error) {
+			close(building)
+			<-unblock
+			return constGenerator("slow"), nil, nil
+		},
+	})
+
+	slow := make(chan domain.IDGenerator)
+	go func() {
+		gen, _ := r.Pick("", "slow")
+		slow <- gen
+	}()
+	<-building
+	gen, err := r.Pick("", "fast")
+	require.NoError(t, err)
+	assert.Equal(t, "fast", gen.GenerateID())
+
+	close(unblock)
+	assert.Equal(t, "slow", (<-slow).GenerateID())
+	gen, err = r.Pick("", "slow")
+	require.NoError(t, err)
+	assert.Equal(t, "slow", gen.GenerateID())
+}
+
+func TestRegistryValidate(t *testing.T) {
+	var built, released int
+	r := NewRegistry("internal", map[string]string{"marketing": "missing"}, nil)
+	r.Register(constStrategy("internal", &built, &released))
+	assert.ErrorIs(t, r.Validate(), domain.ErrUnknownStrategy)
+	assert.Zero(t, built)
+}
+
+func TestRegistryValidID(t *testing.T) {
+	var built, released int
+	r := NewRegistry("internal", nil, nil)
+	r.Register(constStrategy("internal", &built, &released))
+
+	assert.True(t, r.ValidID("ab"))
+	assert.True(t, r.ValidID("abc"))
+	// too short for internal and for random-N
+	assert.False(t, r.ValidID("a"))
+	assert.False(t, r.ValidID("xy"))
+	// random-N
+	assert.True(t, r.ValidID("0rxyzW"))
+	assert.False(t, r.ValidID("xyzW"))
+	assert.False(t, r.ValidID("0rxyzWxyzWxyzWxy"))
+}
+
+func TestStrategiesDontShareIDs(t *testing.T) {
+	seq := SeqStrategy("seq", nil, nil, nil)
+	random := RandomStrategy("random", 6, nil)
+	snowflake := SnowflakeStrategy("snowflake", 1, nil, nil)
+
+	gen, _, err := random.New()
+	require.NoError(t, err)
+	id := gen.GenerateID()
+	assert.True(t, random.Matches(id), id)
+	assert.False(t, seq.Matches(id), id)
+	assert.False(t, snowflake.Matches(id), id)
+
+	gen, _, err = snowflake.New()
+	require.NoError(t, err)
+	id = gen.GenerateID()
+	assert.True(t, snowflake.Matches(id), id)
+	assert.False(t, seq.Matches(id), id)
+	assert.False(t, random.Matches(id), id)
+
+	id = domain.EncodeID(1 << 40)
+	assert.True(t, seq.Matches(id), id)
+	assert.False(t, random.Matches(id), id)
+	assert.False(t, snowflake.Matches(id), id)
+}
+
+func TestSeqStrategyShape(t *testing.T) {
+	perm, err := NewFeistelPermutation([]byte("secret"), 36)
+	require.NoError(t, err)
+	s := SeqStrategy("obfuscated", nil, perm, nil)
+	// scrambled counters are all at least 1<<36, 7 characters
+	assert.Equal(t, 7, s.MinLength)
+	assert.Equal(t, 11, s.MaxLength)
+	assert.Equal(t, 7, len(domain.EncodeID(perm.Permute(1)+permOffset(perm))))
+}
+
+func TestParseTenants(t *testing.T) {
+	tenants, err := ParseTenants("internal-tools:seq, marketing:random-10")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"internal-tools": "seq", "marketing": "random-10"}, tenants)
+
+	_, err = ParseTenants("marketing")
+	assert.Error(t, err)
+}
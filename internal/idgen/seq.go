@@ -2,134 +2,284 @@ package idgen
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/armistcxy/shorten/internal/background"
+	"github.com/armistcxy/shorten/internal/denylist"
 	"github.com/armistcxy/shorten/internal/domain"
-	"github.com/jackc/pgx/v5"
-	"github.com/jmoiron/sqlx"
-	"github.com/riverqueue/river"
 )
 
-// Backed by PostgreSQL
+// Backed by PostgreSQL: every shard hands out ids from its own leased range (see lease.go)
 type SeqIDGenerator struct {
-	shards  []ShardIDManager
-	current uint64
-	db      *sqlx.DB
-	rc      *river.Client[pgx.Tx]
-	mu      sync.Mutex
+	shards []ShardIDManager
+	// free holds the index of the shards that aren't in use, ids wait on it for a shard
+	free   chan int
+	leases *LeaseStore
+	perm   *FeistelPermutation
+	denied *denylist.List
+
+	waits             atomic.Uint64
+	waitTime          atomic.Int64
+	scrambledSpaceLow atomic.Bool
 }
 
 const SHARD_SIZE = 1 << 25
 
-func NewSeqIDGenerator(db *sqlx.DB, start uint64, numberOfShards int, rc *river.Client[pgx.Tx]) *SeqIDGenerator {
-	shards := make([]ShardIDManager, numberOfShards)
-	var (
-		lID     uint64 = 0
-		current uint64 = 1
-	)
-	for i := 0; i < numberOfShards; i++ {
-		for {
-			lID = findLastUsedID(db, current, SHARD_SIZE)
-			if lID == 0 { // no id in given range been used yet
-				lID = current - 1
-			}
-			if lID != current+SHARD_SIZE-1 {
-				break
-			}
-			current += SHARD_SIZE
-		}
+// Ranges are reserved LEASE_STEP ids at a time, a crash loses at most that many ids per shard
+const LEASE_STEP = 1000
 
-		shards[i] = NewShardIDManager(current, current+SHARD_SIZE-1, lID)
-		current += SHARD_SIZE
+// NewSeqIDGenerator doesn't touch the database, the shards lease their ranges on first use
+func NewSeqIDGenerator(leases *LeaseStore, numberOfShards int) *SeqIDGenerator {
+	free := make(chan int, numberOfShards)
+	for i := range numberOfShards {
+		free <- i
 	}
-
 	return &SeqIDGenerator{
-		shards:  shards,
-		current: current,
-		db:      db,
-		rc:      rc,
-		mu:      sync.Mutex{},
+		shards: make([]ShardIDManager, numberOfShards),
+		free:   free,
+		leases: leases,
 	}
 }
-func findLastUsedID(db *sqlx.DB, start uint64, shardSize uint64) uint64 {
-	// This is a littlbe bit tricky
-	// COALESCE(MAX(id), 0) will substitute 0 if MAX(id) is NULL, ensuring the query always returns a value
-	// If the query returns 0, that mean there no id in that range already been used.
-	query := `SELECT COALESCE(MAX(id), 0) FROM ids WHERE id >= $1 and id < $2`
-	var lastUsed uint64
-	if err := db.Get(&lastUsed, query, start, start+shardSize); err != nil {
-		slog.Error("failed when sending find last used id query to database", "error", err.Error())
-		// return maximize in that range in case error occur
-		return start + shardSize - 1
+
+// WithPermutation scrambles the generated ids, must be called before the generator is used.
+// Turning it on for a table that already holds sequential ids can hand out an id that is taken
+func (sg *SeqIDGenerator) WithPermutation(perm *FeistelPermutation) *SeqIDGenerator {
+	sg.perm = perm
+	return sg
+}
+
+// WithDenylist makes the generator skip the ids that denied blocks, the counters are lost
+func (sg *SeqIDGenerator) WithDenylist(denied *denylist.List) *SeqIDGenerator {
+	sg.denied = denied
+	return sg
+}
+
+// Scrambled counters are moved above the plain ones (until plain counters reach 1<<width),
+// so that sequential and scrambled generators can share the leased ranges
+func permOffset(perm *FeistelPermutation) uint64 {
+	if perm.Width() == 64 {
+		return 0
 	}
+	return 1 << perm.Width()
+}
 
-	return lastUsed
+func (sg *SeqIDGenerator) encode(num uint64) string {
+	if sg.perm != nil {
+		num = sg.perm.Permute(num) + permOffset(sg.perm)
+	}
+	return domain.EncodeID(num)
 }
 
+// Counter turns an id generated by sg back into the counter it came from
+func (sg *SeqIDGenerator) Counter(id string) (uint64, error) {
+	num, err := domain.DecodeID(id)
+	if err != nil {
+		return 0, err
+	}
+	if sg.perm != nil {
+		if num < permOffset(sg.perm) {
+			return 0, fmt.Errorf("%w: %q wasn't scrambled", domain.ErrInvalidID, id)
+		}
+		num = sg.perm.Invert(num - permOffset(sg.perm))
+	}
+	return num, nil
+}
+
+// maxLeaseAttempts bounds the lease calls of one id, the database is then taken as unavailable
+const maxLeaseAttempts = 3
+
+// GenerateID waits for the database as long as it takes, GenerateIDContext gives up
 func (sg *SeqIDGenerator) GenerateID() string {
-	// i think associate with channel here might be a better idea => could improve later
-	// current implement: using sharded mutex and iterate over shard to determine whether
-	// we can perform lock on that mutex and yield an id from that range("TryLock")
 	for {
-		for i := range sg.shards {
-			if sg.shards[i].mu.TryLock() {
-				sg.shards[i].cur++
-				idIntForm := sg.shards[i].cur
-				if sg.shards[i].cur > sg.shards[i].end {
-					// give new range to shard[i]
-					sg.mu.Lock()
-					var lID uint64
-					for {
-						lID = findLastUsedID(sg.db, sg.current, SHARD_SIZE)
-						if lID != sg.current+SHARD_SIZE-1 {
-							break
-						}
-						sg.current += SHARD_SIZE
-					}
-					sg.mu.Unlock()
-					_, err := sg.rc.Insert(context.Background(), background.AddLastUsedIDArgs{
-						LastUsedID: sg.shards[i].end,
-					}, nil)
-					if err != nil {
-						slog.Error("failed to enqueue job", "error", err.Error())
-					}
-					sg.shards[i] = NewShardIDManager(sg.current-SHARD_SIZE, sg.current-1, lID)
-					break
-				}
-				sg.shards[i].mu.Unlock()
-				return domain.EncodeID(idIntForm)
+		if id, err := sg.GenerateIDContext(context.Background()); err == nil {
+			return id
+		}
+	}
+}
+
+// GenerateIDContext fails with domain.ErrUnavailable when no range of ids can be leased after a few attempts,
+// or ctx is done first
+func (sg *SeqIDGenerator) GenerateIDContext(ctx context.Context) (string, error) {
+	for attempt := 1; ; {
+		i, err := sg.acquire(ctx)
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", domain.ErrUnavailable, err)
+		}
+		shard := &sg.shards[i]
+		shard.mu.Lock()
+		idIntForm, err := shard.next(ctx, sg.leases)
+		shard.mu.Unlock()
+		if err != nil {
+			slog.Error("failed to lease a range of ids", "holder", sg.leases.Holder(), "shard", i, "attempt", attempt, "error", err.Error())
+			if attempt == maxLeaseAttempts || ctx.Err() != nil {
+				sg.free <- i
+				return "", fmt.Errorf("%w: no range of ids leased: %w", domain.ErrUnavailable, err)
+			}
+			attempt++
+			// the database is unreachable or slow, keep the shard a while so that it isn't hammered
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-ctx.Done():
 			}
+			sg.free <- i
+			continue
 		}
+		sg.free <- i
+
+		sg.checkScrambledSpace(idIntForm)
+		if id := sg.encode(idIntForm); !sg.denied.Blocked(id) {
+			return id, nil
+		}
+		shard.mu.Lock()
+		shard.skipped++
+		shard.mu.Unlock()
 	}
+}
 
+// acquire hands a free shard over, blocking while every shard is in use (until ctx is done)
+func (sg *SeqIDGenerator) acquire(ctx context.Context) (int, error) {
+	select {
+	case i := <-sg.free:
+		return i, nil
+	default:
+	}
+	start := time.Now()
+	select {
+	case i := <-sg.free:
+		sg.waits.Add(1)
+		sg.waitTime.Add(int64(time.Since(start)))
+		return i, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
 }
 
-func (sg *SeqIDGenerator) RetriveLastUsedIds() []uint64 {
-	ids := make([]uint64, len(sg.shards))
-	for i := range ids {
-		if sg.shards[i].cur < sg.shards[i].start {
-			ids[i] = uint64(0) // no update
-		} else {
-			ids[i] = sg.shards[i].cur
+// Past 1<<width, counters are no longer scrambled (see FeistelPermutation), warn well before
+func (sg *SeqIDGenerator) checkScrambledSpace(counter uint64) {
+	if sg.perm == nil || sg.perm.Width() == 64 || sg.scrambledSpaceLow.Load() {
+		return
+	}
+	if counter >= permOffset(sg.perm)/10*9 && sg.scrambledSpaceLow.CompareAndSwap(false, true) {
+		slog.Warn("90% of the scrambled id space is used, increase ID_PERMUTATION_WIDTH for new ids",
+			"counter", counter, "width", sg.perm.Width())
+	}
+}
+
+// Release gives the leased ranges back with the ids that weren't handed out, call it once ids are no longer generated
+func (sg *SeqIDGenerator) Release(ctx context.Context) error {
+	var errs []error
+	for i := range sg.shards {
+		sg.shards[i].mu.Lock()
+		if sg.shards[i].held {
+			errs = append(errs, sg.leases.Release(ctx, sg.shards[i].lease, sg.shards[i].cur))
+			sg.shards[i].held = false
 		}
+		sg.shards[i].mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+type ShardStats struct {
+	Shard     int    `json:"shard"`
+	Held      bool   `json:"held"`
+	Start     uint64 `json:"range_start"`
+	End       uint64 `json:"range_end"`
+	Reserved  uint64 `json:"reserved_upto"`
+	Next      uint64 `json:"next"`
+	Remaining uint64 `json:"remaining"`
+	Issued    uint64 `json:"issued"`
+	Skipped   uint64 `json:"skipped"`
+	Refills   uint64 `json:"refills"`
+	Extends   uint64 `json:"extends"`
+}
+
+type SeqStats struct {
+	Holder string       `json:"holder"`
+	Shards []ShardStats `json:"shards"`
+	// Waits counts the ids that waited for a free shard, WaitTime is their total wait
+	Waits    uint64        `json:"waits"`
+	WaitTime time.Duration `json:"wait_time_ns"`
+	// ScrambledSpaceLow is set once counters get close to the end of the scrambled space
+	ScrambledSpaceLow bool `json:"scrambled_space_low,omitempty"`
+}
+
+// Stats reports the state of every shard and how long ids waited for one
+func (sg *SeqIDGenerator) Stats() SeqStats {
+	stats := SeqStats{
+		Holder:            sg.leases.Holder(),
+		Shards:            make([]ShardStats, len(sg.shards)),
+		Waits:             sg.waits.Load(),
+		WaitTime:          time.Duration(sg.waitTime.Load()),
+		ScrambledSpaceLow: sg.scrambledSpaceLow.Load(),
+	}
+	for i := range sg.shards {
+		stats.Shards[i] = sg.shards[i].stats(i)
 	}
-	return ids
+	return stats
 }
 
 type ShardIDManager struct {
 	mu    sync.Mutex
-	start uint64
-	end   uint64
-	cur   uint64
+	held  bool
+	lease Lease
+	cur   uint64 // next id to hand out
+
+	issued, skipped, refills, extends uint64
 }
 
-func NewShardIDManager(start, end, cur uint64) ShardIDManager {
-	return ShardIDManager{
-		mu:    sync.Mutex{},
-		start: start,
-		end:   end,
-		cur:   cur,
+func (sm *ShardIDManager) stats(i int) ShardStats {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	stats := ShardStats{
+		Shard:    i,
+		Held:     sm.held,
+		Start:    sm.lease.Start,
+		End:      sm.lease.End,
+		Reserved: sm.lease.Reserved,
+		Next:     sm.cur,
+		Issued:   sm.issued,
+		Skipped:  sm.skipped,
+		Refills:  sm.refills,
+		Extends:  sm.extends,
+	}
+	if sm.held && sm.cur <= sm.lease.End {
+		stats.Remaining = sm.lease.End - sm.cur + 1
 	}
+	return stats
+}
+
+// next must be called with the shard locked
+func (sm *ShardIDManager) next(ctx context.Context, leases *LeaseStore) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if sm.held && sm.cur > sm.lease.Reserved && sm.lease.Reserved < sm.lease.End {
+		err := leases.Extend(ctx, &sm.lease)
+		if errors.Is(err, ErrLeaseLost) {
+			slog.Warn("id lease was taken over", "holder", leases.Holder(), "range_start", sm.lease.Start)
+			sm.held = false
+		} else if err != nil {
+			return 0, err
+		} else {
+			sm.extends++
+		}
+	}
+	if !sm.held || sm.cur > sm.lease.End {
+		lease, cur, err := leases.Claim(ctx)
+		if err != nil {
+			return 0, err
+		}
+		slog.Info("leased a range of ids", "holder", leases.Holder(), "range_start", lease.Start, "range_end", lease.End, "next", cur)
+		sm.lease, sm.cur, sm.held = lease, cur, true
+		sm.refills++
+	}
+
+	id := sm.cur
+	sm.cur++
+	sm.issued++
+	return id, nil
 }
@@ -1,27 +1,32 @@
 package idgen
 
 import (
+	"context"
 	"os"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/armistcxy/shorten/internal/migrate"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewSeqIDGenerator(t *testing.T) {
-	var (
-		db             *sqlx.DB = sqlx.MustConnect("postgres", os.Getenv("URL_DSN"))
-		start          uint64   = 1
-		numberOfShards int      = 12
-	)
-
-	sg := NewSeqIDGenerator(db, start, numberOfShards, nil)
+	sg := prepareSeqIDGenerator()
+	for range 100 {
+		sg.GenerateID()
+	}
 	for i := range sg.shards {
-		assert.NotNil(t, &sg.shards[i])
-		t.Logf("Shard %d starts from: %d, end at %d, last used id: %d\n", i, sg.shards[i].start, sg.shards[i].end, sg.shards[i].cur)
+		if sg.shards[i].held {
+			t.Logf("Shard %d leased from: %d, end at %d, reserved up to: %d, next id: %d\n", i,
+				sg.shards[i].lease.Start, sg.shards[i].lease.End, sg.shards[i].lease.Reserved, sg.shards[i].cur)
+		}
 	}
+	assert.NoError(t, sg.Release(context.Background()))
 }
 
 func TestSeqGenerateIDSequential(t *testing.T) {
@@ -113,10 +118,77 @@ func BenchmarkSeqGenerateID(b *testing.B) {
 
 func prepareSeqIDGenerator() *SeqIDGenerator {
 	var (
-		db             *sqlx.DB = sqlx.MustConnect("postgres", os.Getenv("URL_DSN"))
-		start          uint64   = 1
+		db             *sqlx.DB = prepareDB()
 		numberOfShards int      = 12
 	)
 
-	return NewSeqIDGenerator(db, start, numberOfShards, nil)
+	return NewSeqIDGenerator(NewLeaseStore(db, DefaultHolder(), SHARD_SIZE, LEASE_STEP, time.Minute), numberOfShards)
+}
+
+func prepareDB() *sqlx.DB {
+	db := sqlx.MustConnect("postgres", os.Getenv("URL_DSN"))
+	migrator, err := migrate.New(db)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// With every shard in use, an id waits for one to be handed back instead of spinning
+func TestSeqAcquireWaitsForFreeShard(t *testing.T) {
+	ctx := context.Background()
+	sg := NewSeqIDGenerator(nil, 2)
+	first, err := sg.acquire(ctx)
+	require.NoError(t, err)
+	second, err := sg.acquire(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []int{0, 1}, []int{first, second})
+	assert.Zero(t, sg.waits.Load())
+
+	acquired := make(chan int)
+	go func() {
+		i, _ := sg.acquire(ctx)
+		acquired <- i
+	}()
+	select {
+	case i := <-acquired:
+		t.Fatalf("shard %d acquired while in use", i)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	sg.free <- second
+	assert.Equal(t, second, <-acquired)
+	assert.Equal(t, uint64(1), sg.waits.Load())
+	assert.Greater(t, sg.waitTime.Load(), int64(0))
+
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = sg.acquire(timeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// Without the database, ids fail with ErrUnavailable instead of waiting for it
+func TestSeqGenerateIDUnavailable(t *testing.T) {
+	db := sqlx.MustOpen("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	defer db.Close()
+	sg := NewSeqIDGenerator(NewLeaseStore(db, "test", SHARD_SIZE, LEASE_STEP, time.Minute), 1)
+
+	_, err := sg.GenerateIDContext(context.Background())
+	assert.ErrorIs(t, err, domain.ErrUnavailable)
+	// the shard is handed back
+	assert.Len(t, sg.free, 1)
+}
+
+func TestSeqScrambledSpaceAlarm(t *testing.T) {
+	perm, err := NewFeistelPermutation([]byte("secret"), 20)
+	assert.NoError(t, err)
+	sg := NewSeqIDGenerator(nil, 1).WithPermutation(perm)
+
+	sg.checkScrambledSpace(1 << 19)
+	assert.False(t, sg.scrambledSpaceLow.Load())
+	sg.checkScrambledSpace(1<<20 - 1000)
+	assert.True(t, sg.scrambledSpaceLow.Load())
 }
@@ -0,0 +1,164 @@
+package idgen
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/denylist"
+	"github.com/armistcxy/shorten/internal/domain"
+)
+
+// Snowflake ids need no database round trip: 41 bits of milliseconds since SnowflakeEpoch (about 69 years),
+// 10 bits of node id and 12 bits of sequence, so every node can mint 4096 ids per millisecond.
+// They are roughly time ordered, new rows land at the end of the urls primary key index.
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	snowflakeSeqMask  = 1<<snowflakeSeqBits - 1
+
+	MaxSnowflakeNode = 1<<snowflakeNodeBits - 1
+)
+
+var SnowflakeEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+var ErrInvalidNode = errors.New("snowflake node id must be between 0 and 1023")
+
+type SnowflakeGenerator struct {
+	mu    sync.Mutex
+	node  uint64
+	epoch time.Time
+	now   func() time.Time
+
+	last       int64 // milliseconds since epoch of the last id
+	seq        uint64
+	rollback   bool      // the clock is behind last
+	validUntil time.Time // the node id may be used until then, zero when it is ours for good
+	prefix     string
+	denied     *denylist.List
+}
+
+// NewSnowflakeGenerator mints ids for node, no other running generator may use the same node id
+func NewSnowflakeGenerator(node int, epoch time.Time) (*SnowflakeGenerator, error) {
+	if node < 0 || node > MaxSnowflakeNode {
+		return nil, ErrInvalidNode
+	}
+	return &SnowflakeGenerator{
+		node:  uint64(node),
+		epoch: epoch,
+		now:   time.Now,
+	}, nil
+}
+
+// WithDenylist makes the generator skip the ids that denied blocks
+func (sg *SnowflakeGenerator) WithDenylist(denied *denylist.List) *SnowflakeGenerator {
+	sg.denied = denied
+	return sg
+}
+
+// WithPrefix starts the ids with prefix
+func (sg *SnowflakeGenerator) WithPrefix(prefix string) *SnowflakeGenerator {
+	sg.prefix = prefix
+	return sg
+}
+
+func (sg *SnowflakeGenerator) Node() int {
+	return int(sg.node)
+}
+
+// Resume makes sure the next ids come after the timestamp last (milliseconds since epoch),
+// for instance the last one used by a previous holder of the node id
+func (sg *SnowflakeGenerator) Resume(last int64) {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	if last >= sg.last {
+		sg.last = last
+		sg.seq = snowflakeSeqMask // the whole millisecond may be used already
+	}
+}
+
+// Last is the timestamp (milliseconds since epoch) of the last id
+func (sg *SnowflakeGenerator) Last() int64 {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return sg.last
+}
+
+type SnowflakeStats struct {
+	Node       int       `json:"node"`
+	Last       time.Time `json:"last"`
+	ValidUntil time.Time `json:"valid_until,omitempty"`
+	// Behind is set while the clock is behind the timestamp of the last id
+	Behind bool `json:"behind"`
+}
+
+func (sg *SnowflakeGenerator) Stats() SnowflakeStats {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	return SnowflakeStats{
+		Node:       int(sg.node),
+		Last:       sg.epoch.Add(time.Duration(sg.last) * time.Millisecond),
+		ValidUntil: sg.validUntil,
+		Behind:     sg.rollback,
+	}
+}
+
+// SetValidUntil limits the use of the node id, GenerateID waits past that time until it is extended
+func (sg *SnowflakeGenerator) SetValidUntil(t time.Time) {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	sg.validUntil = t
+}
+
+func (sg *SnowflakeGenerator) GenerateID() string {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+
+	// Past the lease another replica may get our node id, minting ids then could duplicate its ids
+	for waited := false; !sg.validUntil.IsZero() && !time.Now().Before(sg.validUntil); waited = true {
+		if !waited {
+			slog.Error("snowflake node lease expired, waiting for it to be renewed", "node", sg.node)
+		}
+		sg.mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		sg.mu.Lock()
+	}
+
+	for {
+		if id := sg.next(); !sg.denied.Blocked(id) {
+			return id
+		}
+	}
+}
+
+// next must be called with sg.mu held
+func (sg *SnowflakeGenerator) next() string {
+	ms := sg.now().Sub(sg.epoch).Milliseconds()
+	if ms < sg.last {
+		// The clock went backwards (NTP step, VM migration): keep counting from the last timestamp
+		// instead of reissuing ids, the ids catch up with the clock once it passes last again
+		if !sg.rollback {
+			slog.Warn("clock moved backwards, ids keep going from the last timestamp", "node", sg.node,
+				"behind", time.Duration(sg.last-ms)*time.Millisecond)
+		}
+		sg.rollback = true
+		ms = sg.last
+	} else if ms > sg.last {
+		sg.rollback = false
+	}
+
+	if ms == sg.last {
+		sg.seq = (sg.seq + 1) & snowflakeSeqMask
+		if sg.seq == 0 {
+			// the millisecond is used up, borrow the next one (quietly, the clock isn't wrong)
+			ms++
+			sg.rollback = true
+		}
+	} else {
+		sg.seq = 0
+	}
+	sg.last = ms
+
+	return domain.EncodePrefixedID(sg.prefix, uint64(ms)<<(snowflakeNodeBits+snowflakeSeqBits)|sg.node<<snowflakeSeqBits|sg.seq)
+}
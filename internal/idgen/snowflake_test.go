@@ -0,0 +1,149 @@
+package idgen
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is moved by hand, concurrent reads are fine
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) Add(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+}
+
+func newTestSnowflake(t *testing.T, node int) (*SnowflakeGenerator, *fakeClock) {
+	sg, err := NewSnowflakeGenerator(node, SnowflakeEpoch)
+	require.NoError(t, err)
+	clock := &fakeClock{now: SnowflakeEpoch.Add(1000 * time.Hour)}
+	sg.now = clock.Now
+	return sg, clock
+}
+
+func decode(t *testing.T, id string) uint64 {
+	num, err := domain.DecodeID(id)
+	require.NoError(t, err)
+	return num
+}
+
+func TestSnowflakeInvalidNode(t *testing.T) {
+	_, err := NewSnowflakeGenerator(-1, SnowflakeEpoch)
+	assert.ErrorIs(t, err, ErrInvalidNode)
+	_, err = NewSnowflakeGenerator(MaxSnowflakeNode+1, SnowflakeEpoch)
+	assert.ErrorIs(t, err, ErrInvalidNode)
+}
+
+func TestSnowflakeLayout(t *testing.T) {
+	sg, clock := newTestSnowflake(t, 513)
+	num := decode(t, sg.GenerateID())
+	assert.Equal(t, uint64(clock.Now().Sub(SnowflakeEpoch).Milliseconds()), num>>22)
+	assert.Equal(t, uint64(513), num>>12&MaxSnowflakeNode)
+	assert.Equal(t, uint64(0), num&snowflakeSeqMask)
+}
+
+// Within a millisecond and once the sequence runs out, ids keep increasing
+func TestSnowflakeIncreasing(t *testing.T) {
+	sg, clock := newTestSnowflake(t, 1)
+	var prev uint64
+	for i := range 3 * (snowflakeSeqMask + 1) {
+		if i%1000 == 0 {
+			clock.Add(time.Millisecond)
+		}
+		num := decode(t, sg.GenerateID())
+		require.Greater(t, num, prev)
+		prev = num
+	}
+}
+
+func TestSnowflakeClockRollback(t *testing.T) {
+	sg, clock := newTestSnowflake(t, 1)
+	used := make(map[string]bool)
+	var prev uint64
+	generate := func() {
+		id := sg.GenerateID()
+		require.False(t, used[id], "id %s reissued", id)
+		used[id] = true
+		num := decode(t, id)
+		require.Greater(t, num, prev)
+		prev = num
+	}
+
+	for range 100 {
+		generate()
+		clock.Add(time.Millisecond)
+	}
+	clock.Add(-5 * time.Second)
+	for range 10_000 {
+		generate()
+	}
+	// once the clock passes the last timestamp again, ids follow it
+	clock.Add(10 * time.Second)
+	generate()
+	assert.Equal(t, clock.Now().Sub(SnowflakeEpoch).Milliseconds(), int64(prev>>22))
+}
+
+func TestSnowflakeResume(t *testing.T) {
+	sg, clock := newTestSnowflake(t, 1)
+	last := clock.Now().Sub(SnowflakeEpoch).Milliseconds() + 60_000
+	sg.Resume(last)
+	num := decode(t, sg.GenerateID())
+	assert.Greater(t, int64(num>>22), last)
+}
+
+func TestSnowflakeConcurrentNodes(t *testing.T) {
+	used := sync.Map{}
+	wg := sync.WaitGroup{}
+	for node := range 4 {
+		sg, err := NewSnowflakeGenerator(node, SnowflakeEpoch)
+		require.NoError(t, err)
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 5000 {
+					id := sg.GenerateID()
+					if _, appear := used.LoadOrStore(id, node); appear {
+						t.Errorf("id %s has already been used before", id)
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func TestSnowflakeWaitsForExpiredLease(t *testing.T) {
+	sg, _ := newTestSnowflake(t, 1)
+	sg.SetValidUntil(time.Now().Add(-time.Second))
+
+	generated := make(chan string)
+	go func() { generated <- sg.GenerateID() }()
+	select {
+	case id := <-generated:
+		t.Fatalf("id %s generated with an expired lease", id)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	sg.SetValidUntil(time.Now().Add(time.Minute))
+	select {
+	case <-generated:
+	case <-time.After(time.Second):
+		t.Fatal("no id generated once the lease was renewed")
+	}
+}
@@ -0,0 +1,199 @@
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Broker fans stats out to the subscribers of every replica
+type Broker interface {
+	Publish(ctx context.Context, stats Stats) error
+	// Listen calls fn with every stats published for the link until stop is called.
+	// fn must not block.
+	Listen(ctx context.Context, id string, fn func(Stats)) (stop func(), err error)
+	// Watch marks the link as watched for ttl
+	Watch(ctx context.Context, id string, ttl time.Duration) error
+	// Watched returns the links currently watched by any replica
+	Watched(ctx context.Context) (map[string]struct{}, error)
+}
+
+const watchedKey = "live:watched"
+
+func statsChannel(id string) string {
+	return fmt.Sprintf("live:stats:%s", id)
+}
+
+// RedisBroker uses Redis pub/sub, every replica shares a single subscriber connection
+// and only subscribes to channels of links that have local subscribers.
+type RedisBroker struct {
+	client redis.UniversalClient
+	pubsub *redis.PubSub
+
+	mu        sync.Mutex
+	listeners map[string]map[int]func(Stats)
+	nextID    int
+}
+
+func NewRedisBroker(client redis.UniversalClient) *RedisBroker {
+	rb := &RedisBroker{
+		client:    client,
+		pubsub:    client.Subscribe(context.Background()),
+		listeners: make(map[string]map[int]func(Stats)),
+	}
+	go rb.dispatch()
+	return rb
+}
+
+func (rb *RedisBroker) dispatch() {
+	for msg := range rb.pubsub.Channel() {
+		var stats Stats
+		if err := json.Unmarshal([]byte(msg.Payload), &stats); err != nil {
+			slog.Error("failed to decode live stats", "channel", msg.Channel, "error", err.Error())
+			continue
+		}
+
+		rb.mu.Lock()
+		for _, fn := range rb.listeners[msg.Channel] {
+			fn(stats)
+		}
+		rb.mu.Unlock()
+	}
+}
+
+func (rb *RedisBroker) Publish(ctx context.Context, stats Stats) error {
+	payload, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return rb.client.Publish(ctx, statsChannel(stats.ID), payload).Err()
+}
+
+func (rb *RedisBroker) Listen(ctx context.Context, id string, fn func(Stats)) (func(), error) {
+	channel := statsChannel(id)
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if len(rb.listeners[channel]) == 0 {
+		if err := rb.pubsub.Subscribe(ctx, channel); err != nil {
+			return nil, err
+		}
+		rb.listeners[channel] = make(map[int]func(Stats))
+	}
+	listenerID := rb.nextID
+	rb.nextID++
+	rb.listeners[channel][listenerID] = fn
+
+	stop := func() {
+		rb.mu.Lock()
+		defer rb.mu.Unlock()
+
+		delete(rb.listeners[channel], listenerID)
+		if len(rb.listeners[channel]) > 0 {
+			return
+		}
+		delete(rb.listeners, channel)
+		if err := rb.pubsub.Unsubscribe(context.Background(), channel); err != nil {
+			slog.Error("failed to unsubscribe from live stats", "channel", channel, "error", err.Error())
+		}
+	}
+	return stop, nil
+}
+
+// Watch stores the link in a sorted set scored by the expiry of the watch
+func (rb *RedisBroker) Watch(ctx context.Context, id string, ttl time.Duration) error {
+	return rb.client.ZAdd(ctx, watchedKey, redis.Z{
+		Score:  float64(time.Now().Add(ttl).UnixMilli()),
+		Member: id,
+	}).Err()
+}
+
+func (rb *RedisBroker) Watched(ctx context.Context) (map[string]struct{}, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if err := rb.client.ZRemRangeByScore(ctx, watchedKey, "-inf", now).Err(); err != nil {
+		return nil, err
+	}
+	ids, err := rb.client.ZRange(ctx, watchedKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	watched := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		watched[id] = struct{}{}
+	}
+	return watched, nil
+}
+
+// MemoryBroker keeps everything in process, it only works with a single replica
+type MemoryBroker struct {
+	mu        sync.Mutex
+	listeners map[string]map[int]func(Stats)
+	nextID    int
+	watched   map[string]time.Time
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		listeners: make(map[string]map[int]func(Stats)),
+		watched:   make(map[string]time.Time),
+	}
+}
+
+func (mb *MemoryBroker) Publish(_ context.Context, stats Stats) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	for _, fn := range mb.listeners[stats.ID] {
+		fn(stats)
+	}
+	return nil
+}
+
+func (mb *MemoryBroker) Listen(_ context.Context, id string, fn func(Stats)) (func(), error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.listeners[id] == nil {
+		mb.listeners[id] = make(map[int]func(Stats))
+	}
+	listenerID := mb.nextID
+	mb.nextID++
+	mb.listeners[id][listenerID] = fn
+
+	stop := func() {
+		mb.mu.Lock()
+		defer mb.mu.Unlock()
+		delete(mb.listeners[id], listenerID)
+	}
+	return stop, nil
+}
+
+func (mb *MemoryBroker) Watch(_ context.Context, id string, ttl time.Duration) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.watched[id] = time.Now().Add(ttl)
+	return nil
+}
+
+func (mb *MemoryBroker) Watched(_ context.Context) (map[string]struct{}, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	now := time.Now()
+	watched := make(map[string]struct{}, len(mb.watched))
+	for id, expiry := range mb.watched {
+		if expiry.Before(now) {
+			delete(mb.watched, id)
+			continue
+		}
+		watched[id] = struct{}{}
+	}
+	return watched, nil
+}
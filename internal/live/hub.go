@@ -0,0 +1,191 @@
+package live
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is the number of clicks a short URL received during one second
+type Stats struct {
+	ID       string    `json:"id"`
+	At       time.Time `json:"at"`
+	Count    int       `json:"count"`
+	BotCount int       `json:"bot_count"`
+	Dropped  int       `json:"dropped,omitempty"` // events not delivered because the subscriber was too slow
+}
+
+var ErrTooManySubscribers = errors.New("too many live subscribers")
+
+const (
+	// WatchTTL is how long a link stays watched after its subscriber's last keep-alive
+	WatchTTL = 45 * time.Second
+	// how often the hub fetches links watched by subscribers of other replicas
+	watchRefreshInterval = 2 * time.Second
+	// events buffered per subscriber before they are dropped
+	subscriberBufferSize = 32
+)
+
+// Hub aggregates clicks per second and fans them out to live subscribers through the broker.
+// Only links that have a subscriber on some replica (watched links) are aggregated and published,
+// so links nobody looks at don't cost anything.
+type Hub struct {
+	broker         Broker
+	maxSubscribers int64
+	subscribers    atomic.Int64
+
+	mu      sync.Mutex
+	clicks  map[string]*Stats   // clicks of the current second
+	watched map[string]struct{} // links that have subscribers on any replica
+}
+
+func NewHub(broker Broker, maxSubscribers int) *Hub {
+	return &Hub{
+		broker:         broker,
+		maxSubscribers: int64(maxSubscribers),
+		clicks:         make(map[string]*Stats),
+		watched:        make(map[string]struct{}),
+	}
+}
+
+// Record counts a click on the link if somebody is watching it
+func (h *Hub) Record(id string, bot bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.watched[id]; !ok {
+		return
+	}
+	stats, ok := h.clicks[id]
+	if !ok {
+		stats = &Stats{ID: id}
+		h.clicks[id] = stats
+	}
+	if bot {
+		stats.BotCount++
+	} else {
+		stats.Count++
+	}
+}
+
+// Run publishes the clicks aggregated during the last second, every second, until ctx is done
+func (h *Hub) Run(ctx context.Context) {
+	publishTicker := time.NewTicker(time.Second)
+	defer publishTicker.Stop()
+	refreshTicker := time.NewTicker(watchRefreshInterval)
+	defer refreshTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-publishTicker.C:
+			h.publish(ctx, now.Truncate(time.Second))
+		case <-refreshTicker.C:
+			h.refreshWatched(ctx)
+		}
+	}
+}
+
+func (h *Hub) publish(ctx context.Context, at time.Time) {
+	h.mu.Lock()
+	clicks := h.clicks
+	h.clicks = make(map[string]*Stats)
+	h.mu.Unlock()
+
+	for _, stats := range clicks {
+		stats.At = at
+		if err := h.broker.Publish(ctx, *stats); err != nil {
+			slog.Error("failed to publish live stats", "url_id", stats.ID, "error", err.Error())
+		}
+	}
+}
+
+func (h *Hub) refreshWatched(ctx context.Context) {
+	watched, err := h.broker.Watched(ctx)
+	if err != nil {
+		slog.Error("failed to retrieve watched links", "error", err.Error())
+		return
+	}
+	h.mu.Lock()
+	h.watched = watched
+	h.mu.Unlock()
+}
+
+// Subscribe starts receiving the per-second stats of the link.
+// It fails with ErrTooManySubscribers when the replica already serves the maximum number of subscribers.
+// The subscription must be closed by the caller.
+func (h *Hub) Subscribe(ctx context.Context, id string) (*Subscription, error) {
+	if h.subscribers.Add(1) > h.maxSubscribers {
+		h.subscribers.Add(-1)
+		return nil, ErrTooManySubscribers
+	}
+
+	sub := &Subscription{
+		hub: h,
+		id:  id,
+		c:   make(chan Stats, subscriberBufferSize),
+	}
+	stop, err := h.broker.Listen(ctx, id, sub.deliver)
+	if err != nil {
+		h.subscribers.Add(-1)
+		return nil, err
+	}
+	sub.stop = stop
+
+	h.mu.Lock()
+	h.watched[id] = struct{}{}
+	h.mu.Unlock()
+	sub.KeepAlive(ctx)
+
+	return sub, nil
+}
+
+// Subscribers returns the number of open subscriptions on this replica
+func (h *Hub) Subscribers() int {
+	return int(h.subscribers.Load())
+}
+
+type Subscription struct {
+	hub     *Hub
+	id      string
+	c       chan Stats
+	dropped atomic.Int64
+	stop    func()
+	once    sync.Once
+}
+
+// C returns the channel on which stats are delivered
+func (s *Subscription) C() <-chan Stats {
+	return s.c
+}
+
+// deliver never blocks the broker: when the subscriber doesn't keep up, stats are dropped
+// and the number of dropped events is reported with the next delivered one
+func (s *Subscription) deliver(stats Stats) {
+	dropped := s.dropped.Load()
+	stats.Dropped = int(dropped)
+	select {
+	case s.c <- stats:
+		s.dropped.Add(-dropped)
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// KeepAlive tells the other replicas that the link is still watched
+func (s *Subscription) KeepAlive(ctx context.Context) {
+	if err := s.hub.broker.Watch(ctx, s.id, WatchTTL); err != nil {
+		slog.Error("failed to mark link as watched", "url_id", s.id, "error", err.Error())
+	}
+}
+
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.stop()
+		s.hub.subscribers.Add(-1)
+	})
+}
@@ -0,0 +1,75 @@
+package live
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHubPublishWatchedOnly(t *testing.T) {
+	hub := NewHub(NewMemoryBroker(), 10)
+
+	sub, err := hub.Subscribe(context.Background(), "abc")
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	defer sub.Close()
+
+	hub.Record("abc", false)
+	hub.Record("abc", false)
+	hub.Record("abc", true)
+	hub.Record("unwatched", false)
+
+	at := time.Now().Truncate(time.Second)
+	hub.publish(context.Background(), at)
+
+	select {
+	case stats := <-sub.C():
+		assert.Equal(t, Stats{ID: "abc", At: at, Count: 2, BotCount: 1}, stats)
+	default:
+		t.Fatal("expected stats to be delivered")
+	}
+	assert.Empty(t, hub.clicks)
+}
+
+func TestHubMaxSubscribers(t *testing.T) {
+	hub := NewHub(NewMemoryBroker(), 1)
+
+	sub, err := hub.Subscribe(context.Background(), "abc")
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+
+	_, err = hub.Subscribe(context.Background(), "def")
+	assert.ErrorIs(t, err, ErrTooManySubscribers)
+
+	sub.Close()
+	sub.Close() // closing twice must not free two slots
+	assert.Equal(t, 0, hub.Subscribers())
+
+	sub, err = hub.Subscribe(context.Background(), "def")
+	assert.NoError(t, err)
+	sub.Close()
+}
+
+func TestSubscriptionDropsWhenSlow(t *testing.T) {
+	hub := NewHub(NewMemoryBroker(), 1)
+	sub, err := hub.Subscribe(context.Background(), "abc")
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	defer sub.Close()
+
+	for range subscriberBufferSize + 3 {
+		sub.deliver(Stats{ID: "abc", Count: 1})
+	}
+	for range subscriberBufferSize {
+		<-sub.C()
+	}
+
+	sub.deliver(Stats{ID: "abc", Count: 1})
+	stats := <-sub.C()
+	assert.Equal(t, 3, stats.Dropped)
+}
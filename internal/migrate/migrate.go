@@ -0,0 +1,290 @@
+package migrate
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// The schema of the urls database is built by numbered migrations embedded in the binary:
+// sql/NNNN_name.up.sql applies migration NNNN, sql/NNNN_name.down.sql reverts it.
+// The applied versions are recorded in schema_migrations, every migration runs in its own transaction,
+// and an advisory lock makes replicas that start together wait for the one that migrates.
+// The River tables are migrated apart, by background.Migrate.
+
+//go:embed sql/*.sql
+var files embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Load reads the migrations of dir, sorted by version. Every migration needs an up file, down is optional
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		base, direction, ok := cutLast(base, ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name.up.sql or NNNN_name.down.sql", entry.Name())
+		}
+		number, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil || version <= 0 || name == "" {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name.up.sql or NNNN_name.down.sql", entry.Name())
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+type Migrator struct {
+	db         *sqlx.DB
+	migrations []Migration
+}
+
+// New migrates db with the embedded migrations
+func New(db *sqlx.DB) (*Migrator, error) {
+	migrations, err := Load(files, "sql")
+	if err != nil {
+		return nil, err
+	}
+	return NewWithMigrations(db, migrations), nil
+}
+
+func NewWithMigrations(db *sqlx.DB, migrations []Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+var ErrNoDown = errors.New("migration can't be reverted")
+
+// lockKey identifies the advisory lock of the migrations, any constant works as long as it's shared
+const lockKey = 7_482_913_004
+
+var (
+	createMigrationsTableQuery = `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+	appliedQuery = `
+		SELECT version, name, applied_at FROM schema_migrations ORDER BY version;
+	`
+	recordQuery = `
+		INSERT INTO schema_migrations (version, name) VALUES ($1, $2);
+	`
+	forgetQuery = `
+		DELETE FROM schema_migrations WHERE version = $1;
+	`
+	migrationsTableExistsQuery = `
+		SELECT to_regclass('schema_migrations') IS NOT NULL;
+	`
+)
+
+// withLock runs f on a connection holding the migrations lock. The lock belongs to the session,
+// so everything runs on that one connection and the lock goes away with it if the process dies
+func (m *Migrator) withLock(ctx context.Context, f func(conn *sqlx.Conn) error) error {
+	conn, err := m.db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	defer func() {
+		// the context may be done already, the lock must be released anyway
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey); err != nil {
+			slog.Error("failed to unlock migrations", "error", err.Error())
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, createMigrationsTableQuery); err != nil {
+		return err
+	}
+	return f(conn)
+}
+
+type applied struct {
+	Version   int       `db:"version"`
+	Name      string    `db:"name"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+func (m *Migrator) applied(ctx context.Context, q sqlx.QueryerContext) (map[int]applied, error) {
+	var rows []applied
+	if err := sqlx.SelectContext(ctx, q, &rows, appliedQuery); err != nil {
+		return nil, err
+	}
+	versions := make(map[int]applied, len(rows))
+	for _, row := range rows {
+		versions[row.Version] = row
+	}
+	return versions, nil
+}
+
+// Up applies the migrations that haven't been applied yet, in order. It returns the versions it applied
+func (m *Migrator) Up(ctx context.Context) ([]int, error) {
+	var done []int
+	err := m.withLock(ctx, func(conn *sqlx.Conn) error {
+		versions, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mg := range m.migrations {
+			if _, ok := versions[mg.Version]; ok {
+				continue
+			}
+			if err := m.run(ctx, conn, mg.Up, func(tx *sqlx.Tx) error {
+				_, err := tx.ExecContext(ctx, recordQuery, mg.Version, mg.Name)
+				return err
+			}); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", mg.Version, mg.Name, err)
+			}
+			slog.Info("applied migration", "version", mg.Version, "name", mg.Name)
+			done = append(done, mg.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, latest first. It returns the versions it reverted
+func (m *Migrator) Down(ctx context.Context, steps int) ([]int, error) {
+	var done []int
+	err := m.withLock(ctx, func(conn *sqlx.Conn) error {
+		versions, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mg := m.migrations[i]
+			if _, ok := versions[mg.Version]; !ok {
+				continue
+			}
+			if mg.Down == "" {
+				return fmt.Errorf("migration %d_%s: %w", mg.Version, mg.Name, ErrNoDown)
+			}
+			if err := m.run(ctx, conn, mg.Down, func(tx *sqlx.Tx) error {
+				_, err := tx.ExecContext(ctx, forgetQuery, mg.Version)
+				return err
+			}); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", mg.Version, mg.Name, err)
+			}
+			slog.Info("reverted migration", "version", mg.Version, "name", mg.Name)
+			done = append(done, mg.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// run executes query and record in one transaction, the migration is recorded only if it went through
+func (m *Migrator) run(ctx context.Context, conn *sqlx.Conn, query string, record func(tx *sqlx.Tx) error) error {
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type Status struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Status lists the known migrations and whether they're applied, along with applied versions
+// this binary doesn't know about (the database was migrated by a newer release).
+// It doesn't wait for the migrations lock: a migration that is being applied shows as not applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var exists bool
+	if err := m.db.GetContext(ctx, &exists, migrationsTableExistsQuery); err != nil {
+		return nil, err
+	}
+	versions := make(map[int]applied)
+	if exists {
+		var err error
+		if versions, err = m.applied(ctx, m.db); err != nil {
+			return nil, err
+		}
+	}
+
+	var statuses []Status
+	for _, mg := range m.migrations {
+		row, ok := versions[mg.Version]
+		statuses = append(statuses, Status{Version: mg.Version, Name: mg.Name, Applied: ok, AppliedAt: row.AppliedAt})
+		delete(versions, mg.Version)
+	}
+	for _, row := range versions {
+		statuses = append(statuses, Status{Version: row.Version, Name: row.Name, Applied: true, AppliedAt: row.AppliedAt})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
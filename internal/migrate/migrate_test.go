@@ -0,0 +1,123 @@
+package migrate
+
+import (
+	"context"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"sql/0002_second.up.sql":  {Data: []byte("CREATE TABLE b ();")},
+		"sql/0001_first.up.sql":   {Data: []byte("CREATE TABLE a ();")},
+		"sql/0001_first.down.sql": {Data: []byte("DROP TABLE a;")},
+		"sql/README":              {Data: []byte("not a migration")},
+		"sql/0010_tenth.up.sql":   {Data: []byte("SELECT 1;")},
+		"sql/0010_tenth.down.sql": {Data: []byte("SELECT 1;")},
+		"other/0003_other.up.sql": {Data: []byte("SELECT 1;")},
+	}
+	migrations, err := Load(fsys, "sql")
+	require.NoError(t, err)
+	require.Len(t, migrations, 3)
+
+	assert.Equal(t, Migration{Version: 1, Name: "first", Up: "CREATE TABLE a ();", Down: "DROP TABLE a;"}, migrations[0])
+	assert.Equal(t, Migration{Version: 2, Name: "second", Up: "CREATE TABLE b ();"}, migrations[1])
+	assert.Equal(t, 10, migrations[2].Version)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, fsys := range map[string]fstest.MapFS{
+		"no direction":  {"sql/0001_first.sql": {}},
+		"no version":    {"sql/first.up.sql": {}},
+		"no name":       {"sql/0001.up.sql": {}},
+		"no up":         {"sql/0001_first.down.sql": {Data: []byte("DROP TABLE a;")}},
+		"renamed":       {"sql/0001_first.up.sql": {Data: []byte("SELECT 1;")}, "sql/0001_other.down.sql": {}},
+		"zero version":  {"sql/0000_first.up.sql": {Data: []byte("SELECT 1;")}},
+		"bad direction": {"sql/0001_first.sideways.sql": {}},
+	} {
+		_, err := Load(fsys, "sql")
+		assert.Error(t, err, name)
+	}
+}
+
+// The embedded migrations must all load and be reversible
+func TestEmbedded(t *testing.T) {
+	migrations, err := Load(files, "sql")
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version, "versions must have no gaps")
+		assert.NotEmpty(t, m.Down, m.Name)
+	}
+}
+
+func TestUpDownStatus(t *testing.T) {
+	db := sqlx.MustConnect("postgres", os.Getenv("URL_DSN"))
+	defer db.Close()
+	ctx := context.Background()
+
+	_, err := db.Exec(`DROP TABLE IF EXISTS migrate_test_a, migrate_test_b; DELETE FROM schema_migrations WHERE version >= 9000`)
+	if err != nil {
+		// schema_migrations doesn't exist yet
+		_, err = db.Exec(`DROP TABLE IF EXISTS migrate_test_a, migrate_test_b`)
+		require.NoError(t, err)
+	}
+	m := NewWithMigrations(db, []Migration{
+		{Version: 9001, Name: "a", Up: "CREATE TABLE migrate_test_a (id INT)", Down: "DROP TABLE migrate_test_a"},
+		{Version: 9002, Name: "b", Up: "CREATE TABLE migrate_test_b (id INT)", Down: "DROP TABLE migrate_test_b"},
+	})
+
+	applied, err := m.Up(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []int{9001, 9002}, applied)
+
+	// applied migrations aren't applied again
+	applied, err = m.Up(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	reverted, err := m.Down(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{9002}, reverted)
+
+	statuses, err := m.Status(ctx)
+	require.NoError(t, err)
+	var ours []Status
+	for _, s := range statuses {
+		if s.Version >= 9000 {
+			ours = append(ours, s)
+		}
+	}
+	require.Len(t, ours, 2)
+	assert.True(t, ours[0].Applied)
+	assert.False(t, ours[1].Applied)
+
+	reverted, err = m.Down(ctx, 5)
+	require.NoError(t, err)
+	assert.Equal(t, []int{9001}, reverted)
+}
+
+// A failing migration is rolled back and not recorded
+func TestUpFailure(t *testing.T) {
+	db := sqlx.MustConnect("postgres", os.Getenv("URL_DSN"))
+	defer db.Close()
+	ctx := context.Background()
+
+	m := NewWithMigrations(db, []Migration{
+		{Version: 9101, Name: "broken", Up: "CREATE TABLE migrate_test_c (id INT); SELECT * FROM missing_table"},
+	})
+	_, err := m.Up(ctx)
+	require.Error(t, err)
+
+	var exists bool
+	require.NoError(t, db.Get(&exists, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = 9101)`))
+	assert.False(t, exists)
+	require.NoError(t, db.Get(&exists, `SELECT to_regclass('migrate_test_c') IS NOT NULL`))
+	assert.False(t, exists)
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS clicks;
+DROP TABLE IF EXISTS view_flushes;
+DROP TABLE IF EXISTS ids;
+DROP TABLE IF EXISTS urls;
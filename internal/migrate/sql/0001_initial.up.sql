@@ -0,0 +1,42 @@
+-- The schema as it was before migrations, IF NOT EXISTS lets databases created back then adopt it
+CREATE TABLE IF NOT EXISTS urls (
+	id TEXT PRIMARY KEY,
+	original_url TEXT NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	fraud BOOLEAN DEFAULT false,
+	count INTEGER DEFAULT 0,
+	bot_count INTEGER DEFAULT 0
+);
+
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS bot_count INTEGER DEFAULT 0;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS campaign TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_urls_owner_created_at ON urls (owner, created_at);
+CREATE INDEX IF NOT EXISTS idx_urls_owner_campaign ON urls (owner, campaign) WHERE campaign <> '';
+CREATE INDEX IF NOT EXISTS idx_urls_count ON urls (count DESC);
+
+CREATE INDEX IF NOT EXISTS idx_urls_id ON urls (id);
+
+CREATE TABLE IF NOT EXISTS ids (
+	id BIGINT PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS view_flushes (
+	token TEXT PRIMARY KEY,
+	url_id TEXT NOT NULL,
+	applied_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_view_flushes_applied_at ON view_flushes (applied_at);
+
+CREATE TABLE IF NOT EXISTS clicks (
+	seq BIGSERIAL PRIMARY KEY,
+	url_id TEXT NOT NULL,
+	clicked_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	bot BOOLEAN NOT NULL DEFAULT false,
+	referer TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_clicks_url_id_clicked_at ON clicks (url_id, clicked_at, seq);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS id_lease_mark;
+DROP TABLE IF EXISTS id_leases;
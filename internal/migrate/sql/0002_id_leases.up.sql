@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS id_leases (
+	range_start BIGINT PRIMARY KEY,
+	range_end BIGINT NOT NULL,
+	reserved_upto BIGINT NOT NULL,
+	holder TEXT NOT NULL,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_id_leases_holder ON id_leases (holder);
+
+-- Fresh ranges start at next_start. The first one is placed after the ranges recorded in ids by the
+-- previous allocator, with room for the 16 ranges a replica held without recording them
+CREATE TABLE IF NOT EXISTS id_lease_mark (
+	singleton BOOLEAN PRIMARY KEY DEFAULT true CHECK (singleton),
+	next_start BIGINT NOT NULL
+);
+
+INSERT INTO id_lease_mark (next_start)
+SELECT (GREATEST(MAX(id) - 1, 0) / 33554432 + 17) * 33554432 + 1 FROM ids
+ON CONFLICT DO NOTHING;
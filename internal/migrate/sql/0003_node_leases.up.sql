@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS node_leases (
+	node_id INTEGER PRIMARY KEY,
+	holder TEXT NOT NULL,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	last_ms BIGINT NOT NULL,
+	released BOOLEAN NOT NULL DEFAULT false
+);
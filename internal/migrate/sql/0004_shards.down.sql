@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS shard_map;
+DROP INDEX IF EXISTS idx_urls_shard_key;
+ALTER TABLE urls DROP COLUMN IF EXISTS shard_key;
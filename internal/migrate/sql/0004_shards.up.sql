@@ -0,0 +1,12 @@
+-- Short URLs are placed on shards by their shard key (see the shard package). Rows written before sharding
+-- have no key until `shortenctl shard backfill` computes it
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS shard_key BIGINT;
+
+CREATE INDEX IF NOT EXISTS idx_urls_shard_key ON urls (shard_key, id);
+
+-- Versions of the shard map, only read on the first shard (the catalog)
+CREATE TABLE IF NOT EXISTS shard_map (
+	version BIGINT PRIMARY KEY,
+	ranges JSONB NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_clicks_source;
+ALTER TABLE clicks DROP COLUMN IF EXISTS source_seq;
+ALTER TABLE clicks DROP COLUMN IF EXISTS source_shard;
@@ -0,0 +1,6 @@
+-- Clicks moved by the rebalancer keep the shard and seq they had on the source, so that a move
+-- interrupted between the insert and the delete can be run again without counting them twice
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS source_shard INTEGER;
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS source_seq BIGINT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_clicks_source ON clicks (source_shard, source_seq);
@@ -0,0 +1,62 @@
+package msq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// URLSubscriber receives every short URL published to the "url" exchange,
+// each subscriber has its own exclusive queue so every replica gets every message.
+type URLSubscriber struct {
+	ch     *amqp.Channel
+	urlMsg <-chan amqp.Delivery
+}
+
+func NewURLSubscriber(conn *amqp.Connection) (*URLSubscriber, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ch.ExchangeDeclare("url", "fanout", true, false, false, false, nil); err != nil {
+		return nil, err
+	}
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = ch.QueueBind(q.Name, "", "url", false, nil); err != nil {
+		return nil, err
+	}
+	urlMsg, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &URLSubscriber{ch: ch, urlMsg: urlMsg}, nil
+}
+
+// Consume calls fn with every published short URL until ctx is done or the channel is closed
+func (us *URLSubscriber) Consume(ctx context.Context, fn func(url string, id string)) error {
+	defer us.ch.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-us.urlMsg:
+			if !ok {
+				return errors.New("url subscription closed")
+			}
+			var data map[string]string
+			if err := json.Unmarshal(msg.Body, &data); err != nil {
+				slog.Error("failed to decode url message", "error", err.Error())
+				continue
+			}
+			fn(data["url"], data["id"])
+		}
+	}
+}
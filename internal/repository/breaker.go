@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/armistcxy/shorten/internal/breaker"
+	"github.com/armistcxy/shorten/internal/domain"
+)
+
+// BreakerURLRepository guards the lookups of short URLs with a circuit breaker: when the database keeps
+// failing, lookups fail right away with domain.ErrUnavailable instead of piling up until they time out.
+// Only Get goes through the breaker, it is the only call on the hot path.
+type BreakerURLRepository struct {
+	domain.URLRepository
+	breaker *breaker.Breaker
+}
+
+func NewBreakerURLRepository(repo domain.URLRepository, b *breaker.Breaker) *BreakerURLRepository {
+	return &BreakerURLRepository{
+		URLRepository: repo,
+		breaker:       b,
+	}
+}
+
+// IsDBFailure tells which errors count against the breaker: a short URL that doesn't exist or is disabled
+// is a valid answer
+func IsDBFailure(err error) bool {
+	return err != nil && !errors.Is(err, domain.ErrNotFound) && !errors.Is(err, domain.ErrDisabled)
+}
+
+func (br *BreakerURLRepository) Get(ctx context.Context, id string) (string, error) {
+	var origin string
+	err := br.breaker.Execute(func() error {
+		var err error
+		origin, err = br.URLRepository.Get(ctx, id)
+		return err
+	})
+	if errors.Is(err, breaker.ErrOpen) {
+		return "", fmt.Errorf("%w: %w", domain.ErrUnavailable, err)
+	}
+	return origin, err
+}
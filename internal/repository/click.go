@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PostgresClickRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresClickRepository(pool *pgxpool.Pool) *PostgresClickRepository {
+	return &PostgresClickRepository{
+		pool: pool,
+	}
+}
+
+var clickColumns = []string{"url_id", "clicked_at", "bot", "referer", "user_agent"}
+
+// BatchRecord inserts clicks with COPY, which is much cheaper than INSERT for large batches
+func (cr *PostgresClickRepository) BatchRecord(ctx context.Context, clicks []domain.Click) error {
+	_, err := cr.pool.CopyFrom(ctx, pgx.Identifier{"clicks"}, clickColumns,
+		pgx.CopyFromSlice(len(clicks), func(i int) ([]any, error) {
+			c := clicks[i]
+			return []any{c.URLID, c.At, c.Bot, c.Referer, c.UserAgent}, nil
+		}),
+	)
+	return err
+}
+
+var (
+	streamClicksQuery = `
+		SELECT seq, url_id, clicked_at, bot, referer, user_agent
+		FROM clicks
+		WHERE url_id = $1 AND clicked_at < $2 AND (bot = false OR $3)
+			AND (clicked_at, seq) > ($4, $5)
+		ORDER BY clicked_at, seq
+		LIMIT $6
+	`
+)
+
+func (cr *PostgresClickRepository) StreamClicks(ctx context.Context, id string, filter domain.StatsFilter, fn func(domain.Click) error) error {
+	// keyset pagination on (clicked_at, seq), seq is never negative
+	// so the first chunk starts with the clicks at filter.From
+	var (
+		lastAt  time.Time = filter.From
+		lastSeq int64     = -1
+	)
+	for {
+		rows, err := cr.pool.Query(ctx, streamClicksQuery, id, filter.To, filter.IncludeBots, lastAt, lastSeq, streamChunkSize)
+		if err != nil {
+			return err
+		}
+
+		n := 0
+		for rows.Next() {
+			var click domain.Click
+			if err := rows.Scan(&lastSeq, &click.URLID, &click.At, &click.Bot, &click.Referer, &click.UserAgent); err != nil {
+				rows.Close()
+				return err
+			}
+			if err := fn(click); err != nil {
+				rows.Close()
+				return err
+			}
+			lastAt = click.At
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if n < streamChunkSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamClicks(t *testing.T) {
+	_, db = getSystem()
+	pool, err := pgxpool.New(context.Background(), os.Getenv("URL_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	clickRepo := NewPostgresClickRepository(pool)
+
+	id := "clicktest"
+	defer func() {
+		_, _ = db.Exec("DELETE FROM clicks WHERE url_id=$1", id)
+	}()
+
+	at := time.Now().Truncate(time.Second)
+	clicks := []domain.Click{
+		{URLID: id, At: at.Add(-2 * time.Hour)},
+		{URLID: id, At: at.Add(-time.Minute), Bot: true, UserAgent: "Slackbot"},
+		{URLID: id, At: at.Add(-time.Minute), Referer: "https://example.com"},
+		{URLID: id, At: at},
+	}
+	if err := clickRepo.BatchRecord(context.Background(), clicks); err != nil {
+		t.Fatalf("failed to record clicks: %s", err)
+	}
+
+	var got []domain.Click
+	filter := domain.StatsFilter{From: at.Add(-time.Hour), To: at}
+	err = clickRepo.StreamClicks(context.Background(), id, filter, func(c domain.Click) error {
+		got = append(got, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to stream clicks: %s", err)
+	}
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, "https://example.com", got[0].Referer)
+	}
+
+	got = nil
+	filter.IncludeBots = true
+	err = clickRepo.StreamClicks(context.Background(), id, filter, func(c domain.Click) error {
+		got = append(got, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to stream clicks: %s", err)
+	}
+	assert.Len(t, got, 2)
+}
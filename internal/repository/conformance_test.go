@@ -0,0 +1,350 @@
+package repository
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Every URLRepository (and its ClickRepository) must pass testURLRepository, so that the handler
+// behaves the same whatever stores the short URLs.
+
+type repoHarness struct {
+	urls   domain.URLRepository
+	clicks domain.ClickRepository
+	// addViews adds to the view counters, the way the background worker flushes views
+	addViews  func(t *testing.T, id string, count int, botCount int)
+	markFraud func(t *testing.T, id string)
+	// clear removes the fixtures, for repositories that outlive the test
+	clear func(ids []string)
+}
+
+func testURLRepository(t *testing.T, newHarness func(t *testing.T) repoHarness) {
+	ctx := context.Background()
+
+	// create makes a fresh repository with the inputs, they're removed when the test ends
+	create := func(t *testing.T, inputs ...domain.CreateInput) repoHarness {
+		h := newHarness(t)
+		if h.clear != nil {
+			ids := make([]string, len(inputs))
+			for i := range inputs {
+				ids[i] = inputs[i].ID
+			}
+			t.Cleanup(func() { h.clear(ids) })
+		}
+		require.NoError(t, h.urls.BatchCreate(ctx, inputs))
+		return h
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		h := create(t)
+		t.Cleanup(func() {
+			if h.clear != nil {
+				h.clear([]string{"cfcrt1"})
+			}
+		})
+		short, err := h.urls.Create(ctx, "cfcrt1", "https://example.com/create")
+		require.NoError(t, err)
+		assert.Equal(t, "cfcrt1", short.ID)
+		assert.Equal(t, "https://example.com/create", short.Origin)
+		assert.WithinDuration(t, time.Now(), short.CreatedAt, time.Minute)
+
+		_, err = h.urls.Create(ctx, "cfcrt1", "https://example.com/other")
+		assert.ErrorIs(t, err, domain.ErrConflict)
+
+		origin, err := h.urls.Get(ctx, "cfcrt1")
+		require.NoError(t, err)
+		assert.Equal(t, "https://example.com/create", origin)
+	})
+
+	t.Run("BatchCreate", func(t *testing.T) {
+		h := create(t,
+			domain.CreateInput{ID: "cfbat1", URL: "https://example.com/1", Owner: "marketing", Campaign: "spring"},
+			domain.CreateInput{ID: "cfbat2", URL: "https://example.com/2"},
+		)
+		origin, err := h.urls.Get(ctx, "cfbat2")
+		require.NoError(t, err)
+		assert.Equal(t, "https://example.com/2", origin)
+
+		owner, err := h.urls.GetOwner(ctx, "cfbat1")
+		require.NoError(t, err)
+		assert.Equal(t, "marketing", owner)
+		owner, err = h.urls.GetOwner(ctx, "cfbat2")
+		require.NoError(t, err)
+		assert.Equal(t, "", owner)
+
+		// a batch with a taken id is rejected as a whole
+		err = h.urls.BatchCreate(ctx, []domain.CreateInput{
+			{ID: "cfbat3", URL: "https://example.com/3"},
+			{ID: "cfbat1", URL: "https://example.com/1"},
+		})
+		assert.ErrorIs(t, err, domain.ErrConflict)
+		_, err = h.urls.Get(ctx, "cfbat3")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+
+		assert.NoError(t, h.urls.BatchCreate(ctx, nil))
+	})
+
+	t.Run("BatchCreateSkipTaken", func(t *testing.T) {
+		h := create(t, domain.CreateInput{ID: "cfskp1", URL: "https://example.com/1"})
+
+		// the taken id is reported, the rest of the batch is inserted
+		taken, err := h.urls.BatchCreateSkipTaken(ctx, []domain.CreateInput{
+			{ID: "cfskp2", URL: "https://example.com/2", Owner: "marketing"},
+			{ID: "cfskp1", URL: "https://example.com/other"},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"cfskp1"}, taken)
+
+		origin, err := h.urls.Get(ctx, "cfskp1")
+		require.NoError(t, err)
+		assert.Equal(t, "https://example.com/1", origin)
+		owner, err := h.urls.GetOwner(ctx, "cfskp2")
+		require.NoError(t, err)
+		assert.Equal(t, "marketing", owner)
+
+		taken, err = h.urls.BatchCreateSkipTaken(ctx, nil)
+		require.NoError(t, err)
+		assert.Empty(t, taken)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		h := create(t)
+		_, err := h.urls.Get(ctx, "cfmiss")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+		_, err = h.urls.RetrieveFraud(ctx, "cfmiss")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+		_, err = h.urls.GetView(ctx, "cfmiss")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+		_, err = h.urls.GetBotView(ctx, "cfmiss")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+		_, err = h.urls.GetOwner(ctx, "cfmiss")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+		assert.ErrorIs(t, h.urls.Delete(ctx, "cfmiss"), domain.ErrNotFound)
+	})
+
+	t.Run("ViewsAndFraud", func(t *testing.T) {
+		h := create(t, domain.CreateInput{ID: "cfview", URL: "https://example.com/view"})
+		view, err := h.urls.GetView(ctx, "cfview")
+		require.NoError(t, err)
+		assert.Zero(t, view)
+		fraud, err := h.urls.RetrieveFraud(ctx, "cfview")
+		require.NoError(t, err)
+		assert.False(t, fraud)
+
+		h.addViews(t, "cfview", 5, 2)
+		h.markFraud(t, "cfview")
+
+		view, err = h.urls.GetView(ctx, "cfview")
+		require.NoError(t, err)
+		assert.Equal(t, 5, view)
+		view, err = h.urls.GetBotView(ctx, "cfview")
+		require.NoError(t, err)
+		assert.Equal(t, 2, view)
+		fraud, err = h.urls.RetrieveFraud(ctx, "cfview")
+		require.NoError(t, err)
+		assert.True(t, fraud)
+		_, err = h.urls.Get(ctx, "cfview")
+		assert.ErrorIs(t, err, domain.ErrDisabled)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		h := create(t, domain.CreateInput{ID: "cfdel1", URL: "https://example.com/delete"})
+		at := time.Now()
+		require.NoError(t, h.clicks.BatchRecord(ctx, []domain.Click{{URLID: "cfdel1", At: at}}))
+
+		require.NoError(t, h.urls.Delete(ctx, "cfdel1"))
+		_, err := h.urls.Get(ctx, "cfdel1")
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+
+		// the clicks go along with the short URL
+		n := 0
+		filter := domain.StatsFilter{From: at.Add(-time.Hour), To: at.Add(time.Hour), IncludeBots: true}
+		require.NoError(t, h.clicks.StreamClicks(ctx, "cfdel1", filter, func(domain.Click) error {
+			n++
+			return nil
+		}))
+		assert.Zero(t, n)
+	})
+
+	t.Run("StreamLinks", func(t *testing.T) {
+		h := create(t,
+			domain.CreateInput{ID: "cfstr2", URL: "https://example.com/2", Owner: "cfmarketing", Campaign: "spring"},
+			domain.CreateInput{ID: "cfstr1", URL: "https://example.com/1", Owner: "cfmarketing"},
+			domain.CreateInput{ID: "cfstr3", URL: "https://example.com/3", Owner: "cfsales"},
+		)
+
+		var links []domain.ShortURL
+		filter := domain.StatsFilter{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}
+		require.NoError(t, h.urls.StreamLinks(ctx, "cfmarketing", filter, func(link domain.ShortURL) error {
+			links = append(links, link)
+			return nil
+		}))
+		require.Len(t, links, 2)
+		assert.Equal(t, "cfstr1", links[0].ID)
+		assert.Equal(t, "cfstr2", links[1].ID)
+		assert.Equal(t, "https://example.com/2", links[1].Origin)
+		assert.Equal(t, "cfmarketing", links[1].Owner)
+		assert.Equal(t, "spring", links[1].Campaign)
+		assert.WithinDuration(t, time.Now(), links[1].CreatedAt, time.Minute)
+
+		// created before the range
+		links = nil
+		filter = domain.StatsFilter{From: time.Now().Add(time.Hour), To: time.Now().Add(2 * time.Hour)}
+		require.NoError(t, h.urls.StreamLinks(ctx, "cfmarketing", filter, func(link domain.ShortURL) error {
+			links = append(links, link)
+			return nil
+		}))
+		assert.Empty(t, links)
+	})
+
+	t.Run("ScanIDs", func(t *testing.T) {
+		h := create(t,
+			domain.CreateInput{ID: "cfscn2", URL: "https://example.com/2"},
+			domain.CreateInput{ID: "cfscn1", URL: "https://example.com/1"},
+		)
+		var ids []string
+		require.NoError(t, h.urls.ScanIDs(ctx, func(id string) error {
+			ids = append(ids, id)
+			return nil
+		}))
+		assert.True(t, slices.IsSorted(ids))
+		assert.Contains(t, ids, "cfscn1")
+		assert.Contains(t, ids, "cfscn2")
+	})
+
+	t.Run("CampaignStats", func(t *testing.T) {
+		h := create(t,
+			domain.CreateInput{ID: "cfcmp1", URL: "https://example.com/a", Owner: "cfmarketing", Campaign: "spring"},
+			domain.CreateInput{ID: "cfcmp2", URL: "https://example.com/b", Owner: "cfmarketing", Campaign: "spring"},
+			domain.CreateInput{ID: "cfcmp3", URL: "https://example.com/c", Owner: "cfmarketing", Campaign: "summer"},
+			domain.CreateInput{ID: "cfcmp4", URL: "https://example.com/d", Owner: "cfsales", Campaign: "spring"},
+			domain.CreateInput{ID: "cfcmp5", URL: "https://example.com/e", Owner: "cfmarketing"},
+		)
+		for _, id := range []string{"cfcmp1", "cfcmp2", "cfcmp4"} {
+			h.addViews(t, id, 3, 1)
+		}
+
+		stats, err := h.urls.GetCampaignStats(ctx, "cfmarketing", "spring")
+		require.NoError(t, err)
+		assert.Equal(t, domain.CampaignStats{Campaign: "spring", Links: 2, Count: 6, BotCount: 2}, stats)
+
+		stats, err = h.urls.GetCampaignStats(ctx, "cfmarketing", "winter")
+		require.NoError(t, err)
+		assert.Equal(t, domain.CampaignStats{Campaign: "winter"}, stats)
+
+		list, err := h.urls.ListCampaignStats(ctx, "cfmarketing")
+		require.NoError(t, err)
+		assert.Equal(t, []domain.CampaignStats{
+			{Campaign: "spring", Links: 2, Count: 6, BotCount: 2},
+			{Campaign: "summer", Links: 1},
+		}, list)
+
+		list, err = h.urls.ListCampaignStats(ctx, "cfnobody")
+		require.NoError(t, err)
+		assert.NotNil(t, list)
+		assert.Empty(t, list)
+	})
+
+	// the repository may hold other short URLs (Postgres), only the fixtures are compared
+	fixtures := func(links []domain.ShortURL, ids ...string) []domain.ShortURL {
+		return slices.DeleteFunc(links, func(link domain.ShortURL) bool { return !slices.Contains(ids, link.ID) })
+	}
+
+	t.Run("TopLinks", func(t *testing.T) {
+		h := create(t,
+			domain.CreateInput{ID: "cftop1", URL: "https://example.com/1"},
+			domain.CreateInput{ID: "cftop2", URL: "https://example.com/2"},
+			domain.CreateInput{ID: "cftop3", URL: "https://example.com/3"},
+		)
+		h.addViews(t, "cftop1", 999999999, 0)
+		h.addViews(t, "cftop2", 1000000000, 0)
+		h.addViews(t, "cftop3", 1000000001, 0)
+		h.markFraud(t, "cftop3")
+
+		links, err := h.urls.TopLinks(ctx, 3, time.Time{})
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(links), 3)
+		assert.Equal(t, []domain.ShortURL{
+			{ID: "cftop2", Origin: "https://example.com/2", Count: 1000000000},
+			{ID: "cftop1", Origin: "https://example.com/1", Count: 999999999},
+		}, fixtures(links, "cftop1", "cftop2", "cftop3"))
+
+		links, err = h.urls.TopLinks(ctx, 1, time.Time{})
+		require.NoError(t, err)
+		assert.Len(t, links, 1)
+	})
+
+	t.Run("TopLinksSince", func(t *testing.T) {
+		h := create(t,
+			domain.CreateInput{ID: "cfrec1", URL: "https://example.com/1"},
+			domain.CreateInput{ID: "cfrec2", URL: "https://example.com/2"},
+		)
+		// huge all-time counts don't matter, only the human clicks since then
+		h.addViews(t, "cfrec1", 1000000000, 0)
+		since := time.Now().Add(-time.Hour)
+		clicks := []domain.Click{
+			{URLID: "cfrec1", At: since.Add(-time.Minute)},
+			{URLID: "cfrec1", At: since.Add(time.Minute)},
+			{URLID: "cfrec1", At: since.Add(time.Minute), Bot: true},
+			{URLID: "cfrec1", At: since.Add(time.Minute), Bot: true},
+		}
+		for range 1000 {
+			clicks = append(clicks, domain.Click{URLID: "cfrec2", At: since.Add(2 * time.Minute)})
+		}
+		require.NoError(t, h.clicks.BatchRecord(ctx, clicks))
+		if h.clear != nil {
+			t.Cleanup(func() { h.clear([]string{"cfrec1", "cfrec2"}) })
+		}
+
+		links, err := h.urls.TopLinks(ctx, 1000, since)
+		require.NoError(t, err)
+		assert.Equal(t, []domain.ShortURL{
+			{ID: "cfrec2", Origin: "https://example.com/2", Count: 1000},
+			{ID: "cfrec1", Origin: "https://example.com/1", Count: 1},
+		}, fixtures(links, "cfrec1", "cfrec2"))
+	})
+
+	t.Run("StreamClicks", func(t *testing.T) {
+		h := create(t)
+		id := "cfclick"
+		if h.clear != nil {
+			t.Cleanup(func() { h.clear([]string{id}) })
+		}
+		at := time.Now().Truncate(time.Second)
+		require.NoError(t, h.clicks.BatchRecord(ctx, []domain.Click{
+			{URLID: id, At: at.Add(-2 * time.Hour)},
+			{URLID: id, At: at.Add(-time.Minute), Bot: true, UserAgent: "Slackbot"},
+			{URLID: id, At: at.Add(-time.Minute), Referer: "https://example.com"},
+			{URLID: id, At: at.Add(-2 * time.Minute), Referer: "https://earlier.example.com"},
+			{URLID: id, At: at},
+		}))
+
+		var got []domain.Click
+		filter := domain.StatsFilter{From: at.Add(-time.Hour), To: at}
+		stream := func() {
+			got = nil
+			require.NoError(t, h.clicks.StreamClicks(ctx, id, filter, func(c domain.Click) error {
+				got = append(got, c)
+				return nil
+			}))
+		}
+		stream()
+		if assert.Len(t, got, 2) {
+			assert.Equal(t, "https://earlier.example.com", got[0].Referer)
+			assert.Equal(t, "https://example.com", got[1].Referer)
+			assert.True(t, got[1].At.Equal(at.Add(-time.Minute)))
+		}
+
+		filter.IncludeBots = true
+		stream()
+		if assert.Len(t, got, 3) {
+			assert.Equal(t, "Slackbot", got[1].UserAgent)
+		}
+	})
+}
@@ -0,0 +1,305 @@
+package repository
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+)
+
+// MemoryURLRepository keeps the short URLs and their clicks in memory, for tests and single replica
+// deployments that can afford to lose everything on restart. It is safe for concurrent use.
+// Callbacks (StreamLinks, ScanIDs, ...) run on a snapshot, they may call the repository.
+type MemoryURLRepository struct {
+	mu     sync.RWMutex
+	urls   map[string]domain.ShortURL
+	clicks map[string][]domain.Click // by short URL, in insertion order
+	now    func() time.Time
+}
+
+func NewMemoryURLRepository() *MemoryURLRepository {
+	return &MemoryURLRepository{
+		urls:   make(map[string]domain.ShortURL),
+		clicks: make(map[string][]domain.Click),
+		now:    time.Now,
+	}
+}
+
+func (mr *MemoryURLRepository) Create(ctx context.Context, id string, url string) (*domain.ShortURL, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, ok := mr.urls[id]; ok {
+		return nil, domain.ErrConflict
+	}
+	short := domain.ShortURL{ID: id, Origin: url, CreatedAt: mr.now()}
+	mr.urls[id] = short
+	return &short, nil
+}
+
+// BatchCreate inserts all the short URLs or none of them
+func (mr *MemoryURLRepository) BatchCreate(ctx context.Context, inputs []domain.CreateInput) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	seen := make(map[string]bool, len(inputs))
+	for _, input := range inputs {
+		if _, ok := mr.urls[input.ID]; ok || seen[input.ID] {
+			return domain.ErrConflict
+		}
+		seen[input.ID] = true
+	}
+	now := mr.now()
+	for _, input := range inputs {
+		mr.urls[input.ID] = domain.ShortURL{
+			ID:        input.ID,
+			Origin:    input.URL,
+			CreatedAt: now,
+			Owner:     input.Owner,
+			Campaign:  input.Campaign,
+		}
+	}
+	return nil
+}
+
+// BatchCreateSkipTaken inserts the short URLs whose id is free
+func (mr *MemoryURLRepository) BatchCreateSkipTaken(ctx context.Context, inputs []domain.CreateInput) ([]string, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	var taken []string
+	now := mr.now()
+	for _, input := range inputs {
+		if _, ok := mr.urls[input.ID]; ok {
+			taken = append(taken, input.ID)
+			continue
+		}
+		mr.urls[input.ID] = domain.ShortURL{
+			ID:        input.ID,
+			Origin:    input.URL,
+			CreatedAt: now,
+			Owner:     input.Owner,
+			Campaign:  input.Campaign,
+		}
+	}
+	return taken, nil
+}
+
+func (mr *MemoryURLRepository) get(id string) (domain.ShortURL, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+	short, ok := mr.urls[id]
+	if !ok {
+		return domain.ShortURL{}, domain.ErrNotFound
+	}
+	return short, nil
+}
+
+func (mr *MemoryURLRepository) Get(ctx context.Context, id string) (string, error) {
+	short, err := mr.get(id)
+	if err == nil && short.Fraud {
+		return "", domain.ErrDisabled
+	}
+	return short.Origin, err
+}
+
+func (mr *MemoryURLRepository) RetrieveFraud(ctx context.Context, id string) (bool, error) {
+	short, err := mr.get(id)
+	return short.Fraud, err
+}
+
+func (mr *MemoryURLRepository) GetView(ctx context.Context, id string) (int, error) {
+	short, err := mr.get(id)
+	return short.Count, err
+}
+
+func (mr *MemoryURLRepository) GetBotView(ctx context.Context, id string) (int, error) {
+	short, err := mr.get(id)
+	return short.BotCount, err
+}
+
+func (mr *MemoryURLRepository) GetOwner(ctx context.Context, id string) (string, error) {
+	short, err := mr.get(id)
+	return short.Owner, err
+}
+
+// AddViews adds to the view counters of the short URL, like the view flushes of the background worker do
+func (mr *MemoryURLRepository) AddViews(ctx context.Context, id string, count int, botCount int) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	short, ok := mr.urls[id]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	short.Count += count
+	short.BotCount += botCount
+	mr.urls[id] = short
+	return nil
+}
+
+// MarkFraud flags the short URL as fraudulent, like the fraud detection does
+func (mr *MemoryURLRepository) MarkFraud(ctx context.Context, id string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	short, ok := mr.urls[id]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	short.Fraud = true
+	mr.urls[id] = short
+	return nil
+}
+
+func (mr *MemoryURLRepository) Delete(ctx context.Context, id string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, ok := mr.urls[id]; !ok {
+		return domain.ErrNotFound
+	}
+	delete(mr.urls, id)
+	delete(mr.clicks, id)
+	return nil
+}
+
+// snapshot returns the short URLs that keep, ordered by ID
+func (mr *MemoryURLRepository) snapshot(keep func(domain.ShortURL) bool) []domain.ShortURL {
+	mr.mu.RLock()
+	links := make([]domain.ShortURL, 0, len(mr.urls))
+	for _, short := range mr.urls {
+		if keep(short) {
+			links = append(links, short)
+		}
+	}
+	mr.mu.RUnlock()
+	sort.Slice(links, func(i, j int) bool { return links[i].ID < links[j].ID })
+	return links
+}
+
+func (mr *MemoryURLRepository) ScanIDs(ctx context.Context, fn func(id string) error) error {
+	for _, short := range mr.snapshot(func(domain.ShortURL) bool { return true }) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(short.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mr *MemoryURLRepository) StreamLinks(ctx context.Context, owner string, filter domain.StatsFilter, fn func(domain.ShortURL) error) error {
+	links := mr.snapshot(func(short domain.ShortURL) bool {
+		return short.Owner == owner && !short.CreatedAt.Before(filter.From) && short.CreatedAt.Before(filter.To)
+	})
+	for _, link := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mr *MemoryURLRepository) ListCampaignStats(ctx context.Context, owner string) ([]domain.CampaignStats, error) {
+	byCampaign := make(map[string]*domain.CampaignStats)
+	for _, short := range mr.snapshot(func(short domain.ShortURL) bool { return short.Owner == owner && short.Campaign != "" }) {
+		cs, ok := byCampaign[short.Campaign]
+		if !ok {
+			cs = &domain.CampaignStats{Campaign: short.Campaign}
+			byCampaign[short.Campaign] = cs
+		}
+		addCampaignStats(cs, short)
+	}
+
+	stats := make([]domain.CampaignStats, 0, len(byCampaign))
+	for _, cs := range byCampaign {
+		stats = append(stats, *cs)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Campaign < stats[j].Campaign })
+	return stats, nil
+}
+
+func (mr *MemoryURLRepository) GetCampaignStats(ctx context.Context, owner string, campaign string) (domain.CampaignStats, error) {
+	cs := domain.CampaignStats{Campaign: campaign}
+	for _, short := range mr.snapshot(func(short domain.ShortURL) bool { return short.Owner == owner && short.Campaign == campaign }) {
+		addCampaignStats(&cs, short)
+	}
+	return cs, nil
+}
+
+func addCampaignStats(cs *domain.CampaignStats, short domain.ShortURL) {
+	cs.Links++
+	cs.Count += short.Count
+	cs.BotCount += short.BotCount
+}
+
+func (mr *MemoryURLRepository) TopLinks(ctx context.Context, n int, since time.Time) ([]domain.ShortURL, error) {
+	links := mr.snapshot(func(short domain.ShortURL) bool { return !short.Fraud })
+	for i := range links {
+		links[i] = domain.ShortURL{ID: links[i].ID, Origin: links[i].Origin, Count: links[i].Count}
+	}
+	if !since.IsZero() {
+		// views are the human clicks since then
+		mr.mu.RLock()
+		for i := range links {
+			links[i].Count = 0
+			for _, click := range mr.clicks[links[i].ID] {
+				if !click.Bot && !click.At.Before(since) {
+					links[i].Count++
+				}
+			}
+		}
+		mr.mu.RUnlock()
+		links = slices.DeleteFunc(links, func(link domain.ShortURL) bool { return link.Count == 0 })
+	}
+
+	// ties are broken by ID so the result is stable
+	sort.SliceStable(links, func(i, j int) bool { return links[i].Count > links[j].Count })
+	return links[:min(n, len(links))], nil
+}
+
+// MemoryClickRepository keeps the clicks in the MemoryURLRepository they're recorded for,
+// deleting a short URL deletes its clicks and TopLinks counts them
+type MemoryClickRepository struct {
+	urls *MemoryURLRepository
+}
+
+func NewMemoryClickRepository(urls *MemoryURLRepository) *MemoryClickRepository {
+	return &MemoryClickRepository{
+		urls: urls,
+	}
+}
+
+func (cr *MemoryClickRepository) BatchRecord(ctx context.Context, clicks []domain.Click) error {
+	cr.urls.mu.Lock()
+	defer cr.urls.mu.Unlock()
+	for _, click := range clicks {
+		cr.urls.clicks[click.URLID] = append(cr.urls.clicks[click.URLID], click)
+	}
+	return nil
+}
+
+func (cr *MemoryClickRepository) StreamClicks(ctx context.Context, id string, filter domain.StatsFilter, fn func(domain.Click) error) error {
+	cr.urls.mu.RLock()
+	var clicks []domain.Click
+	for _, click := range cr.urls.clicks[id] {
+		if (!click.Bot || filter.IncludeBots) && !click.At.Before(filter.From) && click.At.Before(filter.To) {
+			clicks = append(clicks, click)
+		}
+	}
+	cr.urls.mu.RUnlock()
+
+	// chronological, clicks at the same time stay in the order they were recorded
+	sort.SliceStable(clicks, func(i, j int) bool { return clicks[i].At.Before(clicks[j].At) })
+	for _, click := range clicks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(click); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryURLRepository(t *testing.T) {
+	testURLRepository(t, func(t *testing.T) repoHarness {
+		urls := NewMemoryURLRepository()
+		return repoHarness{
+			urls:   urls,
+			clicks: NewMemoryClickRepository(urls),
+			addViews: func(t *testing.T, id string, count int, botCount int) {
+				require.NoError(t, urls.AddViews(context.Background(), id, count, botCount))
+			},
+			markFraud: func(t *testing.T, id string) {
+				require.NoError(t, urls.MarkFraud(context.Background(), id))
+			},
+		}
+	})
+}
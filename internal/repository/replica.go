@@ -0,0 +1,284 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Lookups (Get, GetView, RetrieveFraud) can be served by read replicas, the primary keeps the writes.
+// A replica is only used while its health check passes and it lags less than maxLag behind the primary.
+// A short URL that was just created may not have reached the replicas yet:
+//   - ids created by this process within the recent window are looked up on the primary
+//   - ids created elsewhere that a replica doesn't know (yet) are looked up again on the primary,
+//     misses are rare since the Bloom filter answers most lookups of unknown ids
+// When no replica is usable the primary serves everything.
+
+type ReplicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+	maxLag   time.Duration
+	recent   *recentIDs
+
+	recentReads    atomic.Uint64 // lookups sent to the primary because the id is recent
+	missFallbacks  atomic.Uint64 // lookups retried on the primary after a replica miss
+	errorFallbacks atomic.Uint64 // lookups retried on the primary after a replica error
+}
+
+type replica struct {
+	name    string
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+	lag     atomic.Int64 // nanoseconds, as of the last check
+	reads   atomic.Uint64
+}
+
+// NewReplicaSet routes lookups to pools, the replicas are used once a health check passed (see Run).
+// Ids created within recentWindow are looked up on the primary
+func NewReplicaSet(pools []*pgxpool.Pool, maxLag time.Duration, recentWindow time.Duration) *ReplicaSet {
+	rs := &ReplicaSet{
+		maxLag: maxLag,
+		recent: newRecentIDs(recentWindow),
+	}
+	for _, pool := range pools {
+		config := pool.Config().ConnConfig
+		rs.replicas = append(rs.replicas, &replica{
+			name: fmt.Sprintf("%s:%d", config.Host, config.Port),
+			pool: pool,
+		})
+	}
+	return rs
+}
+
+// WithReplicas serves the lookups from replicas when they're usable
+func (pr *PostgresURLRepository) WithReplicas(replicas *ReplicaSet) *PostgresURLRepository {
+	pr.replicas = replicas
+	return pr
+}
+
+// pick returns the replica that should serve the lookup of id, nil when it must go to the primary.
+// It is safe on a nil set
+func (rs *ReplicaSet) pick(id string) *replica {
+	if rs == nil || len(rs.replicas) == 0 {
+		return nil
+	}
+	if rs.recent.has(id) {
+		rs.recentReads.Add(1)
+		return nil
+	}
+	// round robin over the healthy replicas
+	healthy := 0
+	for _, r := range rs.replicas {
+		if r.healthy.Load() {
+			healthy++
+		}
+	}
+	if healthy == 0 {
+		return nil
+	}
+	nth := int(rs.next.Add(1) % uint64(healthy))
+	for _, r := range rs.replicas {
+		if r.healthy.Load() {
+			if nth == 0 {
+				return r
+			}
+			nth--
+		}
+	}
+	// a replica failed in between
+	return nil
+}
+
+// created records ids just written to the primary
+func (rs *ReplicaSet) created(ids ...string) {
+	if rs == nil || len(rs.replicas) == 0 {
+		return
+	}
+	rs.recent.add(ids...)
+}
+
+// fellBack records that the lookup served by r failed with err and goes to the primary
+func (rs *ReplicaSet) fellBack(r *replica, err error) {
+	if errors.Is(err, domain.ErrNotFound) {
+		rs.missFallbacks.Add(1)
+		return
+	}
+	rs.errorFallbacks.Add(1)
+	// the next health check puts it back
+	if r.healthy.Swap(false) {
+		slog.Warn("read replica failed, lookups go to the other replicas or the primary", "replica", r.name, "error", err.Error())
+	}
+}
+
+// lookup scans the row of query for id into dest, from a replica when one can serve it
+func (pr *PostgresURLRepository) lookup(ctx context.Context, query string, id string, dest ...any) error {
+	if r := pr.replicas.pick(id); r != nil {
+		err := mapError(r.pool.QueryRow(ctx, query, id).Scan(dest...))
+		if err == nil || ctx.Err() != nil {
+			r.reads.Add(1)
+			return err
+		}
+		pr.replicas.fellBack(r, err)
+	}
+	return mapError(pr.pool.QueryRow(ctx, query, id).Scan(dest...))
+}
+
+// The lag is the age of the last replayed transaction, unless everything received has been replayed
+// (an idle primary sends nothing, the replica isn't behind then)
+var replicaLagQuery = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END::float8
+`
+
+// Check probes every replica once, a replica is usable when it answers within timeout and doesn't lag too much
+func (rs *ReplicaSet) Check(ctx context.Context, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, r := range rs.replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			var lagSeconds float64
+			err := r.pool.QueryRow(ctx, replicaLagQuery).Scan(&lagSeconds)
+			lag := time.Duration(lagSeconds * float64(time.Second))
+			if err == nil {
+				r.lag.Store(int64(lag))
+			}
+
+			healthy := err == nil && lag <= rs.maxLag
+			if was := r.healthy.Swap(healthy); was != healthy {
+				if healthy {
+					slog.Info("read replica is usable", "replica", r.name, "lag", lag)
+				} else if err != nil {
+					slog.Warn("read replica failed its health check", "replica", r.name, "error", err.Error())
+				} else {
+					slog.Warn("read replica lags too much", "replica", r.name, "lag", lag, "max_lag", rs.maxLag)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Run checks the replicas every interval until ctx is done, starting right away
+func (rs *ReplicaSet) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rs.Check(ctx, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type ReplicaStats struct {
+	Name    string        `json:"name"`
+	Healthy bool          `json:"healthy"`
+	Lag     time.Duration `json:"lag"`
+	Reads   uint64        `json:"reads"`
+}
+
+type ReplicaSetStats struct {
+	Replicas       []ReplicaStats `json:"replicas"`
+	RecentReads    uint64         `json:"recent_reads"`
+	MissFallbacks  uint64         `json:"miss_fallbacks"`
+	ErrorFallbacks uint64         `json:"error_fallbacks"`
+}
+
+func (rs *ReplicaSet) Stats() ReplicaSetStats {
+	stats := ReplicaSetStats{
+		Replicas:       make([]ReplicaStats, 0, len(rs.replicas)),
+		RecentReads:    rs.recentReads.Load(),
+		MissFallbacks:  rs.missFallbacks.Load(),
+		ErrorFallbacks: rs.errorFallbacks.Load(),
+	}
+	for _, r := range rs.replicas {
+		stats.Replicas = append(stats.Replicas, ReplicaStats{
+			Name:    r.name,
+			Healthy: r.healthy.Load(),
+			Lag:     time.Duration(r.lag.Load()),
+			Reads:   r.reads.Load(),
+		})
+	}
+	return stats
+}
+
+// Var exposes the stats in expvar
+func (rs *ReplicaSet) Var() expvar.Var {
+	return expvar.Func(func() any {
+		return rs.Stats()
+	})
+}
+
+// recentIDs remembers ids for at least window, in two generations: ids are added to cur,
+// cur becomes prev every window and prev is dropped
+type recentIDs struct {
+	mu        sync.Mutex
+	window    time.Duration
+	rotatedAt time.Time
+	cur       map[string]struct{}
+	prev      map[string]struct{}
+	now       func() time.Time
+}
+
+func newRecentIDs(window time.Duration) *recentIDs {
+	return &recentIDs{
+		window:    window,
+		rotatedAt: time.Now(),
+		cur:       make(map[string]struct{}),
+		prev:      make(map[string]struct{}),
+		now:       time.Now,
+	}
+}
+
+func (ri *recentIDs) add(ids ...string) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.rotate()
+	for _, id := range ids {
+		ri.cur[id] = struct{}{}
+	}
+}
+
+func (ri *recentIDs) has(id string) bool {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.rotate()
+	if _, ok := ri.cur[id]; ok {
+		return true
+	}
+	_, ok := ri.prev[id]
+	return ok
+}
+
+// rotate must be called with ri.mu held
+func (ri *recentIDs) rotate() {
+	now := ri.now()
+	elapsed := now.Sub(ri.rotatedAt)
+	if elapsed < ri.window {
+		return
+	}
+	if elapsed < 2*ri.window {
+		ri.prev = ri.cur
+	} else {
+		// nothing was rotated for a while, cur is old too
+		ri.prev = make(map[string]struct{})
+	}
+	ri.cur = make(map[string]struct{})
+	ri.rotatedAt = now
+}
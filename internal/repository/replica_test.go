@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pools don't connect until they're used
+func newTestReplicaSet(t *testing.T, n int) *ReplicaSet {
+	var pools []*pgxpool.Pool
+	for range n {
+		pool, err := pgxpool.New(context.Background(), "postgres://replica.invalid:5432/shorten")
+		require.NoError(t, err)
+		t.Cleanup(pool.Close)
+		pools = append(pools, pool)
+	}
+	return NewReplicaSet(pools, time.Second, time.Minute)
+}
+
+func TestReplicaPick(t *testing.T) {
+	var none *ReplicaSet
+	assert.Nil(t, none.pick("abcdef"))
+
+	rs := newTestReplicaSet(t, 3)
+	// unchecked replicas aren't used
+	assert.Nil(t, rs.pick("abcdef"))
+
+	rs.replicas[0].healthy.Store(true)
+	rs.replicas[2].healthy.Store(true)
+	picked := make(map[*replica]int)
+	for range 100 {
+		picked[rs.pick("abcdef")]++
+	}
+	assert.Len(t, picked, 2)
+	assert.Equal(t, 50, picked[rs.replicas[0]])
+	assert.Equal(t, 50, picked[rs.replicas[2]])
+
+	// ids that were just created go to the primary
+	rs.created("newone")
+	assert.Nil(t, rs.pick("newone"))
+	assert.Equal(t, uint64(1), rs.Stats().RecentReads)
+}
+
+func TestReplicaFallBack(t *testing.T) {
+	rs := newTestReplicaSet(t, 1)
+	r := rs.replicas[0]
+	r.healthy.Store(true)
+
+	// a miss doesn't say anything about the replica
+	rs.fellBack(r, domain.ErrNotFound)
+	assert.True(t, r.healthy.Load())
+
+	rs.fellBack(r, errors.New("connection reset"))
+	assert.False(t, r.healthy.Load())
+	assert.Nil(t, rs.pick("abcdef"))
+
+	stats := rs.Stats()
+	assert.Equal(t, uint64(1), stats.MissFallbacks)
+	assert.Equal(t, uint64(1), stats.ErrorFallbacks)
+}
+
+func TestRecentIDs(t *testing.T) {
+	now := time.Now()
+	ri := newRecentIDs(10 * time.Second)
+	ri.now = func() time.Time { return now }
+	ri.rotatedAt = now
+
+	ri.add("first")
+	now = now.Add(9 * time.Second)
+	ri.add("second")
+
+	// ids are kept for at least the window, and at most twice as long
+	now = now.Add(9 * time.Second)
+	assert.True(t, ri.has("first"))
+	assert.True(t, ri.has("second"))
+	ri.add("third")
+	now = now.Add(11 * time.Second)
+	assert.False(t, ri.has("first"))
+	assert.False(t, ri.has("second"))
+	assert.True(t, ri.has("third"))
+	now = now.Add(11 * time.Second)
+	assert.False(t, ri.has("third"))
+
+	// after a long idle time nothing is recent
+	ri.add("fourth")
+	now = now.Add(time.Hour)
+	assert.False(t, ri.has("fourth"))
+}
+
+// The primary stands in for its own replica: it isn't in recovery, so it doesn't lag
+func TestReplicaLookup(t *testing.T) {
+	_, db = getSystem()
+	replicaPool, err := pgxpool.New(context.Background(), os.Getenv("URL_DSN"))
+	require.NoError(t, err)
+	defer replicaPool.Close()
+	primaryPool, err := pgxpool.New(context.Background(), os.Getenv("URL_DSN"))
+	require.NoError(t, err)
+	defer primaryPool.Close()
+
+	replicas := NewReplicaSet([]*pgxpool.Pool{replicaPool}, time.Second, time.Minute)
+	replicas.Check(context.Background(), time.Second)
+	require.True(t, replicas.Stats().Replicas[0].Healthy)
+
+	pr, err := NewPostgresURLRepository(db, primaryPool)
+	require.NoError(t, err)
+	pr.WithReplicas(replicas)
+
+	id := "rplca1"
+	defer clear(db, []string{id})
+	_, err = pr.Create(context.Background(), id, "https://example.com/replica")
+	require.NoError(t, err)
+
+	// just created: the primary answers
+	origin, err := pr.Get(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/replica", origin)
+	assert.Equal(t, uint64(1), replicas.Stats().RecentReads)
+	assert.Zero(t, replicas.Stats().Replicas[0].Reads)
+
+	// created elsewhere: the replica answers
+	replicas.recent = newRecentIDs(time.Minute)
+	view, err := pr.GetView(context.Background(), id)
+	require.NoError(t, err)
+	assert.Zero(t, view)
+	assert.Equal(t, uint64(1), replicas.Stats().Replicas[0].Reads)
+
+	_, err = pr.Get(context.Background(), "rplmis")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+	assert.Equal(t, uint64(1), replicas.Stats().MissFallbacks)
+}
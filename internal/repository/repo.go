@@ -4,51 +4,33 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"strings"
+	"time"
 
 	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/armistcxy/shorten/internal/shard"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 )
 
 type PostgresURLRepository struct {
-	db   *sqlx.DB
-	pool *pgxpool.Pool
+	db       *sqlx.DB
+	pool     *pgxpool.Pool
+	replicas *ReplicaSet // serves the lookups when set, see WithReplicas
 }
 
+// NewPostgresURLRepository expects the schema to be migrated already (see the migrate package)
 func NewPostgresURLRepository(db *sqlx.DB, pool *pgxpool.Pool) (*PostgresURLRepository, error) {
-	initTables(db)
 	return &PostgresURLRepository{
 		db:   db,
 		pool: pool,
 	}, nil
 }
 
-// Not encourage to do this
-// Note that this is redundant work just to make sure that db schema is up to date
-func initTables(db *sqlx.DB) {
-	createURLTableQuery := `
-		CREATE TABLE IF NOT EXISTS urls (
-			id TEXT PRIMARY KEY,
-			original_url TEXT NOT NULL,
-			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-			fraud BOOLEAN DEFAULT false,
-			count INTEGER DEFAULT 0
-		);
-
-		CREATE INDEX IF NOT EXISTS idx_urls_id ON urls (id);
-
-		CREATE TABLE IF NOT EXISTS ids (
-			id BIGINT PRIMARY KEY
-		);
-	`
-	_ = db.MustExec(createURLTableQuery)
-}
-
 var (
 	insertURLQuery = `
-		INSERT INTO urls (id, original_url) VALUES ($1, $2) RETURNING created_at;
+		INSERT INTO urls (id, original_url, shard_key) VALUES ($1, $2, $3) RETURNING created_at;
 	`
 )
 
@@ -59,29 +41,35 @@ func (pr *PostgresURLRepository) Create(ctx context.Context, id string, url stri
 		ID:     id,
 		Origin: url,
 	}
-	row := pr.pool.QueryRow(ctx, insertURLQuery, id, url)
+	row := pr.pool.QueryRow(ctx, insertURLQuery, id, url, int64(shard.Key(id)))
 	if err := row.Scan(&short.CreatedAt); err != nil {
-		return nil, err
+		return nil, mapError(err)
 	}
+	pr.replicas.created(id)
 	return short, nil
 }
 
 var (
 	getURLQuery = `
-		SELECT original_url FROM urls
+		SELECT original_url, fraud FROM urls
 		WHERE id=$1;
 	`
 )
 
 func (pr *PostgresURLRepository) Get(ctx context.Context, id string) (string, error) {
-	var origin string
+	var (
+		origin string
+		fraud  bool
+	)
 	// if err := pr.db.GetContext(ctx, &origin, getURLQuery, id); err != nil {
 	// 	return "", err
 	// }
-	row := pr.pool.QueryRow(ctx, getURLQuery, id)
-	if err := row.Scan(&origin); err != nil {
+	if err := pr.lookup(ctx, getURLQuery, id, &origin, &fraud); err != nil {
 		return "", err
 	}
+	if fraud {
+		return "", domain.ErrDisabled
+	}
 	return origin, nil
 }
 
@@ -94,9 +82,8 @@ var (
 
 func (pr *PostgresURLRepository) RetrieveFraud(ctx context.Context, id string) (bool, error) {
 	var fraud bool
-	row := pr.pool.QueryRow(ctx, retrieveFraudQuery, id)
-	if err := row.Scan(&fraud); err != nil {
-		return false, nil
+	if err := pr.lookup(ctx, retrieveFraudQuery, id, &fraud); err != nil {
+		return false, err
 	}
 	return fraud, nil
 }
@@ -111,28 +98,316 @@ var (
 
 func (pr *PostgresURLRepository) GetView(ctx context.Context, id string) (int, error) {
 	var view int
-	row := pr.pool.QueryRow(ctx, getViewQuery, id)
-	if err := row.Scan(&view); err != nil {
+	if err := pr.lookup(ctx, getViewQuery, id, &view); err != nil {
 		return 0, err
 	}
 	return view, nil
 }
 
+var (
+	getBotViewQuery = `
+		SELECT bot_count
+		FROM urls
+		WHERE id=$1
+	`
+)
+
+// GetBotView returns the number of hits classified as bot traffic (unfurlers, crawlers, scanners, ...)
+func (pr *PostgresURLRepository) GetBotView(ctx context.Context, id string) (int, error) {
+	var view int
+	row := pr.pool.QueryRow(ctx, getBotViewQuery, id)
+	if err := row.Scan(&view); err != nil {
+		return 0, mapError(err)
+	}
+	return view, nil
+}
+
 func (pr *PostgresURLRepository) BatchCreate(ctx context.Context, inputs []domain.CreateInput) error {
-	byteBuffer := bytes.NewBufferString(`INSERT INTO urls (id, original_url) VALUES `)
-	tuples := make([]string, len(inputs))
-	for i := range tuples {
-		tuples[i] = prepareEach(inputs[i])
+	if len(inputs) == 0 {
+		return nil
 	}
-	byteBuffer.WriteString(strings.Join(tuples, ","))
 
-	query := byteBuffer.String()
-	if _, err := pr.pool.Exec(ctx, query); err != nil {
-		return err
+	query, params := batchInsertQuery(inputs, "")
+	if _, err := pr.pool.Exec(ctx, query, params...); err != nil {
+		return mapError(err)
+	}
+	ids := make([]string, len(inputs))
+	for i := range inputs {
+		ids[i] = inputs[i].ID
 	}
+	pr.replicas.created(ids...)
 	return nil
 }
 
-func prepareEach(input domain.CreateInput) string {
-	return fmt.Sprintf("('%s', '%s')", input.ID, input.URL)
+// BatchCreateSkipTaken doesn't fail the whole batch on a taken id, the rows that conflict are skipped
+func (pr *PostgresURLRepository) BatchCreateSkipTaken(ctx context.Context, inputs []domain.CreateInput) ([]string, error) {
+	if len(inputs) == 0 {
+		return nil, nil
+	}
+
+	query, params := batchInsertQuery(inputs, " ON CONFLICT (id) DO NOTHING RETURNING id")
+	rows, err := pr.pool.Query(ctx, query, params...)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	inserted := make(map[string]int, len(inputs))
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		inserted[id]++
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, mapError(err)
+	}
+	pr.replicas.created(ids...)
+
+	var taken []string
+	for _, input := range inputs {
+		if inserted[input.ID] == 0 {
+			taken = append(taken, input.ID)
+			continue
+		}
+		inserted[input.ID]--
+	}
+	return taken, nil
+}
+
+// batchInsertQuery inserts the inputs in one statement, suffix is appended to it
+func batchInsertQuery(inputs []domain.CreateInput, suffix string) (string, []interface{}) {
+	byteBuffer := bytes.NewBufferString(`INSERT INTO urls (id, original_url, owner, campaign, shard_key) VALUES `)
+	params := make([]interface{}, 0, 5*len(inputs))
+	for i := range inputs {
+		if i > 0 {
+			byteBuffer.WriteString(",")
+		}
+		fmt.Fprintf(byteBuffer, "($%d, $%d, $%d, $%d, $%d)", 5*i+1, 5*i+2, 5*i+3, 5*i+4, 5*i+5)
+		params = append(params, inputs[i].ID, inputs[i].URL, inputs[i].Owner, inputs[i].Campaign, int64(shard.Key(inputs[i].ID)))
+	}
+	byteBuffer.WriteString(suffix)
+	return byteBuffer.String(), params
+}
+
+var (
+	getOwnerQuery = `
+		SELECT owner FROM urls
+		WHERE id=$1
+	`
+)
+
+func (pr *PostgresURLRepository) GetOwner(ctx context.Context, id string) (string, error) {
+	var owner string
+	row := pr.pool.QueryRow(ctx, getOwnerQuery, id)
+	if err := row.Scan(&owner); err != nil {
+		return "", mapError(err)
+	}
+	return owner, nil
+}
+
+var (
+	deleteURLQuery    = `DELETE FROM urls WHERE id=$1`
+	deleteClicksQuery = `DELETE FROM clicks WHERE url_id=$1`
+)
+
+func (pr *PostgresURLRepository) Delete(ctx context.Context, id string) error {
+	tx, err := pr.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, deleteURLQuery, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	if _, err := tx.Exec(ctx, deleteClicksQuery, id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// number of rows fetched per query when streaming
+const streamChunkSize = 5000
+
+var scanIDsQuery = `
+	SELECT id FROM urls
+	WHERE id > $1
+	ORDER BY id
+	LIMIT $2
+`
+
+func (pr *PostgresURLRepository) ScanIDs(ctx context.Context, fn func(id string) error) error {
+	lastID := ""
+	for {
+		rows, err := pr.pool.Query(ctx, scanIDsQuery, lastID, streamChunkSize)
+		if err != nil {
+			return err
+		}
+
+		n := 0
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			if err := fn(id); err != nil {
+				rows.Close()
+				return err
+			}
+			lastID = id
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if n < streamChunkSize {
+			return nil
+		}
+	}
+}
+
+var (
+	streamLinksQuery = `
+		SELECT id, original_url, created_at, fraud, owner, campaign, count, bot_count
+		FROM urls
+		WHERE owner = $1 AND created_at >= $2 AND created_at < $3 AND id > $4
+		ORDER BY id
+		LIMIT $5
+	`
+)
+
+func (pr *PostgresURLRepository) StreamLinks(ctx context.Context, owner string, filter domain.StatsFilter, fn func(domain.ShortURL) error) error {
+	// keyset pagination: every chunk starts after the last ID of the previous one
+	lastID := ""
+	for {
+		rows, err := pr.pool.Query(ctx, streamLinksQuery, owner, filter.From, filter.To, lastID, streamChunkSize)
+		if err != nil {
+			return err
+		}
+
+		n := 0
+		for rows.Next() {
+			var link domain.ShortURL
+			if err := rows.Scan(&link.ID, &link.Origin, &link.CreatedAt, &link.Fraud, &link.Owner, &link.Campaign, &link.Count, &link.BotCount); err != nil {
+				rows.Close()
+				return err
+			}
+			if err := fn(link); err != nil {
+				rows.Close()
+				return err
+			}
+			lastID = link.ID
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if n < streamChunkSize {
+			return nil
+		}
+	}
+}
+
+var (
+	listCampaignStatsQuery = `
+		SELECT campaign, COUNT(*), COALESCE(SUM(count), 0), COALESCE(SUM(bot_count), 0)
+		FROM urls
+		WHERE owner = $1 AND campaign <> ''
+		GROUP BY campaign
+		ORDER BY campaign
+	`
+	getCampaignStatsQuery = `
+		SELECT COUNT(*), COALESCE(SUM(count), 0), COALESCE(SUM(bot_count), 0)
+		FROM urls
+		WHERE owner = $1 AND campaign = $2
+	`
+)
+
+func (pr *PostgresURLRepository) ListCampaignStats(ctx context.Context, owner string) ([]domain.CampaignStats, error) {
+	rows, err := pr.pool.Query(ctx, listCampaignStatsQuery, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make([]domain.CampaignStats, 0)
+	for rows.Next() {
+		var cs domain.CampaignStats
+		if err := rows.Scan(&cs.Campaign, &cs.Links, &cs.Count, &cs.BotCount); err != nil {
+			return nil, err
+		}
+		stats = append(stats, cs)
+	}
+	return stats, rows.Err()
+}
+
+func (pr *PostgresURLRepository) GetCampaignStats(ctx context.Context, owner string, campaign string) (domain.CampaignStats, error) {
+	cs := domain.CampaignStats{Campaign: campaign}
+	row := pr.pool.QueryRow(ctx, getCampaignStatsQuery, owner, campaign)
+	if err := row.Scan(&cs.Links, &cs.Count, &cs.BotCount); err != nil {
+		return cs, err
+	}
+	return cs, nil
+}
+
+var (
+	topLinksQuery = `
+		SELECT id, original_url, count
+		FROM urls
+		WHERE NOT fraud
+		ORDER BY count DESC
+		LIMIT $1
+	`
+	topRecentLinksQuery = `
+		SELECT u.id, u.original_url, t.clicks
+		FROM (
+			SELECT url_id, COUNT(*) AS clicks
+			FROM clicks
+			WHERE clicked_at >= $1 AND NOT bot
+			GROUP BY url_id
+			ORDER BY clicks DESC
+			LIMIT $2
+		) t
+		JOIN urls u ON u.id = t.url_id
+		WHERE NOT u.fraud
+		ORDER BY t.clicks DESC
+	`
+)
+
+func (pr *PostgresURLRepository) TopLinks(ctx context.Context, n int, since time.Time) ([]domain.ShortURL, error) {
+	var (
+		rows pgx.Rows
+		err  error
+	)
+	if since.IsZero() {
+		rows, err = pr.pool.Query(ctx, topLinksQuery, n)
+	} else {
+		rows, err = pr.pool.Query(ctx, topRecentLinksQuery, since, n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make([]domain.ShortURL, 0, n)
+	for rows.Next() {
+		var link domain.ShortURL
+		if err := rows.Scan(&link.ID, &link.Origin, &link.Count); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
 }
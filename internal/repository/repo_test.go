@@ -10,8 +10,10 @@ import (
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/armistcxy/shorten/internal/migrate"
 	"github.com/go-faker/faker/v4"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jmoiron/sqlx"
@@ -89,6 +91,37 @@ func TestRetrieveFraud(t *testing.T) {
 	assert.Equal(t, false, fraud)
 }
 
+func TestNotFound(t *testing.T) {
+	repo, db = getSystem()
+	id := "missng"
+
+	_, err := repo.Get(context.Background(), id)
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+
+	_, err = repo.RetrieveFraud(context.Background(), id)
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+
+	_, err = repo.GetOwner(context.Background(), id)
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+
+	err = repo.Delete(context.Background(), id)
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+}
+
+func TestCreateConflict(t *testing.T) {
+	repo, db = getSystem()
+	id := "abcdef"
+	origin := "https://example.com/abcqwertyuio123456789qwertyuiop"
+	if _, err := repo.Create(context.Background(), id, origin); err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	defer clear(db, []string{id})
+
+	_, err := repo.Create(context.Background(), id, origin)
+	assert.ErrorIs(t, err, domain.ErrConflict)
+}
+
 func TestGetView(t *testing.T) {
 	repo, db = getSystem()
 	id := "abcdef"
@@ -107,6 +140,159 @@ func TestGetView(t *testing.T) {
 	assert.Equal(t, 0, view)
 }
 
+func TestGetBotView(t *testing.T) {
+	repo, db = getSystem()
+	id := "abcdef"
+	origin := "https://example.com/abcqwertyuio123456789qwertyuiop"
+	_, err := repo.Create(context.Background(), id, origin)
+	if err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	defer clear(db, []string{id})
+	view, err := repo.GetBotView(context.Background(), id)
+	if err != nil {
+		t.Errorf("failed to get bot view: %s", err)
+		return
+	}
+	assert.Equal(t, 0, view)
+}
+
+func TestGetOwner(t *testing.T) {
+	repo, db = getSystem()
+	inputs := []domain.CreateInput{
+		{ID: "abcdef", URL: "https://example.com/abcqwertyuio123456789qwertyuiop", Owner: "marketing"},
+		{ID: "fwerwe", URL: "https://example1.com/231231231231231221312312"},
+	}
+	defer clear(db, []string{inputs[0].ID, inputs[1].ID})
+	if err := repo.BatchCreate(context.Background(), inputs); err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	owner, err := repo.GetOwner(context.Background(), inputs[0].ID)
+	if err != nil {
+		t.Errorf("failed to get owner: %s", err)
+		return
+	}
+	assert.Equal(t, "marketing", owner)
+
+	owner, err = repo.GetOwner(context.Background(), inputs[1].ID)
+	if err != nil {
+		t.Errorf("failed to get owner: %s", err)
+		return
+	}
+	assert.Equal(t, "", owner)
+}
+
+func TestStreamLinks(t *testing.T) {
+	repo, db = getSystem()
+	inputs := []domain.CreateInput{
+		{ID: "abcdef", URL: "https://example.com/abcqwertyuio123456789qwertyuiop", Owner: "marketing"},
+		{ID: "fwerwe", URL: "https://example1.com/231231231231231221312312", Owner: "marketing"},
+		{ID: "le123f", URL: "https://example2.com/afsdfaewrr", Owner: "sales"},
+	}
+	defer clear(db, []string{inputs[0].ID, inputs[1].ID, inputs[2].ID})
+	if err := repo.BatchCreate(context.Background(), inputs); err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	filter := domain.StatsFilter{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}
+	var ids []string
+	err := repo.StreamLinks(context.Background(), "marketing", filter, func(link domain.ShortURL) error {
+		ids = append(ids, link.ID)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("failed to stream links: %s", err)
+		return
+	}
+	assert.Equal(t, []string{"abcdef", "fwerwe"}, ids)
+}
+
+func TestCampaignStats(t *testing.T) {
+	repo, db = getSystem()
+	inputs := []domain.CreateInput{
+		{ID: "cmpgn1", URL: "https://example.com/a?utm_campaign=spring", Owner: "marketing", Campaign: "spring"},
+		{ID: "cmpgn2", URL: "https://example.com/b?utm_campaign=spring", Owner: "marketing", Campaign: "spring"},
+		{ID: "cmpgn3", URL: "https://example.com/c?utm_campaign=summer", Owner: "marketing", Campaign: "summer"},
+		{ID: "cmpgn4", URL: "https://example.com/d?utm_campaign=spring", Owner: "sales", Campaign: "spring"},
+	}
+	defer clear(db, []string{inputs[0].ID, inputs[1].ID, inputs[2].ID, inputs[3].ID})
+	if err := repo.BatchCreate(context.Background(), inputs); err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	db.MustExec(`UPDATE urls SET count = 3, bot_count = 1 WHERE id IN ('cmpgn1', 'cmpgn2', 'cmpgn4')`)
+
+	stats, err := repo.GetCampaignStats(context.Background(), "marketing", "spring")
+	if err != nil {
+		t.Errorf("failed to get campaign stats: %s", err)
+		return
+	}
+	assert.Equal(t, domain.CampaignStats{Campaign: "spring", Links: 2, Count: 6, BotCount: 2}, stats)
+
+	list, err := repo.ListCampaignStats(context.Background(), "marketing")
+	if err != nil {
+		t.Errorf("failed to list campaign stats: %s", err)
+		return
+	}
+	assert.Equal(t, []domain.CampaignStats{
+		{Campaign: "spring", Links: 2, Count: 6, BotCount: 2},
+		{Campaign: "summer", Links: 1},
+	}, list)
+}
+
+func TestScanIDs(t *testing.T) {
+	repo, db = getSystem()
+	inputs := []domain.CreateInput{
+		{ID: "scnid1", URL: "https://example.com/1"},
+		{ID: "scnid2", URL: "https://example.com/2"},
+	}
+	defer clear(db, []string{inputs[0].ID, inputs[1].ID})
+	if err := repo.BatchCreate(context.Background(), inputs); err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+
+	ids := make(map[string]bool)
+	if err := repo.ScanIDs(context.Background(), func(id string) error {
+		ids[id] = true
+		return nil
+	}); err != nil {
+		t.Errorf("failed to scan ids: %s", err)
+		return
+	}
+	assert.True(t, ids["scnid1"])
+	assert.True(t, ids["scnid2"])
+}
+
+func TestTopLinks(t *testing.T) {
+	repo, db = getSystem()
+	inputs := []domain.CreateInput{
+		{ID: "toplk1", URL: "https://example.com/1"},
+		{ID: "toplk2", URL: "https://example.com/2"},
+	}
+	defer clear(db, []string{inputs[0].ID, inputs[1].ID})
+	if err := repo.BatchCreate(context.Background(), inputs); err != nil {
+		t.Error(err.Error())
+		t.FailNow()
+	}
+	db.MustExec(`UPDATE urls SET count = 1000000000 WHERE id = 'toplk2'`)
+	db.MustExec(`UPDATE urls SET count = 999999999 WHERE id = 'toplk1'`)
+
+	links, err := repo.TopLinks(context.Background(), 2, time.Time{})
+	if err != nil {
+		t.Errorf("failed to get top links: %s", err)
+		return
+	}
+	assert.Equal(t, []domain.ShortURL{
+		{ID: "toplk2", Origin: "https://example.com/2", Count: 1000000000},
+		{ID: "toplk1", Origin: "https://example.com/1", Count: 999999999},
+	}, links)
+}
+
 func TestBatchCreate(t *testing.T) {
 	repo, db = getSystem()
 	ids := []string{"abcdef", "fwerwe", "le123f"}
@@ -126,6 +312,28 @@ func TestBatchCreate(t *testing.T) {
 	}
 }
 
+func TestPostgresURLRepository(t *testing.T) {
+	testURLRepository(t, func(t *testing.T) repoHarness {
+		repo, db = getSystem()
+		return repoHarness{
+			urls:   repo,
+			clicks: NewPostgresClickRepository(repo.pool),
+			addViews: func(t *testing.T, id string, count int, botCount int) {
+				db.MustExec(`UPDATE urls SET count = count + $1, bot_count = bot_count + $2 WHERE id = $3`, count, botCount, id)
+			},
+			markFraud: func(t *testing.T, id string) {
+				db.MustExec(`UPDATE urls SET fraud = true WHERE id = $1`, id)
+			},
+			clear: func(ids []string) {
+				clear(db, ids)
+				for _, id := range ids {
+					_, _ = db.Exec("DELETE FROM clicks WHERE url_id=$1", id)
+				}
+			},
+		}
+	})
+}
+
 func prepareInstances(numberOfInstances int) []domain.CreateInput {
 	inputs := make([]domain.CreateInput, numberOfInstances)
 	for i := range inputs {
@@ -175,6 +383,8 @@ func BenchmarkRetrieveFraud(b *testing.B) {}
 
 func BenchmarkGetView(b *testing.B) {}
 
+func BenchmarkGetBotView(b *testing.B) {}
+
 func benchmarkBatchCreate(b *testing.B, numberOfInstances int) {
 	repo, db = getSystem()
 	inputs := prepareInstances(numberOfInstances)
@@ -206,7 +416,13 @@ func BenchmarkBatchCreate2000Instances(b *testing.B) {
 func initSystem() {
 	db = sqlx.MustConnect("postgres", os.Getenv("URL_DSN"))
 	pool, _ := pgxpool.New(context.Background(), os.Getenv("URL_DSN"))
-	var err error
+	migrator, err := migrate.New(db)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		panic(err)
+	}
 	repo, err = NewPostgresURLRepository(db, pool)
 	if err != nil {
 		panic(err)
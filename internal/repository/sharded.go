@@ -0,0 +1,487 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/armistcxy/shorten/internal/shard"
+	"golang.org/x/sync/errgroup"
+)
+
+// ShardedURLRepository spreads the short URLs over shards, one repository per Postgres instance, the router
+// says which shard holds a short URL (see the shard package). Lookups go to the shard of the id, listings
+// and stats are gathered from every shard.
+// While a range of ids moves to another shard its short URLs can be on both shards:
+//   - lookups try the shard they're written to first, then the other one
+//   - deletes go to both, and ids taken on either shard are refused
+//   - ScanIDs, StreamLinks, TopLinks and the campaign stats merge the two rows
+type ShardedURLRepository struct {
+	shards []domain.URLRepository
+	router *shard.Router
+}
+
+func NewShardedURLRepository(shards []domain.URLRepository, router *shard.Router) (*ShardedURLRepository, error) {
+	if len(shards) != router.Shards() {
+		return nil, fmt.Errorf("%d shard repositories for a map of %d shards", len(shards), router.Shards())
+	}
+	return &ShardedURLRepository{
+		shards: shards,
+		router: router,
+	}, nil
+}
+
+// taken returns ErrConflict when id is on a shard it is read from but not written to
+func (sr *ShardedURLRepository) taken(ctx context.Context, route shard.Route, id string) error {
+	for _, s := range route.Reads {
+		if s == route.Write {
+			continue
+		}
+		_, err := sr.shards[s].Get(ctx, id)
+		if err == nil || errors.Is(err, domain.ErrDisabled) {
+			return domain.ErrConflict
+		}
+		if !errors.Is(err, domain.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sr *ShardedURLRepository) Create(ctx context.Context, id string, url string) (*domain.ShortURL, error) {
+	route := sr.router.Route(id)
+	if err := sr.taken(ctx, route, id); err != nil {
+		return nil, err
+	}
+	return sr.shards[route.Write].Create(ctx, id, url)
+}
+
+// BatchCreate inserts the inputs of every shard concurrently, it isn't atomic across shards:
+// on error some shards may have their inputs already
+func (sr *ShardedURLRepository) BatchCreate(ctx context.Context, inputs []domain.CreateInput) error {
+	batches := make(map[int][]domain.CreateInput)
+	for _, input := range inputs {
+		route := sr.router.Route(input.ID)
+		if err := sr.taken(ctx, route, input.ID); err != nil {
+			return err
+		}
+		batches[route.Write] = append(batches[route.Write], input)
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	for s, batch := range batches {
+		g.Go(func() error {
+			return sr.shards[s].BatchCreate(gctx, batch)
+		})
+	}
+	return g.Wait()
+}
+
+// BatchCreateSkipTaken inserts the inputs of every shard concurrently, ids taken on any shard they are
+// read from are skipped
+func (sr *ShardedURLRepository) BatchCreateSkipTaken(ctx context.Context, inputs []domain.CreateInput) ([]string, error) {
+	var taken []string
+	batches := make(map[int][]domain.CreateInput)
+	for _, input := range inputs {
+		route := sr.router.Route(input.ID)
+		if err := sr.taken(ctx, route, input.ID); errors.Is(err, domain.ErrConflict) {
+			taken = append(taken, input.ID)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		batches[route.Write] = append(batches[route.Write], input)
+	}
+
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	for s, batch := range batches {
+		g.Go(func() error {
+			ids, err := sr.shards[s].BatchCreateSkipTaken(gctx, batch)
+			mu.Lock()
+			taken = append(taken, ids...)
+			mu.Unlock()
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return taken, nil
+}
+
+// lookup returns get of the first shard that has id
+func lookup[T any](sr *ShardedURLRepository, id string, get func(domain.URLRepository) (T, error)) (T, error) {
+	route := sr.router.Route(id)
+	for i, s := range route.Reads {
+		v, err := get(sr.shards[s])
+		if errors.Is(err, domain.ErrNotFound) && i < len(route.Reads)-1 {
+			continue
+		}
+		return v, err
+	}
+	panic("a route has at least one shard to read from")
+}
+
+func (sr *ShardedURLRepository) Get(ctx context.Context, id string) (string, error) {
+	return lookup(sr, id, func(r domain.URLRepository) (string, error) { return r.Get(ctx, id) })
+}
+
+func (sr *ShardedURLRepository) RetrieveFraud(ctx context.Context, id string) (bool, error) {
+	return lookup(sr, id, func(r domain.URLRepository) (bool, error) { return r.RetrieveFraud(ctx, id) })
+}
+
+func (sr *ShardedURLRepository) GetView(ctx context.Context, id string) (int, error) {
+	return lookup(sr, id, func(r domain.URLRepository) (int, error) { return r.GetView(ctx, id) })
+}
+
+func (sr *ShardedURLRepository) GetBotView(ctx context.Context, id string) (int, error) {
+	return lookup(sr, id, func(r domain.URLRepository) (int, error) { return r.GetBotView(ctx, id) })
+}
+
+func (sr *ShardedURLRepository) GetOwner(ctx context.Context, id string) (string, error) {
+	return lookup(sr, id, func(r domain.URLRepository) (string, error) { return r.GetOwner(ctx, id) })
+}
+
+func (sr *ShardedURLRepository) Delete(ctx context.Context, id string) error {
+	deleted := false
+	for _, s := range sr.router.Route(id).All {
+		err := sr.shards[s].Delete(ctx, id)
+		if errors.Is(err, domain.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		deleted = true
+	}
+	if !deleted {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+// ScanIDs merges the ids of every shard in order
+func (sr *ShardedURLRepository) ScanIDs(ctx context.Context, fn func(id string) error) error {
+	return streamMerged(ctx, sr.shards,
+		func(ctx context.Context, r domain.URLRepository, fn func(string) error) error {
+			return r.ScanIDs(ctx, fn)
+		},
+		strings.Compare,
+		func(a, _ string) string { return a },
+		fn,
+	)
+}
+
+// mergeLink combines the rows of a short URL found on two shards
+func mergeLink(a, b domain.ShortURL) domain.ShortURL {
+	a.Count = max(a.Count, b.Count)
+	a.BotCount = max(a.BotCount, b.BotCount)
+	a.Fraud = a.Fraud || b.Fraud
+	return a
+}
+
+// StreamLinks merges the links of every shard by ID
+func (sr *ShardedURLRepository) StreamLinks(ctx context.Context, owner string, filter domain.StatsFilter, fn func(domain.ShortURL) error) error {
+	return streamMerged(ctx, sr.shards,
+		func(ctx context.Context, r domain.URLRepository, fn func(domain.ShortURL) error) error {
+			return r.StreamLinks(ctx, owner, filter, fn)
+		},
+		func(a, b domain.ShortURL) int { return strings.Compare(a.ID, b.ID) },
+		mergeLink,
+		fn,
+	)
+}
+
+// streamMerged runs stream on every shard concurrently, each stream ordered by compare, and calls fn
+// with the items of all of them in that order. Items of several shards that compare equal are merged,
+// or all passed on when merge is nil
+func streamMerged[R, T any](
+	ctx context.Context,
+	shards []R,
+	stream func(ctx context.Context, r R, fn func(T) error) error,
+	compare func(a, b T) int,
+	merge func(a, b T) T,
+	fn func(T) error,
+) error {
+	if len(shards) == 1 {
+		return stream(ctx, shards[0], fn)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	streams := make([]chan T, len(shards))
+	errs := make([]error, len(shards))
+	for i, r := range shards {
+		streams[i] = make(chan T, streamChunkSize)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(streams[i])
+			errs[i] = stream(ctx, r, func(item T) error {
+				select {
+				case streams[i] <- item:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}()
+	}
+
+	err := mergeStreams(streams, compare, merge, fn)
+	cancel()
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// mergeStreams is the merge of streamMerged, a stream that fails ends early and its error is reported after
+func mergeStreams[T any](streams []chan T, compare func(a, b T) int, merge func(a, b T) T, fn func(T) error) error {
+	heads := make([]*T, len(streams))
+	next := func(i int) {
+		heads[i] = nil
+		if item, ok := <-streams[i]; ok {
+			heads[i] = &item
+		}
+	}
+	for i := range streams {
+		next(i)
+	}
+
+	for {
+		first := -1
+		for i, head := range heads {
+			if head != nil && (first == -1 || compare(*head, *heads[first]) < 0) {
+				first = i
+			}
+		}
+		if first == -1 {
+			return nil
+		}
+
+		item := *heads[first]
+		if merge == nil {
+			next(first)
+		} else {
+			for i, head := range heads {
+				if head != nil && compare(*head, item) == 0 {
+					if i != first {
+						item = merge(item, *head)
+					}
+					next(i)
+				}
+			}
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+}
+
+// gather calls get on every shard concurrently
+func gather[T any](ctx context.Context, shards []domain.URLRepository, get func(ctx context.Context, r domain.URLRepository) (T, error)) ([]T, error) {
+	results := make([]T, len(shards))
+	g, gctx := errgroup.WithContext(ctx)
+	for i, r := range shards {
+		g.Go(func() error {
+			var err error
+			results[i], err = get(gctx, r)
+			return err
+		})
+	}
+	return results, g.Wait()
+}
+
+// moving tells whether some short URLs can be on two shards, the stats of every shard can't be added up then
+func (sr *ShardedURLRepository) moving() bool {
+	return len(sr.router.Map().Moving()) > 0
+}
+
+// streamCampaignStats aggregates the merged links of the owner by campaign, campaigns that keep rejects are skipped
+func (sr *ShardedURLRepository) streamCampaignStats(ctx context.Context, owner string, keep func(campaign string) bool) (map[string]*domain.CampaignStats, error) {
+	// created_at is set by the database, the hour covers the clock skew
+	filter := domain.StatsFilter{
+		From: time.Unix(0, 0).UTC(),
+		To:   time.Now().UTC().Add(time.Hour),
+	}
+	byCampaign := make(map[string]*domain.CampaignStats)
+	err := sr.StreamLinks(ctx, owner, filter, func(link domain.ShortURL) error {
+		if !keep(link.Campaign) {
+			return nil
+		}
+		cs, ok := byCampaign[link.Campaign]
+		if !ok {
+			cs = &domain.CampaignStats{Campaign: link.Campaign}
+			byCampaign[link.Campaign] = cs
+		}
+		cs.Links++
+		cs.Count += link.Count
+		cs.BotCount += link.BotCount
+		return nil
+	})
+	return byCampaign, err
+}
+
+// ListCampaignStats adds up the stats of every shard, while a range moves they're computed from the merged links
+func (sr *ShardedURLRepository) ListCampaignStats(ctx context.Context, owner string) ([]domain.CampaignStats, error) {
+	if sr.moving() {
+		byCampaign, err := sr.streamCampaignStats(ctx, owner, func(campaign string) bool { return campaign != "" })
+		if err != nil {
+			return nil, err
+		}
+		return sortedCampaignStats(byCampaign), nil
+	}
+
+	results, err := gather(ctx, sr.shards, func(ctx context.Context, r domain.URLRepository) ([]domain.CampaignStats, error) {
+		return r.ListCampaignStats(ctx, owner)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byCampaign := make(map[string]*domain.CampaignStats)
+	for _, result := range results {
+		for _, cs := range result {
+			if total, ok := byCampaign[cs.Campaign]; ok {
+				total.Links += cs.Links
+				total.Count += cs.Count
+				total.BotCount += cs.BotCount
+				continue
+			}
+			byCampaign[cs.Campaign] = &cs
+		}
+	}
+	return sortedCampaignStats(byCampaign), nil
+}
+
+func sortedCampaignStats(byCampaign map[string]*domain.CampaignStats) []domain.CampaignStats {
+	stats := make([]domain.CampaignStats, 0, len(byCampaign))
+	for _, cs := range byCampaign {
+		stats = append(stats, *cs)
+	}
+	slices.SortFunc(stats, func(a, b domain.CampaignStats) int {
+		return strings.Compare(a.Campaign, b.Campaign)
+	})
+	return stats
+}
+
+// GetCampaignStats adds up the stats of every shard, while a range moves they're computed from the merged links
+func (sr *ShardedURLRepository) GetCampaignStats(ctx context.Context, owner string, campaign string) (domain.CampaignStats, error) {
+	total := domain.CampaignStats{Campaign: campaign}
+	if sr.moving() {
+		byCampaign, err := sr.streamCampaignStats(ctx, owner, func(c string) bool { return c == campaign })
+		if cs, ok := byCampaign[campaign]; ok {
+			total = *cs
+		}
+		return total, err
+	}
+
+	results, err := gather(ctx, sr.shards, func(ctx context.Context, r domain.URLRepository) (domain.CampaignStats, error) {
+		return r.GetCampaignStats(ctx, owner, campaign)
+	})
+	if err != nil {
+		return total, err
+	}
+	for _, cs := range results {
+		total.Links += cs.Links
+		total.Count += cs.Count
+		total.BotCount += cs.BotCount
+	}
+	return total, nil
+}
+
+// TopLinks takes the n top links of every shard. The all-time count of a link found on two shards
+// is the highest one, its recent clicks are split between the shards and added up
+func (sr *ShardedURLRepository) TopLinks(ctx context.Context, n int, since time.Time) ([]domain.ShortURL, error) {
+	results, err := gather(ctx, sr.shards, func(ctx context.Context, r domain.URLRepository) ([]domain.ShortURL, error) {
+		return r.TopLinks(ctx, n, since)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]int)
+	links := make([]domain.ShortURL, 0, n)
+	for _, result := range results {
+		for _, link := range result {
+			i, ok := byID[link.ID]
+			if !ok {
+				byID[link.ID] = len(links)
+				links = append(links, link)
+				continue
+			}
+			if since.IsZero() {
+				links[i].Count = max(links[i].Count, link.Count)
+			} else {
+				links[i].Count += link.Count
+			}
+		}
+	}
+	slices.SortStableFunc(links, func(a, b domain.ShortURL) int {
+		return b.Count - a.Count
+	})
+	if len(links) > n {
+		links = links[:n]
+	}
+	return links, nil
+}
+
+// ShardedClickRepository records clicks on the shard of their short URL
+type ShardedClickRepository struct {
+	shards []domain.ClickRepository
+	router *shard.Router
+}
+
+func NewShardedClickRepository(shards []domain.ClickRepository, router *shard.Router) (*ShardedClickRepository, error) {
+	if len(shards) != router.Shards() {
+		return nil, fmt.Errorf("%d shard repositories for a map of %d shards", len(shards), router.Shards())
+	}
+	return &ShardedClickRepository{
+		shards: shards,
+		router: router,
+	}, nil
+}
+
+func (sc *ShardedClickRepository) BatchRecord(ctx context.Context, clicks []domain.Click) error {
+	batches := make(map[int][]domain.Click)
+	for _, c := range clicks {
+		s := sc.router.Route(c.URLID).Write
+		batches[s] = append(batches[s], c)
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	for s, batch := range batches {
+		g.Go(func() error {
+			return sc.shards[s].BatchRecord(gctx, batch)
+		})
+	}
+	return g.Wait()
+}
+
+// StreamClicks streams from the shard of the short URL. While it moves its clicks can be on both shards,
+// the streams of both are merged in chronological order then
+func (sc *ShardedClickRepository) StreamClicks(ctx context.Context, id string, filter domain.StatsFilter, fn func(domain.Click) error) error {
+	route := sc.router.Route(id)
+	shards := make([]domain.ClickRepository, len(route.Reads))
+	for i, s := range route.Reads {
+		shards[i] = sc.shards[s]
+	}
+	return streamMerged(ctx, shards,
+		func(ctx context.Context, r domain.ClickRepository, fn func(domain.Click) error) error {
+			return r.StreamClicks(ctx, id, filter, fn)
+		},
+		func(a, b domain.Click) int { return a.At.Compare(b.At) },
+		nil,
+		fn,
+	)
+}
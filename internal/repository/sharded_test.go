@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/armistcxy/shorten/internal/shard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newShardedMemory(t *testing.T, n int, m shard.Map) (*ShardedURLRepository, *ShardedClickRepository, []*MemoryURLRepository) {
+	router, err := shard.NewRouter(n, m)
+	require.NoError(t, err)
+
+	var (
+		memories []*MemoryURLRepository
+		urls     []domain.URLRepository
+		clicks   []domain.ClickRepository
+	)
+	for range n {
+		memory := NewMemoryURLRepository()
+		memories = append(memories, memory)
+		urls = append(urls, memory)
+		clicks = append(clicks, NewMemoryClickRepository(memory))
+	}
+	sr, err := NewShardedURLRepository(urls, router)
+	require.NoError(t, err)
+	sc, err := NewShardedClickRepository(clicks, router)
+	require.NoError(t, err)
+	return sr, sc, memories
+}
+
+func TestShardedURLRepository(t *testing.T) {
+	testURLRepository(t, func(t *testing.T) repoHarness {
+		sr, sc, memories := newShardedMemory(t, 3, shard.Even(3))
+		return repoHarness{
+			urls:   sr,
+			clicks: sc,
+			addViews: func(t *testing.T, id string, count int, botCount int) {
+				for _, s := range sr.router.Route(id).All {
+					require.NoError(t, memories[s].AddViews(context.Background(), id, count, botCount))
+				}
+			},
+			markFraud: func(t *testing.T, id string) {
+				for _, s := range sr.router.Route(id).All {
+					require.NoError(t, memories[s].MarkFraud(context.Background(), id))
+				}
+			},
+		}
+	})
+}
+
+func TestShardedMove(t *testing.T) {
+	ctx := context.Background()
+	id := "mvshrd"
+	key := shard.Key(id)
+
+	// the range of id is being moved from shard 0 to shard 1, its row is on both
+	m, err := shard.Map{Version: 1, Ranges: []shard.Range{{Start: 0, End: shard.MaxKey, Shard: 0}}}.Move(key, key, 1)
+	require.NoError(t, err)
+	sr, sc, memories := newShardedMemory(t, 2, m)
+
+	input := domain.CreateInput{ID: id, URL: "https://example.com/move", Campaign: "spring"}
+	require.NoError(t, memories[0].BatchCreate(ctx, []domain.CreateInput{input}))
+	require.NoError(t, memories[0].AddViews(ctx, id, 5, 1))
+
+	// copying: the source answers, the target doesn't have the row yet
+	view, err := sr.GetView(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, 5, view)
+	_, err = sr.Create(ctx, id, "https://example.com/other")
+	assert.ErrorIs(t, err, domain.ErrConflict)
+
+	require.NoError(t, memories[1].BatchCreate(ctx, []domain.CreateInput{input}))
+	require.NoError(t, memories[1].AddViews(ctx, id, 3, 1))
+
+	// switched: the target answers, the source is the fallback
+	sr.router, err = shard.NewRouter(2, m.Advance(0, shard.MaxKey))
+	require.NoError(t, err)
+	sc.router = sr.router
+	view, err = sr.GetView(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, 3, view)
+
+	// listings merge both rows
+	var links []domain.ShortURL
+	require.NoError(t, sr.StreamLinks(ctx, "", domain.StatsFilter{To: time.Now().Add(time.Minute)}, func(link domain.ShortURL) error {
+		links = append(links, link)
+		return nil
+	}))
+	require.Len(t, links, 1)
+	assert.Equal(t, 5, links[0].Count)
+
+	top, err := sr.TopLinks(ctx, 10, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, top, 1)
+	assert.Equal(t, 5, top[0].Count)
+
+	campaigns, err := sr.ListCampaignStats(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []domain.CampaignStats{{Campaign: "spring", Links: 1, Count: 5, BotCount: 1}}, campaigns)
+	campaign, err := sr.GetCampaignStats(ctx, "", "spring")
+	require.NoError(t, err)
+	assert.Equal(t, domain.CampaignStats{Campaign: "spring", Links: 1, Count: 5, BotCount: 1}, campaign)
+
+	// clicks recorded before and after the switch are on different shards
+	now := time.Now()
+	require.NoError(t, NewMemoryClickRepository(memories[0]).BatchRecord(ctx, []domain.Click{{URLID: id, At: now.Add(-time.Minute)}}))
+	require.NoError(t, sc.BatchRecord(ctx, []domain.Click{{URLID: id, At: now}}))
+	var clicks []domain.Click
+	require.NoError(t, sc.StreamClicks(ctx, id, domain.StatsFilter{To: now.Add(time.Minute)}, func(c domain.Click) error {
+		clicks = append(clicks, c)
+		return nil
+	}))
+	require.Len(t, clicks, 2)
+	assert.True(t, clicks[0].At.Before(clicks[1].At))
+
+	top, err = sr.TopLinks(ctx, 10, now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Len(t, top, 1)
+	assert.Equal(t, 2, top[0].Count)
+
+	// deletes go to both shards
+	require.NoError(t, sr.Delete(ctx, id))
+	for _, memory := range memories {
+		_, err := memory.Get(ctx, id)
+		assert.ErrorIs(t, err, domain.ErrNotFound)
+	}
+	assert.ErrorIs(t, sr.Delete(ctx, id), domain.ErrNotFound)
+}
@@ -0,0 +1,495 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/jmoiron/sqlx"
+	_ "modernc.org/sqlite"
+)
+
+// SQLite stores short URLs and clicks in a single file, for small deployments that run one replica.
+// Times are stored as unix nanoseconds. The schema is small enough to be created on open
+// (the migrations of the migrate package are written for Postgres).
+
+var sqliteSchema = `
+	CREATE TABLE IF NOT EXISTS urls (
+		id TEXT PRIMARY KEY,
+		original_url TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		fraud BOOLEAN NOT NULL DEFAULT false,
+		count INTEGER NOT NULL DEFAULT 0,
+		bot_count INTEGER NOT NULL DEFAULT 0,
+		owner TEXT NOT NULL DEFAULT '',
+		campaign TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_urls_owner_created_at ON urls (owner, created_at);
+	CREATE INDEX IF NOT EXISTS idx_urls_owner_campaign ON urls (owner, campaign) WHERE campaign <> '';
+	CREATE INDEX IF NOT EXISTS idx_urls_count ON urls (count DESC);
+
+	CREATE TABLE IF NOT EXISTS clicks (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		url_id TEXT NOT NULL,
+		clicked_at INTEGER NOT NULL,
+		bot BOOLEAN NOT NULL DEFAULT false,
+		referer TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_clicks_url_id_clicked_at ON clicks (url_id, clicked_at, seq);
+`
+
+// OpenSQLite opens (or creates) the database at path, ":memory:" for one that lives as long as the process.
+// SQLite has a single writer anyway, one connection avoids "database is locked" errors
+func OpenSQLite(path string) (*sqlx.DB, error) {
+	db, err := sqlx.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+type SQLiteURLRepository struct {
+	db *sqlx.DB
+}
+
+// NewSQLiteURLRepository uses a database opened with OpenSQLite
+func NewSQLiteURLRepository(db *sqlx.DB) *SQLiteURLRepository {
+	return &SQLiteURLRepository{
+		db: db,
+	}
+}
+
+var (
+	sqliteInsertURLQuery = `
+		INSERT INTO urls (id, original_url, owner, campaign, created_at) VALUES (?, ?, ?, ?, ?);
+	`
+	sqliteInsertFreeURLQuery = `
+		INSERT INTO urls (id, original_url, owner, campaign, created_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING;
+	`
+)
+
+func (sr *SQLiteURLRepository) Create(ctx context.Context, id string, url string) (*domain.ShortURL, error) {
+	short := &domain.ShortURL{
+		ID:        id,
+		Origin:    url,
+		CreatedAt: time.Now(),
+	}
+	if _, err := sr.db.ExecContext(ctx, sqliteInsertURLQuery, id, url, "", "", short.CreatedAt.UnixNano()); err != nil {
+		return nil, mapError(err)
+	}
+	return short, nil
+}
+
+// BatchCreate inserts all the short URLs or none of them
+func (sr *SQLiteURLRepository) BatchCreate(ctx context.Context, inputs []domain.CreateInput) error {
+	if len(inputs) == 0 {
+		return nil
+	}
+	tx, err := sr.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixNano()
+	for _, input := range inputs {
+		if _, err := tx.ExecContext(ctx, sqliteInsertURLQuery, input.ID, input.URL, input.Owner, input.Campaign, now); err != nil {
+			return mapError(err)
+		}
+	}
+	return tx.Commit()
+}
+
+// BatchCreateSkipTaken inserts the short URLs whose id is free
+func (sr *SQLiteURLRepository) BatchCreateSkipTaken(ctx context.Context, inputs []domain.CreateInput) ([]string, error) {
+	if len(inputs) == 0 {
+		return nil, nil
+	}
+	tx, err := sr.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var taken []string
+	now := time.Now().UnixNano()
+	for _, input := range inputs {
+		res, err := tx.ExecContext(ctx, sqliteInsertFreeURLQuery, input.ID, input.URL, input.Owner, input.Campaign, now)
+		if err != nil {
+			return nil, mapError(err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 0 {
+			taken = append(taken, input.ID)
+		}
+	}
+	return taken, tx.Commit()
+}
+
+var (
+	sqliteGetURLQuery     = `SELECT original_url, fraud FROM urls WHERE id = ?`
+	sqliteGetFraudQuery   = `SELECT fraud FROM urls WHERE id = ?`
+	sqliteGetViewQuery    = `SELECT count FROM urls WHERE id = ?`
+	sqliteGetBotViewQuery = `SELECT bot_count FROM urls WHERE id = ?`
+	sqliteGetOwnerQuery   = `SELECT owner FROM urls WHERE id = ?`
+)
+
+func (sr *SQLiteURLRepository) Get(ctx context.Context, id string) (string, error) {
+	var (
+		origin string
+		fraud  bool
+	)
+	if err := sr.db.QueryRowxContext(ctx, sqliteGetURLQuery, id).Scan(&origin, &fraud); err != nil {
+		return "", mapError(err)
+	}
+	if fraud {
+		return "", domain.ErrDisabled
+	}
+	return origin, nil
+}
+
+func (sr *SQLiteURLRepository) RetrieveFraud(ctx context.Context, id string) (bool, error) {
+	var fraud bool
+	if err := sr.db.GetContext(ctx, &fraud, sqliteGetFraudQuery, id); err != nil {
+		return false, mapError(err)
+	}
+	return fraud, nil
+}
+
+func (sr *SQLiteURLRepository) GetView(ctx context.Context, id string) (int, error) {
+	var view int
+	if err := sr.db.GetContext(ctx, &view, sqliteGetViewQuery, id); err != nil {
+		return 0, mapError(err)
+	}
+	return view, nil
+}
+
+func (sr *SQLiteURLRepository) GetBotView(ctx context.Context, id string) (int, error) {
+	var view int
+	if err := sr.db.GetContext(ctx, &view, sqliteGetBotViewQuery, id); err != nil {
+		return 0, mapError(err)
+	}
+	return view, nil
+}
+
+func (sr *SQLiteURLRepository) GetOwner(ctx context.Context, id string) (string, error) {
+	var owner string
+	if err := sr.db.GetContext(ctx, &owner, sqliteGetOwnerQuery, id); err != nil {
+		return "", mapError(err)
+	}
+	return owner, nil
+}
+
+var (
+	sqliteAddViewsQuery  = `UPDATE urls SET count = count + ?, bot_count = bot_count + ? WHERE id = ?`
+	sqliteMarkFraudQuery = `UPDATE urls SET fraud = true WHERE id = ?`
+)
+
+// AddViews adds to the view counters of the short URL, like the view flushes of the background worker do
+func (sr *SQLiteURLRepository) AddViews(ctx context.Context, id string, count int, botCount int) error {
+	return sr.update(ctx, sqliteAddViewsQuery, count, botCount, id)
+}
+
+// MarkFraud flags the short URL as fraudulent, like the fraud detection does
+func (sr *SQLiteURLRepository) MarkFraud(ctx context.Context, id string) error {
+	return sr.update(ctx, sqliteMarkFraudQuery, id)
+}
+
+// update runs a query that must change one short URL
+func (sr *SQLiteURLRepository) update(ctx context.Context, query string, args ...any) error {
+	result, err := sr.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
+
+var (
+	sqliteDeleteURLQuery    = `DELETE FROM urls WHERE id = ?`
+	sqliteDeleteClicksQuery = `DELETE FROM clicks WHERE url_id = ?`
+)
+
+func (sr *SQLiteURLRepository) Delete(ctx context.Context, id string) error {
+	tx, err := sr.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, sqliteDeleteURLQuery, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return domain.ErrNotFound
+	}
+	if _, err := tx.ExecContext(ctx, sqliteDeleteClicksQuery, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// The single connection can't run queries while a result set is open, so streams read a chunk
+// before handing its rows to fn
+
+var sqliteScanIDsQuery = `SELECT id FROM urls WHERE id > ? ORDER BY id LIMIT ?`
+
+func (sr *SQLiteURLRepository) ScanIDs(ctx context.Context, fn func(id string) error) error {
+	lastID := ""
+	for {
+		var ids []string
+		if err := sr.db.SelectContext(ctx, &ids, sqliteScanIDsQuery, lastID, streamChunkSize); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := fn(id); err != nil {
+				return err
+			}
+		}
+		if len(ids) < streamChunkSize {
+			return nil
+		}
+		lastID = ids[len(ids)-1]
+	}
+}
+
+type sqliteURL struct {
+	ID        string `db:"id"`
+	Origin    string `db:"original_url"`
+	CreatedAt int64  `db:"created_at"`
+	Fraud     bool   `db:"fraud"`
+	Owner     string `db:"owner"`
+	Campaign  string `db:"campaign"`
+	Count     int    `db:"count"`
+	BotCount  int    `db:"bot_count"`
+}
+
+var (
+	sqliteStreamLinksQuery = `
+		SELECT id, original_url, created_at, fraud, owner, campaign, count, bot_count
+		FROM urls
+		WHERE owner = ? AND created_at >= ? AND created_at < ? AND id > ?
+		ORDER BY id
+		LIMIT ?
+	`
+)
+
+func (sr *SQLiteURLRepository) StreamLinks(ctx context.Context, owner string, filter domain.StatsFilter, fn func(domain.ShortURL) error) error {
+	lastID := ""
+	for {
+		var rows []sqliteURL
+		if err := sr.db.SelectContext(ctx, &rows, sqliteStreamLinksQuery, owner, filter.From.UnixNano(), filter.To.UnixNano(),
+			lastID, streamChunkSize); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := fn(domain.ShortURL{
+				ID:        row.ID,
+				Origin:    row.Origin,
+				CreatedAt: time.Unix(0, row.CreatedAt),
+				Fraud:     row.Fraud,
+				Owner:     row.Owner,
+				Campaign:  row.Campaign,
+				Count:     row.Count,
+				BotCount:  row.BotCount,
+			}); err != nil {
+				return err
+			}
+		}
+		if len(rows) < streamChunkSize {
+			return nil
+		}
+		lastID = rows[len(rows)-1].ID
+	}
+}
+
+var (
+	sqliteListCampaignStatsQuery = `
+		SELECT campaign, COUNT(*) AS links, COALESCE(SUM(count), 0) AS count, COALESCE(SUM(bot_count), 0) AS bot_count
+		FROM urls
+		WHERE owner = ? AND campaign <> ''
+		GROUP BY campaign
+		ORDER BY campaign
+	`
+	sqliteGetCampaignStatsQuery = `
+		SELECT COUNT(*) AS links, COALESCE(SUM(count), 0) AS count, COALESCE(SUM(bot_count), 0) AS bot_count
+		FROM urls
+		WHERE owner = ? AND campaign = ?
+	`
+)
+
+type sqliteCampaignStats struct {
+	Campaign string `db:"campaign"`
+	Links    int    `db:"links"`
+	Count    int    `db:"count"`
+	BotCount int    `db:"bot_count"`
+}
+
+func (sr *SQLiteURLRepository) ListCampaignStats(ctx context.Context, owner string) ([]domain.CampaignStats, error) {
+	var rows []sqliteCampaignStats
+	if err := sr.db.SelectContext(ctx, &rows, sqliteListCampaignStatsQuery, owner); err != nil {
+		return nil, err
+	}
+	stats := make([]domain.CampaignStats, 0, len(rows))
+	for _, row := range rows {
+		stats = append(stats, domain.CampaignStats(row))
+	}
+	return stats, nil
+}
+
+func (sr *SQLiteURLRepository) GetCampaignStats(ctx context.Context, owner string, campaign string) (domain.CampaignStats, error) {
+	var row sqliteCampaignStats
+	if err := sr.db.GetContext(ctx, &row, sqliteGetCampaignStatsQuery, owner, campaign); err != nil {
+		return domain.CampaignStats{Campaign: campaign}, err
+	}
+	row.Campaign = campaign
+	return domain.CampaignStats(row), nil
+}
+
+var (
+	sqliteTopLinksQuery = `
+		SELECT id, original_url, count
+		FROM urls
+		WHERE NOT fraud
+		ORDER BY count DESC, id
+		LIMIT ?
+	`
+	sqliteTopRecentLinksQuery = `
+		SELECT u.id, u.original_url, COUNT(*) AS count
+		FROM clicks c
+		JOIN urls u ON u.id = c.url_id
+		WHERE c.clicked_at >= ? AND NOT c.bot AND NOT u.fraud
+		GROUP BY u.id, u.original_url
+		ORDER BY count DESC, u.id
+		LIMIT ?
+	`
+)
+
+type sqliteTopLink struct {
+	ID     string `db:"id"`
+	Origin string `db:"original_url"`
+	Count  int    `db:"count"`
+}
+
+func (sr *SQLiteURLRepository) TopLinks(ctx context.Context, n int, since time.Time) ([]domain.ShortURL, error) {
+	var (
+		rows []sqliteTopLink
+		err  error
+	)
+	if since.IsZero() {
+		err = sr.db.SelectContext(ctx, &rows, sqliteTopLinksQuery, n)
+	} else {
+		err = sr.db.SelectContext(ctx, &rows, sqliteTopRecentLinksQuery, since.UnixNano(), n)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]domain.ShortURL, 0, len(rows))
+	for _, row := range rows {
+		links = append(links, domain.ShortURL{ID: row.ID, Origin: row.Origin, Count: row.Count})
+	}
+	return links, nil
+}
+
+type SQLiteClickRepository struct {
+	db *sqlx.DB
+}
+
+func NewSQLiteClickRepository(db *sqlx.DB) *SQLiteClickRepository {
+	return &SQLiteClickRepository{
+		db: db,
+	}
+}
+
+var (
+	sqliteInsertClickQuery = `
+		INSERT INTO clicks (url_id, clicked_at, bot, referer, user_agent) VALUES (?, ?, ?, ?, ?)
+	`
+)
+
+func (cr *SQLiteClickRepository) BatchRecord(ctx context.Context, clicks []domain.Click) error {
+	tx, err := cr.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, sqliteInsertClickQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, c := range clicks {
+		if _, err := stmt.ExecContext(ctx, c.URLID, c.At.UnixNano(), c.Bot, c.Referer, c.UserAgent); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+var (
+	sqliteStreamClicksQuery = `
+		SELECT seq, url_id, clicked_at, bot, referer, user_agent
+		FROM clicks
+		WHERE url_id = ? AND clicked_at < ? AND (bot = false OR ?)
+			AND (clicked_at, seq) > (?, ?)
+		ORDER BY clicked_at, seq
+		LIMIT ?
+	`
+)
+
+type sqliteClick struct {
+	Seq       int64  `db:"seq"`
+	URLID     string `db:"url_id"`
+	ClickedAt int64  `db:"clicked_at"`
+	Bot       bool   `db:"bot"`
+	Referer   string `db:"referer"`
+	UserAgent string `db:"user_agent"`
+}
+
+func (cr *SQLiteClickRepository) StreamClicks(ctx context.Context, id string, filter domain.StatsFilter, fn func(domain.Click) error) error {
+	// keyset pagination on (clicked_at, seq) like the Postgres repository
+	var (
+		lastAt  int64 = filter.From.UnixNano()
+		lastSeq int64 = -1
+	)
+	for {
+		var rows []sqliteClick
+		if err := cr.db.SelectContext(ctx, &rows, sqliteStreamClicksQuery, id, filter.To.UnixNano(), filter.IncludeBots,
+			lastAt, lastSeq, streamChunkSize); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := fn(domain.Click{
+				URLID:     row.URLID,
+				At:        time.Unix(0, row.ClickedAt),
+				Bot:       row.Bot,
+				Referer:   row.Referer,
+				UserAgent: row.UserAgent,
+			}); err != nil {
+				return err
+			}
+		}
+		if len(rows) < streamChunkSize {
+			return nil
+		}
+		lastAt, lastSeq = rows[len(rows)-1].ClickedAt, rows[len(rows)-1].Seq
+	}
+}
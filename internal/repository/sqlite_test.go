@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteURLRepository(t *testing.T) {
+	testURLRepository(t, func(t *testing.T) repoHarness {
+		db, err := OpenSQLite(filepath.Join(t.TempDir(), "shorten.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+
+		urls := NewSQLiteURLRepository(db)
+		return repoHarness{
+			urls:   urls,
+			clicks: NewSQLiteClickRepository(db),
+			addViews: func(t *testing.T, id string, count int, botCount int) {
+				require.NoError(t, urls.AddViews(context.Background(), id, count, botCount))
+			},
+			markFraud: func(t *testing.T, id string) {
+				require.NoError(t, urls.MarkFraud(context.Background(), id))
+			},
+		}
+	})
+}
+
+// The database outlives its connection, ":memory:" lives as long as the process
+func TestOpenSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shorten.db")
+	db, err := OpenSQLite(path)
+	require.NoError(t, err)
+	_, err = NewSQLiteURLRepository(db).Create(context.Background(), "abcdef", "https://example.com")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	db, err = OpenSQLite(path)
+	require.NoError(t, err)
+	defer db.Close()
+	origin, err := NewSQLiteURLRepository(db).Get(context.Background(), "abcdef")
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com", origin)
+
+	mem, err := OpenSQLite(":memory:")
+	require.NoError(t, err)
+	defer mem.Close()
+	_, err = NewSQLiteURLRepository(mem).Create(context.Background(), "abcdef", "https://example.com")
+	require.NoError(t, err)
+	_, err = NewSQLiteURLRepository(mem).Get(context.Background(), "abcdef")
+	require.NoError(t, err)
+}
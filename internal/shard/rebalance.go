@@ -0,0 +1,382 @@
+package shard
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Rebalancer moves ranges of keys between shards while they're in use. Every step changes the map, then
+// waits settle for every process to load it (see Router.Run) before touching the rows:
+//  1. copying: the rows of the range are copied to the target, new ones are still written to the source
+//  2. switched: new rows go to the target, the source is copied again (rows are merged, views take the
+//     highest count) and the clicks are moved over
+//  3. done: the range belongs to the target, the rows left on the source are deleted
+//
+// Moves can be resumed: running the same move again continues from the phase the map is in.
+// Views are applied to both shards while a range moves, fraud flags and deletes go to every shard holding
+// the row, so merging never loses one. A short URL deleted while its row is being copied may come back
+type Rebalancer struct {
+	store     *Store
+	dbs       []*sqlx.DB
+	settle    time.Duration
+	batchSize int
+}
+
+func NewRebalancer(store *Store, dbs []*sqlx.DB, settle time.Duration) *Rebalancer {
+	return &Rebalancer{
+		store:     store,
+		dbs:       dbs,
+		settle:    settle,
+		batchSize: 1000,
+	}
+}
+
+// WithBatchSize sets the number of rows copied or deleted per query
+func (rb *Rebalancer) WithBatchSize(n int) *Rebalancer {
+	rb.batchSize = n
+	return rb
+}
+
+// Move moves the keys [start, end] to the target shard
+func (rb *Rebalancer) Move(ctx context.Context, start, end uint64, target int) error {
+	m, err := rb.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if err := m.Validate(len(rb.dbs)); err != nil {
+		return err
+	}
+
+	if len(movingWithin(m, start, end)) == 0 {
+		next, err := m.Move(start, end, target)
+		if err != nil {
+			return err
+		}
+		if len(movingWithin(next, start, end)) == 0 {
+			slog.Info("the keys are on the target shard already", "start", start, "end", end, "shard", target)
+			return nil
+		}
+		if m, err = rb.save(ctx, next); err != nil {
+			return err
+		}
+	}
+
+	for {
+		moving := movingWithin(m, start, end)
+		if len(moving) == 0 {
+			return nil
+		}
+		for _, r := range moving {
+			if r.Target != target || r.Phase != moving[0].Phase {
+				return fmt.Errorf("%w: [%d, %d] is moving to shard %d (%s), finish that move first", ErrInvalidRange, r.Start, r.End, r.Target, r.Phase)
+			}
+		}
+
+		switch moving[0].Phase {
+		case Copying:
+			for _, r := range moving {
+				if err := rb.copyURLs(ctx, r); err != nil {
+					return err
+				}
+			}
+		case Switched:
+			// writers that had the previous map are done, the source doesn't change anymore
+			for _, r := range moving {
+				if err := rb.copyURLs(ctx, r); err != nil {
+					return err
+				}
+				if err := rb.moveClicks(ctx, r); err != nil {
+					return err
+				}
+			}
+		}
+
+		next := m.Advance(start, end)
+		if m, err = rb.save(ctx, next); err != nil {
+			return err
+		}
+		if moving[0].Phase == Switched {
+			for _, r := range moving {
+				if _, err := rb.prune(ctx, r.Shard, r.Start, r.End); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// movingWithin returns the moving ranges within [start, end]
+func movingWithin(m Map, start, end uint64) []Range {
+	var moving []Range
+	for _, r := range m.Moving() {
+		if r.Start >= start && r.End <= end {
+			moving = append(moving, r)
+		}
+	}
+	return moving
+}
+
+// save stores next and waits for every process to switch to it
+func (rb *Rebalancer) save(ctx context.Context, next Map) (Map, error) {
+	if err := rb.store.Save(ctx, next); err != nil {
+		return Map{}, err
+	}
+	slog.Info("saved the shard map, waiting for every process to load it", "version", next.Version, "settle", rb.settle)
+	select {
+	case <-ctx.Done():
+		return Map{}, ctx.Err()
+	case <-time.After(rb.settle):
+	}
+	return next, nil
+}
+
+var (
+	copyURLsQuery = `
+		SELECT id, original_url, created_at, fraud, count, bot_count, owner, campaign, shard_key
+		FROM urls
+		WHERE (shard_key, id) > ($1, $2) AND shard_key <= $3
+		ORDER BY shard_key, id
+		LIMIT $4
+	`
+	mergeURLsConflict = `
+		ON CONFLICT (id) DO UPDATE SET
+			count = GREATEST(urls.count, EXCLUDED.count),
+			bot_count = GREATEST(urls.bot_count, EXCLUDED.bot_count),
+			fraud = urls.fraud OR EXCLUDED.fraud
+	`
+)
+
+type urlRow struct {
+	ID        string    `db:"id"`
+	Origin    string    `db:"original_url"`
+	CreatedAt time.Time `db:"created_at"`
+	Fraud     bool      `db:"fraud"`
+	Count     int       `db:"count"`
+	BotCount  int       `db:"bot_count"`
+	Owner     string    `db:"owner"`
+	Campaign  string    `db:"campaign"`
+	ShardKey  int64     `db:"shard_key"`
+}
+
+// copyURLs copies the rows of r from its shard to its target, merging them with the rows there
+func (rb *Rebalancer) copyURLs(ctx context.Context, r Range) error {
+	if _, err := rb.Backfill(ctx, r.Shard); err != nil {
+		return err
+	}
+	src, dst := rb.dbs[r.Shard], rb.dbs[r.Target]
+
+	copied := 0
+	lastKey, lastID := int64(r.Start), ""
+	for {
+		var rows []urlRow
+		if err := src.SelectContext(ctx, &rows, copyURLsQuery, lastKey, lastID, int64(r.End), rb.batchSize); err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+
+		query := bytes.NewBufferString(`INSERT INTO urls (id, original_url, created_at, fraud, count, bot_count, owner, campaign, shard_key) VALUES `)
+		params := make([]any, 0, 9*len(rows))
+		for i, row := range rows {
+			if i > 0 {
+				query.WriteString(",")
+			}
+			fmt.Fprintf(query, "($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)", 9*i+1, 9*i+2, 9*i+3, 9*i+4, 9*i+5, 9*i+6, 9*i+7, 9*i+8, 9*i+9)
+			params = append(params, row.ID, row.Origin, row.CreatedAt, row.Fraud, row.Count, row.BotCount, row.Owner, row.Campaign, row.ShardKey)
+		}
+		query.WriteString(mergeURLsConflict)
+		if _, err := dst.ExecContext(ctx, query.String(), params...); err != nil {
+			return err
+		}
+
+		copied += len(rows)
+		last := rows[len(rows)-1]
+		lastKey, lastID = last.ShardKey, last.ID
+	}
+	slog.Info("copied short URLs", "start", r.Start, "end", r.End, "from", r.Shard, "to", r.Target, "rows", copied, "phase", r.Phase)
+	return nil
+}
+
+var (
+	selectRangeClicksQuery = `
+		SELECT c.seq, c.url_id, c.clicked_at, c.bot, c.referer, c.user_agent
+		FROM clicks c JOIN urls u ON u.id = c.url_id
+		WHERE u.shard_key BETWEEN $1 AND $2 AND c.seq > $3
+		ORDER BY c.seq
+		LIMIT $4
+	`
+	deleteClicksBySeqQuery = `
+		DELETE FROM clicks WHERE seq = ANY($1)
+	`
+)
+
+type clickRow struct {
+	Seq       int64     `db:"seq"`
+	URLID     string    `db:"url_id"`
+	ClickedAt time.Time `db:"clicked_at"`
+	Bot       bool      `db:"bot"`
+	Referer   string    `db:"referer"`
+	UserAgent string    `db:"user_agent"`
+}
+
+// moveClicks moves the clicks recorded on the source of r to its target.
+// A batch is inserted then deleted. The target keeps the source shard and seq of every click in a unique
+// index, if the move is interrupted in between the batch is skipped when it is inserted again
+func (rb *Rebalancer) moveClicks(ctx context.Context, r Range) error {
+	src, dst := rb.dbs[r.Shard], rb.dbs[r.Target]
+
+	moved := 0
+	lastSeq := int64(0)
+	for {
+		var rows []clickRow
+		if err := src.SelectContext(ctx, &rows, selectRangeClicksQuery, int64(r.Start), int64(r.End), lastSeq, rb.batchSize); err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+
+		query := bytes.NewBufferString(`INSERT INTO clicks (url_id, clicked_at, bot, referer, user_agent, source_shard, source_seq) VALUES `)
+		params := make([]any, 0, 7*len(rows))
+		seqs := make([]int64, len(rows))
+		for i, row := range rows {
+			if i > 0 {
+				query.WriteString(",")
+			}
+			fmt.Fprintf(query, "($%d, $%d, $%d, $%d, $%d, $%d, $%d)", 7*i+1, 7*i+2, 7*i+3, 7*i+4, 7*i+5, 7*i+6, 7*i+7)
+			params = append(params, row.URLID, row.ClickedAt, row.Bot, row.Referer, row.UserAgent, r.Shard, row.Seq)
+			seqs[i] = row.Seq
+		}
+		query.WriteString(" ON CONFLICT (source_shard, source_seq) DO NOTHING")
+		if _, err := dst.ExecContext(ctx, query.String(), params...); err != nil {
+			return err
+		}
+		if _, err := src.ExecContext(ctx, deleteClicksBySeqQuery, pq.Array(seqs)); err != nil {
+			return err
+		}
+
+		moved += len(rows)
+		lastSeq = rows[len(rows)-1].Seq
+	}
+	slog.Info("moved clicks", "start", r.Start, "end", r.End, "from", r.Shard, "to", r.Target, "clicks", moved)
+	return nil
+}
+
+var (
+	selectUnkeyedQuery = `
+		SELECT id FROM urls WHERE shard_key IS NULL LIMIT $1
+	`
+	setShardKeysQuery = `
+		UPDATE urls AS u SET shard_key = v.shard_key
+		FROM unnest($1::text[], $2::bigint[]) AS v(id, shard_key)
+		WHERE u.id = v.id
+	`
+)
+
+// Backfill computes the key of the rows of a shard written before sharding, it returns the number of rows
+func (rb *Rebalancer) Backfill(ctx context.Context, shard int) (int, error) {
+	db := rb.dbs[shard]
+	filled := 0
+	for {
+		var ids []string
+		if err := db.SelectContext(ctx, &ids, selectUnkeyedQuery, rb.batchSize); err != nil {
+			return filled, err
+		}
+		if len(ids) == 0 {
+			return filled, nil
+		}
+		keys := make([]int64, len(ids))
+		for i, id := range ids {
+			keys[i] = int64(Key(id))
+		}
+		if _, err := db.ExecContext(ctx, setShardKeysQuery, pq.Array(ids), pq.Array(keys)); err != nil {
+			return filled, err
+		}
+		filled += len(ids)
+	}
+}
+
+// Prune deletes the rows (and their clicks) that a shard holds but the current map assigns elsewhere,
+// left behind by a move that was interrupted before its clean up. It returns the number of deleted rows
+func (rb *Rebalancer) Prune(ctx context.Context) (int, error) {
+	m, err := rb.store.Load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.Validate(len(rb.dbs)); err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for shard := range rb.dbs {
+		if _, err := rb.Backfill(ctx, shard); err != nil {
+			return pruned, err
+		}
+		for _, r := range m.Ranges {
+			if r.Shard == shard || (r.Moving() && r.Target == shard) {
+				continue
+			}
+			n, err := rb.prune(ctx, shard, r.Start, r.End)
+			pruned += n
+			if err != nil {
+				return pruned, err
+			}
+		}
+	}
+	return pruned, nil
+}
+
+var (
+	selectRangeIDsQuery = `
+		SELECT id FROM urls WHERE shard_key BETWEEN $1 AND $2 LIMIT $3
+	`
+	deleteURLsByIDQuery = `
+		DELETE FROM urls WHERE id = ANY($1)
+	`
+	deleteClicksByURLQuery = `
+		DELETE FROM clicks WHERE url_id = ANY($1)
+	`
+)
+
+// prune deletes the rows of the keys [start, end] from a shard
+func (rb *Rebalancer) prune(ctx context.Context, shard int, start, end uint64) (int, error) {
+	db := rb.dbs[shard]
+	pruned := 0
+	for {
+		var ids []string
+		if err := db.SelectContext(ctx, &ids, selectRangeIDsQuery, int64(start), int64(end), rb.batchSize); err != nil {
+			return pruned, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return pruned, err
+		}
+		if _, err := tx.ExecContext(ctx, deleteClicksByURLQuery, pq.Array(ids)); err != nil {
+			tx.Rollback()
+			return pruned, err
+		}
+		if _, err := tx.ExecContext(ctx, deleteURLsByIDQuery, pq.Array(ids)); err != nil {
+			tx.Rollback()
+			return pruned, err
+		}
+		if err := tx.Commit(); err != nil {
+			return pruned, err
+		}
+		pruned += len(ids)
+	}
+	if pruned > 0 {
+		slog.Info("deleted short URLs that moved to another shard", "start", start, "end", end, "shard", shard, "rows", pruned)
+	}
+	return pruned, nil
+}
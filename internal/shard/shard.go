@@ -0,0 +1,212 @@
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"github.com/armistcxy/shorten/internal/domain"
+)
+
+// The urls table is split across Postgres instances (shards). Every short URL has a shard key:
+// its decoded numeric id (domain.DecodeID), or a hash of the slug when it doesn't decode (custom aliases),
+// scrambled so that sequential ids spread over the whole key space. The map assigns ranges of keys to shards,
+// a range is moved to another shard in phases so that lookups and writes never stop:
+//   - copying: writes go to the source, the rows are copied to the target
+//   - switched: writes go to the target, rows written to the source meanwhile are copied over
+//   - then the range belongs to the target, and the source rows are deleted
+//
+// While a range moves, lookups try both shards and views are applied to both.
+// The key depends on ID_CHECK_DIGIT (through domain.DecodeID): every process must use the same setting,
+// and it can't change once short URLs are spread over several shards.
+// fraud-detection marks short URLs on URL_DSN only, it doesn't know about shards yet.
+
+// MaxKey is the largest shard key, keys fit a BIGINT column
+const MaxKey = 1<<63 - 1
+
+// Key returns the shard key of the short URL id
+func Key(id string) uint64 {
+	x, err := domain.DecodeID(id)
+	if err != nil {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+		x = h.Sum64()
+	}
+	// splitmix64 finalizer, a bijection: neighbouring ids land far apart
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return x >> 1
+}
+
+type Phase string
+
+const (
+	Stable   Phase = ""
+	Copying  Phase = "copying"
+	Switched Phase = "switched"
+)
+
+// Range is the keys [Start, End] held by Shard, Target is where it moves to when Phase isn't Stable
+type Range struct {
+	Start  uint64 `json:"start"`
+	End    uint64 `json:"end"`
+	Shard  int    `json:"shard"`
+	Target int    `json:"target,omitempty"`
+	Phase  Phase  `json:"phase,omitempty"`
+}
+
+func (r Range) Moving() bool {
+	return r.Phase != Stable
+}
+
+// Route says where the short URLs of a range are:
+// Write is the shard new rows go to, Reads the shards to look them up in (in order), All every shard
+// that may hold them (updates and deletes go to all of them)
+type Route struct {
+	Write int
+	Reads []int
+	All   []int
+}
+
+func (r Range) Route() Route {
+	switch r.Phase {
+	case Copying:
+		return Route{Write: r.Shard, Reads: []int{r.Shard, r.Target}, All: []int{r.Shard, r.Target}}
+	case Switched:
+		return Route{Write: r.Target, Reads: []int{r.Target, r.Shard}, All: []int{r.Shard, r.Target}}
+	default:
+		return Route{Write: r.Shard, Reads: []int{r.Shard}, All: []int{r.Shard}}
+	}
+}
+
+// Map is a version of the assignment of keys to shards, its ranges are sorted and cover [0, MaxKey]
+type Map struct {
+	Version int64   `json:"version"`
+	Ranges  []Range `json:"ranges"`
+}
+
+var (
+	ErrInvalidMap   = errors.New("invalid shard map")
+	ErrInvalidRange = errors.New("invalid key range")
+)
+
+// Even splits the keys in n ranges of the same size, range i on shard i
+func Even(n int) Map {
+	m := Map{Version: 1}
+	step := uint64(MaxKey)/uint64(n) + 1
+	for i := range n {
+		r := Range{Start: uint64(i) * step, End: uint64(i+1)*step - 1, Shard: i}
+		if i == n-1 {
+			r.End = MaxKey
+		}
+		m.Ranges = append(m.Ranges, r)
+	}
+	return m
+}
+
+// Validate checks that the ranges cover every key once and only name shards below shards
+func (m Map) Validate(shards int) error {
+	if len(m.Ranges) == 0 {
+		return fmt.Errorf("%w: no ranges", ErrInvalidMap)
+	}
+	next := uint64(0)
+	for i, r := range m.Ranges {
+		if r.Start != next || r.End < r.Start || r.End > MaxKey {
+			return fmt.Errorf("%w: range %d [%d, %d] doesn't start at %d", ErrInvalidMap, i, r.Start, r.End, next)
+		}
+		if r.Shard < 0 || r.Shard >= shards || (r.Moving() && (r.Target < 0 || r.Target >= shards || r.Target == r.Shard)) {
+			return fmt.Errorf("%w: range %d [%d, %d] names an unknown shard (there are %d)", ErrInvalidMap, i, r.Start, r.End, shards)
+		}
+		next = r.End + 1
+	}
+	if m.Ranges[len(m.Ranges)-1].End != MaxKey {
+		return fmt.Errorf("%w: the keys after %d aren't assigned", ErrInvalidMap, next-1)
+	}
+	return nil
+}
+
+// Lookup returns the range holding key
+func (m Map) Lookup(key uint64) Range {
+	i := sort.Search(len(m.Ranges), func(i int) bool { return m.Ranges[i].End >= key })
+	return m.Ranges[i]
+}
+
+// Route returns the route of the short URL id
+func (m Map) Route(id string) Route {
+	return m.Lookup(Key(id)).Route()
+}
+
+// Moving returns the ranges that are being moved
+func (m Map) Moving() []Range {
+	var moving []Range
+	for _, r := range m.Ranges {
+		if r.Moving() {
+			moving = append(moving, r)
+		}
+	}
+	return moving
+}
+
+// split makes a range start at key, the ranges are copied
+func (m Map) split(key uint64) Map {
+	ranges := make([]Range, 0, len(m.Ranges)+1)
+	for _, r := range m.Ranges {
+		if r.Start < key && key <= r.End {
+			left, right := r, r
+			left.End, right.Start = key-1, key
+			ranges = append(ranges, left, right)
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	return Map{Version: m.Version, Ranges: ranges}
+}
+
+// Move starts moving the keys [start, end] to target: the stable ranges they cover that aren't on target
+// yet enter the copying phase. Ranges that are already moving can't be moved
+func (m Map) Move(start, end uint64, target int) (Map, error) {
+	if start > end || end > MaxKey {
+		return m, fmt.Errorf("%w: [%d, %d]", ErrInvalidRange, start, end)
+	}
+	next := m.split(start)
+	if end < MaxKey {
+		next = next.split(end + 1)
+	}
+	for i, r := range next.Ranges {
+		if r.Start < start || r.End > end {
+			continue
+		}
+		if r.Moving() {
+			return m, fmt.Errorf("%w: [%d, %d] is already moving to shard %d", ErrInvalidRange, r.Start, r.End, r.Target)
+		}
+		if r.Shard != target {
+			next.Ranges[i].Target, next.Ranges[i].Phase = target, Copying
+		}
+	}
+	next.Version++
+	return next, nil
+}
+
+// Advance moves the moving ranges within [start, end] to their next phase: copying ranges are switched,
+// switched ranges end up on their target. Neighbouring stable ranges of the same shard are merged
+func (m Map) Advance(start, end uint64) Map {
+	next := Map{Version: m.Version + 1, Ranges: make([]Range, 0, len(m.Ranges))}
+	for _, r := range m.Ranges {
+		if r.Start >= start && r.End <= end {
+			switch r.Phase {
+			case Copying:
+				r.Phase = Switched
+			case Switched:
+				r = Range{Start: r.Start, End: r.End, Shard: r.Target}
+			}
+		}
+		if n := len(next.Ranges); n > 0 && !r.Moving() && !next.Ranges[n-1].Moving() && next.Ranges[n-1].Shard == r.Shard {
+			next.Ranges[n-1].End = r.End
+			continue
+		}
+		next.Ranges = append(next.Ranges, r)
+	}
+	return next
+}
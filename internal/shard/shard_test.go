@@ -0,0 +1,97 @@
+package shard
+
+import (
+	"testing"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKey(t *testing.T) {
+	assert.Equal(t, Key("abcdef"), Key("abcdef"))
+	assert.LessOrEqual(t, Key("abcdef"), uint64(MaxKey))
+	// custom aliases are hashed
+	assert.LessOrEqual(t, Key("my-launch!"), uint64(MaxKey))
+	assert.NotEqual(t, Key("my-launch!"), Key("my-launch?"))
+
+	// sequential ids are spread over the shards
+	m := Even(4)
+	perShard := make([]int, 4)
+	for n := range uint64(4000) {
+		perShard[m.Route(domain.EncodeID(n+1_000_000)).Write]++
+	}
+	for _, count := range perShard {
+		assert.InDelta(t, 1000, count, 150)
+	}
+}
+
+func TestEven(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 7} {
+		m := Even(n)
+		require.NoError(t, m.Validate(n))
+		assert.Len(t, m.Ranges, n)
+	}
+	m := Even(2)
+	assert.Equal(t, 0, m.Lookup(0).Shard)
+	assert.Equal(t, 1, m.Lookup(MaxKey).Shard)
+	assert.ErrorIs(t, m.Validate(1), ErrInvalidMap)
+}
+
+func TestValidate(t *testing.T) {
+	gap := Map{Ranges: []Range{{Start: 0, End: 10}, {Start: 12, End: MaxKey}}}
+	assert.ErrorIs(t, gap.Validate(1), ErrInvalidMap)
+	short := Map{Ranges: []Range{{Start: 0, End: 10}}}
+	assert.ErrorIs(t, short.Validate(1), ErrInvalidMap)
+	toItself := Map{Ranges: []Range{{Start: 0, End: MaxKey, Shard: 1, Target: 1, Phase: Copying}}}
+	assert.ErrorIs(t, toItself.Validate(2), ErrInvalidMap)
+	assert.ErrorIs(t, Map{}.Validate(1), ErrInvalidMap)
+}
+
+func TestMove(t *testing.T) {
+	m := Even(2)
+	half := m.Ranges[0].End
+
+	moved, err := m.Move(100, 199, 1)
+	require.NoError(t, err)
+	require.NoError(t, moved.Validate(2))
+	assert.Equal(t, m.Version+1, moved.Version)
+	assert.Equal(t, []Range{
+		{Start: 0, End: 99, Shard: 0},
+		{Start: 100, End: 199, Shard: 0, Target: 1, Phase: Copying},
+		{Start: 200, End: half, Shard: 0},
+		{Start: half + 1, End: MaxKey, Shard: 1},
+	}, moved.Ranges)
+	// the original map is untouched
+	assert.Len(t, m.Ranges, 2)
+
+	assert.Equal(t, Route{Write: 0, Reads: []int{0, 1}, All: []int{0, 1}}, moved.Lookup(150).Route())
+	assert.Equal(t, Route{Write: 0, Reads: []int{0}, All: []int{0}}, moved.Lookup(50).Route())
+
+	_, err = moved.Move(150, 300, 1)
+	assert.ErrorIs(t, err, ErrInvalidRange)
+	_, err = moved.Move(300, 200, 1)
+	assert.ErrorIs(t, err, ErrInvalidRange)
+
+	switched := moved.Advance(100, 199)
+	assert.Equal(t, Switched, switched.Lookup(150).Phase)
+	assert.Equal(t, Route{Write: 1, Reads: []int{1, 0}, All: []int{0, 1}}, switched.Lookup(150).Route())
+
+	done := switched.Advance(100, 199)
+	require.NoError(t, done.Validate(2))
+	assert.Equal(t, m.Version+3, done.Version)
+	assert.Empty(t, done.Moving())
+	assert.Equal(t, 1, done.Lookup(150).Shard)
+	assert.Len(t, done.Ranges, 4)
+
+	// moving it back merges the ranges again
+	back, err := done.Move(100, 199, 0)
+	require.NoError(t, err)
+	back = back.Advance(0, MaxKey).Advance(0, MaxKey)
+	assert.Equal(t, m.Ranges, back.Ranges)
+
+	// keys on the target already don't move
+	same, err := m.Move(half+1, MaxKey, 1)
+	require.NoError(t, err)
+	assert.Empty(t, same.Moving())
+}
@@ -0,0 +1,155 @@
+package shard
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Store keeps the versions of the map in the shard_map table of the catalog database (the first shard).
+// Versions are only ever added, a version can be saved once: two tools moving ranges at the same time
+// can't overwrite each other's map
+type Store struct {
+	db *sqlx.DB
+}
+
+func NewStore(db *sqlx.DB) *Store {
+	return &Store{db: db}
+}
+
+var (
+	ErrNoMap    = errors.New("no shard map has been saved")
+	ErrStaleMap = errors.New("the shard map has changed in the meantime")
+)
+
+var (
+	loadMapQuery = `
+		SELECT ranges FROM shard_map ORDER BY version DESC LIMIT 1
+	`
+	saveMapQuery = `
+		INSERT INTO shard_map (version, ranges) VALUES ($1, $2)
+		ON CONFLICT (version) DO NOTHING
+	`
+)
+
+// Load returns the latest map
+func (s *Store) Load(ctx context.Context) (Map, error) {
+	var raw []byte
+	if err := s.db.GetContext(ctx, &raw, loadMapQuery); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Map{}, ErrNoMap
+		}
+		return Map{}, err
+	}
+	var m Map
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return Map{}, fmt.Errorf("%w: %w", ErrInvalidMap, err)
+	}
+	return m, nil
+}
+
+// Save adds m as the next version, it fails with ErrStaleMap when m.Version is taken
+func (s *Store) Save(ctx context.Context, m Map) error {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.ExecContext(ctx, saveMapQuery, m.Version, raw)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return fmt.Errorf("%w: version %d exists", ErrStaleMap, m.Version)
+	}
+	return nil
+}
+
+// Init saves m unless a map exists already, and returns the latest map
+func (s *Store) Init(ctx context.Context, m Map) (Map, error) {
+	if err := s.Save(ctx, m); err != nil && !errors.Is(err, ErrStaleMap) {
+		return Map{}, err
+	}
+	return s.Load(ctx)
+}
+
+// Router hands out the current map, it is safe for concurrent use
+type Router struct {
+	shards  int
+	current atomic.Pointer[Map]
+}
+
+// NewRouter routes over shards databases, starting with m
+func NewRouter(shards int, m Map) (*Router, error) {
+	if err := m.Validate(shards); err != nil {
+		return nil, err
+	}
+	r := &Router{shards: shards}
+	r.current.Store(&m)
+	return r, nil
+}
+
+// Shards returns the number of shards
+func (r *Router) Shards() int {
+	return r.shards
+}
+
+// Map returns the current map
+func (r *Router) Map() Map {
+	return *r.current.Load()
+}
+
+// Route returns the route of the short URL id
+func (r *Router) Route(id string) Route {
+	return r.current.Load().Route(id)
+}
+
+// Reload switches to the latest map of store when it is newer, invalid maps are ignored
+func (r *Router) Reload(ctx context.Context, store *Store) error {
+	m, err := store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if m.Version <= r.current.Load().Version {
+		return nil
+	}
+	if err := m.Validate(r.shards); err != nil {
+		return err
+	}
+	r.current.Store(&m)
+	slog.Info("switched to a new shard map", "version", m.Version, "ranges", len(m.Ranges), "moving", len(m.Moving()))
+	return nil
+}
+
+// Run reloads the map every interval until ctx is done. Ranges are moved in steps that wait for every
+// process to catch up, the interval must be well below that wait (the settle time of the Rebalancer)
+func (r *Router) Run(ctx context.Context, store *Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := r.Reload(ctx, store); err != nil && ctx.Err() == nil {
+			slog.Error("failed to reload the shard map", "error", err.Error())
+		}
+	}
+}
+
+// Var exposes the current map in expvar
+func (r *Router) Var() expvar.Var {
+	return expvar.Func(func() any {
+		return r.Map()
+	})
+}
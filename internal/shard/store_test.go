@@ -0,0 +1,52 @@
+package shard
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/armistcxy/shorten/internal/migrate"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	db := sqlx.MustConnect("postgres", os.Getenv("URL_DSN"))
+	defer db.Close()
+	ctx := context.Background()
+	migrator, err := migrate.New(db)
+	require.NoError(t, err)
+	_, err = migrator.Up(ctx)
+	require.NoError(t, err)
+
+	// versions far above the ones of a real map
+	const base = 1 << 40
+	cleanup := func() {
+		_, err := db.Exec(`DELETE FROM shard_map WHERE version >= $1`, base)
+		require.NoError(t, err)
+	}
+	cleanup()
+	defer cleanup()
+
+	store := NewStore(db)
+	m := Even(2)
+	m.Version = base
+	require.NoError(t, store.Save(ctx, m))
+	assert.ErrorIs(t, store.Save(ctx, m), ErrStaleMap)
+
+	loaded, err := store.Init(ctx, Even(1))
+	require.NoError(t, err)
+	assert.Equal(t, m, loaded)
+
+	moved, err := m.Move(0, 99, 1)
+	require.NoError(t, err)
+	require.NoError(t, store.Save(ctx, moved))
+
+	router, err := NewRouter(2, m)
+	require.NoError(t, err)
+	require.NoError(t, router.Reload(ctx, store))
+	assert.Equal(t, moved, router.Map())
+	_, err = NewRouter(1, m)
+	assert.ErrorIs(t, err, ErrInvalidMap)
+}
@@ -0,0 +1,25 @@
+package util
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// EnvInt reads a positive integer from the environment, def is used when it is missing or invalid
+func EnvInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
+
+// EnvDuration reads a positive duration from the environment, def is used when it is missing or invalid
+func EnvDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/armistcxy/shorten/internal/domain"
+)
+
+// Error is an error that is meant to be shown to the client as it is
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func NewError(status int, code string, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func BadRequest(message string) *Error {
+	return NewError(http.StatusBadRequest, "bad_request", message)
+}
+
+func Unauthorized(message string) *Error {
+	return NewError(http.StatusUnauthorized, "unauthorized", message)
+}
+
+func Forbidden(message string) *Error {
+	return NewError(http.StatusForbidden, "forbidden", message)
+}
+
+// ErrorBody is the JSON body of every error response
+type ErrorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// errorFor maps err to what the client gets to see, errors that are not expected to reach
+// the client become a generic internal error so that driver messages and such are not leaked
+func errorFor(err error) *Error {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, domain.ErrNotFound):
+		return NewError(http.StatusNotFound, "not_found", "short url not found")
+	case errors.Is(err, domain.ErrExpired):
+		return NewError(http.StatusGone, "expired", "short url has expired")
+	case errors.Is(err, domain.ErrDisabled):
+		return NewError(http.StatusGone, "disabled", "short url has been disabled")
+	case errors.Is(err, domain.ErrConflict):
+		return NewError(http.StatusConflict, "conflict", "short url already exists")
+	case errors.Is(err, domain.ErrUnavailable):
+		return NewError(http.StatusServiceUnavailable, "unavailable", "service temporarily unavailable, retry later")
+	default:
+		return NewError(http.StatusInternalServerError, "internal", "internal server error")
+	}
+}
+
+// WriteError writes err as a JSON error body with the matching status code.
+// The request ID lets the client point at the log lines of the failed request.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	e := errorFor(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	_ = json.NewEncoder(w).Encode(ErrorBody{
+		Code:      e.Code,
+		Message:   e.Message,
+		RequestID: RequestID(r.Context()),
+	})
+}
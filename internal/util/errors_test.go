@@ -0,0 +1,50 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteError(t *testing.T) {
+	testcases := []struct {
+		testname   string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"not found", fmt.Errorf("%w: no rows in result set", domain.ErrNotFound), http.StatusNotFound, "not_found"},
+		{"expired", domain.ErrExpired, http.StatusGone, "expired"},
+		{"disabled", domain.ErrDisabled, http.StatusGone, "disabled"},
+		{"conflict", domain.ErrConflict, http.StatusConflict, "conflict"},
+		{"unavailable", domain.ErrUnavailable, http.StatusServiceUnavailable, "unavailable"},
+		{"client error", BadRequest("invalid 'from'"), http.StatusBadRequest, "bad_request"},
+		{"internal error", errors.New("dial tcp 10.0.0.3:5432: connection refused"), http.StatusInternalServerError, "internal"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.testname, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/short/abc", nil)
+			r = r.WithContext(WithRequestID(r.Context(), "req-1"))
+			w := httptest.NewRecorder()
+
+			WriteError(w, r, tc.err)
+
+			assert.Equal(t, tc.wantStatus, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			var body ErrorBody
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode error body: %s", err)
+			}
+			assert.Equal(t, tc.wantCode, body.Code)
+			assert.Equal(t, "req-1", body.RequestID)
+			assert.NotContains(t, body.Message, "10.0.0.3")
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package warm
+
+// Warming loads the most viewed short URLs into the cache, so that the first hits after
+// a deploy or a Redis flush don't all go to Postgres.
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/cache"
+	"github.com/armistcxy/shorten/internal/domain"
+	"golang.org/x/sync/errgroup"
+)
+
+type Options struct {
+	// N is the number of short URLs to load
+	N int
+	// Since selects short URLs by their clicks since then, zero uses the all-time view count
+	Since time.Time
+	// Concurrency is the number of cache writes in flight
+	Concurrency int
+	// Progress is called after every ProgressEvery cached short URLs and once at the end, it must not block
+	Progress      func(Progress)
+	ProgressEvery int
+}
+
+type Progress struct {
+	Total  int  `json:"total"`
+	Done   int  `json:"done"`
+	Failed int  `json:"failed"`
+	Final  bool `json:"final"`
+}
+
+const (
+	DefaultN             = 1000
+	DefaultConcurrency   = 16
+	DefaultProgressEvery = 100
+)
+
+type Warmer struct {
+	urlRepo domain.URLRepository
+	cache   cache.Cache
+}
+
+func NewWarmer(urlRepo domain.URLRepository, cache cache.Cache) *Warmer {
+	return &Warmer{
+		urlRepo: urlRepo,
+		cache:   cache,
+	}
+}
+
+// Run loads the top links into the cache. A link that can't be cached is counted as failed,
+// it doesn't stop the others. Run only returns an error if the links can't be listed or ctx is done.
+func (wm *Warmer) Run(ctx context.Context, opts Options) (Progress, error) {
+	if opts.N <= 0 {
+		opts.N = DefaultN
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.ProgressEvery <= 0 {
+		opts.ProgressEvery = DefaultProgressEvery
+	}
+
+	links, err := wm.urlRepo.TopLinks(ctx, opts.N, opts.Since)
+	if err != nil {
+		return Progress{}, err
+	}
+
+	var (
+		mu       sync.Mutex
+		progress = Progress{Total: len(links)}
+	)
+	report := func(failed bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		progress.Done++
+		if failed {
+			progress.Failed++
+		}
+		if opts.Progress != nil && progress.Done%opts.ProgressEvery == 0 && progress.Done < progress.Total {
+			opts.Progress(progress)
+		}
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.Concurrency)
+	for _, link := range links {
+		if gctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			// progress only counts the short URLs that are really in the cache
+			if err := wm.cache.Set(cache.WaitForWrite(gctx), link.ID, link.Origin); err != nil {
+				slog.Error("failed to warm short url", "url_id", link.ID, "error", err.Error())
+				report(true)
+				return nil
+			}
+			report(false)
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	progress.Final = true
+	if opts.Progress != nil {
+		opts.Progress(progress)
+	}
+	slog.Info("cache warmed", "total", progress.Total, "done", progress.Done, "failed", progress.Failed)
+	return progress, ctx.Err()
+}
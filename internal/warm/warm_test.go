@@ -0,0 +1,69 @@
+package warm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armistcxy/shorten/internal/cache"
+	"github.com/armistcxy/shorten/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+type topLinksRepo struct {
+	domain.URLRepository
+	links []domain.ShortURL
+}
+
+func (r topLinksRepo) TopLinks(_ context.Context, n int, _ time.Time) ([]domain.ShortURL, error) {
+	return r.links[:min(n, len(r.links))], nil
+}
+
+type mapCache struct {
+	cache.NoopCache
+	mu      sync.Mutex
+	entries map[string]string
+	failing string
+}
+
+func (c *mapCache) Set(_ context.Context, id string, url string) error {
+	if id == c.failing {
+		return errors.New("connection refused")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[id] = url
+	return nil
+}
+
+func TestWarmerRun(t *testing.T) {
+	links := make([]domain.ShortURL, 250)
+	for i := range links {
+		links[i] = domain.ShortURL{ID: fmt.Sprintf("id%d", i), Origin: fmt.Sprintf("https://example.com/%d", i)}
+	}
+	c := &mapCache{entries: make(map[string]string), failing: "id7"}
+	wm := NewWarmer(topLinksRepo{links: links}, c)
+
+	var reports []Progress
+	progress, err := wm.Run(context.Background(), Options{
+		N:             200,
+		Concurrency:   4,
+		ProgressEvery: 50,
+		Progress:      func(p Progress) { reports = append(reports, p) },
+	})
+	if err != nil {
+		t.Fatalf("failed to warm cache: %s", err)
+	}
+
+	assert.Equal(t, Progress{Total: 200, Done: 200, Failed: 1, Final: true}, progress)
+	assert.Len(t, c.entries, 199)
+	assert.Equal(t, "https://example.com/3", c.entries["id3"])
+	assert.NotContains(t, c.entries, "id210")
+
+	// 50, 100, 150 and the final report
+	assert.Len(t, reports, 4)
+	assert.Equal(t, progress, reports[len(reports)-1])
+}
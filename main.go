@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
@@ -10,15 +11,26 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/armistcxy/shorten/internal/background"
+	"github.com/armistcxy/shorten/internal/auth"
+	"github.com/armistcxy/shorten/internal/bloom"
+	"github.com/armistcxy/shorten/internal/breaker"
 	"github.com/armistcxy/shorten/internal/cache"
+	"github.com/armistcxy/shorten/internal/denylist"
+	"github.com/armistcxy/shorten/internal/domain"
 	"github.com/armistcxy/shorten/internal/handler"
 	"github.com/armistcxy/shorten/internal/idgen"
+	"github.com/armistcxy/shorten/internal/live"
+	"github.com/armistcxy/shorten/internal/migrate"
 	"github.com/armistcxy/shorten/internal/msq"
 	"github.com/armistcxy/shorten/internal/repository"
+	"github.com/armistcxy/shorten/internal/shard"
+	"github.com/armistcxy/shorten/internal/util"
+	"github.com/armistcxy/shorten/internal/warm"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
@@ -43,6 +55,11 @@ func main() {
 	// http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 20000
 	// log.Printf("Max idle connections per host: %d\n", http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost)
 
+	apiKeys, err := auth.ParseKeys(os.Getenv("API_KEYS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	store, err := memorystore.New(&memorystore.Config{
 		Tokens:   10,
 		Interval: time.Second,
@@ -57,7 +74,7 @@ func main() {
 		addr = fmt.Sprintf("%s:%d", *host, *port)
 		srv  = http.Server{
 			Addr:    addr,
-			Handler: CORS(ApplyChain(http.DefaultServeMux, HTTPLoggingMiddleware)),
+			Handler: CORS(ApplyChain(http.DefaultServeMux, apiKeys.Middleware, HTTPLoggingMiddleware, RequestIDMiddleware)),
 		}
 	)
 
@@ -88,33 +105,137 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// The schema is migrated on start unless MIGRATE_ON_START=false (migrations are run with shortenctl migrate then)
+	migrateOnStart, err := strconv.ParseBool(os.Getenv("MIGRATE_ON_START"))
+	migrateOnStart = err != nil || migrateOnStart
+	if migrateOnStart {
+		migrateDB(db)
+	}
+
 	postgresURLRepo, err := repository.NewPostgresURLRepository(db, pool)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Lookups are served by the read replicas of URL_REPLICA_DSNS (comma separated) while they're healthy
+	// and don't lag more than REPLICA_MAX_LAG, ids created in the last REPLICA_RECENT_WINDOW are looked up
+	// on the primary
+	if dsns := os.Getenv("URL_REPLICA_DSNS"); dsns != "" {
+		var replicaPools []*pgxpool.Pool
+		for _, dsn := range strings.Split(dsns, ",") {
+			replicaPool, err := pgxpool.New(context.Background(), strings.TrimSpace(dsn))
+			if err != nil {
+				log.Fatalf("invalid read replica dsn: %s", err)
+			}
+			replicaPools = append(replicaPools, replicaPool)
+		}
+		replicas := repository.NewReplicaSet(replicaPools, util.EnvDuration("REPLICA_MAX_LAG", 5*time.Second),
+			util.EnvDuration("REPLICA_RECENT_WINDOW", 5*time.Second))
+		go replicas.Run(context.Background(), util.EnvDuration("REPLICA_CHECK_INTERVAL", 2*time.Second))
+		postgresURLRepo.WithReplicas(replicas)
+		expvar.Publish("db_replicas", replicas.Var())
+	}
+	var (
+		urlRepo   domain.URLRepository   = postgresURLRepo
+		clickRepo domain.ClickRepository = repository.NewPostgresClickRepository(pool)
+	)
+	// URL_SHARD_DSNS (comma separated) adds shards to the one of URL_DSN. Short URLs are placed by the shard map
+	// kept on the first shard and reloaded every SHARD_MAP_REFRESH, ranges are moved with shortenctl shard
+	if dsns := os.Getenv("URL_SHARD_DSNS"); dsns != "" {
+		shardDBs := []*sqlx.DB{db}
+		shardURLRepos := []domain.URLRepository{postgresURLRepo}
+		shardClickRepos := []domain.ClickRepository{clickRepo}
+		for _, dsn := range strings.Split(dsns, ",") {
+			shardDB := sqlx.MustConnect("postgres", strings.TrimSpace(dsn))
+			shardPool, err := pgxpool.New(context.Background(), strings.TrimSpace(dsn))
+			if err != nil {
+				log.Fatalf("invalid shard dsn: %s", err)
+			}
+			if migrateOnStart {
+				migrateDB(shardDB)
+			}
+			shardURLRepo, err := repository.NewPostgresURLRepository(shardDB, shardPool)
+			if err != nil {
+				log.Fatal(err)
+			}
+			shardDBs = append(shardDBs, shardDB)
+			shardURLRepos = append(shardURLRepos, shardURLRepo)
+			shardClickRepos = append(shardClickRepos, repository.NewPostgresClickRepository(shardPool))
+		}
+
+		// a new map keeps every key on the first shard, where the short URLs created before sharding are
+		shardStore := shard.NewStore(db)
+		shardMap, err := shardStore.Init(context.Background(), shard.Even(1))
+		if err != nil {
+			log.Fatalf("failed to load the shard map: %s", err)
+		}
+		router, err := shard.NewRouter(len(shardDBs), shardMap)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go router.Run(context.Background(), shardStore, util.EnvDuration("SHARD_MAP_REFRESH", 5*time.Second))
+		expvar.Publish("shard_map", router.Var())
+
+		if urlRepo, err = repository.NewShardedURLRepository(shardURLRepos, router); err != nil {
+			log.Fatal(err)
+		}
+		if clickRepo, err = repository.NewShardedClickRepository(shardClickRepos, router); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// redisURL := os.Getenv("REDIS_URL")
-	// ca := cache.NewRedisCache(redisURL)
+	// The cache backend is chosen by CACHE_BACKEND, see cache.ConfigFromEnv
+	cacheConfig, err := cache.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	redisClient, err := cache.NewClient(cacheConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ca, err := cache.New(cacheConfig, redisClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if runner, ok := ca.(cache.Runner); ok {
+		go runner.Run(context.Background())
+	}
+	viewCache := cache.NewViewCache(cacheConfig, redisClient)
+	slog.Info("cache configured", "backend", cacheConfig.Backend, "nodes", len(cacheConfig.Addrs))
 
-	redisURLs := make([]string, 9)
-	for i := 1; i <= 9; i++ {
-		redisURLs[i-1] = fmt.Sprintf("redis://redis_%d:6379", i)
-		// redisURLs[i-1] = fmt.Sprintf("redis://localhost:%d", i+6379)
+	maxLiveSubscribers, err := strconv.Atoi(os.Getenv("LIVE_MAX_SUBSCRIBERS"))
+	if err != nil || maxLiveSubscribers <= 0 {
+		maxLiveSubscribers = 1000
+	}
+	// Without Redis, live stats only cover the clicks served by this replica
+	var liveBroker live.Broker = live.NewMemoryBroker()
+	if redisClient != nil {
+		liveBroker = live.NewRedisBroker(redisClient)
 	}
-	ca := cache.NewRedisClusterCache(redisURLs)
+	liveHub := live.NewHub(liveBroker, maxLiveSubscribers)
 
-	// ristrettoCache, err := ristretto.NewCache(&ristretto.Config[string, string]{
-	// 	NumCounters: 1e7,
-	// 	MaxCost:     1 << 30,
-	// 	BufferItems: 512,
-	// })
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// ca := cache.NewRistrettoCache(ristrettoCache)
+	// a check digit lets lookups reject mistyped ids without any I/O, ids created before it was enabled still
+	// resolve when the Bloom filter knows them
+	if checkDigits, _ := strconv.ParseBool(os.Getenv("ID_CHECK_DIGIT")); checkDigits {
+		domain.SetCheckDigits(true)
+	}
 
-	viewCache := cache.NewViewRedisCache(redisURLs)
-	idgen := idgen.NewSeqIDGenerator(db, 0, 16, riverClient)
+	// ids are scrambled with a keyed permutation so they can't be enumerated, keep the key secret and stable
+	var perm *idgen.FeistelPermutation
+	if key := os.Getenv("ID_PERMUTATION_KEY"); key != "" {
+		perm, err = idgen.NewFeistelPermutation([]byte(key), uint(util.EnvInt("ID_PERMUTATION_WIDTH", 36)))
+		if err != nil {
+			log.Fatalf("invalid id permutation: %s", err)
+		}
+	}
+	// generated ids and custom aliases can't spell offensive words or take route names
+	denied := denylist.Default()
+	if path := os.Getenv("DENYLIST_FILE"); path != "" {
+		denied, err = denylist.Load(path)
+		if err != nil {
+			log.Fatalf("failed to load denylist: %s", err)
+		}
+	}
+	idStrategies := newIDStrategies(db, perm, denied)
 
 	rabbitMQURL := os.Getenv("RABBITMQ_URL")
 	conn, err := amqp.Dial(rabbitMQURL)
@@ -123,7 +244,47 @@ func main() {
 	}
 	urlPublisher := msq.NewURLPublisher(conn)
 
-	urlHandler := handler.NewURLHandler(postgresURLRepo, idgen, ca, urlPublisher, riverClient, viewCache)
+	expectedIDs, err := strconv.ParseUint(os.Getenv("BLOOM_EXPECTED_IDS"), 10, 64)
+	if err != nil || expectedIDs == 0 {
+		expectedIDs = 10_000_000
+	}
+	ids := bloom.New(expectedIDs, 0.01)
+
+	// Lookups go through a circuit breaker, when the database keeps failing they fail fast
+	// and cached origins (even stale ones) are all that is served
+	dbBreaker := breaker.New(breaker.Config{
+		Threshold:     util.EnvInt("DB_BREAKER_THRESHOLD", 5),
+		OpenTimeout:   util.EnvDuration("DB_BREAKER_OPEN_TIMEOUT", 5*time.Second),
+		HalfOpenCalls: util.EnvInt("DB_BREAKER_HALF_OPEN_CALLS", 3),
+		IsFailure:     repository.IsDBFailure,
+		OnStateChange: func(from, to breaker.State) {
+			slog.Warn("database circuit breaker changed state", "from", from.String(), "to", to.String())
+		},
+	})
+	expvar.Publish("db_breaker", dbBreaker.Var())
+	lookupRepo := repository.NewBreakerURLRepository(urlRepo, dbBreaker)
+
+	urlHandler := handler.NewURLHandler(lookupRepo, clickRepo, idStrategies, ca, urlPublisher, riverClient, viewCache, liveHub, ids, denied)
+
+	// Short URLs created by other replicas are added to the Bloom filter through the url exchange,
+	// the subscription starts before the filter is loaded so that no ID is missed in between
+	urlSubscriber, err := msq.NewURLSubscriber(conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		if err := urlSubscriber.Consume(context.Background(), func(_ string, id string) {
+			urlHandler.AddID(id)
+		}); err != nil {
+			slog.Error("stopped adding created short urls to bloom filter", "error", err.Error())
+			urlHandler.StopFilteringIDs()
+		}
+	}()
+	go func() {
+		if err := urlHandler.LoadIDs(context.Background()); err != nil {
+			slog.Error("failed to load short url ids into bloom filter, lookups are not filtered", "error", err.Error())
+		}
+	}()
 	{
 		createShortURLHandler := http.HandlerFunc(urlHandler.CreateShortURLHandle)
 		http.Handle("POST /short", createShortURLHandler)
@@ -131,14 +292,55 @@ func main() {
 		getURLHandler := http.HandlerFunc(urlHandler.GetOriginURLHandle)
 		http.Handle("GET /short/{id}", getURLHandler)
 
+		deleteShortURLHandler := http.HandlerFunc(urlHandler.DeleteShortURLHandle)
+		http.Handle("DELETE /short/{id}", deleteShortURLHandler)
+
 		retrieveFraudHandler := http.HandlerFunc(urlHandler.RetrieveFraudURLHandle)
 		http.Handle("GET /fraud/{id}", retrieveFraudHandler)
 
 		getViewHandler := http.HandlerFunc(urlHandler.GetURLView)
 		http.Handle("GET /view/{id}", getViewHandler)
 
+		streamStatsHandler := http.HandlerFunc(urlHandler.StreamStatsHandle)
+		http.Handle("GET /stats/{id}/live", streamStatsHandler)
+
+		exportClicksHandler := http.HandlerFunc(urlHandler.ExportClicksHandle)
+		http.Handle("GET /export/{id}/clicks", exportClicksHandler)
+
+		exportLinksHandler := http.HandlerFunc(urlHandler.ExportLinksHandle)
+		http.Handle("GET /export/links", exportLinksHandler)
+
+		listCampaignsHandler := http.HandlerFunc(urlHandler.ListCampaignsHandle)
+		http.Handle("GET /campaigns", listCampaignsHandler)
+
+		campaignStatsHandler := http.HandlerFunc(urlHandler.CampaignStatsHandle)
+		http.Handle("GET /campaigns/{campaign}/stats", campaignStatsHandler)
+
+		// WARM_ON_START loads that many of the most viewed short URLs into the cache at startup
+		warmer := warm.NewWarmer(urlRepo, ca)
+		if n, err := strconv.Atoi(os.Getenv("WARM_ON_START")); err == nil && n > 0 {
+			go func() {
+				if _, err := warmer.Run(context.Background(), warm.Options{N: n}); err != nil {
+					slog.Error("failed to warm cache at startup", "error", err.Error())
+				}
+			}()
+		}
+
+		// admin endpoints are disabled unless ADMIN_TOKEN is set
+		adminHandler := handler.NewAdminHandler(os.Getenv("ADMIN_TOKEN"), warmer, idStrategies)
+		warmCacheHandler := adminHandler.RequireAdmin(http.HandlerFunc(adminHandler.WarmCacheHandle))
+		http.Handle("POST /admin/cache/warm", warmCacheHandler)
+		idGeneratorsHandler := adminHandler.RequireAdmin(http.HandlerFunc(adminHandler.IDGeneratorsHandle))
+		http.Handle("GET /admin/idgen", idGeneratorsHandler)
+
+		healthHandler := handler.NewHealthHandler(dbBreaker)
+		http.Handle("GET /healthz", http.HandlerFunc(healthHandler.HealthHandle))
+		http.Handle("GET /metrics", expvar.Handler())
+
 		go urlHandler.BatchCreate()
 		go urlHandler.BatchUpdateView()
+		go urlHandler.BatchRecordClicks()
+		go liveHub.Run(context.Background())
 	}
 
 	// Gracefully shutdown
@@ -157,16 +359,9 @@ func main() {
 			slog.Error("Error when shutdown HTTP server", "error", err.Error())
 		}
 
-		// After handling all the remain requests: update maximum ID for each range
-		updateIDs := idgen.RetriveLastUsedIds()
-		for _, id := range updateIDs {
-			if id != 0 {
-				_, err := riverClient.Insert(context.Background(),
-					background.AddLastUsedIDArgs{LastUsedID: id}, nil)
-				if err != nil {
-					slog.Error("failed to enqueue 'AddLastUsedID' job", "error", err.Error())
-				}
-			}
+		// After handling all the remain requests: give the unused part of the id ranges back
+		if err := idStrategies.Release(ctx); err != nil {
+			slog.Error("failed to release id leases", "error", err.Error())
 		}
 		close(done)
 	}()
@@ -178,3 +373,65 @@ func main() {
 
 	<-done
 }
+
+// newIDStrategies registers the id strategies, short URLs use the one they ask for, otherwise the one of
+// their tenant (TENANT_ID_STRATEGIES="owner:strategy,..."), otherwise ID_GENERATOR:
+//   - seq (default): ranges leased from the database
+//   - obfuscated: like seq, scrambled with ID_PERMUTATION_KEY (only when the key is set)
+//   - random-N: random ids of N characters after "0r", checked for collisions when they're inserted,
+//     random is random-RANDOM_ID_LENGTH
+//   - snowflake: time ordered ids after "0s" minted without the database, the node id comes from
+//     SNOWFLAKE_NODE_ID or is leased from the database
+//
+// Random and snowflake ids minted before they had a prefix are still looked up, like custom aliases.
+func newIDStrategies(db *sqlx.DB, perm *idgen.FeistelPermutation, denied *denylist.List) *idgen.Registry {
+	tenants, err := idgen.ParseTenants(os.Getenv("TENANT_ID_STRATEGIES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	def := os.Getenv("ID_GENERATOR")
+	if def == "" {
+		def = "seq"
+		if perm != nil {
+			def = "obfuscated"
+		}
+	}
+	strategies := idgen.NewRegistry(def, tenants, denied)
+
+	leases := idgen.NewLeaseStore(db, idgen.DefaultHolder(), idgen.SHARD_SIZE, idgen.LEASE_STEP,
+		util.EnvDuration("ID_LEASE_TTL", time.Minute))
+	go leases.Run(context.Background())
+	strategies.Register(idgen.SeqStrategy("seq", leases, nil, denied))
+	if perm != nil {
+		strategies.Register(idgen.SeqStrategy("obfuscated", leases, perm, denied))
+	}
+
+	// random ids get longer as the keyspace fills up
+	strategies.Register(idgen.RandomStrategy("random", util.EnvInt("RANDOM_ID_LENGTH", 6), denied))
+
+	node := -1
+	if s := os.Getenv("SNOWFLAKE_NODE_ID"); s != "" {
+		if node, err = strconv.Atoi(s); err != nil || node < 0 || node > idgen.MaxSnowflakeNode {
+			log.Fatalf("invalid SNOWFLAKE_NODE_ID %q", s)
+		}
+	}
+	// a long lease lets the replica keep minting ids through a database outage
+	leaser := idgen.NewNodeLeaser(db, idgen.DefaultHolder(), util.EnvDuration("SNOWFLAKE_LEASE_TTL", time.Hour))
+	strategies.Register(idgen.SnowflakeStrategy("snowflake", node, leaser, denied))
+
+	if err := strategies.Validate(); err != nil {
+		log.Fatalf("invalid id strategies: %s", err)
+	}
+	expvar.Publish("id_generators", strategies.Var())
+	return strategies
+}
+
+func migrateDB(db *sqlx.DB) {
+	migrator, err := migrate.New(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+}
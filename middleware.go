@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/armistcxy/shorten/internal/util"
 	"github.com/felixge/httpsnoop"
 	"github.com/tomasen/realip"
 )
@@ -34,6 +35,7 @@ func HTTPLoggingMiddleware(next http.Handler) http.Handler {
 		}
 
 		httpInfo := &HTTPInfo{
+			requestID:       util.RequestID(r.Context()),
 			method:          r.Method,
 			proto:           r.Proto,
 			userAgent:       r.UserAgent(),
@@ -51,6 +53,7 @@ func HTTPLoggingMiddleware(next http.Handler) http.Handler {
 }
 
 type HTTPInfo struct {
+	requestID       string
 	method          string
 	proto           string
 	userAgent       string
@@ -67,7 +70,8 @@ func logHTTPInfo(info *HTTPInfo) {
 	var strBuilder strings.Builder
 
 	// Append all fields to the string builder
-	strBuilder.WriteString(fmt.Sprintf("\nmethod: %s\n", info.method))
+	strBuilder.WriteString(fmt.Sprintf("\nrequestID: %s\n", info.requestID))
+	strBuilder.WriteString(fmt.Sprintf("method: %s\n", info.method))
 	strBuilder.WriteString(fmt.Sprintf("proto: %s\n", info.proto))
 	strBuilder.WriteString(fmt.Sprintf("userAgent: %s\n", info.userAgent))
 	strBuilder.WriteString(fmt.Sprintf("referer: %s\n", info.referer))
@@ -81,11 +85,25 @@ func logHTTPInfo(info *HTTPInfo) {
 	log.Println(strBuilder.String())
 }
 
+// RequestIDMiddleware gives every request an ID, taken from the X-Request-ID header when the proxy
+// in front already set one. The ID is sent back and included in error bodies and logs.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(util.RequestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = util.NewRequestID()
+		}
+		w.Header().Set(util.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(util.WithRequestID(r.Context(), id)))
+	})
+}
+
 func CORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID, X-Admin-Token")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 
 		if r.Method == "OPTIONS" {
 			return